@@ -21,6 +21,25 @@ const (
 	// Required fields: Entity
 	OpPromulgate   Operation = "promulgate"
 	OpUnpromulgate Operation = "unpromulgate"
+
+	// OpDelete represents the permanent removal of an entity.
+	// Required fields: Entity
+	OpDelete Operation = "delete"
+
+	// OpTransfer represents the transfer of a base entity to a new id.
+	// Required fields: Entity, NewEntity
+	OpTransfer Operation = "transfer"
+
+	// OpApprove, OpReject represent an approver's decision on
+	// promoting an entity to a gated channel.
+	// Required fields: Entity, Channel
+	OpApprove Operation = "approve"
+	OpReject  Operation = "reject"
+
+	// OpSetPromotionPolicy represents the setting or removal
+	// of the promotion policy of a base entity.
+	// Required fields: Entity, Channel
+	OpSetPromotionPolicy Operation = "set-promotion-policy"
 )
 
 // ACL represents an access control list.
@@ -36,4 +55,10 @@ type Entry struct {
 	Op     Operation  `json:"op"`
 	Entity *charm.URL `json:"entity,omitempty"`
 	ACL    *ACL       `json:"acl,omitempty"`
+
+	// NewEntity holds the new id of a transferred entity.
+	NewEntity *charm.URL `json:"new-entity,omitempty"`
+
+	// Channel holds the channel that an approval applies to.
+	Channel string `json:"channel,omitempty"`
 }
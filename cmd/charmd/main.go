@@ -13,7 +13,6 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/goose.v2/identity"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 	"gopkg.in/mgo.v2"
@@ -92,39 +91,39 @@ func serve(confPath string) error {
 
 	logger.Infof("setting up the API server")
 	cfg := charmstore.ServerParams{
-		AuthUsername:            conf.AuthUsername,
-		AuthPassword:            conf.AuthPassword,
-		IdentityLocation:        conf.IdentityLocation,
-		TermsLocation:           conf.TermsLocation,
-		AgentUsername:           conf.AgentUsername,
-		AgentKey:                conf.AgentKey,
-		StatsCacheMaxAge:        conf.StatsCacheMaxAge.Duration,
-		MaxMgoSessions:          conf.MaxMgoSessions,
-		HTTPRequestWaitDuration: conf.RequestTimeout.Duration,
-		SearchCacheMaxAge:       conf.SearchCacheMaxAge.Duration,
-		PublicKeyLocator:        keyring,
-		MinUploadPartSize:       conf.MinUploadPartSize,
-		MaxUploadPartSize:       conf.MaxUploadPartSize,
-		MaxUploadParts:          conf.MaxUploadParts,
-		RunBlobStoreGC:          true,
-	}
-	switch conf.BlobStore {
-	case config.MongoDBBlobStore:
-		// This is the default. No need for a custom function.
-	case config.SwiftBlobStore:
-		cred := &identity.Credentials{
-			URL:        conf.SwiftAuthURL,
-			User:       conf.SwiftUsername,
-			Secrets:    conf.SwiftSecret,
-			Region:     conf.SwiftRegion,
-			TenantName: conf.SwiftTenant,
-		}
-		cfg.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
-			return blobstore.NewSwiftBackend(cred, conf.SwiftAuthMode.Mode, conf.SwiftBucket)
-		}
-	default:
-		return errgo.Newf("unknown blob store type")
+		AuthUsername:                 conf.AuthUsername,
+		AuthPassword:                 conf.AuthPassword,
+		IdentityLocation:             conf.IdentityLocation,
+		TermsLocation:                conf.TermsLocation,
+		AgentUsername:                conf.AgentUsername,
+		AgentKey:                     conf.AgentKey,
+		StatsCacheMaxAge:             conf.StatsCacheMaxAge.Duration,
+		MaxMgoSessions:               conf.MaxMgoSessions,
+		HTTPRequestWaitDuration:      conf.RequestTimeout.Duration,
+		SearchCacheMaxAge:            conf.SearchCacheMaxAge.Duration,
+		PublicKeyLocator:             keyring,
+		MinUploadPartSize:            conf.MinUploadPartSize,
+		MaxUploadPartSize:            conf.MaxUploadPartSize,
+		MaxUploadParts:               conf.MaxUploadParts,
+		RunBlobStoreGC:               true,
+		BlobScrubInterval:            conf.BlobScrubInterval.Duration,
+		DeletedEntityRetention:       conf.DeletedEntityRetention.Duration,
+		RevisionPruneInterval:        conf.RevisionPruneInterval.Duration,
+		RetentionKeepUnpublished:     conf.RetentionKeepUnpublished,
+		RetentionKeepPublished:       conf.RetentionKeepPublished,
+		RetentionKeepYoungerThan:     conf.RetentionKeepYoungerThan.Duration,
+		ScheduledPublishInterval:     conf.ScheduledPublishInterval.Duration,
+		WebhookDeliveryInterval:      conf.WebhookDeliveryInterval.Duration,
+		WebhookAllowPrivateAddresses: conf.WebhookAllowPrivateAddresses,
+		PromulgatorsGroup:            conf.PromulgatorsGroup,
+		Roles:                        conf.Roles,
+	}
+	newBackend, closeBackends, err := blobstore.NewBackendFromConfig(conf, session, dbName)
+	if err != nil {
+		return errgo.Mask(err)
 	}
+	defer closeBackends()
+	cfg.NewBlobBackend = newBackend
 
 	if conf.AuditLogFile != "" {
 		cfg.AuditLogger = &lumberjack.Logger{
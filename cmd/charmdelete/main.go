@@ -6,18 +6,20 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/natefinch/lumberjack.v2"
 
 	"gopkg.in/juju/charmstore.v5-unstable/config"
 	"gopkg.in/juju/charmstore.v5-unstable/elasticsearch"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
-	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
 var logger = loggo.GetLogger("charmdelete")
@@ -25,9 +27,13 @@ var logger = loggo.GetLogger("charmdelete")
 var (
 	index             = flag.String("index", "cs", "Name of index to charmDelete.")
 	loggingConfig     = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
-	user              = flag.String("user", "", "Delete all charms for a user. Do not mix with charmMatch.")
-	charmMatch        = flag.String("charm-match", "", "Delete all charms maching this expression. Do not mix with user.")
-	dryrun            = flag.Bool("dry-run", false, "Don't actually delete; just print them.")
+	user              = flag.String("user", "", "Delete charms owned by this user.")
+	charmMatch        = flag.String("charm-match", "", "Delete charms whose id matches this expression.")
+	channel           = flag.String("channel", "", "Delete charms that have been published to this channel.")
+	uploadedAfter     = flag.String("uploaded-after", "", "Delete charms uploaded at or after this time (RFC3339 or YYYY-MM-DD).")
+	uploadedBefore    = flag.String("uploaded-before", "", "Delete charms uploaded before this time (RFC3339 or YYYY-MM-DD).")
+	unpublished       = flag.Bool("unpublished", false, "Delete charms that have not been published to any channel.")
+	dryrun            = flag.Bool("dry-run", false, "Don't actually delete; just print what would be deleted.")
 	verbose           = flag.Bool("verbose", false, "")
 	deletePromulgated = flag.Bool("delete-promulgated", false, "Delete a charm even if it is promulgated.")
 )
@@ -55,19 +61,37 @@ func main() {
 }
 
 func run(confPath string) error {
+	p := charmstore.BulkDeleteParams{
+		User:              *user,
+		Match:             *charmMatch,
+		Channel:           params.Channel(*channel),
+		Unpublished:       *unpublished,
+		DeletePromulgated: *deletePromulgated,
+		DryRun:            *dryrun,
+		AuditUser:         auditUser(),
+	}
+	var err error
+	if p.UploadedAfter, err = parseTime(*uploadedAfter); err != nil {
+		return errgo.Notef(err, "invalid -uploaded-after value")
+	}
+	if p.UploadedBefore, err = parseTime(*uploadedBefore); err != nil {
+		return errgo.Notef(err, "invalid -uploaded-before value")
+	}
 	logger.Debugf("reading config file %q", confPath)
 	conf, err := config.Read(confPath)
 	if err != nil {
 		return errgo.Notef(err, "cannot read config file %q", confPath)
 	}
-	if conf.ESAddr == "" {
-		return errgo.Newf("no elasticsearch-addr specified in config file %q", confPath)
-	}
-	si := &charmstore.SearchIndex{
-		Database: &elasticsearch.Database{
-			conf.ESAddr,
-		},
-		Index: *index,
+	var si *charmstore.SearchIndex
+	if conf.ESAddr != "" {
+		si = &charmstore.SearchIndex{
+			Database: &elasticsearch.Database{
+				conf.ESAddr,
+			},
+			Index: *index,
+		}
+	} else {
+		logger.Warningf("no elasticsearch-addr specified in config file %q; search records will not be removed", confPath)
 	}
 	session, err := mgo.Dial(conf.MongoURL)
 	if err != nil {
@@ -76,65 +100,86 @@ func run(confPath string) error {
 	defer session.Close()
 	db := session.DB("juju")
 
-	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{})
+	var cfg charmstore.ServerParams
+	if conf.AuditLogFile != "" {
+		cfg.AuditLogger = &lumberjack.Logger{
+			Filename: conf.AuditLogFile,
+			MaxSize:  conf.AuditLogMaxSize,
+			MaxAge:   conf.AuditLogMaxAge,
+		}
+	}
+	pool, err := charmstore.NewPool(db, si, nil, cfg)
 	if err != nil {
 		return errgo.Notef(err, "cannot create a new store")
 	}
+	defer pool.Close()
 	store := pool.Store()
 	defer store.Close()
-	entities := store.DB.Entities()
-
-	query := bson.D{{"user", *user}}
-	if *user == "" {
-		fmt.Printf("using match _id $regex %s\n", *charmMatch)
-		query = bson.D{{"_id", bson.D{{"$regex", *charmMatch}}}}
 
-		if *charmMatch == "" {
-			query = nil
-		}
+	plan, err := store.BulkDelete(p)
+	if err != nil {
+		return errgo.Notef(err, "cannot delete entities")
 	}
-	if query != nil {
-		var entity mongodoc.Entity
-		iter := entities.Find(query).Iter()
-		defer iter.Close()
+	printPlan(os.Stdout, plan)
+	return nil
+}
 
-		counter := 0
-		for iter.Next(&entity) {
-			if entity.PromulgatedURL != nil && !*deletePromulgated {
-				fmt.Printf("not deleting promulgated charm %s\n", entity.URL)
-				continue
-			}
-			if *verbose {
-				fmt.Printf("deleting %s\n", entity.URL)
-			}
-			if !*dryrun {
-				deleteEntity(&entity, store)
-			}
-			counter++
-			if counter%100 == 0 {
-				logger.Infof("%d entities deleted", counter)
-			}
+// printPlan prints a description of the given plan to w. The
+// individual entities are only listed when running with -dry-run or
+// -verbose.
+func printPlan(w io.Writer, plan *charmstore.BulkDeletePlan) {
+	verb := "deleted"
+	if *dryrun {
+		verb = "would delete"
+	}
+	if *dryrun || *verbose {
+		for _, id := range plan.Entities {
+			fmt.Fprintf(w, "%s entity %s\n", verb, id)
+		}
+		for _, id := range plan.BaseEntities {
+			fmt.Fprintf(w, "%s base entity %s\n", verb, id)
+		}
+		for _, r := range plan.Resources {
+			fmt.Fprintf(w, "%s resource %s %s/%d\n", verb, r.BaseURL, r.Name, r.Revision)
+		}
+		for _, id := range plan.SearchRecords {
+			fmt.Fprintf(w, "%s search record %s\n", verb, id)
+		}
+		for _, skip := range plan.Skipped {
+			fmt.Fprintf(w, "not deleting %s: %s\n", skip.URL, skip.Reason)
 		}
 	}
-
-	return nil
+	fmt.Fprintf(w, "%s %d entities, %d base entities, %d resources and %d search records; skipped %d entities\n",
+		verb,
+		len(plan.Entities),
+		len(plan.BaseEntities),
+		len(plan.Resources),
+		len(plan.SearchRecords),
+		len(plan.Skipped),
+	)
 }
 
-func deleteEntity(entity *mongodoc.Entity, store *charmstore.Store) {
-	err := store.DB.Entities().Remove(bson.D{{"_id", entity.URL}})
+// parseTime parses a time given on the command line. The empty string
+// is parsed as the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		logger.Errorf("could not remove entity for charm %s %s", entity.URL, err)
-	} else if *verbose {
-		fmt.Printf("deleted entity %s\n", entity.URL)
+		return time.Time{}, errgo.Mask(err)
 	}
-	c, err := store.DB.Entities().Find(bson.D{{"baseurl", entity.BaseURL}}).Count()
+	return t, nil
+}
 
-	if c == 0 {
-		err = store.DB.BaseEntities().Remove(bson.D{{"_id", entity.BaseURL}})
-		if err != nil {
-			logger.Errorf("could not remove base_entity for charm %s %s", entity.BaseURL, err)
-		} else if *verbose {
-			fmt.Printf("deleted base entity %s\n", entity.BaseURL)
-		}
+// auditUser returns the name recorded as the user in audit log
+// entries for deleted entities.
+func auditUser() string {
+	if u := os.Getenv("USER"); u != "" {
+		return "charmdelete:" + u
 	}
+	return "charmdelete"
 }
@@ -0,0 +1,105 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The charmgc command runs the blob store garbage collector once. With
+// the -dry-run flag, it lists the blobs that would be removed without
+// removing them.
+package main // import "gopkg.in/juju/charmstore.v5-unstable/cmd/charmgc"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/config"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+)
+
+var logger = loggo.GetLogger("charmgc")
+
+var (
+	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+	dryRun        = flag.Bool("dry-run", false, "Don't actually remove blobs; just print them.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		logger.Errorf("cannot run: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	newBackend, closeBackends, err := blobstore.NewBackendFromConfig(conf, session, dbName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer closeBackends()
+	pool, err := charmstore.NewPool(session.DB(dbName), nil, nil, charmstore.ServerParams{
+		NewBlobBackend: newBackend,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	before := time.Now().Add(-charmstore.BlobStoreGCGracePeriod)
+	if !*dryRun {
+		if err := store.BlobStore.RemoveExpiredUploads(); err != nil {
+			return errgo.Notef(err, "expired-upload garbage collection failed")
+		}
+		if err := store.BlobStoreGC(before); err != nil {
+			return errgo.Notef(err, "blob garbage collection failed")
+		}
+		return nil
+	}
+	garbage, err := store.BlobStoreGCDryRun(before)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var total int64
+	for _, blob := range garbage {
+		fmt.Printf("%s %d %s\n", blob.Hash, blob.Size, blob.PutTime.UTC().Format(time.RFC3339))
+		total += blob.Size
+	}
+	fmt.Printf("%d blobs (%d bytes) would be removed\n", len(garbage), total)
+	return nil
+}
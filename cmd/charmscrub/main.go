@@ -0,0 +1,105 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The charmscrub command reads every blob referenced by the
+// charm store and reports any that are missing or corrupt.
+// It exits with a non-zero status if any problems are found.
+package main // import "gopkg.in/juju/charmstore.v5-unstable/cmd/charmscrub"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/config"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+)
+
+var logger = loggo.GetLogger("charmscrub")
+
+var loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+
+// errProblemsFound is returned by run when the
+// scrub completes but finds missing or corrupt blobs.
+var errProblemsFound = errgo.New("missing or corrupt blobs found")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		if err != errProblemsFound {
+			logger.Errorf("cannot run: %v", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	newBackend, closeBackends, err := blobstore.NewBackendFromConfig(conf, session, dbName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer closeBackends()
+	pool, err := charmstore.NewPool(session.DB(dbName), nil, nil, charmstore.ServerParams{
+		NewBlobBackend: newBackend,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	report, err := store.ScrubBlobs()
+	if err != nil {
+		return errgo.Notef(err, "cannot scrub blobs")
+	}
+	for _, p := range report.Problems {
+		what := p.URL.String()
+		if p.Resource != "" {
+			what += " resource " + p.Resource
+		}
+		fmt.Printf("%s: %s\n", what, p.Message)
+	}
+	if report.Truncated {
+		fmt.Printf("(further problems omitted)\n")
+	}
+	fmt.Printf("%d blobs checked; %d missing; %d corrupt\n", report.Checked, report.Missing, report.Corrupt)
+	if report.Missing > 0 || report.Corrupt > 0 {
+		return errProblemsFound
+	}
+	return nil
+}
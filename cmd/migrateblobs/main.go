@@ -2,35 +2,54 @@
 // Licensed under the AGPLv3, see LICENCE file for details.
 
 // This command migrates blobstore blobs of charms and resources for all
-// entities.  This command is intended to be run on the production db and then
-// discarded.  The first time this command is executed, all the entities are
-// updated.  Subsequent runs migrate missing destination blobs.
+// entities from GridFS to the blob store configured by the "blobstore"
+// setting (swift, filesystem or s3), including any encryption, local cache
+// or secondary blob store that is configured. This command is intended to
+// be run on the production db and then discarded.
+//
+// The progress of the migration is recorded in the "migrateblobs"
+// collection of the configured database, so if the command is
+// interrupted, running it again resumes where it left off. Each blob is
+// verified by reading it back from the destination after it has been
+// copied. The -reset flag discards the recorded progress, so that every
+// blob is checked again.
+//
+// With the -verify-only flag, nothing is copied; instead each blob is
+// compared with its copy in the destination and any that are missing or
+// different are reported and marked so that the next migration copies
+// them again.
+//
+// To migrate without downtime, first run charmd with the new blob store
+// as "blobstore" and "mongodb" as "blobstore-secondary", so that new
+// blobs are written to both and reads fall back to GridFS, then run this
+// command to copy the existing blobs across.
 package main
 
 import (
 	"flag"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
 	"path/filepath"
-	"sync/atomic"
+	"sort"
+	"sync"
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils/parallel"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/goose.v2/client"
-	"gopkg.in/goose.v2/errors"
-	"gopkg.in/goose.v2/identity"
-	"gopkg.in/goose.v2/swift"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
-	"gopkg.in/juju/charmstore.v5-unstable/config"
+	charmstoreconfig "gopkg.in/juju/charmstore.v5-unstable/config"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 )
 
 var (
 	logger        = loggo.GetLogger("migrateblobs")
 	loggingConfig = flag.String("logging-config", "INFO", "specify log levels for modules e.g. <root>=TRACE")
 	numParallel   = flag.Int("p", 1, "the number of parallel copiers")
+	verifyOnly    = flag.Bool("verify-only", false, "compare source and destination blobs without copying anything")
+	reset         = flag.Bool("reset", false, "discard the recorded progress of previous runs")
 )
 
 const maxRetries = 10
@@ -60,7 +79,7 @@ func main() {
 
 func run(confPath string) error {
 	logger.Infof("reading configuration")
-	config, err := config.Read(confPath)
+	config, err := charmstoreconfig.Read(confPath)
 	if err != nil {
 		return errgo.Notef(err, "cannot read config file %q", confPath)
 	}
@@ -71,122 +90,316 @@ func run(confPath string) error {
 		return errgo.Notef(err, "cannot dial mongo at %q", config.MongoURL)
 	}
 	defer session.Close()
-	db := session.DB("juju")
+	dbName := "juju"
+	if config.Database != "" {
+		dbName = config.Database
+	}
+	db := session.DB(dbName)
 
-	cred := &identity.Credentials{
-		URL:        config.SwiftAuthURL,
-		User:       config.SwiftUsername,
-		Secrets:    config.SwiftSecret,
-		Region:     config.SwiftRegion,
-		TenantName: config.SwiftTenant,
+	if config.BlobStore == charmstoreconfig.MongoDBBlobStore {
+		return errgo.Newf("cannot migrate blobs to blob store type %q", config.BlobStore)
 	}
-	if config.SwiftEndpointURL != "" {
-		//do something with config.SwiftEndpointURL
+	// Create the destination as charmd does, so that any
+	// encryption, local cache or secondary blob store
+	// configured also applies to the migrated blobs.
+	newBackend, closeBackends, err := blobstore.NewBackendFromConfig(config, session, dbName)
+	if err != nil {
+		return errgo.Mask(err)
 	}
-	client := client.NewClient(cred, config.SwiftAuthMode.Mode, nil)
-	client.SetRequiredServiceTypes([]string{"object-store"})
-	dst := swift.New(client)
+	defer closeBackends()
+	dst := newBackend(db)
 
-	logger.Infof("migrating entity blobs")
-	counter, alreadyExistsCounter, err := migrate(db.GridFS("entitystore"), dst, config.SwiftBucket)
-	logger.Infof("Total entities migrated %d, already existing %d", counter, alreadyExistsCounter)
+	state := newMigrationState(db.C(stateCollection), blobstore.Location(config))
+	if *reset {
+		logger.Infof("discarding migration state")
+		if err := state.reset(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	m, err := newMigrator(db.GridFS("entitystore"), dst, state)
 	if err != nil {
-		return errgo.Notef(err, "cannot migrate entity blobs")
+		return errgo.Mask(err)
+	}
+	if *verifyOnly {
+		logger.Infof("verifying entity blobs")
+	} else {
+		logger.Infof("migrating entity blobs")
+	}
+	done := make(chan struct{})
+	go m.progress.report(done)
+	err = m.run(*verifyOnly)
+	close(done)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	m.printSummary(*verifyOnly)
+	if len(m.failures) > 0 {
+		return errgo.Newf("%d blobs failed", len(m.failures))
 	}
 	logger.Infof("done")
 	return nil
 }
 
-func migrate(gridfs *mgo.GridFS, sc *swift.Client, dstContainerName string) (counter int32, alreadyExistsCounter int32, err error) {
-	iter := gridfs.Find(nil).Sort("-uploadDate").Iter()
+// migrator migrates blobs from GridFS to a destination backend.
+type migrator struct {
+	gridfs   *mgo.GridFS
+	dst      blobstore.Backend
+	state    *migrationState
+	progress *progress
+
+	// done holds the names of the blobs that were
+	// migrated by a previous run.
+	done map[string]bool
+
+	mu sync.Mutex
+	// copied, existing, resumed and verified count
+	// the blobs dealt with by this run.
+	copied, existing, resumed, verified int
+	// failures holds the blobs that could not be
+	// migrated or verified, keyed by name.
+	failures map[string]error
+}
+
+func newMigrator(gridfs *mgo.GridFS, dst blobstore.Backend, state *migrationState) (*migrator, error) {
+	var total struct {
+		Count int
+		Size  int64
+	}
+	err := gridfs.Files.Pipe([]bson.D{{{
+		"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$sum", "$length"}}},
+		},
+	}}}).One(&total)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot count blobs")
+	}
+	done, err := state.done()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(done) > 0 {
+		logger.Infof("resuming migration; %d blobs already migrated", len(done))
+	}
+	return &migrator{
+		gridfs:   gridfs,
+		dst:      dst,
+		state:    state,
+		progress: newProgress(total.Count, total.Size),
+		done:     done,
+		failures: make(map[string]error),
+	}, nil
+}
+
+// run migrates or, if verifyOnly is true, verifies all the blobs.
+func (m *migrator) run(verifyOnly bool) error {
+	iter := m.gridfs.Find(nil).Sort("-uploadDate").Iter()
 	defer iter.Close()
 	run := parallel.NewRun(*numParallel)
 	var file *mgo.GridFile
-	for gridfs.OpenNext(iter, &file) {
-		fileId := file.Id()
+	for m.gridfs.OpenNext(iter, &file) {
+		fileId, name, size := file.Id(), file.Name(), file.Size()
+		if !verifyOnly && m.done[name] {
+			m.mu.Lock()
+			m.resumed++
+			m.mu.Unlock()
+			m.progress.add(size, true)
+			continue
+		}
 		run.Do(func() error {
 			// Avoid session issue if the main session stop working
 			// Copy the existing session
-			session := gridfs.Files.Database.Session.Copy()
+			session := m.gridfs.Files.Database.Session.Copy()
 			defer session.Close()
-			gridfs2 := &mgo.GridFS{
-				Files:  gridfs.Files.With(session),
-				Chunks: gridfs.Chunks.With(session),
-			}
-			file1, err := gridfs2.OpenId(fileId)
-			if err != nil {
-				return errgo.Mask(err)
-			}
-			found := false
-			err = retry(func() error {
-				_, err := sc.HeadObject(dstContainerName, file1.Name())
-				if err == nil {
-					found = true
-					logger.Infof("- skipping/existing %s [%d] %v",
-						file1.Name(), file1.Size(),
-						file1.UploadDate().Format("2006-01-02 15:04:05"))
-					return nil
-				}
-				if err != nil && !errors.IsNotFound(err) {
-					return errgo.Mask(err)
-				}
-				return nil
-			})
-			if err != nil {
-				logger.Errorf("cannot stat: %s", err)
-				return errgo.Mask(err)
+			gridfs := &mgo.GridFS{
+				Files:  m.gridfs.Files.With(session),
+				Chunks: m.gridfs.Chunks.With(session),
 			}
-			if found {
-				atomic.AddInt32(&alreadyExistsCounter, 1)
-				return nil
+			state := m.state.with(session)
+			var err error
+			if verifyOnly {
+				err = m.verifyBlob(gridfs, fileId, state)
+			} else {
+				err = m.migrateBlob(gridfs, fileId, state)
 			}
-			err = copyObject(file1, sc, dstContainerName)
 			if err != nil {
-				logger.Errorf("cannot copy: %s", err)
-				return errgo.Mask(err)
+				logger.Errorf("%s: %v", name, err)
+				m.mu.Lock()
+				m.failures[name] = err
+				m.mu.Unlock()
 			}
-			counter1 := atomic.AddInt32(&counter, 1)
-			logger.Infof("%d Migrated %s [%d] %v", counter1, file1.Name(), file1.Size(),
-				file1.UploadDate().Format("2006-01-02 15:04:05"))
+			m.progress.add(size, false)
 			return nil
 		})
 	}
-	if err := run.Wait(); err != nil {
-		for _, err1 := range err.(parallel.Errors) {
-			logger.Infof("error when migrating %s", err1)
-		}
-		return counter, alreadyExistsCounter, errgo.Mask(err)
-	}
+	run.Wait()
 	if err := iter.Err(); err != nil {
-		return counter, alreadyExistsCounter, errgo.Notef(err, "cannot iterate entities")
+		return errgo.Notef(err, "cannot iterate entities")
 	}
-	return counter, alreadyExistsCounter, nil
+	return nil
 }
 
-func copyObject(file *mgo.GridFile, sc *swift.Client, dstContainerName string) error {
-	err := retry(func() error {
-		file.Seek(0, 0) // If file was read and we are retrying, we need to seek to start of file.
-		return sc.PutReader(dstContainerName, file.Name(), file, file.Size())
-	})
+// migrateBlob copies the GridFS file with the given id to the
+// destination unless an identical copy is already there, and
+// records the result in the given state.
+func (m *migrator) migrateBlob(gridfs *mgo.GridFS, fileId interface{}, state *migrationState) error {
+	file, err := gridfs.OpenId(fileId)
 	if err != nil {
-		return errgo.Notef(err, "cannot put archive for %s", file.Name())
+		return errgo.Mask(err)
+	}
+	defer file.Close()
+	hash, err := hashOf(file)
+	if err != nil {
+		return errgo.Notef(err, "cannot read %s", file.Name())
+	}
+	err = checkDest(m.dst, file.Name(), hash)
+	switch errgo.Cause(err) {
+	case nil:
+		logger.Infof("- skipping/existing %s [%d] %v",
+			file.Name(), file.Size(),
+			file.UploadDate().Format("2006-01-02 15:04:05"))
+		m.mu.Lock()
+		m.existing++
+		m.mu.Unlock()
+		return errgo.Mask(state.setDone(file.Name(), file.Size(), hash))
+	case blobstore.ErrNotFound, errHashMismatch:
+	default:
+		return errgo.Notef(err, "cannot check destination")
+	}
+	if err := copyObject(file, hash, m.dst); err != nil {
+		state.setFailed(file.Name(), file.Size(), err)
+		return errgo.Mask(err)
+	}
+	if err := checkDest(m.dst, file.Name(), hash); err != nil {
+		err = errgo.Notef(err, "cannot verify copy")
+		state.setFailed(file.Name(), file.Size(), err)
+		return errgo.Mask(err)
 	}
-	var head http.Header
-	err = retry(func() (err error) {
-		head, err = sc.HeadObject(dstContainerName, file.Name())
-		return err
+	if err := state.setDone(file.Name(), file.Size(), hash); err != nil {
+		return errgo.Mask(err)
+	}
+	m.mu.Lock()
+	m.copied++
+	n := m.copied
+	m.mu.Unlock()
+	logger.Infof("%d Migrated %s [%d] %v", n, file.Name(), file.Size(),
+		file.UploadDate().Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// verifyBlob compares the GridFS file with the given id to its copy
+// in the destination, and records the result in the given state so
+// that a subsequent migration copies it again if it differs.
+func (m *migrator) verifyBlob(gridfs *mgo.GridFS, fileId interface{}, state *migrationState) error {
+	file, err := gridfs.OpenId(fileId)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer file.Close()
+	hash, err := hashOf(file)
+	if err != nil {
+		return errgo.Notef(err, "cannot read %s", file.Name())
+	}
+	err = checkDest(m.dst, file.Name(), hash)
+	switch errgo.Cause(err) {
+	case nil:
+		m.mu.Lock()
+		m.verified++
+		m.mu.Unlock()
+		return errgo.Mask(state.setDone(file.Name(), file.Size(), hash))
+	case blobstore.ErrNotFound:
+		err = errgo.New("missing from destination")
+	case errHashMismatch:
+	default:
+		return errgo.Notef(err, "cannot check destination")
+	}
+	if err1 := state.setFailed(file.Name(), file.Size(), err); err1 != nil {
+		logger.Errorf("%v", err1)
+	}
+	return err
+}
+
+// printSummary prints a summary of the results of the run.
+func (m *migrator) printSummary(verifyOnly bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if verifyOnly {
+		fmt.Printf("%d blobs verified; %d failed\n", m.verified, len(m.failures))
+	} else {
+		fmt.Printf("%d blobs migrated; %d already existing; %d migrated previously; %d failed\n", m.copied, m.existing, m.resumed, len(m.failures))
+	}
+	names := make([]string, 0, len(m.failures))
+	for name := range m.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("failed: %s: %v\n", name, m.failures[name])
+	}
+}
+
+var errHashMismatch = errgo.New("destination hash mismatch")
+
+// verifyDest checks that the blob with the given name in the destination
+// has the given hash. It returns an error with an ErrNotFound cause if
+// the blob does not exist, or an errHashMismatch cause if it differs.
+func verifyDest(dst blobstore.Backend, name, hash string) error {
+	r, _, err := dst.Get(name)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(blobstore.ErrNotFound))
+	}
+	defer r.Close()
+	dstHash, err := hashOf(r)
+	if err != nil {
+		return errgo.Notef(err, "cannot read destination blob")
+	}
+	if dstHash != hash {
+		return errHashMismatch
+	}
+	return nil
+}
+
+// checkDest calls verifyDest, retrying on errors other
+// than the blob being missing or different.
+func checkDest(dst blobstore.Backend, name, hash string) error {
+	var verifyErr error
+	err := retry(func() error {
+		verifyErr = verifyDest(dst, name, hash)
+		switch errgo.Cause(verifyErr) {
+		case blobstore.ErrNotFound, errHashMismatch:
+			return nil
+		}
+		return verifyErr
 	})
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if head.Get("Etag") != file.MD5() {
-		err = retry(func() error {
-			return sc.DeleteObject(dstContainerName, file.Name())
-		})
-		if err != nil {
-			logger.Errorf("unable to delete swift file: %q", file.Name())
+	return errgo.Mask(verifyErr, errgo.Is(blobstore.ErrNotFound), errgo.Is(errHashMismatch))
+}
+
+// hashOf returns the hash of the data read from r.
+func hashOf(r io.Reader) (string, error) {
+	hasher := blobstore.NewHash()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// copyObject copies the given GridFS file, which has the given hash,
+// to the destination backend. The backend checks the hash of the data
+// as it is written.
+func copyObject(file *mgo.GridFile, hash string, dst blobstore.Backend) error {
+	err := retry(func() error {
+		// If file was read and we are retrying, we need to seek to start of file.
+		if _, err := file.Seek(0, 0); err != nil {
+			return errgo.Mask(err)
 		}
-		return errgo.Notef(nil, "md5 check sum failed for file: %q", file.Name())
+		return dst.Put(file.Name(), file, file.Size(), hash)
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot put archive for %s", file.Name())
 	}
 	return nil
 }
@@ -0,0 +1,95 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// progressInterval holds how often progress is reported.
+const progressInterval = 30 * time.Second
+
+// progress tracks how much of a migration has been completed.
+type progress struct {
+	start      time.Time
+	totalBlobs int
+	totalBytes int64
+
+	mu sync.Mutex
+
+	// blobs and bytes hold the number and size of the
+	// blobs that have been dealt with so far.
+	blobs int
+	bytes int64
+
+	// resumedBytes holds the size of the blobs that were
+	// skipped because they had been migrated by a previous
+	// run. These are excluded when estimating the time
+	// remaining.
+	resumedBytes int64
+}
+
+func newProgress(totalBlobs int, totalBytes int64) *progress {
+	return &progress{
+		start:      time.Now(),
+		totalBlobs: totalBlobs,
+		totalBytes: totalBytes,
+	}
+}
+
+// add records that a blob of the given size has been dealt with.
+// The resumed argument reports whether the blob was skipped
+// because a previous run had already migrated it.
+func (p *progress) add(size int64, resumed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blobs++
+	p.bytes += size
+	if resumed {
+		p.resumedBytes += size
+	}
+}
+
+// report logs the progress at regular intervals until
+// the given channel is closed.
+func (p *progress) report(done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			logger.Infof("progress: %s", p)
+		}
+	}
+}
+
+func (p *progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	percent := 100.0
+	if p.totalBytes > 0 {
+		percent = float64(p.bytes) * 100 / float64(p.totalBytes)
+	}
+	eta := "unknown"
+	elapsed := time.Since(p.start)
+	if worked := p.bytes - p.resumedBytes; worked > 0 {
+		remaining := p.totalBytes - p.bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		d := time.Duration(float64(elapsed) * float64(remaining) / float64(worked))
+		eta = (d - d%time.Second).String()
+	}
+	return fmt.Sprintf("%d/%d blobs; %d/%d bytes (%.1f%%); elapsed %v; ETA %s",
+		p.blobs, p.totalBlobs,
+		p.bytes, p.totalBytes,
+		percent,
+		elapsed-elapsed%time.Second,
+		eta,
+	)
+}
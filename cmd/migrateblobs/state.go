@@ -0,0 +1,129 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// stateCollection holds the name of the collection
+// that records the progress of migrations.
+const stateCollection = "migrateblobs"
+
+const (
+	statusDone   = "done"
+	statusFailed = "failed"
+)
+
+// blobDoc holds the migration state of a single blob.
+type blobDoc struct {
+	// Id holds the destination and the name of the blob,
+	// separated by a space.
+	Id string `bson:"_id"`
+
+	// Dest identifies the destination blob store.
+	Dest string
+
+	// Name holds the name of the blob.
+	Name string
+
+	// Size holds the size of the blob.
+	Size int64
+
+	// Hash holds the hash of the blob, recorded
+	// when it was successfully migrated.
+	Hash string `bson:",omitempty"`
+
+	// Status holds statusDone or statusFailed.
+	Status string
+
+	// Error holds the reason the migration
+	// of the blob last failed.
+	Error string `bson:",omitempty"`
+
+	// Time holds when the state was last updated.
+	Time time.Time
+}
+
+// migrationState records which blobs have been migrated to
+// a given destination, so that an interrupted migration can be
+// resumed without copying or checking those blobs again.
+type migrationState struct {
+	c    *mgo.Collection
+	dest string
+}
+
+func newMigrationState(c *mgo.Collection, dest string) *migrationState {
+	return &migrationState{
+		c:    c,
+		dest: dest,
+	}
+}
+
+// with returns a copy of s that uses the given session.
+func (s *migrationState) with(session *mgo.Session) *migrationState {
+	return &migrationState{
+		c:    s.c.With(session),
+		dest: s.dest,
+	}
+}
+
+// done returns the names of all the blobs that
+// have been successfully migrated.
+func (s *migrationState) done() (map[string]bool, error) {
+	names := make(map[string]bool)
+	iter := s.c.Find(bson.D{{"dest", s.dest}, {"status", statusDone}}).
+		Select(bson.D{{"name", 1}}).
+		Iter()
+	var doc blobDoc
+	for iter.Next(&doc) {
+		names[doc.Name] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot read migration state")
+	}
+	return names, nil
+}
+
+// setDone records that the given blob has been migrated.
+func (s *migrationState) setDone(name string, size int64, hash string) error {
+	return s.set(&blobDoc{
+		Name:   name,
+		Size:   size,
+		Hash:   hash,
+		Status: statusDone,
+	})
+}
+
+// setFailed records that the given blob could not be migrated.
+func (s *migrationState) setFailed(name string, size int64, migrateErr error) error {
+	return s.set(&blobDoc{
+		Name:   name,
+		Size:   size,
+		Status: statusFailed,
+		Error:  migrateErr.Error(),
+	})
+}
+
+func (s *migrationState) set(doc *blobDoc) error {
+	doc.Id = s.dest + " " + doc.Name
+	doc.Dest = s.dest
+	doc.Time = time.Now()
+	if _, err := s.c.UpsertId(doc.Id, doc); err != nil {
+		return errgo.Notef(err, "cannot update migration state of %q", doc.Name)
+	}
+	return nil
+}
+
+// reset discards all the migration state for the destination.
+func (s *migrationState) reset() error {
+	if _, err := s.c.RemoveAll(bson.D{{"dest", s.dest}}); err != nil {
+		return errgo.Notef(err, "cannot reset migration state")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// This command re-encrypts all blobs that are not encrypted with the
+// key named by the "blobstore-encryption-key-id" setting, including any
+// blobs stored before encryption was enabled.
+//
+// To rotate keys, add the new key to "blobstore-encryption-keys", make
+// it the current key with "blobstore-encryption-key-id" and restart
+// charmd, then run this command. When it has completed, the old key can
+// be removed from the configuration.
+package main // import "gopkg.in/juju/charmstore.v5-unstable/cmd/reencryptblobs"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/config"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+)
+
+var (
+	logger        = loggo.GetLogger("reencryptblobs")
+	loggingConfig = flag.String("logging-config", "INFO", "specify log levels for modules e.g. <root>=TRACE")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Infof("reading configuration")
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	if conf.BlobEncryptionKeyId == "" {
+		return errgo.Newf("no blobstore-encryption-key-id specified in config file %q", confPath)
+	}
+
+	logger.Infof("connecting to mongo")
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	newBackend, closeBackends, err := blobstore.NewBackendFromConfig(conf, session, dbName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer closeBackends()
+	pool, err := charmstore.NewPool(session.DB(dbName), nil, nil, charmstore.ServerParams{
+		NewBlobBackend: newBackend,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	logger.Infof("re-encrypting blobs with key %q", conf.BlobEncryptionKeyId)
+	n, err := store.BlobStore.Reencrypt()
+	logger.Infof("%d blobs re-encrypted", n)
+	if err != nil {
+		return errgo.Notef(err, "cannot re-encrypt blobs")
+	}
+	logger.Infof("done")
+	return nil
+}
@@ -6,8 +6,10 @@
 package config // import "gopkg.in/juju/charmstore.v5-unstable/config"
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -52,13 +54,99 @@ type Config struct {
 	SwiftRegion       string            `yaml:"swift-region"`
 	SwiftTenant       string            `yaml:"swift-tenant"`
 	SwiftAuthMode     *SwiftAuthMode    `yaml:"swift-authmode"`
+	FilesystemPath    string            `yaml:"filesystem-path"`
+	S3Endpoint        string            `yaml:"s3-endpoint"`
+	S3Region          string            `yaml:"s3-region"`
+	S3Bucket          string            `yaml:"s3-bucket"`
+	S3AccessKey       string            `yaml:"s3-access-key"`
+	S3SecretKey       string            `yaml:"s3-secret-key"`
+
+	// BlobStoreSecondary, if set, causes blobs to be replicated to
+	// a second blob store of the given type, configured with the
+	// same fields as above. The store named by BlobStore is the
+	// primary.
+	BlobStoreSecondary      BlobStoreType `yaml:"blobstore-secondary"`
+	BlobStoreReadPreference string        `yaml:"blobstore-read-preference"`
+	BlobStoreRepair         bool          `yaml:"blobstore-repair"`
+
+	// BlobCacheDir, if set, holds the directory used to cache
+	// blobs read from the blob store, up to BlobCacheSize bytes.
+	BlobCacheDir  string `yaml:"blobstore-cache-dir"`
+	BlobCacheSize int64  `yaml:"blobstore-cache-size"`
+
+	// BlobEncryptionKeys, if set, holds base64-encoded 32 byte keys
+	// used to encrypt blobs, indexed by key id. New blobs are
+	// encrypted with the key named by BlobEncryptionKeyId; the others
+	// are kept so that blobs encrypted with them can still be read
+	// until they have been re-encrypted.
+	BlobEncryptionKeys  map[string]EncryptionKey `yaml:"blobstore-encryption-keys"`
+	BlobEncryptionKeyId string                   `yaml:"blobstore-encryption-key-id"`
+
+	// BlobScrubInterval, if non-zero, holds how often the blob
+	// integrity scrubber is run.
+	BlobScrubInterval DurationString `yaml:"blobstore-scrub-interval,omitempty"`
+
+	// DeletedEntityRetention holds how long deleted entities are kept
+	// so that they can be restored. If it is zero, a default is used.
+	DeletedEntityRetention DurationString `yaml:"deleted-entity-retention,omitempty"`
+
+	// RevisionPruneInterval, if non-zero, holds how often old
+	// revisions are pruned according to their retention policies.
+	RevisionPruneInterval DurationString `yaml:"revision-prune-interval,omitempty"`
+
+	// RetentionKeepUnpublished, RetentionKeepPublished and
+	// RetentionKeepYoungerThan hold the global revision retention
+	// policy used for charms and bundles without their own policy.
+	RetentionKeepUnpublished int            `yaml:"retention-keep-unpublished,omitempty"`
+	RetentionKeepPublished   bool           `yaml:"retention-keep-published,omitempty"`
+	RetentionKeepYoungerThan DurationString `yaml:"retention-keep-younger-than,omitempty"`
+
+	// ScheduledPublishInterval holds how often scheduled publishes
+	// that are due are made. If it is zero, one minute is used.
+	ScheduledPublishInterval DurationString `yaml:"scheduled-publish-interval,omitempty"`
+
+	// WebhookDeliveryInterval holds how often webhook deliveries
+	// that are due are attempted. If it is zero, ten seconds is used.
+	WebhookDeliveryInterval DurationString `yaml:"webhook-delivery-interval,omitempty"`
+
+	// WebhookAllowPrivateAddresses holds whether webhook events may
+	// be delivered to loopback, link-local and private addresses.
+	WebhookAllowPrivateAddresses bool `yaml:"webhook-allow-private-addresses,omitempty"`
+
+	// PromulgatorsGroup holds the name of the group whose members
+	// may promulgate charms and bundles. If it is empty, "charmers"
+	// is used.
+	PromulgatorsGroup string `yaml:"promulgators-group,omitempty"`
+
+	// Roles maps the names of roles to the users and groups that
+	// have them. See Roles for the roles that may be given.
+	Roles map[string][]string `yaml:"roles,omitempty"`
+}
+
+// defaultScheduledPublishInterval holds the interval at which
+// scheduled publishes are made when none has been configured.
+const defaultScheduledPublishInterval = time.Minute
+
+// defaultWebhookDeliveryInterval holds the interval at which webhook
+// deliveries are attempted when none has been configured.
+const defaultWebhookDeliveryInterval = 10 * time.Second
+
+// Roles holds the names of the roles that may be given to users
+// and groups with the roles configuration setting.
+var Roles = []string{
+	"super-admin",
+	"promulgator",
+	"stats-writer",
+	"auditor",
 }
 
 type BlobStoreType string
 
 const (
-	MongoDBBlobStore BlobStoreType = "mongodb"
-	SwiftBlobStore   BlobStoreType = "swift"
+	MongoDBBlobStore    BlobStoreType = "mongodb"
+	SwiftBlobStore      BlobStoreType = "swift"
+	FilesystemBlobStore BlobStoreType = "filesystem"
+	S3BlobStore         BlobStoreType = "s3"
 )
 
 // SwiftAuthMode implements unmarshaling for
@@ -100,7 +188,63 @@ func (c *Config) validate() error {
 	if c.BlobStore == "" {
 		c.BlobStore = MongoDBBlobStore
 	}
-	switch c.BlobStore {
+	if c.ScheduledPublishInterval.Duration == 0 {
+		c.ScheduledPublishInterval.Duration = defaultScheduledPublishInterval
+	}
+	if c.WebhookDeliveryInterval.Duration == 0 {
+		c.WebhookDeliveryInterval.Duration = defaultWebhookDeliveryInterval
+	}
+	if err := c.validateBlobStore(c.BlobStore, needString); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.BlobStoreSecondary != "" {
+		if c.BlobStoreSecondary == c.BlobStore {
+			return errgo.Newf("secondary blob store type %q is the same as the primary", c.BlobStoreSecondary)
+		}
+		if err := c.validateBlobStore(c.BlobStoreSecondary, needString); err != nil {
+			return errgo.Mask(err)
+		}
+		switch c.BlobStoreReadPreference {
+		case "", "primary", "secondary":
+		default:
+			return errgo.Newf("invalid blobstore-read-preference %q", c.BlobStoreReadPreference)
+		}
+	}
+	if c.BlobCacheDir != "" && c.BlobCacheSize <= 0 {
+		missing = append(missing, "blobstore-cache-size")
+	}
+	if len(c.BlobEncryptionKeys) > 0 {
+		needString("blobstore-encryption-key-id", c.BlobEncryptionKeyId)
+	}
+	if c.BlobEncryptionKeyId != "" {
+		if _, ok := c.BlobEncryptionKeys[c.BlobEncryptionKeyId]; !ok {
+			return errgo.Newf("blobstore-encryption-key-id %q not found in blobstore-encryption-keys", c.BlobEncryptionKeyId)
+		}
+	}
+	for role := range c.Roles {
+		if !isRole(role) {
+			return errgo.Newf("invalid role %q", role)
+		}
+	}
+	if len(missing) != 0 {
+		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func isRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBlobStore checks that the fields required by
+// the given blob store type are present.
+func (c *Config) validateBlobStore(t BlobStoreType, needString func(name, val string)) error {
+	switch t {
 	case SwiftBlobStore:
 		needString("swift-auth-url", c.SwiftAuthURL)
 		needString("swift-username", c.SwiftUsername)
@@ -109,14 +253,25 @@ func (c *Config) validate() error {
 		needString("swift-region", c.SwiftRegion)
 		needString("swift-tenant", c.SwiftTenant)
 		if c.SwiftAuthMode == nil {
-			missing = append(missing, "swift-auth-mode")
+			needString("swift-auth-mode", "")
+		}
+	case FilesystemBlobStore:
+		needString("filesystem-path", c.FilesystemPath)
+	case S3BlobStore:
+		needString("s3-endpoint", c.S3Endpoint)
+		needString("s3-region", c.S3Region)
+		needString("s3-bucket", c.S3Bucket)
+		needString("s3-access-key", c.S3AccessKey)
+		needString("s3-secret-key", c.S3SecretKey)
+		if c.S3Endpoint != "" {
+			u, err := url.Parse(c.S3Endpoint)
+			if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				return errgo.Newf("invalid s3-endpoint %q", c.S3Endpoint)
+			}
 		}
 	case MongoDBBlobStore:
 	default:
-		return errgo.Newf("invalid blob store type %q", c.BlobStore)
-	}
-	if len(missing) != 0 {
-		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
+		return errgo.Newf("invalid blob store type %q", t)
 	}
 	return nil
 }
@@ -144,6 +299,22 @@ func Read(path string) (*Config, error) {
 	return &conf, nil
 }
 
+// EncryptionKey holds a blob encryption key that
+// unmarshals from a base64-encoded string.
+type EncryptionKey []byte
+
+func (k *EncryptionKey) UnmarshalText(data []byte) error {
+	key, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return errgo.Notef(err, "cannot decode encryption key")
+	}
+	if len(key) != 32 {
+		return errgo.Newf("encryption key is %d bytes long, not 32", len(key))
+	}
+	*k = key
+	return nil
+}
+
 // DurationString holds a duration that marshals and
 // unmarshals as a friendly string.
 type DurationString struct {
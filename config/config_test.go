@@ -59,6 +59,19 @@ swift-bucket: bucket
 swift-region: somewhere
 swift-tenant: a-tenant
 swift-authmode: userpass
+blobstore-scrub-interval: 24h
+deleted-entity-retention: 168h
+revision-prune-interval: 6h
+retention-keep-unpublished: 10
+retention-keep-published: true
+retention-keep-younger-than: 720h
+scheduled-publish-interval: 30s
+webhook-delivery-interval: 5s
+webhook-allow-private-addresses: true
+promulgators-group: promulgators
+roles:
+  super-admin: [admins]
+  stats-writer: [statsbot]
 `
 
 func (s *ConfigSuite) readConfig(c *gc.C, content string) (*config.Config, error) {
@@ -99,18 +112,32 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 				mustParseKey("lsvcDkapKoFxIyjX9/eQgb3s41KVwPMISFwAJdVCZ70="),
 			},
 		},
-		StatsCacheMaxAge:  config.DurationString{time.Hour},
-		RequestTimeout:    config.DurationString{500 * time.Millisecond},
-		MaxMgoSessions:    10,
-		SearchCacheMaxAge: config.DurationString{15 * time.Minute},
-		BlobStore:         config.SwiftBlobStore,
-		SwiftAuthURL:      "https://foo.com",
-		SwiftUsername:     "bob",
-		SwiftSecret:       "secret",
-		SwiftBucket:       "bucket",
-		SwiftRegion:       "somewhere",
-		SwiftTenant:       "a-tenant",
-		SwiftAuthMode:     &config.SwiftAuthMode{identity.AuthUserPass},
+		StatsCacheMaxAge:             config.DurationString{time.Hour},
+		RequestTimeout:               config.DurationString{500 * time.Millisecond},
+		MaxMgoSessions:               10,
+		SearchCacheMaxAge:            config.DurationString{15 * time.Minute},
+		BlobStore:                    config.SwiftBlobStore,
+		SwiftAuthURL:                 "https://foo.com",
+		SwiftUsername:                "bob",
+		SwiftSecret:                  "secret",
+		SwiftBucket:                  "bucket",
+		SwiftRegion:                  "somewhere",
+		SwiftTenant:                  "a-tenant",
+		SwiftAuthMode:                &config.SwiftAuthMode{identity.AuthUserPass},
+		BlobScrubInterval:            config.DurationString{24 * time.Hour},
+		DeletedEntityRetention:       config.DurationString{7 * 24 * time.Hour},
+		RevisionPruneInterval:        config.DurationString{6 * time.Hour},
+		RetentionKeepUnpublished:     10,
+		RetentionKeepPublished:       true,
+		RetentionKeepYoungerThan:     config.DurationString{30 * 24 * time.Hour},
+		ScheduledPublishInterval:     config.DurationString{30 * time.Second},
+		WebhookDeliveryInterval:      config.DurationString{5 * time.Second},
+		WebhookAllowPrivateAddresses: true,
+		PromulgatorsGroup:            "promulgators",
+		Roles: map[string][]string{
+			"super-admin":  {"admins"},
+			"stats-writer": {"statsbot"},
+		},
 	})
 }
 
@@ -128,6 +155,82 @@ func (s *ConfigSuite) TestValidateConfigError(c *gc.C) {
 	cfg, err = s.readConfig(c, "blobstore: swift\n")
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, swift-auth-url, swift-username, swift-secret, swift-bucket, swift-region, swift-tenant, swift-auth-mode in config file")
 	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: filesystem\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, filesystem-path in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: s3\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, s3-endpoint, s3-region, s3-bucket, s3-access-key, s3-secret-key in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: s3\ns3-endpoint: 'localhost:9000'\n")
+	c.Assert(err, gc.ErrorMatches, `invalid s3-endpoint "localhost:9000"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: filesystem\nblobstore-secondary: swift\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, filesystem-path, swift-auth-url, swift-username, swift-secret, swift-bucket, swift-region, swift-tenant, swift-auth-mode in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore: mongodb\nblobstore-secondary: mongodb\n")
+	c.Assert(err, gc.ErrorMatches, `secondary blob store type "mongodb" is the same as the primary`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-secondary: foo\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blob store type "foo"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-secondary: filesystem\nblobstore-read-preference: tertiary\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blobstore-read-preference "tertiary"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-cache-dir: /tmp/cache\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-cache-size in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-encryption-keys:\n  key1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, blobstore-encryption-key-id in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-encryption-key-id: key2\nblobstore-encryption-keys:\n  key1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n")
+	c.Assert(err, gc.ErrorMatches, `blobstore-encryption-key-id "key2" not found in blobstore-encryption-keys`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "roles:\n  root: [bob]\n")
+	c.Assert(err, gc.ErrorMatches, `invalid role "root"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-encryption-keys:\n  key1: c2hvcnQ=\n")
+	c.Assert(err, gc.ErrorMatches, `cannot parse ".*": encryption key is 5 bytes long, not 32`)
+	c.Assert(cfg, gc.IsNil)
+}
+
+func (s *ConfigSuite) TestReadEncryptionKeys(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig+`
+blobstore-encryption-key-id: key2
+blobstore-encryption-keys:
+  key1: MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+  key2: ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=
+`)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(conf.BlobEncryptionKeyId, gc.Equals, "key2")
+	c.Assert(conf.BlobEncryptionKeys, jc.DeepEquals, map[string]config.EncryptionKey{
+		"key1": config.EncryptionKey("0123456789abcdef0123456789abcdef"),
+		"key2": config.EncryptionKey("fedcba9876543210fedcba9876543210"),
+	})
+}
+
+func (s *ConfigSuite) TestReadDefaults(c *gc.C) {
+	conf, err := s.readConfig(c, `
+mongo-url: localhost:23456
+api-addr: blah:2324
+auth-username: myuser
+auth-password: mypasswd
+`)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(conf.BlobStore, gc.Equals, config.MongoDBBlobStore)
+	c.Assert(conf.ScheduledPublishInterval.Duration, gc.Equals, time.Minute)
+	c.Assert(conf.WebhookDeliveryInterval.Duration, gc.Equals, 10*time.Second)
 }
 
 func mustParseKey(s string) bakery.Key {
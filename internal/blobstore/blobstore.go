@@ -68,6 +68,9 @@ type blobRefDoc struct {
 	PutTime time.Time
 	// Size holds the size of the blob.
 	Size int64 `bson:"size"`
+	// KeyId holds the id of the key used to encrypt
+	// the blob, or is empty if the blob is not encrypted.
+	KeyId string `bson:"keyid,omitempty"`
 
 	// TODO store the kind of object that
 	// caused the reference to be created
@@ -163,10 +166,7 @@ func (s *Store) PutAtTime(r io.Reader, hash string, size int64, now time.Time) e
 		// The blob has been garbage collected, so use
 		// the usual put mechanism.
 	}
-	// Choose an arbitrary name for the blob (but include
-	// some of the hash in there for debugging purposes)
-	uuid := uuidGen.Next()
-	name := fmt.Sprintf(hash[0:16] + "-" + fmt.Sprintf("%x", uuid[0:8]))
+	name := newBlobName(hash)
 	if err := s.backend.Put(name, r, size, hash); err != nil {
 		return errgo.Mask(err)
 	}
@@ -175,6 +175,7 @@ func (s *Store) PutAtTime(r io.Reader, hash string, size int64, now time.Time) e
 		Name:    name,
 		PutTime: now,
 		Size:    size,
+		KeyId:   backendKeyId(s.backend),
 	})
 	if err == nil {
 		return nil
@@ -192,6 +193,15 @@ func (s *Store) PutAtTime(r io.Reader, hash string, size int64, now time.Time) e
 	return nil
 }
 
+// newBlobName returns a new backend blob name for
+// a blob with the given hash.
+func newBlobName(hash string) string {
+	// Choose an arbitrary name for the blob (but include
+	// some of the hash in there for debugging purposes)
+	uuid := uuidGen.Next()
+	return hash[0:16] + "-" + fmt.Sprintf("%x", uuid[0:8])
+}
+
 // Open opens the entry with the given hash. It returns an error
 // with an ErrNotFound cause if the entry does not exist.
 func (s *Store) Open(hash string, index *mongodoc.MultipartIndex) (ReadSeekCloser, int64, error) {
@@ -214,6 +224,43 @@ func (s *Store) Open(hash string, index *mongodoc.MultipartIndex) (ReadSeekClose
 // Note that it also adds any internal blobs held by
 // in-progress uploads to refs.
 func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
+	return s.gc(refs, before, nil)
+}
+
+// GarbageBlob holds information about a blob that
+// would be removed by the garbage collector.
+type GarbageBlob struct {
+	// Hash holds the hex-encoded hash of the blob.
+	Hash string
+	// Name holds the name of the blob in the backend.
+	Name string
+	// Size holds the size of the blob.
+	Size int64
+	// PutTime holds the last time the blob was Put.
+	PutTime time.Time
+}
+
+// GCDryRun returns the blobs that GC would delete if called with the
+// same arguments, without deleting anything.
+func (s *Store) GCDryRun(refs *Refs, before time.Time) ([]GarbageBlob, error) {
+	garbage := []GarbageBlob{}
+	_, err := s.gc(refs, before, func(doc *blobRefDoc) {
+		garbage = append(garbage, GarbageBlob{
+			Hash:    doc.Hash,
+			Name:    doc.Name,
+			Size:    doc.Size,
+			PutTime: doc.PutTime,
+		})
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return garbage, nil
+}
+
+// gc implements GC and GCDryRun. If dryRun is non-nil, it is
+// called for each garbage blob instead of removing the blob.
+func (s *Store) gc(refs *Refs, before time.Time, dryRun func(*blobRefDoc)) (monitoring.BlobStats, error) {
 	fail := func(err error) (monitoring.BlobStats, error) {
 		return monitoring.BlobStats{}, err
 	}
@@ -223,7 +270,7 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 		return fail(errgo.Mask(err))
 	}
 	iter := s.blobRefc.Find(bson.D{{"puttime", bson.D{{"$lte", before}}}}).
-		Select(bson.D{{"name", 1}, {"size", 1}}).
+		Select(bson.D{{"name", 1}, {"size", 1}, {"puttime", 1}}).
 		Batch(5000).
 		Iter()
 	var doc blobRefDoc
@@ -236,6 +283,10 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 			}
 			continue
 		}
+		if dryRun != nil {
+			dryRun(&doc)
+			continue
+		}
 		// Blob not found in refs, which means it's garbage
 		// and should be collected right now.
 		if err := s.blobRefc.Remove(bson.D{{
@@ -267,6 +318,87 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 	return stats, nil
 }
 
+// Reencrypt re-encrypts every blob that is not encrypted with the
+// current key of the store's backend, including any blobs stored
+// before encryption was enabled, so that old keys can be retired.
+// It returns the number of blobs that were re-encrypted.
+//
+// Each blob is written to the backend under a new name before its
+// blob ref is updated, so blobs remain readable throughout, although
+// a reader that opened a blob before it was re-encrypted may see an
+// error if it takes a long time to read it.
+func (s *Store) Reencrypt() (int, error) {
+	keyId := backendKeyId(s.backend)
+	if keyId == "" {
+		return 0, errgo.New("blob store backend does not encrypt blobs")
+	}
+	iter := s.blobRefc.Find(bson.D{{"keyid", bson.D{{"$ne", keyId}}}}).
+		Select(bson.D{{"name", 1}, {"keyid", 1}}).
+		Iter()
+	n := 0
+	var doc blobRefDoc
+	for iter.Next(&doc) {
+		// The blob ref may have been re-encrypted already
+		// if the iterator has returned it twice.
+		if doc.KeyId != keyId {
+			if err := s.reencrypt(doc.Hash, doc.Name, keyId); err != nil {
+				iter.Close()
+				return n, errgo.Notef(err, "cannot re-encrypt blob %q", doc.Name)
+			}
+			n++
+			if n%100 == 0 {
+				logger.Infof("%d blobs re-encrypted", n)
+			}
+		}
+		doc = blobRefDoc{}
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate over blobrefs")
+	}
+	return n, nil
+}
+
+// reencrypt copies the blob with the given hash and backend name to a
+// new blob encrypted with the given key, and points its blob ref at the
+// copy.
+func (s *Store) reencrypt(hash, oldName, keyId string) error {
+	r, size, err := s.backend.Get(oldName)
+	if errgo.Cause(err) == ErrNotFound {
+		// The blob has been garbage collected.
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	name := newBlobName(hash)
+	if err := s.backend.Put(name, r, size, hash); err != nil {
+		return errgo.Mask(err)
+	}
+	err = s.blobRefc.Update(bson.D{{
+		"_id", hash,
+	}, {
+		"name", oldName,
+	}}, bson.D{{
+		"$set", bson.D{{"name", name}, {"keyid", keyId}},
+	}})
+	if err != nil {
+		if err := s.backend.Remove(name); err != nil {
+			logger.Errorf("cannot remove unused blob %q: %v", name, err)
+		}
+		if err == mgo.ErrNotFound {
+			// The blob has been garbage collected
+			// or re-encrypted concurrently.
+			return nil
+		}
+		return errgo.Notef(err, "cannot update blob ref")
+	}
+	if err := s.backend.Remove(oldName); err != nil {
+		logger.Errorf("cannot remove old blob %q: %v", oldName, err)
+	}
+	return nil
+}
+
 // Refs holds information about the existence of
 // a set of blob hashes.
 type Refs struct {
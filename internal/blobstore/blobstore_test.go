@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +29,7 @@ import (
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/monitoring"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/s3test"
 )
 
 var _ = gc.Suite(&MongoStoreSuite{})
@@ -96,6 +100,630 @@ func (s *SwiftStoreSuite) TearDownTest(c *gc.C) {
 	s.openstack.Stop()
 }
 
+type FilesystemStoreSuite struct {
+	dir string
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&FilesystemStoreSuite{})
+
+func (s *FilesystemStoreSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewFilesystemBackend(s.dir)
+	})
+}
+
+func (s *FilesystemStoreSuite) TestPutConcurrent(c *gc.C) {
+	s.blobStoreSuite.TestPutConcurrent(c)
+
+	// Additionally check that there's only one blob left
+	// in the underlying directory and that no temporary
+	// files have been left behind.
+	var names []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(names, gc.HasLen, 1)
+}
+
+func (s *FilesystemStoreSuite) TestPutWrongSize(c *gc.C) {
+	backend := blobstore.NewFilesystemBackend(s.dir)
+	content := "some data"
+	err := backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)+1), hashOf(content))
+	c.Assert(err, gc.ErrorMatches, `unexpected blob size 9 \(expected 10\)`)
+	_, _, err = backend.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *FilesystemStoreSuite) TestInvalidName(c *gc.C) {
+	backend := blobstore.NewFilesystemBackend(s.dir)
+	_, _, err := backend.Get("../foo")
+	c.Assert(err, gc.ErrorMatches, `invalid blob name "../foo"`)
+}
+
+func (s *FilesystemStoreSuite) TestShortNames(c *gc.C) {
+	backend := blobstore.NewFilesystemBackend(s.dir)
+	for _, name := range []string{"tmp", "a", "abcd"} {
+		c.Logf("name %q", name)
+		content := "data for " + name
+		err := backend.Put(name, strings.NewReader(content), int64(len(content)), hashOf(content))
+		c.Assert(err, gc.Equals, nil)
+		r, _, err := backend.Get(name)
+		c.Assert(err, gc.Equals, nil)
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(data), gc.Equals, content)
+	}
+	// No blob is stored directly in the root directory.
+	infos, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, gc.Equals, nil)
+	for _, info := range infos {
+		c.Assert(info.IsDir(), gc.Equals, true, gc.Commentf("file %q", info.Name()))
+	}
+}
+
+type S3StoreSuite struct {
+	server  *s3test.Server
+	backend blobstore.Backend
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&S3StoreSuite{})
+
+func (s *S3StoreSuite) SetUpTest(c *gc.C) {
+	s.server = s3test.NewServer("access-key")
+	s.server.CreateBucket("testbucket")
+	backend, err := blobstore.NewS3Backend(blobstore.S3Params{
+		Endpoint:  s.server.URL,
+		Region:    "some-region",
+		Bucket:    "testbucket",
+		AccessKey: "access-key",
+		SecretKey: "secret-key",
+	})
+	c.Assert(err, gc.Equals, nil)
+	s.backend = backend
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return s.backend
+	})
+}
+
+func (s *S3StoreSuite) TearDownTest(c *gc.C) {
+	s.blobStoreSuite.TearDownTest(c)
+	s.server.Close()
+}
+
+func (s *S3StoreSuite) TestPutConcurrent(c *gc.C) {
+	s.blobStoreSuite.TestPutConcurrent(c)
+
+	// Additionally check that there's only one object
+	// left in the bucket.
+	c.Assert(s.server.Objects("testbucket"), gc.HasLen, 1)
+}
+
+func (s *S3StoreSuite) TestRangedReads(c *gc.C) {
+	content := "0123456789abcdefghij"
+	err := s.backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	r, size, err := s.backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+
+	// Seeking does not make any requests until
+	// the data is read.
+	_, err = r.Seek(15, 0)
+	c.Assert(err, gc.Equals, nil)
+	_, err = r.Seek(10, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s.server.Ranges(), gc.HasLen, 0)
+
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "abcdefghij")
+
+	_, err = r.Seek(-5, 1)
+	c.Assert(err, gc.Equals, nil)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(r, buf)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(buf), gc.Equals, "fgh")
+	c.Assert(s.server.Ranges(), jc.DeepEquals, []string{"bytes=10-", "bytes=15-"})
+}
+
+func (s *S3StoreSuite) TestPutEmpty(c *gc.C) {
+	// An empty blob must be sent with a zero Content-Length
+	// rather than chunked, which S3 refuses.
+	err := s.backend.Put("0123456789abcdef-x", strings.NewReader(""), 0, hashOf(""))
+	c.Assert(err, gc.Equals, nil)
+	r, size, err := s.backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(0))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "")
+}
+
+func (s *S3StoreSuite) TestRangeIgnored(c *gc.C) {
+	content := "0123456789abcdefghij"
+	err := s.backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := s.backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	s.server.SetIgnoreRanges(true)
+	_, err = r.Seek(10, 0)
+	c.Assert(err, gc.Equals, nil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, `S3 request failed: unexpected status "200 OK" in response to ranged request`)
+}
+
+func (s *S3StoreSuite) TestGetNotFound(c *gc.C) {
+	_, _, err := s.backend.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *S3StoreSuite) TestBadCredentials(c *gc.C) {
+	backend, err := blobstore.NewS3Backend(blobstore.S3Params{
+		Endpoint:  s.server.URL,
+		Region:    "some-region",
+		Bucket:    "testbucket",
+		AccessKey: "other-key",
+		SecretKey: "secret-key",
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.ErrorMatches, `S3 request failed: 403 Forbidden`)
+}
+
+func (s *S3StoreSuite) TestInvalidEndpoint(c *gc.C) {
+	_, err := blobstore.NewS3Backend(blobstore.S3Params{
+		Endpoint: "localhost:1234",
+		Bucket:   "testbucket",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid S3 endpoint "localhost:1234"`)
+}
+
+type ReplicaStoreSuite struct {
+	primary   blobstore.Backend
+	secondary blobstore.Backend
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&ReplicaStoreSuite{})
+
+func (s *ReplicaStoreSuite) SetUpTest(c *gc.C) {
+	s.primary = blobstore.NewFilesystemBackend(c.MkDir())
+	s.secondary = blobstore.NewFilesystemBackend(c.MkDir())
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{})
+	})
+}
+
+func (s *ReplicaStoreSuite) TestPutWritesToBoth(c *gc.C) {
+	backend := blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{})
+	content := "some data"
+	err := backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	assertBackendContent(c, s.primary, "0123456789abcdef-x", content)
+	assertBackendContent(c, s.secondary, "0123456789abcdef-x", content)
+
+	err = backend.Remove("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	_, _, err = s.primary.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	_, _, err = s.secondary.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *ReplicaStoreSuite) TestPutFailureRemovesFromOtherBackend(c *gc.C) {
+	backend := blobstore.NewReplicaBackend(s.primary, failingBackend{}, blobstore.ReplicaParams{})
+	content := "some data"
+	err := backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.ErrorMatches, `cannot write to secondary backend: put failed`)
+	_, _, err = s.primary.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	backend = blobstore.NewReplicaBackend(failingBackend{}, s.secondary, blobstore.ReplicaParams{})
+	err = backend.Put("0123456789abcdef-x", strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.ErrorMatches, `cannot write to primary backend: put failed`)
+	_, _, err = s.secondary.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *ReplicaStoreSuite) TestGetFallsBack(c *gc.C) {
+	putBackendContent(c, s.secondary, "0123456789abcdef-x", "secondary data")
+	backend := blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{})
+	assertBackendContent(c, backend, "0123456789abcdef-x", "secondary data")
+
+	putBackendContent(c, s.primary, "0123456789abcdef-y", "primary data")
+	backend = blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{
+		ReadPreference: blobstore.ReadSecondary,
+	})
+	assertBackendContent(c, backend, "0123456789abcdef-y", "primary data")
+
+	_, _, err := backend.Get("0123456789abcdef-z")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *ReplicaStoreSuite) TestReadPreference(c *gc.C) {
+	putBackendContent(c, s.primary, "0123456789abcdef-x", "primary data")
+	putBackendContent(c, s.secondary, "0123456789abcdef-x", "secondary data")
+
+	backend := blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{})
+	assertBackendContent(c, backend, "0123456789abcdef-x", "primary data")
+
+	backend = blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{
+		ReadPreference: blobstore.ReadSecondary,
+	})
+	assertBackendContent(c, backend, "0123456789abcdef-x", "secondary data")
+}
+
+func (s *ReplicaStoreSuite) TestRepair(c *gc.C) {
+	repairer := blobstore.NewReplicaRepairer(func() (blobstore.Backend, blobstore.Backend, func()) {
+		return s.primary, s.secondary, func() {}
+	}, 2)
+	putBackendContent(c, s.secondary, "0123456789abcdef-x", "some data")
+	backend := blobstore.NewReplicaBackend(s.primary, s.secondary, blobstore.ReplicaParams{
+		Repairer: repairer,
+	})
+	assertBackendContent(c, backend, "0123456789abcdef-x", "some data")
+
+	// Wait for the repair to complete.
+	repairer.Close()
+	assertBackendContent(c, s.primary, "0123456789abcdef-x", "some data")
+}
+
+func (s *ReplicaStoreSuite) TestRepairBlobNotFound(c *gc.C) {
+	repairer := blobstore.NewReplicaRepairer(func() (blobstore.Backend, blobstore.Backend, func()) {
+		return s.primary, s.secondary, func() {}
+	}, 1)
+	defer repairer.Close()
+	err := repairer.RepairBlob("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func putBackendContent(c *gc.C, b blobstore.Backend, name, content string) {
+	err := b.Put(name, strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func assertBackendContent(c *gc.C, b blobstore.Backend, name, content string) {
+	r, size, err := b.Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
+}
+
+// failingBackend is a backend whose operations always fail.
+type failingBackend struct{}
+
+func (failingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	return nil, 0, errgo.New("get failed")
+}
+
+func (failingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	return errgo.New("put failed")
+}
+
+func (failingBackend) Remove(name string) error {
+	return errgo.New("remove failed")
+}
+
+type CachingStoreSuite struct {
+	cache *blobstore.DiskCache
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&CachingStoreSuite{})
+
+func (s *CachingStoreSuite) SetUpTest(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 1024*1024)
+	c.Assert(err, gc.Equals, nil)
+	s.cache = cache
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewCachingBackend(blobstore.NewMongoBackend(db, "blobstore"), s.cache)
+	})
+}
+
+func (s *CachingStoreSuite) TestGetFromCache(c *gc.C) {
+	underlying := &countingBackend{Backend: blobstore.NewFilesystemBackend(c.MkDir())}
+	putBackendContent(c, underlying, "0123456789abcdef-x", "some data")
+	backend := blobstore.NewCachingBackend(underlying, s.cache)
+	assertBackendContent(c, backend, "0123456789abcdef-x", "some data")
+	assertBackendContent(c, backend, "0123456789abcdef-x", "some data")
+	c.Assert(underlying.gets, gc.Equals, 1)
+	c.Assert(s.cache.Size(), gc.Equals, int64(len("some data")))
+
+	// Removing the blob removes it from the cache too.
+	err := backend.Remove("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s.cache.Size(), gc.Equals, int64(0))
+	_, _, err = backend.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *CachingStoreSuite) TestEviction(c *gc.C) {
+	dir := c.MkDir()
+	cache, err := blobstore.NewDiskCache(dir, 25)
+	c.Assert(err, gc.Equals, nil)
+	underlying := &countingBackend{Backend: blobstore.NewFilesystemBackend(c.MkDir())}
+	backend := blobstore.NewCachingBackend(underlying, cache)
+	for _, name := range []string{"a", "b", "c"} {
+		putBackendContent(c, underlying, "0123456789abcdef-"+name, strings.Repeat(name, 10))
+	}
+	assertBackendContent(c, backend, "0123456789abcdef-a", strings.Repeat("a", 10))
+	assertBackendContent(c, backend, "0123456789abcdef-b", strings.Repeat("b", 10))
+	// Use a again so that b is the least recently used.
+	assertBackendContent(c, backend, "0123456789abcdef-a", strings.Repeat("a", 10))
+	c.Assert(underlying.gets, gc.Equals, 2)
+
+	// Adding c evicts b.
+	assertBackendContent(c, backend, "0123456789abcdef-c", strings.Repeat("c", 10))
+	c.Assert(underlying.gets, gc.Equals, 3)
+	c.Assert(cache.Size(), gc.Equals, int64(20))
+	_, err = os.Stat(filepath.Join(dir, "0123456789abcdef-b"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	assertBackendContent(c, backend, "0123456789abcdef-a", strings.Repeat("a", 10))
+	assertBackendContent(c, backend, "0123456789abcdef-c", strings.Repeat("c", 10))
+	c.Assert(underlying.gets, gc.Equals, 3)
+
+	// A new cache in the same directory picks up the
+	// existing blobs.
+	cache, err = blobstore.NewDiskCache(dir, 25)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(cache.Size(), gc.Equals, int64(20))
+	backend = blobstore.NewCachingBackend(underlying, cache)
+	assertBackendContent(c, backend, "0123456789abcdef-a", strings.Repeat("a", 10))
+	c.Assert(underlying.gets, gc.Equals, 3)
+}
+
+func (s *CachingStoreSuite) TestBlobLargerThanCache(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 5)
+	c.Assert(err, gc.Equals, nil)
+	underlying := &countingBackend{Backend: blobstore.NewFilesystemBackend(c.MkDir())}
+	putBackendContent(c, underlying, "0123456789abcdef-x", "some data")
+	backend := blobstore.NewCachingBackend(underlying, cache)
+	assertBackendContent(c, backend, "0123456789abcdef-x", "some data")
+	assertBackendContent(c, backend, "0123456789abcdef-x", "some data")
+	c.Assert(underlying.gets, gc.Equals, 2)
+	c.Assert(cache.Size(), gc.Equals, int64(0))
+}
+
+// countingBackend counts the calls to Get on the
+// underlying backend.
+type countingBackend struct {
+	blobstore.Backend
+	mu   sync.Mutex
+	gets int
+}
+
+func (b *countingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	b.mu.Lock()
+	b.gets++
+	b.mu.Unlock()
+	return b.Backend.Get(name)
+}
+
+type EncryptingStoreSuite struct {
+	dir        string
+	underlying blobstore.Backend
+	blobStoreSuite
+}
+
+var _ = gc.Suite(&EncryptingStoreSuite{})
+
+var (
+	testKey1 = []byte("0123456789abcdef0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func (s *EncryptingStoreSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.underlying = blobstore.NewFilesystemBackend(s.dir)
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return s.encryptingBackend(c, "key1")
+	})
+}
+
+// encryptingBackend returns an encrypting backend
+// that encrypts new blobs with the given key.
+func (s *EncryptingStoreSuite) encryptingBackend(c *gc.C, keyId string) blobstore.Backend {
+	keys, err := blobstore.NewEncryptionKeys(map[string][]byte{
+		"key1": testKey1,
+		"key2": testKey2,
+	}, keyId)
+	c.Assert(err, gc.Equals, nil)
+	return blobstore.NewEncryptingBackend(s.underlying, keys)
+}
+
+func (s *EncryptingStoreSuite) TestPutEncrypts(c *gc.C) {
+	content := strings.Repeat("some data", 10)
+	putBackendContent(c, s.encryptingBackend(c, "key1"), "0123456789abcdef-x", content)
+	r, _, err := s.underlying.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(strings.Contains(string(data), "some data"), gc.Equals, false)
+	assertBackendContent(c, s.encryptingBackend(c, "key2"), "0123456789abcdef-x", content)
+}
+
+func (s *EncryptingStoreSuite) TestPutRecordsKeyId(c *gc.C) {
+	content := "some data"
+	err := s.store.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+	var doc struct {
+		KeyId string
+	}
+	err = s.Session.DB("db").C("blobstore.blobref").FindId(hashOf(content)).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.KeyId, gc.Equals, "key1")
+}
+
+func (s *EncryptingStoreSuite) TestPutHashMismatch(c *gc.C) {
+	backend := s.encryptingBackend(c, "key1")
+	err := backend.Put("0123456789abcdef-x", strings.NewReader("some data"), 9, hashOf("other data"))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+	_, _, err = s.underlying.Get("0123456789abcdef-x")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *EncryptingStoreSuite) TestSeek(c *gc.C) {
+	// Use a blob that spans several encryption chunks.
+	const size = 200 * 1024
+	data, err := ioutil.ReadAll(newDataSource(1234, size))
+	c.Assert(err, gc.Equals, nil)
+	backend := s.encryptingBackend(c, "key1")
+	putBackendContent(c, backend, "0123456789abcdef-x", string(data))
+	r, rsize, err := backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(rsize, gc.Equals, int64(size))
+	for i, pos := range []int64{size - 10, 0, 64*1024 - 5, 100, 130 * 1024, size} {
+		c.Logf("test %d: pos %d", i, pos)
+		p, err := r.Seek(pos, 0)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(p, gc.Equals, pos)
+		buf := make([]byte, 20)
+		n, err := io.ReadFull(r, buf)
+		switch {
+		case pos == size:
+			c.Assert(err, gc.Equals, io.EOF)
+		case pos+20 > size:
+			c.Assert(err, gc.Equals, io.ErrUnexpectedEOF)
+		default:
+			c.Assert(err, gc.Equals, nil)
+		}
+		c.Assert(string(buf[0:n]), gc.Equals, string(data[pos:pos+int64(n)]))
+	}
+	p, err := r.Seek(-3, 2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(p, gc.Equals, int64(size-3))
+	_, err = r.Seek(-1, 0)
+	c.Assert(err, gc.ErrorMatches, "negative seek position")
+}
+
+func (s *EncryptingStoreSuite) TestGetUnencrypted(c *gc.C) {
+	putBackendContent(c, s.underlying, "0123456789abcdef-x", "unencrypted data")
+	putBackendContent(c, s.underlying, "0123456789abcdef-y", "short")
+	backend := s.encryptingBackend(c, "key1")
+	assertBackendContent(c, backend, "0123456789abcdef-x", "unencrypted data")
+	assertBackendContent(c, backend, "0123456789abcdef-y", "short")
+}
+
+func (s *EncryptingStoreSuite) TestGetUnknownKey(c *gc.C) {
+	putBackendContent(c, s.encryptingBackend(c, "key2"), "0123456789abcdef-x", "some data")
+	keys, err := blobstore.NewEncryptionKeys(map[string][]byte{
+		"key1": testKey1,
+	}, "key1")
+	c.Assert(err, gc.Equals, nil)
+	backend := blobstore.NewEncryptingBackend(s.underlying, keys)
+	_, _, err = backend.Get("0123456789abcdef-x")
+	c.Assert(err, gc.ErrorMatches, `cannot read blob "0123456789abcdef-x": unknown encryption key "key2"`)
+}
+
+func (s *EncryptingStoreSuite) TestGetTampered(c *gc.C) {
+	backend := s.encryptingBackend(c, "key1")
+	putBackendContent(c, backend, "0123456789abcdef-x", "some data")
+	r, _, err := s.underlying.Get("0123456789abcdef-x")
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.Equals, nil)
+
+	// Change the last byte of the encrypted data.
+	tampered := string(data[0:len(data)-1]) + string(data[len(data)-1]^1)
+	putBackendContent(c, s.underlying, "0123456789abcdef-y", tampered)
+	r, _, err = backend.Get("0123456789abcdef-y")
+	c.Assert(err, gc.Equals, nil)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.ErrorMatches, "cannot decrypt blob: .*")
+
+	// Truncate the encrypted data.
+	putBackendContent(c, s.underlying, "0123456789abcdef-z", string(data[0:len(data)-20]))
+	_, _, err = backend.Get("0123456789abcdef-z")
+	c.Assert(err, gc.ErrorMatches, `cannot read blob "0123456789abcdef-z": encrypted blob has invalid size .*`)
+}
+
+func (s *EncryptingStoreSuite) TestNewEncryptionKeysErrors(c *gc.C) {
+	_, err := blobstore.NewEncryptionKeys(map[string][]byte{
+		"key1": testKey1,
+	}, "key2")
+	c.Assert(err, gc.ErrorMatches, `encryption key "key2" not found`)
+	_, err = blobstore.NewEncryptionKeys(map[string][]byte{
+		"key1": []byte("short"),
+	}, "key1")
+	c.Assert(err, gc.ErrorMatches, `encryption key "key1" is 5 bytes long, not 32`)
+}
+
+func (s *EncryptingStoreSuite) TestReencrypt(c *gc.C) {
+	// Put one blob before encryption was enabled
+	// and another encrypted with key1.
+	plainStore := blobstore.New(s.Session.DB("db"), "blobstore", s.underlying)
+	err := plainStore.Put(strings.NewReader("plain data"), hashOf("plain data"), 10)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Put(strings.NewReader("key1 data"), hashOf("key1 data"), 9)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = plainStore.Reencrypt()
+	c.Assert(err, gc.ErrorMatches, "blob store backend does not encrypt blobs")
+
+	store := blobstore.New(s.Session.DB("db"), "blobstore", s.encryptingBackend(c, "key2"))
+	n, err := store.Reencrypt()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 2)
+
+	// The blobs that were replaced have been removed.
+	c.Assert(s.blobFileCount(c), gc.Equals, 2)
+
+	// All blobs can now be read with only key2.
+	keys, err := blobstore.NewEncryptionKeys(map[string][]byte{
+		"key2": testKey2,
+	}, "key2")
+	c.Assert(err, gc.Equals, nil)
+	s.store = blobstore.New(s.Session.DB("db"), "blobstore", blobstore.NewEncryptingBackend(s.underlying, keys))
+	s.assertBlobContent(c, nil, "plain data")
+	s.assertBlobContent(c, nil, "key1 data")
+
+	// Running it again does nothing.
+	n, err = store.Reencrypt()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(s.blobFileCount(c), gc.Equals, 2)
+}
+
+// blobFileCount returns the number of blobs
+// in the underlying backend.
+func (s *EncryptingStoreSuite) blobFileCount(c *gc.C) int {
+	n := 0
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	c.Assert(err, gc.Equals, nil)
+	return n
+}
+
 type blobStoreSuite struct {
 	jujutesting.IsolatedMgoSuite
 	store      *blobstore.Store
@@ -151,6 +779,45 @@ func (s *blobStoreSuite) TestGC(c *gc.C) {
 	}
 }
 
+func (s *blobStoreSuite) TestGCDryRun(c *gc.C) {
+	now := time.Now().Truncate(time.Millisecond)
+	contents := []string{"a", "bb", "ccc", "dddd"}
+	for i, content := range contents {
+		err := s.store.PutAtTime(strings.NewReader(content), hashOf(content), int64(len(content)), now.Add(time.Duration(i)*time.Minute))
+		c.Assert(err, gc.Equals, nil)
+	}
+	refs := blobstore.NewRefs(0)
+	refs.Add(hashOf("bb"))
+	garbage, err := s.store.GCDryRun(refs, now.Add(2*time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	for i := range garbage {
+		c.Assert(garbage[i].Name, gc.Matches, garbage[i].Hash[0:16]+"-.+")
+		garbage[i].Name = ""
+		garbage[i].PutTime = garbage[i].PutTime.UTC()
+	}
+	sort.Sort(garbageBlobsByPutTime(garbage))
+	c.Assert(garbage, jc.DeepEquals, []blobstore.GarbageBlob{{
+		Hash:    hashOf("a"),
+		Size:    1,
+		PutTime: now.UTC(),
+	}, {
+		Hash:    hashOf("ccc"),
+		Size:    3,
+		PutTime: now.Add(2 * time.Minute).UTC(),
+	}})
+
+	// Nothing has been removed.
+	for _, content := range contents {
+		s.assertBlobContent(c, nil, content)
+	}
+}
+
+type garbageBlobsByPutTime []blobstore.GarbageBlob
+
+func (b garbageBlobsByPutTime) Len() int           { return len(b) }
+func (b garbageBlobsByPutTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b garbageBlobsByPutTime) Less(i, j int) bool { return b[i].PutTime.Before(b[j].PutTime) }
+
 func (s *blobStoreSuite) TestPutInvalidHash(c *gc.C) {
 	content := "some data"
 	err := s.store.Put(strings.NewReader(content), hashOf("wrong"), int64(len(content)))
@@ -215,7 +882,7 @@ func (s *blobStoreSuite) TestPutConcurrent(c *gc.C) {
 
 func (s *blobStoreSuite) TestNewParts(c *gc.C) {
 	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond)
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(id, gc.Not(gc.Equals), "")
 
@@ -673,7 +1340,7 @@ func (s *blobStoreSuite) TestFinishUploadCalledWhenCalculatingHash(c *gc.C) {
 func (s *blobStoreSuite) TestRemoveUploadSuccessWithNoPart(c *gc.C) {
 	s.store.MinPartSize = 10
 	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond)
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 	err = s.store.RemoveUpload(id)
 	c.Assert(err, gc.Equals, nil)
@@ -688,7 +1355,7 @@ func (s *blobStoreSuite) TestRemoveUploadOnNonExistingUpload(c *gc.C) {
 func (s *blobStoreSuite) TestRemoveUploadSuccessWithParts(c *gc.C) {
 	s.store.MinPartSize = 10
 	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond)
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 	content := "123456789 12345"
 	err = s.store.PutPart(id, 0, strings.NewReader(content), int64(len(content)), hashOf(content))
@@ -705,7 +1372,7 @@ func (s *blobStoreSuite) TestRemoveUploadSuccessWithParts(c *gc.C) {
 func (s *blobStoreSuite) TestSetOwner(c *gc.C) {
 	s.store.MinPartSize = 10
 	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond)
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 	content := "123456789 12345"
 	err = s.store.PutPart(id, 0, strings.NewReader(content), int64(len(content)), hashOf(content))
@@ -749,7 +1416,7 @@ func (s *blobStoreSuite) TestSetOwner(c *gc.C) {
 func (s *blobStoreSuite) TestRemoveFinishedUploadRemovesParts(c *gc.C) {
 	s.store.MinPartSize = 10
 
-	id, err := s.store.NewUpload(time.Now().Add(time.Minute))
+	id, err := s.store.NewUpload(time.Now().Add(time.Minute), "")
 	c.Assert(err, gc.Equals, nil)
 	content := "123456789 12345"
 	err = s.store.PutPart(id, 0, strings.NewReader(content), int64(len(content)), hashOf(content))
@@ -775,7 +1442,7 @@ func (s *blobStoreSuite) TestRemoveExpiredUploads(c *gc.C) {
 	expireTimes := []time.Duration{-time.Minute, -time.Second, time.Minute, time.Hour}
 	ids := make([]string, len(expireTimes))
 	for i, dt := range expireTimes {
-		id, err := s.store.NewUpload(time.Now().Add(dt))
+		id, err := s.store.NewUpload(time.Now().Add(dt), "")
 		c.Assert(err, gc.Equals, nil)
 		content := fmt.Sprintf("%15d", i)
 		err = s.store.PutPart(id, 0, strings.NewReader(content), int64(len(content)), hashOf(content))
@@ -865,6 +1532,7 @@ func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	}
 	info.Expires = time.Time{}
 	c.Assert(info, jc.DeepEquals, blobstore.UploadInfo{
+		Id: id,
 		Parts: []*blobstore.PartInfo{{
 			Hash:     hashOf(part0),
 			Size:     int64(len(part0)),
@@ -888,6 +1556,50 @@ func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	s.assertBlobContent(c, idx, part0+part1+part2)
 }
 
+func (s *blobStoreSuite) TestUploads(c *gc.C) {
+	s.store.MinPartSize = 10
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	id1, err := s.store.NewUpload(now.Add(2*time.Minute), "bob")
+	c.Assert(err, gc.Equals, nil)
+	content := "123456789 12345"
+	err = s.store.PutPart(id1, 0, strings.NewReader(content), int64(len(content)), hashOf(content))
+	c.Assert(err, gc.Equals, nil)
+	id2, err := s.store.NewUpload(now.Add(time.Minute), "bob")
+	c.Assert(err, gc.Equals, nil)
+	id3, err := s.store.NewUpload(now.Add(time.Minute), "alice")
+	c.Assert(err, gc.Equals, nil)
+
+	infos, err := s.store.Uploads("bob")
+	c.Assert(err, gc.Equals, nil)
+	for i := range infos {
+		infos[i].Expires = infos[i].Expires.UTC()
+	}
+	c.Assert(infos, jc.DeepEquals, []blobstore.UploadInfo{{
+		Id:      id2,
+		Creator: "bob",
+		Expires: now.Add(time.Minute),
+	}, {
+		Id:      id1,
+		Creator: "bob",
+		Expires: now.Add(2 * time.Minute),
+		Parts: []*blobstore.PartInfo{{
+			Hash:     hashOf(content),
+			Size:     int64(len(content)),
+			Complete: true,
+		}},
+	}})
+
+	infos, err = s.store.Uploads("")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(infos, gc.HasLen, 3)
+
+	err = s.store.RemoveUpload(id3)
+	c.Assert(err, gc.Equals, nil)
+	infos, err = s.store.Uploads("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
 var multipartSeekTests = []struct {
 	initialOffset int64
 	offset        int64
@@ -971,7 +1683,7 @@ func (s *blobStoreSuite) putMultipart(c *gc.C, contents ...string) (string, *mon
 
 func (s *blobStoreSuite) putMultipartNoRemove(c *gc.C, contents ...string) (string, *mongodoc.MultipartIndex) {
 	expires := time.Now().Add(time.Minute)
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 
 	parts := make([]blobstore.Part, len(contents))
@@ -1018,7 +1730,7 @@ func (s *blobStoreSuite) assertBlobContent(c *gc.C, idx *mongodoc.MultipartIndex
 // newUpload returns the id of a new upload instance.
 func (s *blobStoreSuite) newUpload(c *gc.C) string {
 	expires := time.Now().Add(time.Minute).UTC()
-	id, err := s.store.NewUpload(expires)
+	id, err := s.store.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 	return id
 }
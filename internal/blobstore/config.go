@@ -0,0 +1,140 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/goose.v2/identity"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/config"
+)
+
+// maxConcurrentRepairs holds the maximum number of blobs
+// that will be copied to the primary blob store at once.
+const maxConcurrentRepairs = 5
+
+// NewBackendFromConfig returns a function, suitable for use as
+// ServerParams.NewBlobBackend, that creates backends as specified by
+// the blob store settings in conf, including any secondary blob store,
+// local cache and encryption.
+//
+// The given session is copied to run any background repairs of the
+// primary blob store, so it must remain open until the returned close
+// function has been called.
+func NewBackendFromConfig(conf *config.Config, session *mgo.Session, dbName string) (newBackend func(db *mgo.Database) Backend, close func(), err error) {
+	close = func() {}
+	newBackend, err = newBackendForType(conf, conf.BlobStore)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	if conf.BlobStoreSecondary != "" {
+		newSecondary, err := newBackendForType(conf, conf.BlobStoreSecondary)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		newPrimary := newBackend
+		p := ReplicaParams{
+			ReadPreference: ReadPreference(conf.BlobStoreReadPreference),
+		}
+		if conf.BlobStoreRepair {
+			p.Repairer = NewReplicaRepairer(func() (Backend, Backend, func()) {
+				s := session.Copy()
+				db := s.DB(dbName)
+				return newPrimary(db), newSecondary(db), s.Close
+			}, maxConcurrentRepairs)
+			close = p.Repairer.Close
+		}
+		newBackend = func(db *mgo.Database) Backend {
+			return NewReplicaBackend(newPrimary(db), newSecondary(db), p)
+		}
+	}
+	if conf.BlobCacheDir != "" {
+		cache, err := NewDiskCache(conf.BlobCacheDir, conf.BlobCacheSize)
+		if err != nil {
+			close()
+			return nil, nil, errgo.Notef(err, "cannot create blob cache")
+		}
+		newUncached := newBackend
+		newBackend = func(db *mgo.Database) Backend {
+			return NewCachingBackend(newUncached(db), cache)
+		}
+	}
+	if conf.BlobEncryptionKeyId != "" {
+		// Encryption is applied outermost so that blobs are
+		// encrypted in the cache and both replicas.
+		keyMap := make(map[string][]byte)
+		for id, key := range conf.BlobEncryptionKeys {
+			keyMap[id] = key
+		}
+		keys, err := NewEncryptionKeys(keyMap, conf.BlobEncryptionKeyId)
+		if err != nil {
+			close()
+			return nil, nil, errgo.Notef(err, "invalid blob encryption keys")
+		}
+		newUnencrypted := newBackend
+		newBackend = func(db *mgo.Database) Backend {
+			return NewEncryptingBackend(newUnencrypted(db), keys)
+		}
+	}
+	return newBackend, close, nil
+}
+
+// newBackendForType returns a function that creates blob store
+// backends of the given type.
+func newBackendForType(conf *config.Config, t config.BlobStoreType) (func(db *mgo.Database) Backend, error) {
+	switch t {
+	case config.MongoDBBlobStore:
+		return func(db *mgo.Database) Backend {
+			return NewMongoBackend(db, "entitystore")
+		}, nil
+	case config.SwiftBlobStore:
+		cred := &identity.Credentials{
+			URL:        conf.SwiftAuthURL,
+			User:       conf.SwiftUsername,
+			Secrets:    conf.SwiftSecret,
+			Region:     conf.SwiftRegion,
+			TenantName: conf.SwiftTenant,
+		}
+		return func(db *mgo.Database) Backend {
+			return NewSwiftBackend(cred, conf.SwiftAuthMode.Mode, conf.SwiftBucket)
+		}, nil
+	case config.FilesystemBlobStore:
+		return func(db *mgo.Database) Backend {
+			return NewFilesystemBackend(conf.FilesystemPath)
+		}, nil
+	case config.S3BlobStore:
+		backend, err := NewS3Backend(S3Params{
+			Endpoint:  conf.S3Endpoint,
+			Region:    conf.S3Region,
+			Bucket:    conf.S3Bucket,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create S3 blob store backend")
+		}
+		return func(db *mgo.Database) Backend {
+			return backend
+		}, nil
+	}
+	return nil, errgo.Newf("unknown blob store type %q", t)
+}
+
+// Location returns a string identifying the location of the primary
+// blob store specified by conf, suitable for recording which blob
+// store some blobs have been written to.
+func Location(conf *config.Config) string {
+	switch conf.BlobStore {
+	case config.SwiftBlobStore:
+		return fmt.Sprintf("swift:%s/%s", conf.SwiftAuthURL, conf.SwiftBucket)
+	case config.FilesystemBlobStore:
+		return fmt.Sprintf("filesystem:%s", conf.FilesystemPath)
+	case config.S3BlobStore:
+		return fmt.Sprintf("s3:%s/%s", conf.S3Endpoint, conf.S3Bucket)
+	}
+	return string(conf.BlobStore)
+}
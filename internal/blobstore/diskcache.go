@@ -0,0 +1,261 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/monitoring"
+)
+
+// DiskCache holds a size-bounded cache of blobs in a local directory.
+// Blobs are evicted in least-recently-used order when the total size
+// of the cache would exceed its limit.
+//
+// A blob's name includes a prefix of its hash and is never reused for
+// different content, so cached blobs never need to be invalidated.
+//
+// A DiskCache may be shared between any number of backends
+// created with NewCachingBackend.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// diskCacheEntry holds an entry in the DiskCache LRU list.
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// NewDiskCache returns a cache that stores at most maxSize bytes of
+// blobs in the given directory, which is created if necessary. Any
+// blobs already in the directory (for example from a previous run)
+// are added to the cache, with the most recently modified treated as
+// the most recently used.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if maxSize <= 0 {
+		return nil, errgo.Newf("invalid disk cache size %d", maxSize)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, filesystemTmpDir), 0700); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	sort.Sort(byModTime(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || checkFileName(info.Name()) != nil {
+			continue
+		}
+		c.entries[info.Name()] = c.lru.PushFront(&diskCacheEntry{
+			name: info.Name(),
+			size: info.Size(),
+		})
+		c.size += info.Size()
+	}
+	// Remove any temporary files left over from a previous run.
+	tmpInfos, err := ioutil.ReadDir(filepath.Join(dir, filesystemTmpDir))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, info := range tmpInfos {
+		os.Remove(filepath.Join(dir, filesystemTmpDir, info.Name()))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// Size returns the current total size of the blobs in the cache.
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// open opens the cached blob with the given name. It returns
+// nil if the blob is not in the cache.
+func (c *DiskCache) open(name string) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.entries[name]
+	if elem == nil {
+		return nil
+	}
+	// Note that on Unix, an open file remains readable even
+	// if it is subsequently evicted and removed.
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		logger.Errorf("cannot open cached blob: %v", err)
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return f
+}
+
+// add reads the blob with the given name and size from r into the
+// cache, and returns the newly cached file.
+func (c *DiskCache) add(name string, r io.Reader, size int64) (*os.File, error) {
+	if err := checkFileName(name); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(filepath.Join(c.dir, filesystemTmpDir), "blob")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	tmpPath := f.Name()
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = errgo.Newf("unexpected blob size %d (expected %d)", n, size)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, errgo.Mask(err)
+	}
+	if _, err := f.Seek(0, seekStart); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, errgo.Mask(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmpPath, filepath.Join(c.dir, name)); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, errgo.Mask(err)
+	}
+	if elem := c.entries[name]; elem != nil {
+		// Another goroutine has cached the same blob concurrently.
+		// The content is the same, so just update the size.
+		e := elem.Value.(*diskCacheEntry)
+		c.size -= e.size
+		e.size = size
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[name] = c.lru.PushFront(&diskCacheEntry{
+			name: name,
+			size: size,
+		})
+	}
+	c.size += size
+	c.evict()
+	return f, nil
+}
+
+// drop removes the blob with the given name from the cache.
+func (c *DiskCache) drop(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[name]; elem != nil {
+		c.remove(elem)
+	}
+}
+
+// evict evicts least recently used blobs until the cache is
+// within its size limit. It must be called with c.mu held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxSize {
+		elem := c.lru.Back()
+		size := elem.Value.(*diskCacheEntry).size
+		c.remove(elem)
+		monitoring.BlobCacheEvicted(size)
+	}
+	monitoring.SetBlobCacheSize(c.size)
+}
+
+// remove removes the given entry and its file.
+// It must be called with c.mu held.
+func (c *DiskCache) remove(elem *list.Element) {
+	e := elem.Value.(*diskCacheEntry)
+	if err := os.Remove(filepath.Join(c.dir, e.name)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("cannot remove cached blob: %v", err)
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	monitoring.SetBlobCacheSize(c.size)
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+type cachingBackend struct {
+	Backend
+	cache *DiskCache
+}
+
+// NewCachingBackend returns a backend that reads blobs through the
+// given cache, fetching them in full from the underlying backend when
+// they are not already cached. Blobs larger than the whole cache are
+// read directly from the underlying backend. Writes are not cached.
+func NewCachingBackend(b Backend, cache *DiskCache) Backend {
+	return &cachingBackend{
+		Backend: b,
+		cache:   cache,
+	}
+}
+
+func (b *cachingBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	if f := b.cache.open(name); f != nil {
+		info, err := f.Stat()
+		if err == nil {
+			monitoring.BlobCacheHit()
+			return f, info.Size(), nil
+		}
+		f.Close()
+	}
+	monitoring.BlobCacheMiss()
+	r, size, err := b.Backend.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	if size > b.cache.maxSize {
+		return r, size, nil
+	}
+	f, err := b.cache.add(name, r, size)
+	r.Close()
+	if err == nil {
+		return f, size, nil
+	}
+	// The cache is an optimisation only, so fall back
+	// to reading directly from the backend.
+	logger.Errorf("cannot cache blob %q: %v", name, err)
+	r, size, err = b.Backend.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return r, size, nil
+}
+
+func (b *cachingBackend) Remove(name string) error {
+	b.cache.drop(name)
+	return errgo.Mask(b.Backend.Remove(name), errgo.Is(ErrNotFound))
+}
@@ -0,0 +1,418 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Encrypted blobs are stored as a header followed by the blob content
+// split into chunks of encryptionChunkSize bytes, each of which is
+// sealed separately with AES-256-GCM so that any part of the blob can
+// be read without reading the parts before it.
+//
+// The header holds encryptionMagic, a single byte holding the length
+// of the key id, the key id itself and a random salt. The salt is used
+// to derive a key unique to the blob from the key named by the key id.
+//
+// The GCM nonce of each chunk holds the chunk index and a flag that is
+// set only for the final chunk, so chunks cannot be reordered and the
+// blob cannot be truncated without detection. There is always at least
+// one chunk, even when the blob is empty.
+const (
+	encryptionMagic     = "csenc\x00\x00\x01"
+	encryptionSaltSize  = 16
+	encryptionChunkSize = 64 * 1024
+	encryptionKeySize   = 32
+)
+
+// EncryptionKeys holds the keys used by encrypting backends.
+// An EncryptionKeys value may be shared between any number
+// of backends created with NewEncryptingBackend.
+type EncryptionKeys struct {
+	keys      map[string][]byte
+	currentId string
+}
+
+// NewEncryptionKeys returns a set of encryption keys holding the given
+// keys, indexed by key id. Each key must be 32 bytes long. New blobs
+// are encrypted with the key with the given current id; the others are
+// only used to decrypt blobs that were encrypted with them.
+func NewEncryptionKeys(keys map[string][]byte, currentId string) (*EncryptionKeys, error) {
+	if _, ok := keys[currentId]; !ok {
+		return nil, errgo.Newf("encryption key %q not found", currentId)
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, errgo.Newf("invalid encryption key id %q", id)
+		}
+		if len(key) != encryptionKeySize {
+			return nil, errgo.Newf("encryption key %q is %d bytes long, not %d", id, len(key), encryptionKeySize)
+		}
+	}
+	return &EncryptionKeys{
+		keys:      keys,
+		currentId: currentId,
+	}, nil
+}
+
+type encryptingBackend struct {
+	Backend
+	keys *EncryptionKeys
+}
+
+// NewEncryptingBackend returns a backend that encrypts blobs with the
+// current key in keys before writing them to the given backend, and
+// decrypts them when they are read back. Blobs that were written to
+// the underlying backend without encryption can still be read.
+//
+// Because the underlying backend must be told the hash of the
+// encrypted data before it is written, Put encrypts the blob to a
+// temporary file first.
+func NewEncryptingBackend(b Backend, keys *EncryptionKeys) Backend {
+	return &encryptingBackend{
+		Backend: b,
+		keys:    keys,
+	}
+}
+
+// keyId implements keyIdentifier.keyId.
+func (b *encryptingBackend) keyId() string {
+	return b.keys.currentId
+}
+
+func (b *encryptingBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	r, size, err := b.Backend.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	er, plainSize, err := b.newDecryptingReader(r, size)
+	if err != nil {
+		r.Close()
+		return nil, 0, errgo.NoteMask(err, fmt.Sprintf("cannot read blob %q", name), errgo.Is(ErrNotFound))
+	}
+	return er, plainSize, nil
+}
+
+func (b *encryptingBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	f, err := ioutil.TempFile("", "blob")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return errgo.Notef(err, "cannot generate salt")
+	}
+	aead, err := newBlobAEAD(b.keys.keys[b.keys.currentId], salt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	encHasher := NewHash()
+	cw := &countingWriter{w: io.MultiWriter(f, encHasher)}
+	header := make([]byte, 0, len(encryptionMagic)+1+len(b.keys.currentId)+encryptionSaltSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, byte(len(b.keys.currentId)))
+	header = append(header, b.keys.currentId...)
+	header = append(header, salt...)
+	if _, err := cw.Write(header); err != nil {
+		return errgo.Mask(err)
+	}
+	hasher := NewHash()
+	w := &encryptingWriter{
+		w:    cw,
+		aead: aead,
+		buf:  make([]byte, 0, encryptionChunkSize),
+	}
+	n, err := io.Copy(w, io.TeeReader(r, hasher))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := w.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if n != size {
+		return errgo.Newf("unexpected blob size %d (expected %d)", n, size)
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != hash {
+		return errgo.New("hash mismatch")
+	}
+	if _, err := f.Seek(0, seekStart); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := b.Backend.Put(name, f, cw.n, fmt.Sprintf("%x", encHasher.Sum(nil))); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// newDecryptingReader returns a reader that reads the decrypted
+// contents of r, which holds size bytes, and the size of the decrypted
+// contents. If r does not hold an encrypted blob, it is returned
+// unchanged.
+func (b *encryptingBackend) newDecryptingReader(r ReadSeekCloser, size int64) (ReadSeekCloser, int64, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if size < int64(len(magic)) {
+		return r, size, nil
+	}
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	if string(magic) != encryptionMagic {
+		// The blob was stored before encryption was enabled.
+		if _, err := r.Seek(0, seekStart); err != nil {
+			return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		return r, size, nil
+	}
+	var keyIdLen [1]byte
+	if _, err := io.ReadFull(r, keyIdLen[:]); err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	rest := make([]byte, int(keyIdLen[0])+encryptionSaltSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	keyId, salt := string(rest[0:keyIdLen[0]]), rest[keyIdLen[0]:]
+	key, ok := b.keys.keys[keyId]
+	if !ok {
+		return nil, 0, errgo.Newf("unknown encryption key %q", keyId)
+	}
+	aead, err := newBlobAEAD(key, salt)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	headerSize := int64(len(magic) + 1 + len(rest))
+	// Work out the size of the decrypted data from the number
+	// of chunks, remembering that every chunk, including the
+	// last one, has its own authentication tag.
+	bodySize := size - headerSize
+	sealedChunkSize := int64(encryptionChunkSize + aead.Overhead())
+	nchunks := (bodySize + sealedChunkSize - 1) / sealedChunkSize
+	if nchunks == 0 || bodySize-(nchunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		return nil, 0, errgo.Newf("encrypted blob has invalid size %d", size)
+	}
+	plainSize := bodySize - nchunks*int64(aead.Overhead())
+	dr := &decryptingReader{
+		r:          r,
+		aead:       aead,
+		headerSize: headerSize,
+		size:       plainSize,
+		nchunks:    nchunks,
+		rpos:       headerSize,
+		chunk:      -1,
+	}
+	if plainSize == 0 {
+		// Read will never look at the only chunk of an
+		// empty blob, so authenticate it now.
+		if err := dr.readChunk(0); err != nil {
+			return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+	}
+	return dr, plainSize, nil
+}
+
+// newBlobAEAD returns the AEAD used to seal the chunks of a blob
+// with the given salt, encrypted with the given key.
+func newBlobAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// chunkNonce returns the nonce for the chunk with the given index.
+func chunkNonce(aead cipher.AEAD, index int64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingWriter encrypts the data written to it in chunks.
+// It must be closed to write the final chunk.
+type encryptingWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index int64
+}
+
+func (w *encryptingWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 {
+		if len(w.buf) == encryptionChunkSize {
+			// There's more data to come, so this
+			// chunk is not the final one.
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], data)
+		w.buf = w.buf[0 : len(w.buf)+m]
+		data = data[m:]
+	}
+	return n, nil
+}
+
+// Close writes the final chunk. It does not close
+// the underlying writer.
+func (w *encryptingWriter) Close() error {
+	return w.flush(true)
+}
+
+func (w *encryptingWriter) flush(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.index, final), w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// decryptingReader reads the decrypted contents of an encrypted blob,
+// decrypting one chunk at a time.
+type decryptingReader struct {
+	// r holds the underlying reader.
+	r    ReadSeekCloser
+	aead cipher.AEAD
+
+	// headerSize holds the size of the header
+	// that precedes the first chunk.
+	headerSize int64
+
+	// size holds the size of the decrypted blob.
+	size int64
+
+	// nchunks holds the number of chunks in the blob.
+	nchunks int64
+
+	// rpos holds the current position of the underlying reader.
+	rpos int64
+
+	// pos holds the current position in the decrypted blob.
+	pos int64
+
+	// chunk holds the index of the chunk held in buf,
+	// or -1 if there is none.
+	chunk int64
+
+	// buf holds the decrypted contents of the current chunk.
+	buf []byte
+
+	// sealed holds the encrypted contents of the current chunk.
+	sealed []byte
+}
+
+// Read implements io.Reader.Read.
+func (r *decryptingReader) Read(buf []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	chunk := r.pos / encryptionChunkSize
+	if chunk != r.chunk {
+		if err := r.readChunk(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, r.buf[r.pos-chunk*encryptionChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// readChunk reads and decrypts the chunk with the given index into r.buf.
+func (r *decryptingReader) readChunk(chunk int64) error {
+	r.chunk = -1
+	sealedChunkSize := int64(encryptionChunkSize + r.aead.Overhead())
+	start := r.headerSize + chunk*sealedChunkSize
+	if start != r.rpos {
+		if _, err := r.r.Seek(start, seekStart); err != nil {
+			return errgo.Notef(err, "cannot seek into blob")
+		}
+		r.rpos = start
+	}
+	size := sealedChunkSize
+	if chunk == r.nchunks-1 {
+		size = r.size - chunk*encryptionChunkSize + int64(r.aead.Overhead())
+	}
+	if r.sealed == nil {
+		r.sealed = make([]byte, sealedChunkSize)
+	}
+	n, err := io.ReadFull(r.r, r.sealed[0:size])
+	r.rpos += int64(n)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errgo.New("encrypted blob is truncated")
+		}
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	buf, err := r.aead.Open(r.buf[:0], chunkNonce(r.aead, chunk, chunk == r.nchunks-1), r.sealed[0:size], nil)
+	if err != nil {
+		return errgo.Notef(err, "cannot decrypt blob")
+	}
+	r.buf = buf
+	r.chunk = chunk
+	return nil
+}
+
+// Seek implements io.Seeker.Seek.
+func (r *decryptingReader) Seek(pos int64, whence int) (int64, error) {
+	switch whence {
+	case seekStart:
+	case seekEnd:
+		pos = r.size + pos
+	case seekCurrent:
+		pos = r.pos + pos
+	default:
+		return 0, errgo.Newf("unknown seek whence value")
+	}
+	if pos < 0 {
+		return 0, errgo.Newf("negative seek position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close implements io.Closer.Close.
+func (r *decryptingReader) Close() error {
+	return r.r.Close()
+}
+
+// keyIdentifier is implemented by backends that encrypt blobs.
+type keyIdentifier interface {
+	// keyId returns the id of the key used to encrypt new blobs.
+	keyId() string
+}
+
+// backendKeyId returns the id of the key used by the given backend
+// to encrypt new blobs, or the empty string if it does not encrypt
+// them.
+func backendKeyId(b Backend) string {
+	if kb, ok := b.(keyIdentifier); ok {
+		return kb.keyId()
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// filesystemTmpDir holds the name of the directory, relative to the
+// root of a filesystem backend, that is used to hold blobs while
+// they are being written.
+const filesystemTmpDir = "tmp"
+
+type filesystemBackend struct {
+	dir string
+}
+
+// NewFilesystemBackend returns a backend which stores each blob as a
+// file under the given directory. Blob names start with a prefix of the
+// blob's hash, so the files are sharded into subdirectories by that
+// prefix.
+//
+// Blobs are written to a temporary file, synced to disk and checked
+// against their expected hash before being atomically renamed into
+// place, so a partially written blob is never visible.
+func NewFilesystemBackend(dir string) Backend {
+	return &filesystemBackend{
+		dir: dir,
+	}
+}
+
+func (b *filesystemBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	path, err := b.path(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errgo.WithCausef(nil, ErrNotFound, "backend blob not found")
+		}
+		return nil, 0, errgo.Mask(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errgo.Mask(err)
+	}
+	return f, info.Size(), nil
+}
+
+func (b *filesystemBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	path, err := b.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmpDir := filepath.Join(b.dir, filesystemTmpDir)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmpPath := f.Name()
+	if err := writeBlobFile(f, r, size, hash); err != nil {
+		os.Remove(tmpPath)
+		return errgo.Mask(err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		os.Remove(tmpPath)
+		return errgo.Mask(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return errgo.Mask(err)
+	}
+	// Sync the directory so that the new entry survives a crash.
+	if err := syncDir(dir); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// writeBlobFile writes the contents of r to f, checking that it has the
+// given size and hash, and syncs and closes f.
+func writeBlobFile(f *os.File, r io.Reader, size int64, hash string) error {
+	defer f.Close()
+	cw := &countingWriter{w: f}
+	if err := copyAndCheckHash(cw, r, hash); err != nil {
+		return errgo.Mask(err)
+	}
+	if cw.n != size {
+		return errgo.Newf("unexpected blob size %d (expected %d)", cw.n, size)
+	}
+	if err := f.Sync(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
+
+func (b *filesystemBackend) Remove(name string) error {
+	path, err := b.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errgo.Notef(err, "cannot delete %q", name)
+	}
+	return nil
+}
+
+// path returns the path of the file that holds the blob with the
+// given name. Every blob is sharded into two levels of two-character
+// subdirectories, so no blob can collide with the temporary directory.
+func (b *filesystemBackend) path(name string) (string, error) {
+	if err := checkFileName(name); err != nil {
+		return "", errgo.Mask(err)
+	}
+	// Pad short names so that they are sharded like the others.
+	prefix := name
+	if len(prefix) < 4 {
+		prefix += strings.Repeat("_", 4-len(prefix))
+	}
+	return filepath.Join(b.dir, prefix[0:2], prefix[2:4], name), nil
+}
+
+// checkFileName checks that the given blob name
+// is safe to use as a file name.
+func checkFileName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || name[0] == '.' {
+		return errgo.Newf("invalid blob name %q", name)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return errgo.Mask(f.Sync())
+}
+
+// countingWriter counts the bytes written to the
+// underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
@@ -54,6 +54,11 @@ type uploadDoc struct {
 	// accidentally removing an upload because the
 	// update process failed half-way through.
 	Owner string `bson:",omitempty"`
+
+	// Creator holds the name of the user that created
+	// the upload. It is empty for uploads that were not
+	// created on behalf of any particular user.
+	Creator string `bson:",omitempty"`
 }
 
 // Note that the PartInfo type is also used as a document
@@ -73,6 +78,13 @@ type PartInfo struct {
 
 // UploadInfo holds information on a given upload.
 type UploadInfo struct {
+	// Id holds the upload id.
+	Id string `bson:"_id"`
+
+	// Creator holds the name of the user that
+	// created the upload, if known.
+	Creator string `bson:",omitempty"`
+
 	// Parts holds all the known parts of the upload.
 	// Parts that haven't been uploaded yet will have nil
 	// elements. Parts that are in progress or have been
@@ -111,11 +123,15 @@ func (info *UploadInfo) Index() (*mongodoc.MultipartIndex, bool) {
 // It returns an uploadId that can be used to refer to it. After
 // creating the upload, each part must be uploaded individually, and
 // then the whole completed by calling FinishUpload and RemoveUpload.
-func (s *Store) NewUpload(expires time.Time) (uploadId string, err error) {
+//
+// The creator parameter holds the name of the user creating the
+// upload, and may be empty.
+func (s *Store) NewUpload(expires time.Time, creator string) (uploadId string, err error) {
 	uploadId = base64.RawURLEncoding.EncodeToString([]byte(bson.NewObjectId()))
 	if err := s.uploadc.Insert(uploadDoc{
 		Id:      uploadId,
 		Expires: expires,
+		Creator: creator,
 	}); err != nil {
 		return "", errgo.Notef(err, "cannot create new upload")
 	}
@@ -249,11 +265,36 @@ func (s *Store) UploadInfo(uploadId string) (UploadInfo, error) {
 	if err != nil {
 		return UploadInfo{}, errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
+	return udoc.info(), nil
+}
+
+// Uploads returns information on all the uploads created by the given
+// user, ordered by expiry time. If creator is empty, all uploads are
+// returned.
+func (s *Store) Uploads(creator string) ([]UploadInfo, error) {
+	var query bson.D
+	if creator != "" {
+		query = bson.D{{"creator", creator}}
+	}
+	var udocs []uploadDoc
+	if err := s.uploadc.Find(query).Sort("expires", "_id").All(&udocs); err != nil {
+		return nil, errgo.Notef(err, "cannot get uploads")
+	}
+	infos := make([]UploadInfo, len(udocs))
+	for i := range udocs {
+		infos[i] = udocs[i].info()
+	}
+	return infos, nil
+}
+
+func (udoc *uploadDoc) info() UploadInfo {
 	return UploadInfo{
+		Id:      udoc.Id,
+		Creator: udoc.Creator,
 		Parts:   udoc.Parts,
 		Expires: udoc.Expires,
 		Hash:    udoc.Hash,
-	}, nil
+	}
 }
 
 // initializePart creates the initial record for a part.
@@ -0,0 +1,257 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ReadPreference determines which backend of a replica backend
+// is read from first.
+type ReadPreference string
+
+const (
+	// ReadPrimary causes blobs to be read from the primary
+	// backend, falling back to the secondary.
+	ReadPrimary ReadPreference = "primary"
+
+	// ReadSecondary causes blobs to be read from the secondary
+	// backend, falling back to the primary.
+	ReadSecondary ReadPreference = "secondary"
+)
+
+// ReplicaParams holds parameters for a replica backend.
+type ReplicaParams struct {
+	// ReadPreference holds which backend to read from first.
+	// If it is empty, ReadPrimary is assumed.
+	ReadPreference ReadPreference
+
+	// Repairer, if non-nil, is notified of blobs that were
+	// found in the secondary backend but not in the primary.
+	Repairer *ReplicaRepairer
+}
+
+type replicaBackend struct {
+	primary   Backend
+	secondary Backend
+	p         ReplicaParams
+}
+
+// NewReplicaBackend returns a backend that writes every blob to both
+// the primary and secondary backends and reads from one of them,
+// falling back to the other when a blob is not found. It is intended
+// for migrating between backends without downtime: new blobs go to
+// both places while existing blobs are copied across, either in the
+// background by a ReplicaRepairer or with cmd/migrateblobs.
+func NewReplicaBackend(primary, secondary Backend, p ReplicaParams) Backend {
+	if p.ReadPreference == "" {
+		p.ReadPreference = ReadPrimary
+	}
+	return &replicaBackend{
+		primary:   primary,
+		secondary: secondary,
+		p:         p,
+	}
+}
+
+func (b *replicaBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	first, second := b.primary, b.secondary
+	if b.p.ReadPreference == ReadSecondary {
+		first, second = second, first
+	}
+	r, size, err := first.Get(name)
+	if err == nil {
+		if b.p.ReadPreference == ReadSecondary && b.p.Repairer != nil {
+			// We haven't looked in the primary, so let the
+			// repairer check that it holds the blob.
+			b.p.Repairer.Repair(name)
+		}
+		return r, size, nil
+	}
+	if errgo.Cause(err) != ErrNotFound {
+		return nil, 0, errgo.Mask(err)
+	}
+	r, size, err = second.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	if b.p.ReadPreference == ReadPrimary && b.p.Repairer != nil {
+		b.p.Repairer.Repair(name)
+	}
+	return r, size, nil
+}
+
+// Put implements Backend.Put by streaming the data to both backends
+// concurrently. If either write fails, the blob is removed from
+// the other backend.
+func (b *replicaBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	pr, pw := io.Pipe()
+	secondaryDone := make(chan error, 1)
+	secondaryFailed := make(chan struct{})
+	go func() {
+		err := b.secondary.Put(name, pr, size, hash)
+		if err != nil {
+			close(secondaryFailed)
+		}
+		// Make sure that if the secondary write fails, the primary's
+		// write fails too rather than blocking forever on the pipe.
+		pr.CloseWithError(err)
+		secondaryDone <- err
+	}()
+	primaryErr := b.primary.Put(name, io.TeeReader(r, pw), size, hash)
+	secondaryFailedFirst := false
+	select {
+	case <-secondaryFailed:
+		secondaryFailedFirst = true
+	default:
+	}
+	pw.CloseWithError(primaryErr)
+	secondaryErr := <-secondaryDone
+	switch {
+	case primaryErr == nil && secondaryErr == nil:
+		return nil
+	case primaryErr == nil:
+		if err := b.primary.Remove(name); err != nil && errgo.Cause(err) != ErrNotFound {
+			logger.Errorf("cannot remove %q from primary backend after failed secondary write: %v", name, err)
+		}
+		return errgo.Notef(secondaryErr, "cannot write to secondary backend")
+	case secondaryErr == nil:
+		if err := b.secondary.Remove(name); err != nil && errgo.Cause(err) != ErrNotFound {
+			logger.Errorf("cannot remove %q from secondary backend after failed primary write: %v", name, err)
+		}
+	case secondaryFailedFirst:
+		// The secondary failed first, which will have caused
+		// the primary write to fail too.
+		return errgo.Notef(secondaryErr, "cannot write to secondary backend")
+	}
+	return errgo.Notef(primaryErr, "cannot write to primary backend")
+}
+
+// Remove implements Backend.Remove by removing the blob from both
+// backends. It returns an ErrNotFound error only if neither backend
+// holds the blob.
+func (b *replicaBackend) Remove(name string) error {
+	primaryErr := b.primary.Remove(name)
+	secondaryErr := b.secondary.Remove(name)
+	if primaryErr != nil && errgo.Cause(primaryErr) != ErrNotFound {
+		return errgo.Notef(primaryErr, "cannot remove from primary backend")
+	}
+	if secondaryErr != nil && errgo.Cause(secondaryErr) != ErrNotFound {
+		return errgo.Notef(secondaryErr, "cannot remove from secondary backend")
+	}
+	if primaryErr != nil && secondaryErr != nil {
+		return errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	return nil
+}
+
+// ReplicaRepairer copies blobs that are missing from the primary
+// backend of a replica backend from its secondary, in the
+// background.
+type ReplicaRepairer struct {
+	newBackends func() (primary, secondary Backend, close func())
+	limit       chan struct{}
+	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[string]bool
+}
+
+// NewReplicaRepairer returns a new repairer that runs at most
+// maxConcurrent repairs at a time. The newBackends function is called
+// to obtain the backends for each repair; because repairs outlive the
+// request that triggered them, it should return backends that are
+// independent of any request (for example using a copied MongoDB
+// session), and a function that releases them.
+func NewReplicaRepairer(newBackends func() (primary, secondary Backend, close func()), maxConcurrent int) *ReplicaRepairer {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	return &ReplicaRepairer{
+		newBackends: newBackends,
+		limit:       make(chan struct{}, maxConcurrent),
+		pending:     make(map[string]bool),
+	}
+}
+
+// Repair starts copying the blob with the given name into the primary
+// backend if it is missing there. It does not wait for the copy to
+// complete. The request is dropped if a repair of the same blob is
+// already in progress or if the maximum number of concurrent repairs
+// has been reached; the blob will be repaired when it is next read.
+func (r *ReplicaRepairer) Repair(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.pending[name] {
+		return
+	}
+	select {
+	case r.limit <- struct{}{}:
+	default:
+		return
+	}
+	r.pending[name] = true
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.pending, name)
+			r.mu.Unlock()
+			<-r.limit
+		}()
+		if err := r.RepairBlob(name); err != nil {
+			logger.Errorf("cannot repair blob %q: %v", name, err)
+		}
+	}()
+}
+
+// RepairBlob synchronously copies the blob with the given name from
+// the secondary backend to the primary if the primary does not already
+// hold it.
+func (r *ReplicaRepairer) RepairBlob(name string) error {
+	primary, secondary, close := r.newBackends()
+	defer close()
+	pr, _, err := primary.Get(name)
+	if err == nil {
+		pr.Close()
+		return nil
+	}
+	if errgo.Cause(err) != ErrNotFound {
+		return errgo.Mask(err)
+	}
+	sr, size, err := secondary.Get(name)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	defer sr.Close()
+	// Read the blob once to find out its hash so that
+	// the primary can verify the data as it is written.
+	h := NewHash()
+	if _, err := io.Copy(h, sr); err != nil {
+		return errgo.Notef(err, "cannot read blob from secondary backend")
+	}
+	if _, err := sr.Seek(0, seekStart); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := primary.Put(name, sr, size, fmt.Sprintf("%x", h.Sum(nil))); err != nil {
+		return errgo.Notef(err, "cannot write blob to primary backend")
+	}
+	logger.Infof("repaired blob %q in primary backend", name)
+	return nil
+}
+
+// Close waits for any repairs in progress to complete. Subsequent
+// calls to Repair will do nothing.
+func (r *ReplicaRepairer) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.wg.Wait()
+}
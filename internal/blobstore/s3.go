@@ -0,0 +1,331 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// S3Params holds the parameters for an S3 backend.
+type S3Params struct {
+	// Endpoint holds the base URL of the S3 service,
+	// for example "https://s3.eu-west-1.amazonaws.com".
+	// Buckets are addressed path-style relative to this URL,
+	// which is supported by most S3-compatible services.
+	Endpoint string
+
+	// Region holds the region used to sign requests.
+	Region string
+
+	// Bucket holds the name of the bucket that
+	// will hold all the blobs. It must already exist.
+	Bucket string
+
+	// AccessKey and SecretKey hold the credentials
+	// used to sign requests.
+	AccessKey string
+	SecretKey string
+
+	// Client holds the HTTP client used to make requests.
+	// If it is nil, http.DefaultClient will be used.
+	Client *http.Client
+}
+
+type s3Backend struct {
+	p        S3Params
+	endpoint *url.URL
+}
+
+// NewS3Backend returns a backend which stores blobs as objects in an
+// S3-compatible object store. Reads use HTTP range requests, so seeking
+// within a blob does not require the preceding data to be fetched.
+func NewS3Backend(p S3Params) (Backend, error) {
+	u, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid S3 endpoint")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errgo.Newf("invalid S3 endpoint %q", p.Endpoint)
+	}
+	if p.Bucket == "" {
+		return nil, errgo.New("no S3 bucket specified")
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+	return &s3Backend{
+		p:        p,
+		endpoint: u,
+	}, nil
+}
+
+func (b *s3Backend) Get(name string) (ReadSeekCloser, int64, error) {
+	resp, err := b.do("HEAD", name, nil, -1, nil)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, 0, errgo.Newf("no content length for S3 object %q", name)
+	}
+	return &s3Reader{
+		b:    b,
+		name: name,
+		size: resp.ContentLength,
+	}, resp.ContentLength, nil
+}
+
+func (b *s3Backend) Put(name string, r io.Reader, size int64, hash string) error {
+	h := NewHash()
+	resp, err := b.do("PUT", name, io.TeeReader(r, h), size, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if hash != fmt.Sprintf("%x", h.Sum(nil)) {
+		if err := b.Remove(name); err != nil {
+			logger.Errorf("could not delete object from bucket after a hash mismatch was detected: %v", err)
+		}
+		return errgo.New("hash mismatch")
+	}
+	return nil
+}
+
+func (b *s3Backend) Remove(name string) error {
+	resp, err := b.do("DELETE", name, nil, -1, nil)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do makes a signed request for the object with the given name. If
+// body is non-nil, size holds its length. Any response with a non-2xx
+// status is returned as an error.
+func (b *s3Backend) do(method, name string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.p.Bucket + "/" + name
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		// The payload is verified against our own hash, so
+		// there is no need to read it twice to sign it.
+		payloadHash = "UNSIGNED-PAYLOAD"
+		if size == 0 {
+			// A non-nil body with a zero length would be
+			// sent chunked, which S3 does not accept.
+			req.Body = http.NoBody
+		} else {
+			req.Body = ioutil.NopCloser(body)
+		}
+		req.ContentLength = size
+	}
+	b.sign(req, payloadHash, time.Now())
+	resp, err := b.p.Client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+// s3ErrorResponse holds the body of an error response
+// from the S3 API.
+type s3ErrorResponse struct {
+	Code    string
+	Message string
+}
+
+// s3Error returns an error for the given unsuccessful response.
+// Not-found errors have an ErrNotFound cause.
+func s3Error(resp *http.Response) error {
+	var e s3ErrorResponse
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, &e)
+	if resp.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey" {
+		return errgo.WithCausef(nil, ErrNotFound, "")
+	}
+	if e.Code == "" {
+		return errgo.Newf("S3 request failed: %s", resp.Status)
+	}
+	return errgo.Newf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+// emptyPayloadHash holds the SHA256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign signs the given request using AWS signature version 4.
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (b *s3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host header and all the x-amz headers.
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders []string
+	for _, k := range names {
+		canonicalHeaders = append(canonicalHeaders, k+":"+headers[k]+"\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		strings.Join(canonicalHeaders, ""),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + b.p.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+b.p.SecretKey), date)
+	key = hmacSHA256(key, b.p.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.p.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes the given path as required by the
+// canonical request: every byte other than unreserved
+// characters and '/' is percent-encoded.
+func s3EscapePath(p string) string {
+	var buf []byte
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) != -1 {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// s3Reader reads an S3 object. It issues a ranged GET request
+// starting at the current offset when it is first read and
+// after each seek.
+type s3Reader struct {
+	b    *s3Backend
+	name string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (r *s3Reader) Read(buf []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := make(http.Header)
+		header.Set("Range", "bytes="+strconv.FormatInt(r.pos, 10)+"-")
+		resp, err := r.b.do("GET", r.name, nil, -1, header)
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			// The server has ignored the range, so the body
+			// does not start at the current offset.
+			resp.Body.Close()
+			return 0, errgo.Newf("S3 request failed: unexpected status %q in response to ranged request", resp.Status)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(buf)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := r.pos
+	switch whence {
+	case seekStart:
+		pos = offset
+	case seekCurrent:
+		pos += offset
+	case seekEnd:
+		pos = r.size + offset
+	default:
+		return r.pos, errgo.Newf("unknown seek whence value")
+	}
+	if pos < 0 {
+		return r.pos, errgo.New("negative seek position")
+	}
+	if pos != r.pos {
+		r.closeBody()
+		r.pos = pos
+	}
+	return pos, nil
+}
+
+func (r *s3Reader) Close() error {
+	r.closeBody()
+	return nil
+}
+
+func (r *s3Reader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
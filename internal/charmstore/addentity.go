@@ -118,6 +118,8 @@ func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{
 //	params.ErrDuplicateUpload if the URL duplicates an existing entity.
 //	params.ErrEntityIdNotAllowed if the id may not be created.
 //	params.ErrInvalidEntity if the provided blob is invalid.
+//	router.ErrQuotaExceeded if the entity would take the user's
+//	namespace over its quota.
 func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel) error {
 	// Strictly speaking these tests are redundant, because a ResolvedURL should
 	// always be canonical, but check just in case anyway, as this is
@@ -129,6 +131,9 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	if url.URL.Revision == -1 {
 		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify revision")
 	}
+	if err := s.checkQuota(url.URL.User, size, 1); err != nil {
+		return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
 	blobHash256, err := s.putArchive(blob, size, blobHash)
 	if err != nil {
 		return errgo.Mask(err)
@@ -150,6 +155,7 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 			errgo.Is(params.ErrInvalidEntity),
 		)
 	}
+	s.RecordEvent(mongodoc.EventUpload, &url.URL, nil)
 	return nil
 }
 
@@ -516,7 +522,9 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 		entity.CharmMetrics = metrics
 	}
 	denormalizeEntity(entity)
-	setEntityChannels(entity, p.chans)
+	if err := s.setEntityChannels(entity, p.chans); err != nil {
+		return errgo.Mask(err)
+	}
 
 	// Check that we're not going to create a charm that duplicates
 	// the name of a bundle. This is racy, but it's the best we can
@@ -541,14 +549,27 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 }
 
 // setEntityChannels associates the entity with the given channels, ignoring
-// unknown channels and the unpublished channel.
-func setEntityChannels(entity *mongodoc.Entity, chans []params.Channel) {
+// invalid channels and the unpublished channel. Channels without a track
+// are resolved with the default track of the entity's base entity, if it
+// exists.
+func (s *Store) setEntityChannels(entity *mongodoc.Entity, chans []params.Channel) error {
 	entity.Published = make(map[params.Channel]bool, len(chans))
 	for _, c := range chans {
-		if params.ValidChannels[c] && c != params.UnpublishedChannel {
-			entity.Published[c] = true
+		if !ValidChannel(c) || c == params.UnpublishedChannel {
+			continue
+		}
+		rc, err := s.resolveChannel(entity.URL, c)
+		if errgo.Cause(err) == params.ErrNotFound {
+			// The base entity will be created with the
+			// default track.
+			rc, err = ResolveChannel(c, ""), nil
 		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		entity.Published[rc] = true
 	}
+	return nil
 }
 
 // addBundle adds a bundle to the entities collection with the given
@@ -580,7 +601,9 @@ func (s *Store) addBundle(b charm.Bundle, p addParams) error {
 		PromulgatedURL:     p.url.PromulgatedURL(),
 	}
 	denormalizeEntity(entity)
-	setEntityChannels(entity, p.chans)
+	if err := s.setEntityChannels(entity, p.chans); err != nil {
+		return errgo.Mask(err)
+	}
 
 	// Check that we're not going to create a bundle that duplicates
 	// the name of a charm. This is racy, but it's the best we can do.
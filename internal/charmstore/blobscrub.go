@@ -0,0 +1,303 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/mgo.v2"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/monitoring"
+)
+
+// scrubReportId holds the id of the document in the
+// scrub reports collection that holds the latest report.
+const scrubReportId = "blobs"
+
+// maxScrubProblems holds the maximum number of problems
+// recorded in a scrub report, so that the report stays
+// well within the MongoDB document size limit.
+const maxScrubProblems = 1000
+
+// ScrubBlobs reads every blob referenced by an entity or resource,
+// checks it against its recorded hash and size, and returns a report
+// of any that are missing or corrupt. Multipart resource blobs have
+// each of their parts checked too. The report is also saved so that it
+// can be retrieved later with BlobScrubReport.
+func (s *Store) ScrubBlobs() (*mongodoc.ScrubReport, error) {
+	sc := &scrubber{
+		store: s,
+		report: &mongodoc.ScrubReport{
+			Id:        scrubReportId,
+			StartTime: time.Now(),
+		},
+		results: make(map[string]*scrubError),
+	}
+	iter := s.DB.Entities().Find(nil).Select(FieldSelector(
+		"blobhash",
+		"size",
+		"prev5blobextrahash",
+		"prev5blobsize",
+	)).Iter()
+	var entity mongodoc.Entity
+	for iter.Next(&entity) {
+		sc.check(entity.URL, "", entity.BlobHash, entity.Size, nil)
+		if entity.PreV5BlobExtraHash != "" {
+			sc.check(entity.URL, "", entity.PreV5BlobExtraHash, entity.PreV5BlobSize-entity.Size, nil)
+		}
+		// Reset the entity so that no fields are carried
+		// over to the next one.
+		entity = mongodoc.Entity{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate through entities")
+	}
+	iter = s.DB.Resources().Find(nil).Select(FieldSelector(
+		"baseurl",
+		"name",
+		"revision",
+		"blobhash",
+		"size",
+		"blobindex",
+	)).Iter()
+	var resource mongodoc.Resource
+	for iter.Next(&resource) {
+		if resource.BlobHash != "" {
+			sc.check(resource.BaseURL, fmt.Sprintf("%s/%d", resource.Name, resource.Revision), resource.BlobHash, resource.Size, resource.BlobIndex)
+		}
+		resource = mongodoc.Resource{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate through resources")
+	}
+	sc.report.EndTime = time.Now()
+	if _, err := s.DB.ScrubReports().UpsertId(scrubReportId, sc.report); err != nil {
+		return nil, errgo.Notef(err, "cannot save scrub report")
+	}
+	monitoring.SetBlobScrubStats(monitoring.ScrubStats{
+		Checked: sc.report.Checked,
+		Missing: sc.report.Missing,
+		Corrupt: sc.report.Corrupt,
+		Time:    sc.report.EndTime,
+	})
+	return sc.report, nil
+}
+
+// BlobScrubReport returns the report from the most recently
+// completed blob integrity scrub. It returns an error with an
+// mgo.ErrNotFound cause if the scrubber has never been run.
+func (s *Store) BlobScrubReport() (*mongodoc.ScrubReport, error) {
+	var report mongodoc.ScrubReport
+	if err := s.DB.ScrubReports().FindId(scrubReportId).One(&report); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(mgo.ErrNotFound))
+	}
+	return &report, nil
+}
+
+// scrubber holds the state of a single run of the blob scrubber.
+type scrubber struct {
+	store  *Store
+	report *mongodoc.ScrubReport
+
+	// results holds the result of checking each blob, keyed
+	// by hash, so that blobs shared between several entities
+	// or resources are only read once.
+	results map[string]*scrubError
+}
+
+// scrubError describes a problem found with a blob.
+type scrubError struct {
+	missing bool
+	message string
+}
+
+// check checks the blob with the given hash, size and optional
+// multipart index, and records any problem against the given
+// entity or resource.
+func (sc *scrubber) check(url *charm.URL, resource, hash string, size int64, idx *mongodoc.MultipartIndex) {
+	result, ok := sc.results[hash]
+	if !ok {
+		result = sc.checkBlob(hash, size, idx)
+		sc.results[hash] = result
+		sc.report.Checked++
+	}
+	if result == nil {
+		return
+	}
+	if result.missing {
+		sc.report.Missing++
+	} else {
+		sc.report.Corrupt++
+	}
+	logger.Errorf("blob scrub: %s %s: %s", url, resource, result.message)
+	if len(sc.report.Problems) >= maxScrubProblems {
+		sc.report.Truncated = true
+		return
+	}
+	sc.report.Problems = append(sc.report.Problems, mongodoc.ScrubProblem{
+		URL:      url,
+		Resource: resource,
+		Hash:     hash,
+		Missing:  result.missing,
+		Message:  result.message,
+	})
+}
+
+// checkBlob reads the blob with the given hash and reports whether
+// it is missing or does not match its expected hash and size. It
+// returns nil if the blob is intact.
+func (sc *scrubber) checkBlob(hash string, size int64, idx *mongodoc.MultipartIndex) *scrubError {
+	if idx == nil {
+		return sc.checkSingleBlob(hash, size, nil)
+	}
+	if len(idx.Sizes) != len(idx.Hashes) {
+		// Without the size of every part, the parts
+		// cannot be checked against the size of the blob.
+		return &scrubError{
+			message: fmt.Sprintf("invalid multipart index: %d part sizes for %d parts", len(idx.Sizes), len(idx.Hashes)),
+		}
+	}
+	// Check each part in turn, computing the hash
+	// of the whole blob as we go.
+	h := blobstore.NewHash()
+	var total int64
+	for i, partHash := range idx.Hashes {
+		partSize := int64(idx.Sizes[i])
+		if err := sc.checkSingleBlob(partHash, partSize, h); err != nil {
+			err.message = fmt.Sprintf("part %d: %s", i, err.message)
+			return err
+		}
+		total += partSize
+	}
+	if total != size {
+		return &scrubError{
+			message: fmt.Sprintf("size mismatch: parts total %d bytes, expected %d", total, size),
+		}
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != hash {
+		return &scrubError{
+			message: fmt.Sprintf("hash mismatch: got %s", got),
+		}
+	}
+	return nil
+}
+
+// checkSingleBlob checks the single-part blob with the given hash and
+// size. If size is negative, it is not checked. The data is also
+// written to w if it is non-nil.
+func (sc *scrubber) checkSingleBlob(hash string, size int64, w io.Writer) *scrubError {
+	r, _, err := sc.store.BlobStore.Open(hash, nil)
+	if err != nil {
+		return newScrubError(err)
+	}
+	defer r.Close()
+	h := blobstore.NewHash()
+	dst := io.Writer(h)
+	if w != nil {
+		dst = io.MultiWriter(h, w)
+	}
+	n, err := io.Copy(dst, r)
+	if err != nil {
+		return newScrubError(err)
+	}
+	if size >= 0 && n != size {
+		return &scrubError{
+			message: fmt.Sprintf("size mismatch: got %d bytes, expected %d", n, size),
+		}
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != hash {
+		return &scrubError{
+			message: fmt.Sprintf("hash mismatch: got %s", got),
+		}
+	}
+	return nil
+}
+
+func newScrubError(err error) *scrubError {
+	if errgo.Cause(err) == blobstore.ErrNotFound {
+		return &scrubError{
+			missing: true,
+			message: "blob not found",
+		}
+	}
+	return &scrubError{
+		message: fmt.Sprintf("cannot read blob: %v", err),
+	}
+}
+
+// blobScrubber implements the worker that periodically
+// runs the blob integrity scrubber.
+type blobScrubber struct {
+	tomb     tomb.Tomb
+	pool     *Pool
+	interval time.Duration
+}
+
+// newBlobScrubber returns a new running blob scrubber worker
+// that scrubs the blob store at the given interval.
+func newBlobScrubber(pool *Pool, interval time.Duration) *blobScrubber {
+	s := &blobScrubber{
+		pool:     pool,
+		interval: interval,
+	}
+	s.tomb.Go(s.run)
+	return s
+}
+
+// Kill implements worker.Worker.Kill.
+func (s *blobScrubber) Kill() {
+	s.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (s *blobScrubber) Wait() error {
+	return s.tomb.Wait()
+}
+
+func (s *blobScrubber) run() error {
+	for {
+		wait, err := s.doScrub()
+		if err != nil {
+			logger.Errorf("%v", err)
+			wait = s.interval
+		}
+		select {
+		case <-s.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doScrub runs the scrubber unless another server has run it within
+// the scrub interval. It returns how long to wait before trying again.
+func (s *blobScrubber) doScrub() (time.Duration, error) {
+	store := s.pool.Store()
+	defer store.Close()
+	report, err := store.BlobScrubReport()
+	if err != nil && errgo.Cause(err) != mgo.ErrNotFound {
+		return 0, errgo.Notef(err, "cannot get last blob scrub report")
+	}
+	if report != nil {
+		if next := report.StartTime.Add(s.interval); time.Now().Before(next) {
+			return next.Sub(time.Now()), nil
+		}
+	}
+	duration := monitoring.NewBlobScrubDuration()
+	logger.Infof("starting blob integrity scrub")
+	report, err = store.ScrubBlobs()
+	if err != nil {
+		return 0, errgo.Notef(err, "blob integrity scrub failed")
+	}
+	duration.Done()
+	logger.Infof("completed blob integrity scrub: %d blobs checked; %d missing; %d corrupt", report.Checked, report.Missing, report.Corrupt)
+	return s.interval, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/retry.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type BlobScrubSuite struct {
+	commonSuite
+	blobDir string
+}
+
+var _ = gc.Suite(&BlobScrubSuite{})
+
+func (s *BlobScrubSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	s.blobDir = c.MkDir()
+}
+
+func (s *BlobScrubSuite) serverParams() ServerParams {
+	return ServerParams{
+		MinUploadPartSize: 10,
+		NewBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewFilesystemBackend(s.blobDir)
+		},
+	}
+}
+
+func (s *BlobScrubSuite) newStore(c *gc.C) *Store {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, s.serverParams())
+	c.Assert(err, gc.Equals, nil)
+	store := p.Store()
+	defer p.Close()
+	return store
+}
+
+// blobFile returns the path of the file holding the
+// blob with the given hash.
+func (s *BlobScrubSuite) blobFile(c *gc.C, hash string) string {
+	paths, err := filepath.Glob(filepath.Join(s.blobDir, "*", "*", hash[0:16]+"-*"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(paths, gc.HasLen, 1)
+	return paths[0]
+}
+
+// corruptBlob overwrites the start of the blob with
+// the given hash without changing its size.
+func (s *BlobScrubSuite) corruptBlob(c *gc.C, hash string) {
+	path := s.blobFile(c, hash)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.Equals, nil)
+	copy(data, "corrupt")
+	err = ioutil.WriteFile(path, data, 0600)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *BlobScrubSuite) TestScrubBlobs(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	id1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	err := store.AddCharmWithArchive(id1, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will be corrupted",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	id2 := router.MustNewResolvedURL("~charmers/precise/wordpress-2", -1)
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will go missing",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	id3 := router.MustNewResolvedURL("~charmers/precise/withresource-1", -1)
+	err = store.AddCharmWithArchive(id3, storetesting.NewCharm(storetesting.MetaWithResources(&charm.Meta{
+		Series: []string{"precise"},
+	}, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uid := putMultipart(c, store.BlobStore, time.Time{}, "123456789 123456789 ", "abcdefghijklmnopqrstuvxwyz")
+	_, err = store.AddResourceWithUploadId(id3, "someResource", uid)
+	c.Assert(err, gc.Equals, nil)
+
+	// With nothing wrong, the scrub reports no problems.
+	report, err := store.ScrubBlobs()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Missing, gc.Equals, 0)
+	c.Assert(report.Corrupt, gc.Equals, 0)
+	c.Assert(report.Problems, gc.HasLen, 0)
+	// Three archives, one resource and its two parts.
+	c.Assert(report.Checked, gc.Equals, 4)
+
+	entity1, err := store.FindEntity(id1, nil)
+	c.Assert(err, gc.Equals, nil)
+	s.corruptBlob(c, entity1.BlobHash)
+	entity2, err := store.FindEntity(id2, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = os.Remove(s.blobFile(c, entity2.BlobHash))
+	c.Assert(err, gc.Equals, nil)
+	s.corruptBlob(c, hashOfString("abcdefghijklmnopqrstuvxwyz"))
+
+	report, err = store.ScrubBlobs()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Missing, gc.Equals, 1)
+	c.Assert(report.Corrupt, gc.Equals, 2)
+	for i := range report.Problems {
+		c.Assert(report.Problems[i].Message, gc.Matches, ".+")
+		report.Problems[i].Message = ""
+	}
+	c.Assert(report.Problems, jc.DeepEquals, []mongodoc.ScrubProblem{{
+		URL:  &id1.URL,
+		Hash: entity1.BlobHash,
+	}, {
+		URL:     &id2.URL,
+		Hash:    entity2.BlobHash,
+		Missing: true,
+	}, {
+		URL:      charm.MustParseURL("cs:~charmers/withresource"),
+		Resource: "someResource/0",
+		Hash:     hashOfString("123456789 123456789 abcdefghijklmnopqrstuvxwyz"),
+	}})
+
+	// The report has been saved.
+	saved, err := store.BlobScrubReport()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(saved.Missing, gc.Equals, 1)
+	c.Assert(saved.Corrupt, gc.Equals, 2)
+	c.Assert(saved.Problems, gc.HasLen, 3)
+}
+
+func (s *BlobScrubSuite) TestScrubBlobsMissingPartSizes(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	id := router.MustNewResolvedURL("~charmers/precise/withresource-1", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(&charm.Meta{
+		Series: []string{"precise"},
+	}, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uid := putMultipart(c, store.BlobStore, time.Time{}, "123456789 123456789 ", "abcdefghijklmnopqrstuvxwyz")
+	_, err = store.AddResourceWithUploadId(id, "someResource", uid)
+	c.Assert(err, gc.Equals, nil)
+
+	// Remove the size of the last part from the index.
+	err = store.DB.Resources().Update(nil, bson.D{{"$pop", bson.D{{"blobindex.sizes", 1}}}})
+	c.Assert(err, gc.Equals, nil)
+
+	report, err := store.ScrubBlobs()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Corrupt, gc.Equals, 1)
+	c.Assert(report.Problems, gc.HasLen, 1)
+	c.Assert(report.Problems[0].Resource, gc.Equals, "someResource/0")
+	c.Assert(report.Problems[0].Message, gc.Equals, "invalid multipart index: 1 part sizes for 2 parts")
+}
+
+func (s *BlobScrubSuite) TestBlobScrubReportNotFound(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+	_, err := store.BlobScrubReport()
+	c.Assert(errgo.Cause(err), gc.Equals, mgo.ErrNotFound)
+}
+
+func (s *BlobScrubSuite) TestServerStartsBlobScrubber(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+	id := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	params := s.serverParams()
+	params.AuthUsername = "test-user"
+	params.AuthPassword = "test-password"
+	params.IdentityLocation = "http://0.1.2.3"
+	params.BlobScrubInterval = time.Hour
+	h, err := NewServer(s.Session.DB("juju_test"), nil, params, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	// The scrub should run immediately but because
+	// it's running asynchronously, it may be delayed.
+	attempt := retry.Regular{
+		Total: 5 * time.Second,
+		Delay: 50 * time.Millisecond,
+	}
+	var report *mongodoc.ScrubReport
+	for a := attempt.Start(nil); a.Next(); {
+		report, err = store.BlobScrubReport()
+		if err == nil {
+			break
+		}
+		c.Assert(errgo.Cause(err), gc.Equals, mgo.ErrNotFound)
+	}
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Checked, gc.Equals, 1)
+	c.Assert(report.Problems, gc.HasLen, 0)
+}
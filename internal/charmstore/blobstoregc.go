@@ -14,6 +14,12 @@ import (
 
 var gcInterval = time.Hour
 
+// BlobStoreGCGracePeriod holds how long a blob is kept after it was
+// last put even if nothing refers to it, so that blobs are not
+// collected before the entity or resource referring to them has been
+// added.
+const BlobStoreGCGracePeriod = 30 * time.Minute
+
 // blobstoreGC implements the worker that runs the blobstore
 // garbage collector.
 type blobstoreGC struct {
@@ -67,7 +73,14 @@ func (gc *blobstoreGC) doGC() error {
 	if err != nil {
 		return errgo.Notef(err, "expired-upload garbage collection failed")
 	}
-	err = store.BlobStoreGC(time.Now().Add(-30 * time.Minute))
+	n, err := store.RemoveExpiredDeletedEntities(time.Now().Add(-gc.pool.config.DeletedEntityRetention))
+	if err != nil {
+		return errgo.Notef(err, "deleted entity garbage collection failed")
+	}
+	if n > 0 {
+		logger.Infof("permanently removed %d deleted entities", n)
+	}
+	err = store.BlobStoreGC(time.Now().Add(-BlobStoreGCGracePeriod))
 	if err != nil {
 		return errgo.Notef(err, "blob garbage collection failed")
 	}
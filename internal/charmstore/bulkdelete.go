@@ -0,0 +1,323 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// BulkDeleteParams holds the parameters for a BulkDelete call. All the
+// selection criteria that are specified must match for an entity to be
+// selected, and at least one must be specified.
+type BulkDeleteParams struct {
+	// User selects entities owned by the given user.
+	User string
+
+	// Match selects entities whose id matches the given regular
+	// expression.
+	Match string
+
+	// Channel selects entities that have been published to the given
+	// channel. A channel without a track refers to the latest track.
+	Channel params.Channel
+
+	// UploadedAfter and UploadedBefore select entities uploaded
+	// at or after and before the given times respectively. They are
+	// ignored when zero.
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+
+	// Unpublished selects entities that have never been published
+	// to any channel.
+	Unpublished bool
+
+	// DeletePromulgated allows promulgated entities to be deleted.
+	// When it is false promulgated entities are skipped.
+	DeletePromulgated bool
+
+	// DryRun causes BulkDelete to return the plan without changing
+	// anything.
+	DryRun bool
+
+	// AuditUser holds the user recorded in the audit log for each
+	// deleted entity.
+	AuditUser string
+}
+
+// BulkDeletePlan describes the changes made, or that would be made,
+// by BulkDelete.
+type BulkDeletePlan struct {
+	// Entities holds the ids of the entities that are deleted.
+	Entities []*charm.URL
+
+	// BaseEntities holds the ids of the base entities that are
+	// deleted because none of their entities remain.
+	BaseEntities []*charm.URL
+
+	// Resources holds the resources that are deleted because their
+	// base entity is deleted.
+	Resources []*mongodoc.Resource
+
+	// SearchRecords holds the ids of the entities whose search
+	// records are removed.
+	SearchRecords []*charm.URL
+
+	// Skipped holds the entities that matched the selection
+	// criteria but are not deleted.
+	Skipped []BulkDeleteSkip
+}
+
+// BulkDeleteSkip records an entity that was selected for deletion but
+// has been kept.
+type BulkDeleteSkip struct {
+	URL    *charm.URL
+	Reason string
+}
+
+// BulkDelete permanently deletes all the entities selected by p. Unlike
+// DeleteEntity, deleted entities are not kept for restoring.
+//
+// An entity that is the current revision in any channel is only deleted
+// when all the entities with the same base entity are deleted, in which
+// case the base entity is deleted along with its resources and search
+// records. Otherwise it is skipped and recorded in the returned plan.
+func (s *Store) BulkDelete(p BulkDeleteParams) (*BulkDeletePlan, error) {
+	query, err := bulkDeleteQuery(p)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	plan := new(BulkDeletePlan)
+	// Group the selected entities by base entity.
+	selected := make(map[string][]*mongodoc.Entity)
+	var baseURLs []*charm.URL
+	iter := s.DB.Entities().Find(query).Select(FieldSelector("baseurl", "promulgated-url", "published")).Sort("_id").Iter()
+	var entity mongodoc.Entity
+	for iter.Next(&entity) {
+		if p.Unpublished && isPublished(&entity) {
+			// The query only excludes entities published to
+			// channels in the latest track.
+			entity = mongodoc.Entity{}
+			continue
+		}
+		if entity.PromulgatedURL != nil && !p.DeletePromulgated {
+			plan.Skipped = append(plan.Skipped, BulkDeleteSkip{
+				URL:    entity.URL,
+				Reason: "promulgated",
+			})
+			continue
+		}
+		e := entity
+		key := e.BaseURL.String()
+		if selected[key] == nil {
+			baseURLs = append(baseURLs, e.BaseURL)
+		}
+		selected[key] = append(selected[key], &e)
+		entity = mongodoc.Entity{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot select entities")
+	}
+	sort.Sort(urlsByString(baseURLs))
+	for _, baseURL := range baseURLs {
+		if err := s.planBaseEntityDelete(plan, baseURL, selected[baseURL.String()]); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if p.DryRun {
+		return plan, nil
+	}
+	if err := s.executeBulkDelete(plan, p.AuditUser); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return plan, nil
+}
+
+// bulkDeleteQuery returns the entities query for the selection
+// criteria in p.
+func bulkDeleteQuery(p BulkDeleteParams) (bson.D, error) {
+	var query bson.D
+	if p.User != "" {
+		query = append(query, bson.DocElem{"user", p.User})
+	}
+	if p.Match != "" {
+		query = append(query, bson.DocElem{"_id", bson.D{{"$regex", p.Match}}})
+	}
+	if p.Channel != "" {
+		if !ValidChannel(p.Channel) {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", p.Channel)
+		}
+		// Base entities may have different default tracks, so
+		// a channel without a track is taken to be in the
+		// latest track.
+		query = append(query, bson.DocElem{"published." + string(ResolveChannel(p.Channel, "")), true})
+	}
+	var uploadTime bson.D
+	if !p.UploadedAfter.IsZero() {
+		uploadTime = append(uploadTime, bson.DocElem{"$gte", p.UploadedAfter})
+	}
+	if !p.UploadedBefore.IsZero() {
+		uploadTime = append(uploadTime, bson.DocElem{"$lt", p.UploadedBefore})
+	}
+	if len(uploadTime) > 0 {
+		query = append(query, bson.DocElem{"uploadtime", uploadTime})
+	}
+	if p.Unpublished {
+		for _, ch := range params.OrderedChannels {
+			if ch == params.UnpublishedChannel {
+				continue
+			}
+			query = append(query, bson.DocElem{"published." + string(ch), bson.D{{"$ne", true}}})
+		}
+	}
+	if len(query) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no selection criteria specified")
+	}
+	return query, nil
+}
+
+// planBaseEntityDelete adds the changes needed to delete the given
+// selected entities, which all have the given base URL, to plan.
+func (s *Store) planBaseEntityDelete(plan *BulkDeletePlan, baseURL *charm.URL, entities []*mongodoc.Entity) error {
+	n, err := s.DB.Entities().Find(bson.D{{"baseurl", baseURL}}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count entities for %q", baseURL)
+	}
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("channelentities", "defaulttrack"))
+	if err != nil && errgo.Cause(err) != params.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	if n > len(entities) {
+		// Some entities remain, so the base entity stays and
+		// any entities it currently publishes must be kept.
+		for _, e := range entities {
+			if baseEntity != nil {
+				if channels := publishedChannels(baseEntity, e.URL); len(channels) > 0 {
+					plan.Skipped = append(plan.Skipped, BulkDeleteSkip{
+						URL:    e.URL,
+						Reason: fmt.Sprintf("current revision in channels %s", channels),
+					})
+					continue
+				}
+			}
+			plan.Entities = append(plan.Entities, e.URL)
+		}
+		return nil
+	}
+	for _, e := range entities {
+		plan.Entities = append(plan.Entities, e.URL)
+	}
+	if baseEntity == nil {
+		return nil
+	}
+	plan.BaseEntities = append(plan.BaseEntities, baseURL)
+	var resources []*mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{{"baseurl", baseURL}}).
+		Select(FieldSelector("baseurl", "name", "revision", "blobhash", "size")).
+		Sort("name", "revision").
+		All(&resources); err != nil {
+		return errgo.Notef(err, "cannot get resources for %q", baseURL)
+	}
+	plan.Resources = append(plan.Resources, resources...)
+	plan.SearchRecords = append(plan.SearchRecords, searchRecordIds(baseEntity)...)
+	return nil
+}
+
+// publishedChannels returns the channels, in order, in which id is the
+// current revision of baseEntity.
+func publishedChannels(baseEntity *mongodoc.BaseEntity, id *charm.URL) []string {
+	var channels []string
+	for ch, ids := range baseEntity.ChannelEntities {
+		for _, publishedId := range ids {
+			if *publishedId == *id {
+				channels = append(channels, string(ch))
+				break
+			}
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// searchRecordIds returns the ids under which the search records for
+// baseEntity are indexed. Multi-series charms are indexed under their
+// own id as well as once for each supported series.
+func searchRecordIds(baseEntity *mongodoc.BaseEntity) []*charm.URL {
+	return channelSearchRecordIds(baseEntity, searchChannel(baseEntity))
+}
+
+// channelSearchRecordIds returns the ids under which the search records
+// for the entities current in the given channel of baseEntity would be
+// indexed.
+func channelSearchRecordIds(baseEntity *mongodoc.BaseEntity, ch params.Channel) []*charm.URL {
+	var ids []*charm.URL
+	seen := make(map[string]bool)
+	add := func(id *charm.URL) {
+		if !seen[id.String()] {
+			seen[id.String()] = true
+			ids = append(ids, id)
+		}
+	}
+	stable := baseEntity.ChannelEntities[ch]
+	series := make([]string, 0, len(stable))
+	for s := range stable {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+	for _, s := range series {
+		id := stable[s]
+		add(id)
+		if id.Series == "" {
+			u := *id
+			u.Series = s
+			add(&u)
+		}
+	}
+	return ids
+}
+
+// executeBulkDelete makes the changes described by plan.
+func (s *Store) executeBulkDelete(plan *BulkDeletePlan, auditUser string) error {
+	for _, id := range plan.Entities {
+		if err := s.DB.Entities().RemoveId(id); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove entity %q", id)
+		}
+		s.AddAudit(audit.Entry{
+			User:   auditUser,
+			Op:     audit.OpDelete,
+			Entity: id,
+		})
+		s.RecordEvent(mongodoc.EventDelete, id, nil)
+	}
+	for _, baseURL := range plan.BaseEntities {
+		if _, err := s.DB.Resources().RemoveAll(bson.D{{"baseurl", baseURL}}); err != nil {
+			return errgo.Notef(err, "cannot remove resources for %q", baseURL)
+		}
+		if err := s.DB.BaseEntities().RemoveId(baseURL); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove base entity %q", baseURL)
+		}
+	}
+	for _, id := range plan.SearchRecords {
+		if err := s.ES.delete(id); err != nil {
+			return errgo.Notef(err, "cannot remove search record for %q", id)
+		}
+	}
+	return nil
+}
+
+type urlsByString []*charm.URL
+
+func (u urlsByString) Len() int           { return len(u) }
+func (u urlsByString) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u urlsByString) Less(i, j int) bool { return u[i].String() < u[j].String() }
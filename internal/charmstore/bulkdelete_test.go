@@ -0,0 +1,319 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type bulkDeleteSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&bulkDeleteSuite{})
+
+// addBulkDeleteEntities adds some entities owned by bob, one of which
+// has a resource and one of which is published to the stable channel,
+// and an entity owned by alice.
+func (s *bulkDeleteSuite) addBulkDeleteEntities(c *gc.C, store *Store) {
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "someResource", "resource content")
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("cs:~bob/precise/wordpress-2")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id2, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	id3 := MustParseResolvedURL("cs:~alice/precise/mysql-0")
+	err = store.AddCharmWithArchive(id3, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteNoCriteria(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.BulkDelete(BulkDeleteParams{DryRun: true})
+	c.Assert(err, gc.ErrorMatches, `no selection criteria specified`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteInvalidChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.BulkDelete(BulkDeleteParams{Channel: "bad"})
+	c.Assert(err, gc.ErrorMatches, `invalid channel "bad"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteAllForUser(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+
+	id1 := charm.MustParseURL("cs:~bob/precise/wordpress-1")
+	present, err := store.ES.HasDocument(s.TestIndex, typeName, store.ES.getID(id1))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(present, gc.Equals, true)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		User: "bob",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan.Entities, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		id1,
+		charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+	})
+	c.Assert(plan.BaseEntities, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~bob/wordpress"),
+	})
+	c.Assert(plan.Resources, gc.HasLen, 1)
+	c.Assert(plan.Resources[0].Name, gc.Equals, "someResource")
+	c.Assert(plan.SearchRecords, jc.DeepEquals, []*charm.URL{id1})
+	c.Assert(plan.Skipped, gc.HasLen, 0)
+
+	n, err := store.DB.Entities().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.BaseEntities().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.Resources().Find(bson.D{{"baseurl", charm.MustParseURL("cs:~bob/wordpress")}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	present, err = store.ES.HasDocument(s.TestIndex, typeName, store.ES.getID(id1))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(present, gc.Equals, false)
+
+	// Alice's entity is untouched.
+	_, err = store.FindEntity(MustParseResolvedURL("cs:~alice/precise/mysql-0"), nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteKeepsPublishedRevisions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		Match: "^cs:~bob/precise/wordpress-[12]$",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Skipped: []BulkDeleteSkip{{
+			URL:    charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+			Reason: "current revision in channels [stable]",
+		}, {
+			URL:    charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+			Reason: "current revision in channels [edge]",
+		}},
+	})
+	for _, id := range []string{"cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-2"} {
+		_, err := store.FindEntity(MustParseResolvedURL(id), nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteUnpublished(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		User:        "bob",
+		Unpublished: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Entities: []*charm.URL{
+			charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		},
+	})
+	_, err = store.FindEntity(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	// The base entity remains, so its resources are kept.
+	n, err := store.DB.Resources().Find(bson.D{{"baseurl", charm.MustParseURL("cs:~bob/wordpress")}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteByChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+	// Publish a newer revision to edge so that wordpress-2
+	// is no longer current in any channel.
+	id3 := MustParseResolvedURL("cs:~bob/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id3, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id3, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		Channel: params.EdgeChannel,
+		DryRun:  true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Entities: []*charm.URL{
+			charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+		},
+		Skipped: []BulkDeleteSkip{{
+			URL:    &id3.URL,
+			Reason: "current revision in channels [edge]",
+		}},
+	})
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteByUploadTime(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"cs:~bob/precise/wordpress-0", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-2", "cs:~alice/precise/mysql-0"} {
+		err := store.DB.Entities().UpdateId(charm.MustParseURL(id), bson.D{{
+			"$set", bson.D{{"uploadtime", t0.Add(time.Duration(i) * time.Hour)}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		UploadedAfter:  t0.Add(time.Hour),
+		UploadedBefore: t0.Add(4 * time.Hour),
+		DryRun:         true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Entities: []*charm.URL{
+			charm.MustParseURL("cs:~alice/precise/mysql-0"),
+		},
+		BaseEntities: []*charm.URL{
+			charm.MustParseURL("cs:~alice/mysql"),
+		},
+		Skipped: []BulkDeleteSkip{{
+			URL:    charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+			Reason: "current revision in channels [stable]",
+		}, {
+			URL:    charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+			Reason: "current revision in channels [edge]",
+		}},
+	})
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteDryRun(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		User:   "bob",
+		DryRun: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan.Entities, gc.HasLen, 3)
+	c.Assert(plan.BaseEntities, gc.HasLen, 1)
+	c.Assert(plan.Resources, gc.HasLen, 1)
+
+	n, err := store.DB.Entities().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 3)
+	n, err = store.DB.Resources().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteSkipsPromulgated(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := router.MustNewResolvedURL("cs:~charmers/precise/mysql-0", 0)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	plan, err := store.BulkDelete(BulkDeleteParams{
+		User: "charmers",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Skipped: []BulkDeleteSkip{{
+			URL:    &id.URL,
+			Reason: "promulgated",
+		}},
+	})
+
+	plan, err = store.BulkDelete(BulkDeleteParams{
+		User:              "charmers",
+		DeletePromulgated: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(plan, jc.DeepEquals, &BulkDeletePlan{
+		Entities:     []*charm.URL{&id.URL},
+		BaseEntities: []*charm.URL{charm.MustParseURL("cs:~charmers/mysql")},
+	})
+	_, err = store.FindEntity(id, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *bulkDeleteSuite) TestBulkDeleteAudit(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "audit.log")
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		AuditLogger: &lumberjack.Logger{
+			Filename: filename,
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	s.addBulkDeleteEntities(c, store)
+
+	_, err = store.BulkDelete(BulkDeleteParams{
+		User:      "alice",
+		AuditUser: "admin",
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, gc.Equals, nil)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	c.Assert(lines, gc.HasLen, 1)
+	var entry audit.Entry
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	c.Assert(err, gc.Equals, nil)
+	entry.Time = time.Time{}
+	c.Assert(entry, jc.DeepEquals, audit.Entry{
+		User:   "admin",
+		Op:     audit.OpDelete,
+		Entity: charm.MustParseURL("cs:~alice/precise/mysql-0"),
+	})
+}
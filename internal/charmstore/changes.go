@@ -0,0 +1,121 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// changeRetention holds how long changes are kept in the changes
+// collection.
+const changeRetention = 7 * 24 * time.Hour
+
+// changeGapTimeout holds how long Changes waits for a change with a
+// missing sequence number to be recorded before skipping it. Changes
+// are numbered before they are inserted, so concurrent changes may be
+// inserted out of order, and a server may fail between numbering a
+// change and inserting it.
+const changeGapTimeout = 10 * time.Second
+
+// changesSequence holds the id of the document in the sequences
+// collection that numbers the changes.
+const changesSequence = "changes"
+
+// recordedChanges holds the kinds of event that are recorded in the
+// changes collection.
+var recordedChanges = map[mongodoc.StoreEvent]bool{
+	mongodoc.EventUpload:  true,
+	mongodoc.EventPublish: true,
+	mongodoc.EventPerm:    true,
+	mongodoc.EventDelete:  true,
+}
+
+// RecordEvent records that the given event has affected the entity
+// with the given id. Uploads, publishes, permission changes and
+// deletions are added to the changes collection, and the event is
+// queued for delivery to the webhooks subscribed to it. The channels
+// are only relevant to publish events. Failures are logged rather than
+// returned because the event has already happened.
+func (s *Store) RecordEvent(event mongodoc.StoreEvent, id *charm.URL, channels []params.Channel) {
+	if recordedChanges[event] {
+		if err := s.recordChange(event, id, channels); err != nil {
+			logger.Errorf("cannot record %s change for %v: %v", event, id, err)
+		}
+	}
+	s.notifyWebhooks(event, id, channels)
+}
+
+func (s *Store) recordChange(event mongodoc.StoreEvent, id *charm.URL, channels []params.Channel) error {
+	var seq struct {
+		Value int64
+	}
+	if _, err := s.DB.Sequences().FindId(changesSequence).Apply(mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"value", 1}}}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &seq); err != nil {
+		return errgo.Notef(err, "cannot allocate change id")
+	}
+	if err := s.DB.Changes().Insert(&mongodoc.Change{
+		Id:       seq.Value,
+		Event:    event,
+		URL:      id,
+		Channels: channels,
+		Time:     time.Now(),
+	}); err != nil {
+		return errgo.Notef(err, "cannot insert change %d", seq.Value)
+	}
+	return nil
+}
+
+// LatestChangeId returns the id of the most recently numbered change,
+// or zero if no change has been recorded.
+func (s *Store) LatestChangeId() (int64, error) {
+	var seq struct {
+		Value int64
+	}
+	if err := s.DB.Sequences().FindId(changesSequence).One(&seq); err != nil {
+		if err == mgo.ErrNotFound {
+			return 0, nil
+		}
+		return 0, errgo.Notef(err, "cannot get latest change id")
+	}
+	return seq.Value, nil
+}
+
+// Changes returns at most limit of the changes recorded after the
+// change with the given id, oldest first. If limit is zero, all such
+// changes are returned.
+//
+// A change is not returned until all the changes numbered before it
+// have been recorded, so that a client that resumes from the id of the
+// last change it received never misses a change. A change that is
+// still missing after changeGapTimeout is assumed never to be recorded
+// and is skipped.
+func (s *Store) Changes(since int64, limit int) ([]*mongodoc.Change, error) {
+	q := s.DB.Changes().Find(bson.D{{"_id", bson.D{{"$gt", since}}}}).Sort("_id")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	var changes []*mongodoc.Change
+	if err := q.All(&changes); err != nil {
+		return nil, errgo.Notef(err, "cannot get changes")
+	}
+	next := since + 1
+	for i, c := range changes {
+		if c.Id != next && time.Since(c.Time) < changeGapTimeout {
+			return changes[:i], nil
+		}
+		next = c.Id + 1
+	}
+	return changes, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type changesSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&changesSuite{})
+
+func (s *changesSuite) TestChanges(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	latest, err := store.LatestChangeId()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(latest, gc.Equals, int64(0))
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	for _, id := range []*router.ResolvedURL{id0, id1} {
+		err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err = store.Publish(id1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	// Promulgation is not recorded as a change.
+	err = store.SetPromulgated(id1, true)
+	c.Assert(err, gc.Equals, nil)
+	store.RecordEvent(mongodoc.EventPerm, &id1.URL, nil)
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+
+	changes, err := store.Changes(0, 0)
+	c.Assert(err, gc.Equals, nil)
+	for _, ch := range changes {
+		c.Assert(ch.Time.IsZero(), gc.Equals, false)
+		ch.Time = time.Time{}
+	}
+	c.Assert(changes, jc.DeepEquals, []*mongodoc.Change{{
+		Id:    1,
+		Event: mongodoc.EventUpload,
+		URL:   &id0.URL,
+	}, {
+		Id:    2,
+		Event: mongodoc.EventUpload,
+		URL:   &id1.URL,
+	}, {
+		Id:       3,
+		Event:    mongodoc.EventPublish,
+		URL:      &id1.URL,
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		Id:    4,
+		Event: mongodoc.EventPerm,
+		URL:   &id1.URL,
+	}, {
+		Id:    5,
+		Event: mongodoc.EventDelete,
+		URL:   &id0.URL,
+	}})
+
+	latest, err = store.LatestChangeId()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(latest, gc.Equals, int64(5))
+
+	// Changes can be resumed and limited.
+	changes, err = store.Changes(2, 2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 2)
+	c.Assert(changes[0].Id, gc.Equals, int64(3))
+	c.Assert(changes[1].Id, gc.Equals, int64(4))
+
+	changes, err = store.Changes(5, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 0)
+}
+
+func (s *changesSuite) TestChangesWaitsForGap(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	store.RecordEvent(mongodoc.EventUpload, charm.MustParseURL("cs:~bob/precise/wordpress-0"), nil)
+	// Simulate change 2 having been numbered but not yet inserted.
+	err := store.DB.Changes().Insert(&mongodoc.Change{
+		Id:    3,
+		Event: mongodoc.EventUpload,
+		URL:   charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+		Time:  time.Now(),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	changes, err := store.Changes(0, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].Id, gc.Equals, int64(1))
+
+	// Once change 2 is recorded, both are returned.
+	err = store.DB.Changes().Insert(&mongodoc.Change{
+		Id:    2,
+		Event: mongodoc.EventUpload,
+		URL:   charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		Time:  time.Now(),
+	})
+	c.Assert(err, gc.Equals, nil)
+	changes, err = store.Changes(1, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 2)
+	c.Assert(changes[0].Id, gc.Equals, int64(2))
+	c.Assert(changes[1].Id, gc.Equals, int64(3))
+}
+
+func (s *changesSuite) TestChangesSkipsStaleGap(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// Change 1 was numbered but never inserted.
+	err := store.DB.Changes().Insert(&mongodoc.Change{
+		Id:    2,
+		Event: mongodoc.EventDelete,
+		URL:   charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		Time:  time.Now().Add(-changeGapTimeout - time.Second),
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.DB.Changes().Insert(&mongodoc.Change{
+		Id:    4,
+		Event: mongodoc.EventDelete,
+		URL:   charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		Time:  time.Now(),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	changes, err := store.Changes(0, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].Id, gc.Equals, int64(2))
+
+	err = store.DB.Changes().UpdateId(int64(4), bson.D{{"$set", bson.D{{"time", time.Now().Add(-changeGapTimeout - time.Second)}}}})
+	c.Assert(err, gc.Equals, nil)
+	changes, err = store.Changes(2, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].Id, gc.Equals, int64(4))
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// LatestTrack holds the name of the track that channels without a track
+// belong to when a base entity has no default track. Channels in this
+// track are stored under their risk alone (for instance "stable"), so
+// that entities published before tracks existed remain in it.
+const LatestTrack = "latest"
+
+// validTrack matches valid track names. Track names may not contain
+// dots because channel names are used as keys in MongoDB documents.
+var validTrack = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidTrack reports whether track is a valid track name.
+func ValidTrack(track string) bool {
+	return validTrack.MatchString(track)
+}
+
+// ParseChannel splits ch, of the form [<track>/]<risk>, into its track
+// and risk. The track is empty if ch does not specify one. The risk must
+// be one of params.ValidChannels; the unpublished channel cannot have a
+// track.
+func ParseChannel(ch params.Channel) (track string, risk params.Channel, err error) {
+	s := string(ch)
+	if i := strings.Index(s, "/"); i >= 0 {
+		track, risk = s[:i], params.Channel(s[i+1:])
+		if !ValidTrack(track) || risk == params.UnpublishedChannel {
+			return "", "", errgo.Newf("invalid channel %q", ch)
+		}
+	} else {
+		risk = ch
+	}
+	if !params.ValidChannels[risk] {
+		return "", "", errgo.Newf("invalid channel %q", ch)
+	}
+	return track, risk, nil
+}
+
+// ValidChannel reports whether ch is a valid channel, with or without a
+// track.
+func ValidChannel(ch params.Channel) bool {
+	_, _, err := ParseChannel(ch)
+	return err == nil
+}
+
+// ResolveChannel returns the channel that ch refers to for a base entity
+// with the given default track. The returned channel is the one used as
+// a key in the base entity's ChannelEntities, ChannelACLs and
+// ChannelResources and in the entity's Published field. If ch has no
+// track, the default track is used; channels in the latest track have
+// the track removed. Invalid channels, NoChannel and the unpublished
+// channel are returned unchanged.
+func ResolveChannel(ch params.Channel, defaultTrack string) params.Channel {
+	track, risk, err := ParseChannel(ch)
+	if err != nil || risk == params.UnpublishedChannel {
+		return ch
+	}
+	if track == "" {
+		track = defaultTrack
+	}
+	if track == "" || track == LatestTrack {
+		return risk
+	}
+	return params.Channel(track + "/" + string(risk))
+}
+
+// searchChannel returns the channel whose entities are included in the
+// search index for baseEntity: the stable channel of its default track.
+func searchChannel(baseEntity *mongodoc.BaseEntity) params.Channel {
+	return ResolveChannel(params.StableChannel, baseEntity.DefaultTrack)
+}
+
+// ChannelACL returns the ACL of the given channel in baseEntity, which
+// must be as returned by ResolveChannel. A channel in a track that has
+// no ACL of its own uses the ACL of the channel with the same risk in
+// the latest track.
+func ChannelACL(baseEntity *mongodoc.BaseEntity, ch params.Channel) mongodoc.ACL {
+	if acl, ok := baseEntity.ChannelACLs[ch]; ok {
+		return acl
+	}
+	if _, risk, err := ParseChannel(ch); err == nil {
+		return baseEntity.ChannelACLs[risk]
+	}
+	return mongodoc.ACL{}
+}
+
+// OrderedChannels returns the given channels, which must be as returned
+// by ResolveChannel, in order of preference: channels in the default
+// track come first, followed by those in the other tracks in name
+// order. Within a track, channels are ordered by stability as in
+// params.OrderedChannels. Invalid channels are omitted.
+func OrderedChannels(chans []params.Channel, defaultTrack string) []params.Channel {
+	if defaultTrack == "" {
+		defaultTrack = LatestTrack
+	}
+	ordered := make(channelsByPreference, 0, len(chans))
+	for _, ch := range chans {
+		track, risk, err := ParseChannel(ch)
+		if err != nil {
+			continue
+		}
+		if track == "" {
+			track = LatestTrack
+		}
+		ordered = append(ordered, channelPreference{
+			channel:   ch,
+			track:     track,
+			risk:      riskOrder(risk),
+			isDefault: track == defaultTrack,
+		})
+	}
+	sort.Sort(ordered)
+	result := make([]params.Channel, len(ordered))
+	for i, p := range ordered {
+		result[i] = p.channel
+	}
+	return result
+}
+
+// riskOrder returns the position of risk in params.OrderedChannels.
+func riskOrder(risk params.Channel) int {
+	for i, ch := range params.OrderedChannels {
+		if ch == risk {
+			return i
+		}
+	}
+	return len(params.OrderedChannels)
+}
+
+type channelPreference struct {
+	channel   params.Channel
+	track     string
+	risk      int
+	isDefault bool
+}
+
+type channelsByPreference []channelPreference
+
+func (c channelsByPreference) Len() int      { return len(c) }
+func (c channelsByPreference) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c channelsByPreference) Less(i, j int) bool {
+	if c[i].isDefault != c[j].isDefault {
+		return c[i].isDefault
+	}
+	if c[i].track != c[j].track {
+		return c[i].track < c[j].track
+	}
+	return c[i].risk < c[j].risk
+}
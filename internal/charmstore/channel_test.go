@@ -0,0 +1,288 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type channelSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&channelSuite{})
+
+var parseChannelTests = []struct {
+	channel     params.Channel
+	expectTrack string
+	expectRisk  params.Channel
+	expectError string
+}{{
+	channel:    "stable",
+	expectRisk: params.StableChannel,
+}, {
+	channel:    "unpublished",
+	expectRisk: params.UnpublishedChannel,
+}, {
+	channel:     "2/edge",
+	expectTrack: "2",
+	expectRisk:  params.EdgeChannel,
+}, {
+	channel:     "latest/candidate",
+	expectTrack: "latest",
+	expectRisk:  params.CandidateChannel,
+}, {
+	channel:     "1-x/beta",
+	expectTrack: "1-x",
+	expectRisk:  params.BetaChannel,
+}, {
+	channel:     "2/unpublished",
+	expectError: `invalid channel "2/unpublished"`,
+}, {
+	channel:     "1.x/stable",
+	expectError: `invalid channel "1.x/stable"`,
+}, {
+	channel:     "/stable",
+	expectError: `invalid channel "/stable"`,
+}, {
+	channel:     "2/stable/foo",
+	expectError: `invalid channel "2/stable/foo"`,
+}, {
+	channel:     "2",
+	expectError: `invalid channel "2"`,
+}, {
+	channel:     "",
+	expectError: `invalid channel ""`,
+}}
+
+func (s *channelSuite) TestParseChannel(c *gc.C) {
+	for i, test := range parseChannelTests {
+		c.Logf("test %d: %q", i, test.channel)
+		track, risk, err := ParseChannel(test.channel)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(ValidChannel(test.channel), gc.Equals, false)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(track, gc.Equals, test.expectTrack)
+		c.Assert(risk, gc.Equals, test.expectRisk)
+		c.Assert(ValidChannel(test.channel), gc.Equals, true)
+	}
+}
+
+var resolveChannelTests = []struct {
+	channel      params.Channel
+	defaultTrack string
+	expect       params.Channel
+}{{
+	channel: "stable",
+	expect:  "stable",
+}, {
+	channel:      "stable",
+	defaultTrack: "latest",
+	expect:       "stable",
+}, {
+	channel:      "stable",
+	defaultTrack: "2",
+	expect:       "2/stable",
+}, {
+	channel:      "latest/stable",
+	defaultTrack: "2",
+	expect:       "stable",
+}, {
+	channel: "2/edge",
+	expect:  "2/edge",
+}, {
+	channel:      "3/edge",
+	defaultTrack: "2",
+	expect:       "3/edge",
+}, {
+	channel:      "unpublished",
+	defaultTrack: "2",
+	expect:       "unpublished",
+}, {
+	channel:      "",
+	defaultTrack: "2",
+	expect:       "",
+}}
+
+func (s *channelSuite) TestResolveChannel(c *gc.C) {
+	for i, test := range resolveChannelTests {
+		c.Logf("test %d: %q in track %q", i, test.channel, test.defaultTrack)
+		c.Assert(ResolveChannel(test.channel, test.defaultTrack), gc.Equals, test.expect)
+	}
+}
+
+func (s *channelSuite) TestOrderedChannels(c *gc.C) {
+	chans := []params.Channel{"3/stable", "edge", "2/edge", "stable", "2/stable", "candidate"}
+	c.Assert(OrderedChannels(chans, ""), jc.DeepEquals, []params.Channel{
+		"stable", "candidate", "edge", "2/stable", "2/edge", "3/stable",
+	})
+	c.Assert(OrderedChannels(chans, "2"), jc.DeepEquals, []params.Channel{
+		"2/stable", "2/edge", "3/stable", "stable", "candidate", "edge",
+	})
+}
+
+func (s *channelSuite) TestChannelACL(c *gc.C) {
+	be := &mongodoc.BaseEntity{
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.StableChannel: {Read: []string{"everyone"}, Write: []string{"bob"}},
+			"2/stable":           {Read: []string{"bob"}, Write: []string{"bob"}},
+		},
+	}
+	c.Assert(ChannelACL(be, "stable"), jc.DeepEquals, mongodoc.ACL{Read: []string{"everyone"}, Write: []string{"bob"}})
+	c.Assert(ChannelACL(be, "2/stable"), jc.DeepEquals, mongodoc.ACL{Read: []string{"bob"}, Write: []string{"bob"}})
+	c.Assert(ChannelACL(be, "3/stable"), jc.DeepEquals, mongodoc.ACL{Read: []string{"everyone"}, Write: []string{"bob"}})
+	c.Assert(ChannelACL(be, "3/edge"), jc.DeepEquals, mongodoc.ACL{})
+}
+
+func (s *channelSuite) TestPublishToTrack(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&id0.URL, "stable.read", "everyone")
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.Publish(id0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, "2/stable")
+	c.Assert(err, gc.Equals, nil)
+
+	be, err := store.FindBaseEntity(&id0.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {"precise": &id0.URL},
+		"2/stable":           {"precise": &id1.URL},
+	})
+	// The new track takes the ACL of the stable channel.
+	c.Assert(be.ChannelACLs["2/stable"], jc.DeepEquals, be.ChannelACLs[params.StableChannel])
+	e, err := store.FindEntity(id1, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published, jc.DeepEquals, map[params.Channel]bool{"2/stable": true})
+
+	url := charm.MustParseURL("cs:~bob/wordpress")
+	assertBest := func(ch params.Channel, expect *charm.URL) {
+		e, err := store.FindBestEntity(url, ch, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.URL, jc.DeepEquals, expect)
+	}
+	assertBest(params.NoChannel, &id0.URL)
+	assertBest(params.StableChannel, &id0.URL)
+	assertBest("latest/stable", &id0.URL)
+	assertBest("2/stable", &id1.URL)
+	_, err = store.FindBestEntity(url, "2/edge", nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Changing the default track changes what channels
+	// without a track refer to.
+	err = store.UpdateBaseEntity(id0, bson.D{{"$set", bson.D{{"defaulttrack", "2"}}}})
+	c.Assert(err, gc.Equals, nil)
+	assertBest(params.NoChannel, &id1.URL)
+	assertBest(params.StableChannel, &id1.URL)
+	assertBest("latest/stable", &id0.URL)
+
+	// A revision is only found in the channels it was published to.
+	_, err = store.FindBestEntity(&id0.URL, params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	e, err = store.FindBestEntity(&id1.URL, params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL, jc.DeepEquals, &id1.URL)
+
+	// Publishing to a channel without a track now
+	// publishes to the default track.
+	err = store.Publish(id0, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	assertBest("2/edge", &id0.URL)
+	_, err = store.FindBestEntity(url, "latest/edge", nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *channelSuite) TestSetEntityChannels(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	chans := []params.Channel{
+		params.StableChannel,
+		"latest/edge",
+		"3/beta",
+		params.UnpublishedChannel,
+		"1.x/stable",
+		"bad",
+	}
+
+	// Without a base entity, channels without a track
+	// refer to the latest track.
+	e := &mongodoc.Entity{
+		URL: charm.MustParseURL("cs:~charmers/precise/wordpress-0"),
+	}
+	err := store.setEntityChannels(e, chans)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel: true,
+		params.EdgeChannel:   true,
+		"3/beta":             true,
+	})
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-0")
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"defaulttrack", "2"}}}})
+	c.Assert(err, gc.Equals, nil)
+	e = &mongodoc.Entity{
+		URL: charm.MustParseURL("cs:~charmers/precise/wordpress-1"),
+	}
+	err = store.setEntityChannels(e, chans)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published, jc.DeepEquals, map[params.Channel]bool{
+		"2/stable":         true,
+		params.EdgeChannel: true,
+		"3/beta":           true,
+	})
+}
+
+func (s *channelSuite) TestSearchUsesDefaultTrack(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	id1 := MustParseResolvedURL("cs:~bob/trusty/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, "2/stable")
+	c.Assert(err, gc.Equals, nil)
+
+	assertIndexed := func(id *router.ResolvedURL, expect bool) {
+		present, err := store.ES.HasDocument(s.TestIndex, typeName, store.ES.getID(&id.URL))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(present, gc.Equals, expect, gc.Commentf("%v", id))
+	}
+	assertIndexed(id0, true)
+	assertIndexed(id1, false)
+
+	err = store.UpdateBaseEntity(id0, bson.D{{"$set", bson.D{{"defaulttrack", "2"}}}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateSearchBaseURL(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	assertIndexed(id0, false)
+	assertIndexed(id1, true)
+}
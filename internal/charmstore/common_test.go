@@ -32,7 +32,8 @@ func (s *commonSuite) newStore(c *gc.C, withElasticSearch bool) *Store {
 		si = &SearchIndex{s.ES, s.TestIndex}
 	}
 	p, err := NewPool(s.Session.DB("juju_test"), si, &bakery.NewServiceParams{}, ServerParams{
-		MinUploadPartSize: 10,
+		MinUploadPartSize:            10,
+		WebhookAllowPrivateAddresses: true,
 	})
 	c.Assert(err, gc.Equals, nil)
 	store := p.Store()
@@ -0,0 +1,198 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"regexp"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// validGroupName matches the names of groups and their members. As
+// well as the characters allowed in the user names of charm and bundle
+// ids, an @ is allowed so that users from other identity domains can
+// be members.
+var validGroupName = regexp.MustCompile(`^[a-z0-9][a-zA-Z0-9+.@-]*$`)
+
+// SetGroup creates the group with the given name, or replaces its
+// members if it already exists. Because group names share a namespace
+// with user names in ACLs, an error with an ErrBadRequest cause is
+// returned if the group name is already known as a user or any member
+// is the name of a group.
+func (s *Store) SetGroup(name string, members []string) error {
+	if err := checkGroupNames(name, members); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := s.checkNotUser(name); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := s.checkMembersNotGroups(name, members); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if _, err := s.DB.Groups().UpsertId(name, bson.D{
+		{"$set", bson.D{{"members", dedupe(members)}}},
+		{"$setOnInsert", bson.D{{"createtime", time.Now()}}},
+	}); err != nil {
+		return errgo.Notef(err, "cannot set group %q", name)
+	}
+	return nil
+}
+
+// UpdateGroupMembers adds the users in add to the group with the given
+// name and then removes the users in remove from it. If there is no
+// such group, an error with an ErrNotFound cause is returned.
+func (s *Store) UpdateGroupMembers(name string, add, remove []string) error {
+	if err := checkGroupNames(name, add); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := s.checkMembersNotGroups(name, add); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// MongoDB does not allow a field to be both added to
+	// and pulled from in the same update.
+	updates := make([]bson.D, 0, 2)
+	if len(add) > 0 {
+		updates = append(updates, bson.D{{"$addToSet", bson.D{{"members", bson.D{{"$each", add}}}}}})
+	}
+	if len(remove) > 0 {
+		updates = append(updates, bson.D{{"$pullAll", bson.D{{"members", remove}}}})
+	}
+	if len(updates) == 0 {
+		_, err := s.Group(name)
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	for _, update := range updates {
+		if err := s.DB.Groups().UpdateId(name, update); err != nil {
+			if err == mgo.ErrNotFound {
+				return errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+			}
+			return errgo.Notef(err, "cannot update group %q", name)
+		}
+	}
+	return nil
+}
+
+// RemoveGroup removes the group with the given name. If there is no
+// such group, an error with an ErrNotFound cause is returned.
+func (s *Store) RemoveGroup(name string) error {
+	if err := s.DB.Groups().RemoveId(name); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+		}
+		return errgo.Notef(err, "cannot remove group %q", name)
+	}
+	return nil
+}
+
+// Group returns the group with the given name. If there is no such
+// group, an error with an ErrNotFound cause is returned.
+func (s *Store) Group(name string) (*mongodoc.Group, error) {
+	var g mongodoc.Group
+	if err := s.DB.Groups().FindId(name).One(&g); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", name)
+		}
+		return nil, errgo.Notef(err, "cannot get group %q", name)
+	}
+	return &g, nil
+}
+
+// Groups returns all the groups, ordered by name.
+func (s *Store) Groups() ([]*mongodoc.Group, error) {
+	var gs []*mongodoc.Group
+	if err := s.DB.Groups().Find(nil).Sort("_id").All(&gs); err != nil {
+		return nil, errgo.Notef(err, "cannot get groups")
+	}
+	return gs, nil
+}
+
+// UserGroups returns the names of the groups that the given user is a
+// member of, in alphabetical order.
+func (s *Store) UserGroups(user string) ([]string, error) {
+	var gs []mongodoc.Group
+	if err := s.DB.Groups().Find(bson.D{{"members", user}}).Select(bson.D{{"_id", 1}}).Sort("_id").All(&gs); err != nil {
+		return nil, errgo.Notef(err, "cannot get groups for %q", user)
+	}
+	names := make([]string, len(gs))
+	for i, g := range gs {
+		names[i] = g.Name
+	}
+	return names, nil
+}
+
+// checkGroupNames checks that the given group and member
+// names are valid.
+func checkGroupNames(group string, members []string) error {
+	if !validGroupName.MatchString(group) || group == params.Everyone {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid group name %q", group)
+	}
+	for _, m := range members {
+		if !validGroupName.MatchString(m) || m == params.Everyone {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid user name %q", m)
+		}
+	}
+	return nil
+}
+
+// checkNotUser checks that the given group name is not known as the
+// name of a user, either as a member of a group or as the user of an
+// API token.
+func (s *Store) checkNotUser(group string) error {
+	n, err := s.DB.Groups().Find(bson.D{{"members", group}}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot check group members")
+	}
+	if n == 0 {
+		n, err = s.DB.APITokens().Find(bson.D{{"user", group}}).Count()
+		if err != nil {
+			return errgo.Notef(err, "cannot check API tokens")
+		}
+	}
+	if n > 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "group name %q clashes with an existing user", group)
+	}
+	return nil
+}
+
+// checkMembersNotGroups checks that none of the given members of the
+// given group is itself the name of a group.
+func (s *Store) checkMembersNotGroups(group string, members []string) error {
+	for _, m := range members {
+		if m == group {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "user name %q clashes with a group", m)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	var g mongodoc.Group
+	err := s.DB.Groups().Find(bson.D{{"_id", bson.D{{"$in", members}}}}).Select(bson.D{{"_id", 1}}).One(&g)
+	if err == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "user name %q clashes with a group", g.Name)
+	}
+	if err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot check group names")
+	}
+	return nil
+}
+
+// dedupe returns the given names without duplicates,
+// keeping the first occurrence of each.
+func dedupe(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type groupSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&groupSuite{})
+
+func (s *groupSuite) TestGroups(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.SetGroup("qa", []string{"bob", "alice", "bob"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetGroup("ci", nil)
+	c.Assert(err, gc.Equals, nil)
+
+	g, err := store.Group("qa")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(g.Name, gc.Equals, "qa")
+	c.Assert(g.Members, jc.DeepEquals, []string{"bob", "alice"})
+	c.Assert(g.CreateTime.IsZero(), gc.Equals, false)
+	createTime := g.CreateTime
+
+	gs, err := store.Groups()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(gs, gc.HasLen, 2)
+	c.Assert(gs[0].Name, gc.Equals, "ci")
+	c.Assert(gs[0].Members, jc.DeepEquals, []string{})
+	c.Assert(gs[1].Name, gc.Equals, "qa")
+
+	// Setting an existing group replaces its members.
+	err = store.SetGroup("qa", []string{"carol"})
+	c.Assert(err, gc.Equals, nil)
+	g, err = store.Group("qa")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(g.Members, jc.DeepEquals, []string{"carol"})
+	c.Assert(g.CreateTime.Equal(createTime), gc.Equals, true)
+
+	err = store.UpdateGroupMembers("qa", []string{"bob", "carol"}, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateGroupMembers("ci", []string{"bob"}, nil)
+	c.Assert(err, gc.Equals, nil)
+	groups, err := store.UserGroups("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"ci", "qa"})
+
+	err = store.UpdateGroupMembers("qa", []string{"dave"}, []string{"bob", "carol"})
+	c.Assert(err, gc.Equals, nil)
+	g, err = store.Group("qa")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(g.Members, jc.DeepEquals, []string{"dave"})
+	groups, err = store.UserGroups("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"ci"})
+
+	err = store.RemoveGroup("ci")
+	c.Assert(err, gc.Equals, nil)
+	groups, err = store.UserGroups("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{})
+
+	_, err = store.Group("ci")
+	c.Assert(err, gc.ErrorMatches, `group "ci" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveGroup("ci")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.UpdateGroupMembers("ci", []string{"bob"}, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.UpdateGroupMembers("ci", nil, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *groupSuite) TestInvalidGroupNames(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.SetGroup("Bad Name", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid group name "Bad Name"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.SetGroup("everyone", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid group name "everyone"`)
+
+	err = store.SetGroup("qa", []string{"bob@external", "-bob"})
+	c.Assert(err, gc.ErrorMatches, `invalid user name "-bob"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *groupSuite) TestGroupNameClashes(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.SetGroup("qa", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AddAPIToken(&mongodoc.APIToken{
+		User:  "alice",
+		Scope: mongodoc.APITokenRead,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// A group cannot be named after a known user.
+	err = store.SetGroup("bob", nil)
+	c.Assert(err, gc.ErrorMatches, `group name "bob" clashes with an existing user`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	err = store.SetGroup("alice", nil)
+	c.Assert(err, gc.ErrorMatches, `group name "alice" clashes with an existing user`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	// A group cannot have a group as a member.
+	err = store.SetGroup("ci", []string{"carol", "qa"})
+	c.Assert(err, gc.ErrorMatches, `user name "qa" clashes with a group`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	err = store.SetGroup("ci", []string{"ci"})
+	c.Assert(err, gc.ErrorMatches, `user name "ci" clashes with a group`)
+	err = store.UpdateGroupMembers("qa", []string{"qa"}, nil)
+	c.Assert(err, gc.ErrorMatches, `user name "qa" clashes with a group`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	// An API token cannot act as a group.
+	_, err = store.AddAPIToken(&mongodoc.APIToken{
+		User:  "qa",
+		Scope: mongodoc.APITokenRead,
+	})
+	c.Assert(err, gc.ErrorMatches, `API token user "qa" clashes with a group`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
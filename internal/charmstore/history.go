@@ -0,0 +1,116 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// ChannelHistory returns the publish history of the base entity of id
+// in the given channel, most recent first. If channel is empty, the
+// history for all channels is returned. A channel without a track
+// refers to the default track of the base entity.
+func (s *Store) ChannelHistory(id *charm.URL, channel params.Channel) ([]*mongodoc.PublishEvent, error) {
+	query := bson.D{{"baseurl", mongodoc.BaseURL(id)}}
+	if channel != params.NoChannel {
+		ch, err := s.resolveChannel(id, channel)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		query = append(query, bson.DocElem{"channel", ch})
+	}
+	var events []*mongodoc.PublishEvent
+	if err := s.DB.PublishHistory().Find(query).Sort("-time", "-_id").All(&events); err != nil {
+		return nil, errgo.Notef(err, "cannot get publish history for %q", id)
+	}
+	return events, nil
+}
+
+// Rollback republishes to the given channel the entity that was current
+// in the channel before the current one, along with the resources it was
+// published with. The current entity is the one most recently published
+// to the channel, and only entities published for at least one of the
+// same series are considered, because the channel holds a separate
+// current entity for each series. Entities that have been rolled back
+// from are skipped, so repeated rollbacks step further back through the
+// history. The given user is recorded in the publish history. Because
+// the entity rolled back to has already been published to the channel,
+// the promotion policy of the base entity is not checked.
+//
+// If there is no earlier entity to roll back to, an error with an
+// ErrNotFound cause is returned.
+func (s *Store) Rollback(id *charm.URL, channel params.Channel, user string) (*mongodoc.PublishEvent, error) {
+	if !ValidChannel(channel) || channel == params.UnpublishedChannel {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+	}
+	// Note that ChannelHistory and publish both resolve
+	// the channel with the base entity's default track.
+	events, err := s.ChannelHistory(id, channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if len(events) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "%q has not been published to the %s channel", mongodoc.BaseURL(id), channel)
+	}
+	current := events[0].URL
+	currentSeries := make(map[string]bool)
+	for _, series := range events[0].Series {
+		currentSeries[series] = true
+	}
+	rolledBack := make(map[charm.URL]bool)
+	var target *mongodoc.PublishEvent
+	for _, e := range events {
+		if e.RolledBackFrom != nil {
+			rolledBack[*e.RolledBackFrom] = true
+		}
+		if *e.URL != *current && !rolledBack[*e.URL] && anySeries(e.Series, currentSeries) {
+			target = e
+			break
+		}
+	}
+	if target == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no earlier revision of %q to roll back to in the %s channel", mongodoc.BaseURL(id), channel)
+	}
+	entity, err := s.FindEntity(&router.ResolvedURL{URL: *target.URL, PromulgatedRevision: -1}, FieldSelector("promulgated-url"))
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot roll back", errgo.Is(params.ErrNotFound))
+	}
+	resources := make(map[string]int, len(target.Resources))
+	for _, r := range target.Resources {
+		resources[r.Name] = r.Revision
+	}
+	if err := s.publish(EntityResolvedURL(entity), resources, mongodoc.PublishEvent{
+		User:           user,
+		RolledBackFrom: current,
+	}, []params.Channel{channel}); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	events, err = s.ChannelHistory(id, channel)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return events[0], nil
+}
+
+// anySeries reports whether any of the given series is in set.
+func anySeries(series []string, set map[string]bool) bool {
+	for _, s := range series {
+		if set[s] {
+			return true
+		}
+	}
+	return false
+}
+
+type resourceRevisionsByName []mongodoc.ResourceRevision
+
+func (r resourceRevisionsByName) Len() int           { return len(r) }
+func (r resourceRevisionsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r resourceRevisionsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
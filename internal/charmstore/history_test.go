@@ -0,0 +1,208 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type historySuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&historySuite{})
+
+func (s *historySuite) TestPublishRecordsHistory(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "someResource", "resource content")
+	err = store.PublishAs("bob", id0, map[string]int{"someResource": 0}, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id0, map[string]int{"someResource": 0}, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	events, err := store.ChannelHistory(charm.MustParseURL("cs:~bob/wordpress"), params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 1)
+	c.Assert(events[0].Time.IsZero(), gc.Equals, false)
+	c.Assert(events[0].Id, gc.Not(gc.Equals), bson.ObjectId(""))
+	c.Assert(events[0], jc.DeepEquals, &mongodoc.PublishEvent{
+		Id:        events[0].Id,
+		BaseURL:   charm.MustParseURL("cs:~bob/wordpress"),
+		URL:       &id0.URL,
+		Channel:   params.StableChannel,
+		Series:    []string{"precise"},
+		Resources: []mongodoc.ResourceRevision{{Name: "someResource", Revision: 0}},
+		User:      "bob",
+		Time:      events[0].Time,
+	})
+
+	events, err = store.ChannelHistory(&id0.URL, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 2)
+	c.Assert(events[0].User, gc.Equals, "")
+	c.Assert(events[1].User, gc.Equals, "bob")
+
+	events, err = store.ChannelHistory(&id0.URL, params.NoChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 3)
+}
+
+func (s *historySuite) TestRollback(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "someResource", "resource content")
+	uploadResource(c, store, id0, "someResource", "new resource content")
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("cs:~bob/precise/wordpress-2")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.Publish(id0, map[string]int{"someResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, map[string]int{"someResource": 1}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id2, map[string]int{"someResource": 1}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The first rollback goes back to the previous revision.
+	event, err := store.Rollback(&id2.URL, params.StableChannel, "alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL, jc.DeepEquals, &id1.URL)
+	c.Assert(event.RolledBackFrom, jc.DeepEquals, &id2.URL)
+	c.Assert(event.User, gc.Equals, "alice")
+	s.assertStableEntity(c, store, id1, 1)
+
+	// A second rollback skips the revision that was rolled
+	// back from and restores the original resource revision.
+	event, err = store.Rollback(&id2.URL, params.StableChannel, "alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL, jc.DeepEquals, &id0.URL)
+	c.Assert(event.RolledBackFrom, jc.DeepEquals, &id1.URL)
+	s.assertStableEntity(c, store, id0, 0)
+
+	// There is nothing earlier to roll back to.
+	_, err = store.Rollback(&id2.URL, params.StableChannel, "alice")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `no earlier revision of "cs:~bob/wordpress" to roll back to in the stable channel`)
+	s.assertStableEntity(c, store, id0, 0)
+
+	// Publishing again makes the rolled back revisions
+	// current, so they can be rolled back to once more.
+	err = store.Publish(id2, map[string]int{"someResource": 1}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	event, err = store.Rollback(&id2.URL, params.StableChannel, "")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL, jc.DeepEquals, &id0.URL)
+}
+
+func (s *historySuite) TestRollbackSeries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	ids := make([]*router.ResolvedURL, 4)
+	for i, id := range []string{
+		"cs:~bob/precise/wordpress-0",
+		"cs:~bob/trusty/wordpress-1",
+		"cs:~bob/precise/wordpress-2",
+		"cs:~bob/trusty/wordpress-3",
+	} {
+		ids[i] = MustParseResolvedURL(id)
+		err := store.AddCharmWithArchive(ids[i], storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(ids[i], nil, params.StableChannel)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// The rollback goes back to the previous trusty revision,
+	// leaving the current precise revision alone.
+	event, err := store.Rollback(charm.MustParseURL("cs:~bob/wordpress"), params.StableChannel, "")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL, jc.DeepEquals, &ids[1].URL)
+	c.Assert(event.RolledBackFrom, jc.DeepEquals, &ids[3].URL)
+	entity, err := store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		"precise": &ids[2].URL,
+		"trusty":  &ids[1].URL,
+	})
+
+	// There is no earlier trusty revision to roll back to.
+	_, err = store.Rollback(charm.MustParseURL("cs:~bob/wordpress"), params.StableChannel, "")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *historySuite) TestRollbackErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.Rollback(&id0.URL, params.StableChannel, "")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/wordpress" has not been published to the stable channel`)
+
+	err = store.Publish(id0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.Rollback(&id0.URL, params.StableChannel, "")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.Rollback(&id0.URL, params.UnpublishedChannel, "")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `invalid channel "unpublished"`)
+}
+
+func (s *historySuite) TestTransferMovesHistory(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, id := range []string{"cs:~bob/precise/wordpress-0", "cs:~bob/precise/wordpress-1"} {
+		rurl := MustParseResolvedURL(id)
+		err := store.AddCharmWithArchive(rurl, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(rurl, nil, params.StableChannel)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.TransferBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	events, err := store.ChannelHistory(charm.MustParseURL("cs:~bob/wordpress"), params.NoChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 0)
+	event, err := store.Rollback(charm.MustParseURL("cs:~alice/wordpress"), params.StableChannel, "")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL.String(), gc.Equals, "cs:~alice/precise/wordpress-0")
+	c.Assert(event.RolledBackFrom.String(), gc.Equals, "cs:~alice/precise/wordpress-1")
+}
+
+func (s *historySuite) assertStableEntity(c *gc.C, store *Store, id *router.ResolvedURL, resourceRev int) {
+	be, err := store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelEntities[params.StableChannel]["precise"], jc.DeepEquals, &id.URL)
+	c.Assert(be.ChannelResources[params.StableChannel], jc.DeepEquals, []mongodoc.ResourceRevision{{
+		Name:     "someResource",
+		Revision: resourceRev,
+	}})
+}
@@ -4,12 +4,14 @@
 package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
 
 import (
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/juju/utils/parallel"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
@@ -31,6 +33,7 @@ const (
 	migrationCandidateBetaChannels   mongodoc.MigrationName = "populate candidate and beta channel ACLs"
 	migrationRevisionsCollection     mongodoc.MigrationName = "populate revisions collection"
 	migrationBlobRefs                mongodoc.MigrationName = "populate blobref table"
+	migrationPublishHistory          mongodoc.MigrationName = "populate publish history"
 )
 
 // migrations holds all the migration functions that are executed in the order
@@ -87,6 +90,9 @@ var migrations = []migration{{
 }, {
 	name:    migrationBlobRefs,
 	migrate: migrateBlobRefs,
+}, {
+	name:    migrationPublishHistory,
+	migrate: migratePublishHistory,
 }}
 
 // migration holds a migration function with its corresponding name.
@@ -215,6 +221,61 @@ func migrateRevisionsCollection(db StoreDatabase) error {
 	return nil
 }
 
+// migratePublishHistory records a publish event for each entity that
+// is current in a channel of a base entity that has no publish history
+// in that channel, so that the entities published before the history
+// was recorded are included in the published changes. As the time that
+// such an entity was published is not known, its upload time is used.
+func migratePublishHistory(db StoreDatabase) error {
+	iter := db.BaseEntities().Find(nil).Select(bson.D{{"channelentities", 1}}).Iter()
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		for ch, entities := range baseEntity.ChannelEntities {
+			if ch == params.UnpublishedChannel {
+				continue
+			}
+			n, err := db.PublishHistory().Find(bson.D{{"baseurl", baseEntity.URL}, {"channel", ch}}).Count()
+			if err != nil {
+				return errgo.Notef(err, "cannot count publish history of %v", baseEntity.URL)
+			}
+			if n > 0 {
+				continue
+			}
+			// An entity may be current in the channel
+			// for several series.
+			series := make(map[charm.URL][]string)
+			for s, url := range entities {
+				series[*url] = append(series[*url], s)
+			}
+			for url, ss := range series {
+				url := url
+				var entity mongodoc.Entity
+				if err := db.Entities().FindId(&url).Select(bson.D{{"uploadtime", 1}}).One(&entity); err != nil {
+					if err == mgo.ErrNotFound {
+						continue
+					}
+					return errgo.Notef(err, "cannot get entity %v", &url)
+				}
+				sort.Strings(ss)
+				if err := db.PublishHistory().Insert(&mongodoc.PublishEvent{
+					Id:      bson.NewObjectId(),
+					BaseURL: baseEntity.URL,
+					URL:     &url,
+					Channel: ch,
+					Series:  ss,
+					Time:    entity.UploadTime,
+				}); err != nil {
+					return errgo.Notef(err, "cannot record publish history of %v", &url)
+				}
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "cannot iterate through base entities")
+	}
+	return nil
+}
+
 // blobRefDoc holds a mapping from blob hash to
 // backend blob name.
 // This is duplicated from internal/blobstore.
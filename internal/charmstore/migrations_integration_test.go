@@ -655,6 +655,18 @@ func (s *migrationsIntegrationSuite) TestMigrationFromDump(c *gc.C) {
 		}
 	}
 	c.Assert(revs, jc.DeepEquals, expectRevDocs)
+
+	// Check that the publish history has been populated
+	// for the entities published before it was recorded.
+	var events []*mongodoc.PublishEvent
+	err = store.DB.PublishHistory().Find(bson.D{{"url", charm.MustParseURL("cs:~charmers/allchans-0")}}).Sort("channel").All(&events)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 4)
+	for i, ch := range []params.Channel{params.BetaChannel, params.CandidateChannel, params.EdgeChannel, params.StableChannel} {
+		c.Assert(events[i].Channel, gc.Equals, ch)
+		c.Assert(events[i].BaseURL, jc.DeepEquals, charm.MustParseURL("cs:~charmers/allchans"))
+		c.Assert(events[i].Time.IsZero(), gc.Equals, false)
+	}
 }
 
 func checkAllEntityInvariants(c *gc.C, store *Store) {
@@ -0,0 +1,133 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// ErrPromotionDenied is the cause of the error returned by PublishAs
+// when the publish is not allowed by the base entity's promotion policy.
+var ErrPromotionDenied = errgo.Newf("promotion denied by policy")
+
+// Approve records the decision of approval.User on promoting the entity
+// with the given id to approval.Channel, replacing any earlier decision
+// by the same user for that channel. A channel without a track refers to
+// the default track of the base entity. If approval.Time is zero, the
+// current time is used.
+func (s *Store) Approve(id *router.ResolvedURL, approval mongodoc.Approval) error {
+	if !ValidChannel(approval.Channel) || approval.Channel == params.UnpublishedChannel {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", approval.Channel)
+	}
+	ch, err := s.resolveChannel(&id.URL, approval.Channel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	approval.Channel = ch
+	if approval.Time.IsZero() {
+		approval.Time = time.Now()
+	}
+	if err := s.UpdateEntity(id, bson.D{{"$pull", bson.D{{"approvals", bson.D{
+		{"channel", approval.Channel},
+		{"user", approval.User},
+	}}}}}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateEntity(id, bson.D{{"$push", bson.D{{"approvals", approval}}}}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// checkPromotion checks that the given user may publish the entity with
+// the given id to the given channels according to the promotion policy
+// of its base entity. An entity that has already been published to the
+// gated channel may be published to it again without further checks.
+func (s *Store) checkPromotion(id *router.ResolvedURL, user string, channels []params.Channel) error {
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("promotionpolicy", "defaulttrack"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	policy := baseEntity.PromotionPolicy
+	if policy == nil {
+		return nil
+	}
+	// The policy's channels are stored resolved, so
+	// only the channels being published to need resolving.
+	gated := policy.Channel
+	found := false
+	for _, c := range channels {
+		if ResolveChannel(c, baseEntity.DefaultTrack) == gated {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	entity, err := s.FindEntity(id, FieldSelector("baseurl", "published", "approvals"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.Published[gated] {
+		return nil
+	}
+	if policy.SourceChannel != params.NoChannel {
+		source := policy.SourceChannel
+		var event mongodoc.PublishEvent
+		err := s.DB.PublishHistory().Find(bson.D{
+			{"baseurl", entity.BaseURL},
+			{"channel", source},
+			{"url", &id.URL},
+		}).Sort("time").One(&event)
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, ErrPromotionDenied, "%q has not been published to the %s channel", &id.URL, source)
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot get publish history for %q", &id.URL)
+		}
+		if soak := time.Since(event.Time); soak < policy.MinSoak {
+			return errgo.WithCausef(nil, ErrPromotionDenied, "%q has been in the %s channel for %v but %v is required", &id.URL, source, soak-soak%time.Second, policy.MinSoak)
+		}
+	}
+	approvals := 0
+	for _, a := range entity.Approvals {
+		if a.Channel != gated {
+			continue
+		}
+		if a.Rejected {
+			return errgo.WithCausef(nil, ErrPromotionDenied, "promotion of %q to the %s channel rejected by %s", &id.URL, gated, a.User)
+		}
+		// The publisher cannot approve their own promotion.
+		if a.User != user {
+			approvals++
+		}
+	}
+	if approvals < policy.RequiredApprovals {
+		return errgo.WithCausef(nil, ErrPromotionDenied, "%q has %d of %d required approvals for the %s channel", &id.URL, approvals, policy.RequiredApprovals, gated)
+	}
+	return nil
+}
+
+// ClearApprovals removes the decisions recorded with Approve for all the
+// entities with the same base entity as id. It is used when a change to
+// the promotion policy means that they may no longer be valid.
+func (s *Store) ClearApprovals(id *charm.URL) error {
+	if _, err := s.DB.Entities().UpdateAll(
+		bson.D{{"baseurl", mongodoc.BaseURL(id)}, {"approvals", bson.D{{"$exists", true}}}},
+		bson.D{{"$unset", bson.D{{"approvals", nil}}}},
+	); err != nil {
+		return errgo.Notef(err, "cannot clear approvals for %q", mongodoc.BaseURL(id))
+	}
+	return nil
+}
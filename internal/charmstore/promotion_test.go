@@ -0,0 +1,171 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type promotionSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&promotionSuite{})
+
+func (s *promotionSuite) addGatedCharm(c *gc.C, store *Store, policy *mongodoc.PromotionPolicy) *router.ResolvedURL {
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"promotionpolicy", policy}}}})
+	c.Assert(err, gc.Equals, nil)
+	return id
+}
+
+func (s *promotionSuite) TestSourceChannelAndSoak(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := s.addGatedCharm(c, store, &mongodoc.PromotionPolicy{
+		Channel:       params.StableChannel,
+		SourceChannel: params.CandidateChannel,
+		MinSoak:       48 * time.Hour,
+	})
+
+	// Channels other than the gated one are not restricted.
+	err := store.PublishAs("bob", id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPromotionDenied)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/precise/wordpress-0" has not been published to the candidate channel`)
+
+	err = store.PublishAs("bob", id, nil, params.CandidateChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPromotionDenied)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/precise/wordpress-0" has been in the candidate channel for .* but 48h0m0s is required`)
+
+	// Pretend that the entity was published to candidate three days ago.
+	err = store.DB.PublishHistory().Update(bson.D{
+		{"url", &id.URL},
+		{"channel", params.CandidateChannel},
+	}, bson.D{{"$set", bson.D{{"time", time.Now().Add(-72 * time.Hour)}}}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published[params.StableChannel], gc.Equals, true)
+}
+
+func (s *promotionSuite) TestApprovals(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := s.addGatedCharm(c, store, &mongodoc.PromotionPolicy{
+		Channel:           params.StableChannel,
+		RequiredApprovals: 2,
+	})
+
+	err := store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/precise/wordpress-0" has 0 of 2 required approvals for the stable channel`)
+
+	// Approvals by the publisher do not count.
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "bob"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "alice"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/precise/wordpress-0" has 1 of 2 required approvals for the stable channel`)
+
+	// A rejection blocks the promotion regardless of approvals.
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "carol", Rejected: true, Comment: "broken"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("alice", id, nil, params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPromotionDenied)
+	c.Assert(err, gc.ErrorMatches, `promotion of "cs:~bob/precise/wordpress-0" to the stable channel rejected by carol`)
+
+	// A later decision replaces an earlier one by the same user.
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "carol"})
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Approvals, gc.HasLen, 3)
+	for _, a := range e.Approvals {
+		c.Assert(a.Rejected, gc.Equals, false)
+		c.Assert(a.Time.IsZero(), gc.Equals, false)
+	}
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// Once published to the gated channel, the entity
+	// can be published there again.
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"promotionpolicy.requiredapprovals", 5}}}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *promotionSuite) TestPolicyInTrack(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := s.addGatedCharm(c, store, &mongodoc.PromotionPolicy{
+		Channel:           "2/stable",
+		RequiredApprovals: 1,
+	})
+
+	// The stable channel of the latest track is not gated.
+	err := store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", id, nil, "2/stable")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPromotionDenied)
+
+	// When the track is the default, approvals
+	// without a track apply to it.
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"defaulttrack", "2"}}}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "alice"})
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Approvals, jc.DeepEquals, []mongodoc.Approval{{
+		Channel: "2/stable",
+		User:    "alice",
+		Time:    e.Approvals[0].Time,
+	}})
+	err = store.PublishAs("bob", id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *promotionSuite) TestRollbackIgnoresPolicy(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.UpdateBaseEntity(id0, bson.D{{"$set", bson.D{{"promotionpolicy", &mongodoc.PromotionPolicy{
+		Channel:           params.StableChannel,
+		RequiredApprovals: 1,
+	}}}}})
+	c.Assert(err, gc.Equals, nil)
+	event, err := store.Rollback(&id1.URL, params.StableChannel, "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.URL, jc.DeepEquals, &id0.URL)
+}
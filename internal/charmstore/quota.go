@@ -0,0 +1,138 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"regexp"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// QuotaUsage holds the storage used by a user's namespace.
+type QuotaUsage struct {
+	// Bytes holds the total size of all the entity
+	// archives and resources in the namespace.
+	Bytes int64
+
+	// Entities holds the number of entities in the namespace.
+	Entities int
+}
+
+// Quota returns the storage quota that applies to the given user. If
+// the user has no quota of their own, the quota set for params.Everyone
+// is returned. If there is no such quota either, a quota for the user
+// with no limits is returned.
+func (s *Store) Quota(user string) (*mongodoc.Quota, error) {
+	var quotas []mongodoc.Quota
+	err := s.DB.Quotas().Find(bson.D{{
+		"_id", bson.D{{"$in", []string{user, params.Everyone}}},
+	}}).All(&quotas)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get quota for %q", user)
+	}
+	quota := &mongodoc.Quota{
+		User: user,
+	}
+	for i := range quotas {
+		if quotas[i].User == user {
+			return &quotas[i], nil
+		}
+		quota = &quotas[i]
+	}
+	return quota, nil
+}
+
+// SetQuota sets the storage quota for the user named in q. If
+// the quota has no limits, any existing quota for the user is
+// removed so that the quota for params.Everyone applies again.
+func (s *Store) SetQuota(q *mongodoc.Quota) error {
+	if q.User == "" {
+		return errgo.New("no user specified for quota")
+	}
+	if q.MaxBytes < 0 || q.MaxEntities < 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "negative quota limit")
+	}
+	if q.MaxBytes == 0 && q.MaxEntities == 0 {
+		if err := s.DB.Quotas().RemoveId(q.User); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove quota for %q", q.User)
+		}
+		return nil
+	}
+	if _, err := s.DB.Quotas().UpsertId(q.User, q); err != nil {
+		return errgo.Notef(err, "cannot set quota for %q", q.User)
+	}
+	return nil
+}
+
+// QuotaUsage returns the storage currently used by the
+// given user's namespace.
+func (s *Store) QuotaUsage(user string) (QuotaUsage, error) {
+	var usage QuotaUsage
+	var total struct {
+		Count int
+		Size  int64
+	}
+	err := s.DB.Entities().Pipe([]bson.D{
+		{{"$match", bson.D{{"user", user}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}}},
+	}).One(&total)
+	if err != nil && err != mgo.ErrNotFound {
+		return QuotaUsage{}, errgo.Notef(err, "cannot get entity usage for %q", user)
+	}
+	usage.Entities = total.Count
+	usage.Bytes = total.Size
+
+	total.Size = 0
+	err = s.DB.Resources().Pipe([]bson.D{
+		{{"$match", bson.D{{
+			"baseurl", bson.D{{"$regex", "^cs:~" + regexp.QuoteMeta(user) + "/"}},
+		}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}}},
+	}).One(&total)
+	if err != nil && err != mgo.ErrNotFound {
+		return QuotaUsage{}, errgo.Notef(err, "cannot get resource usage for %q", user)
+	}
+	usage.Bytes += total.Size
+	return usage, nil
+}
+
+// checkQuota checks that adding the given number of bytes and entities
+// to the given user's namespace would not exceed its quota. If it
+// would, it returns an error with a router.ErrQuotaExceeded cause.
+//
+// Note that concurrent uploads to the same namespace may take
+// it slightly over quota.
+func (s *Store) checkQuota(user string, bytes int64, entities int) error {
+	quota, err := s.Quota(user)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if quota.MaxBytes == 0 && quota.MaxEntities == 0 {
+		return nil
+	}
+	usage, err := s.QuotaUsage(user)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if quota.MaxEntities > 0 && entities > 0 && usage.Entities+entities > quota.MaxEntities {
+		return errgo.WithCausef(nil, router.ErrQuotaExceeded, "entity quota exceeded for user %q (limit %d entities)", user, quota.MaxEntities)
+	}
+	if quota.MaxBytes > 0 && usage.Bytes+bytes > quota.MaxBytes {
+		return errgo.WithCausef(nil, router.ErrQuotaExceeded, "storage quota exceeded for user %q (limit %d bytes)", user, quota.MaxBytes)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type quotaSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&quotaSuite{})
+
+func (s *quotaSuite) TestQuotaDefaults(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// With no quotas set, there are no limits.
+	q, err := store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{User: "bob"})
+
+	// The quota for everyone applies to all users
+	// without their own quota.
+	err = store.SetQuota(&mongodoc.Quota{
+		User:     params.Everyone,
+		MaxBytes: 1000,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetQuota(&mongodoc.Quota{
+		User:        "alice",
+		MaxEntities: 5,
+	})
+	c.Assert(err, gc.Equals, nil)
+	q, err = store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{
+		User:     params.Everyone,
+		MaxBytes: 1000,
+	})
+	q, err = store.Quota("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{
+		User:        "alice",
+		MaxEntities: 5,
+	})
+
+	// Setting a quota with no limits removes it.
+	err = store.SetQuota(&mongodoc.Quota{
+		User: "alice",
+	})
+	c.Assert(err, gc.Equals, nil)
+	q, err = store.Quota("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q, jc.DeepEquals, &mongodoc.Quota{
+		User:     params.Everyone,
+		MaxBytes: 1000,
+	})
+}
+
+func (s *quotaSuite) TestSetQuotaNegative(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetQuota(&mongodoc.Quota{
+		User:     "bob",
+		MaxBytes: -1,
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *quotaSuite) TestQuotaUsage(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	usage, err := store.QuotaUsage("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(usage, gc.Equals, QuotaUsage{})
+
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	id3 := MustParseResolvedURL("cs:~bobby/precise/wordpress-0")
+	err = store.AddCharmWithArchive(id3, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id1, "someResource", "resource content")
+
+	e1, err := store.FindEntity(id1, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+	e2, err := store.FindEntity(id2, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+	usage, err = store.QuotaUsage("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(usage, gc.Equals, QuotaUsage{
+		Entities: 2,
+		Bytes:    e1.Size + e2.Size + int64(len("resource content")),
+	})
+}
+
+func (s *quotaSuite) TestUploadEntityOverEntityQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetQuota(&mongodoc.Quota{
+		User:        "bob",
+		MaxEntities: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-1"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.ErrorMatches, `entity quota exceeded for user "bob" \(limit 1 entities\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+
+	// Other users are not affected.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~alice/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *quotaSuite) TestUploadEntityOverStorageQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetQuota(&mongodoc.Quota{
+		User:     params.Everyone,
+		MaxBytes: 10,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.ErrorMatches, `storage quota exceeded for user "bob" \(limit 10 bytes\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+}
+
+func (s *quotaSuite) TestUploadResourceOverQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(id, FieldSelector("size"))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetQuota(&mongodoc.Quota{
+		User:     "bob",
+		MaxBytes: e.Size + 5,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	blob := "12345"
+	_, err = store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+
+	blob = "x"
+	_, err = store.UploadResource(id, "someResource", strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+
+	uid := putMultipart(c, store.BlobStore, time.Time{}, "123456789 123456789 ", "abcdefghijklmnopqrstuvwyz")
+	_, err = store.AddResourceWithUploadId(id, "someResource", uid)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+}
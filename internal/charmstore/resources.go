@@ -57,6 +57,7 @@ func (sorted resourcesByName) Less(i, j int) bool {
 // given id. If the unpublished channel is specified then set is
 // composed of the latest revision for each resource. Otherwise it holds
 // the revisions declared when the charm/channel pair was published.
+// The channel must already have been resolved with ResolveChannel.
 func (s *Store) ListResources(id *router.ResolvedURL, channel params.Channel) ([]*mongodoc.Resource, error) {
 	if channel == params.NoChannel {
 		return nil, errgo.Newf("no channel specified")
@@ -139,6 +140,9 @@ func mapRevisions(resourceRevisions []mongodoc.ResourceRevision) map[string]int
 // the given name to the entity with the given id. The revision of the new resource
 // will be calculated to be one higher than any existing resources.
 //
+// If the resource would take the charm owner's namespace over its
+// quota, an error with a router.ErrQuotaExceeded cause is returned.
+//
 // TODO consider restricting uploads so that if the hash matches the
 // latest revision then a new revision isn't created. This would match
 // the behaviour for charms and bundles.
@@ -150,6 +154,9 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, blob io.Read
 	if !charmHasResource(entity.CharmMeta, name) {
 		return nil, errgo.Newf("charm does not have resource %q", name)
 	}
+	if err := s.checkQuota(entity.BaseURL.User, size, 0); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
 	if _, err := s.putArchive(blob, size, blobHash); err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -189,6 +196,9 @@ func (s *Store) AddResourceWithUploadId(id *router.ResolvedURL, name string, upl
 	if !ok {
 		return nil, errgo.Newf("upload not completed yet")
 	}
+	if err := s.checkQuota(entity.BaseURL.User, size, 0); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
 	res, err := s.addResource(&mongodoc.Resource{
 		BaseURL:    entity.BaseURL,
 		Name:       name,
@@ -262,7 +272,8 @@ func (s *Store) nextResourceRevision(baseURL *charm.URL, name string) (int, erro
 // cannot be found an error with the cause params.ErrNotFound will be
 // returned.
 // If revision is negative, the most recently published revision
-// for the given channel will be returned.
+// for the given channel will be returned. The channel must already
+// have been resolved with ResolveChannel.
 func (s *Store) ResolveResource(url *router.ResolvedURL, name string, revision int, channel params.Channel) (*mongodoc.Resource, error) {
 	if channel == params.NoChannel {
 		channel = params.StableChannel
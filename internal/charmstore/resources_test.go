@@ -306,7 +306,7 @@ func putMultipart(c *gc.C, bs *blobstore.Store, expires time.Time, contents ...s
 	if expires.IsZero() {
 		expires = time.Now().Add(time.Minute)
 	}
-	id, err := bs.NewUpload(expires)
+	id, err := bs.NewUpload(expires, "")
 	c.Assert(err, gc.Equals, nil)
 
 	parts := make([]blobstore.Part, len(contents))
@@ -0,0 +1,192 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// GlobalRetentionPolicy returns the retention policy that applies to
+// base entities without a policy of their own. It returns nil if no
+// global policy has been configured.
+func (s *Store) GlobalRetentionPolicy() *mongodoc.RetentionPolicy {
+	config := s.pool.config
+	policy := &mongodoc.RetentionPolicy{
+		KeepUnpublished: config.RetentionKeepUnpublished,
+		KeepPublished:   config.RetentionKeepPublished,
+		KeepYoungerThan: config.RetentionKeepYoungerThan,
+	}
+	if *policy == (mongodoc.RetentionPolicy{}) {
+		return nil
+	}
+	return policy
+}
+
+// RevisionsToPrune returns the ids of all the entities that would be
+// pruned at the given time by applying the retention policy of each
+// base entity. The given global policy is used for base entities that
+// do not have a policy of their own; it may be nil.
+func (s *Store) RevisionsToPrune(global *mongodoc.RetentionPolicy, now time.Time) ([]*charm.URL, error) {
+	var ids []*charm.URL
+	iter := s.DB.BaseEntities().Find(nil).Select(FieldSelector("channelentities", "retentionpolicy")).Sort("_id").Iter()
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		policy := baseEntity.RetentionPolicy
+		if policy == nil {
+			policy = global
+		}
+		if policy == nil || (policy.KeepUnpublished == 0 && policy.KeepYoungerThan == 0) {
+			baseEntity = mongodoc.BaseEntity{}
+			continue
+		}
+		var entities []*mongodoc.Entity
+		if err := s.DB.Entities().Find(bson.D{{"baseurl", baseEntity.URL}}).
+			Select(FieldSelector("uploadtime", "published")).
+			Sort("-uploadtime", "-_id").
+			All(&entities); err != nil {
+			iter.Close()
+			return nil, errgo.Notef(err, "cannot get entities for %q", baseEntity.URL)
+		}
+		ids = append(ids, prunableEntities(&baseEntity, entities, policy, now)...)
+		baseEntity = mongodoc.BaseEntity{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate base entities")
+	}
+	return ids, nil
+}
+
+// prunableEntities returns the ids of the given entities that policy
+// allows to be pruned. The entities must all belong to baseEntity and
+// be sorted by upload time, newest first.
+func prunableEntities(baseEntity *mongodoc.BaseEntity, entities []*mongodoc.Entity, policy *mongodoc.RetentionPolicy, now time.Time) []*charm.URL {
+	current := make(map[charm.URL]bool)
+	for _, ids := range baseEntity.ChannelEntities {
+		for _, id := range ids {
+			current[*id] = true
+		}
+	}
+	var ids []*charm.URL
+	// rank holds the rank of each unpublished revision; published
+	// revisions do not count towards KeepUnpublished.
+	rank := 0
+	for i, e := range entities {
+		if current[*e.URL] {
+			continue
+		}
+		published := isPublished(e)
+		if !published {
+			rank++
+		}
+		switch {
+		case i == 0:
+			// Always keep the latest revision so that the
+			// base entity is never left empty.
+		case !published && policy.KeepUnpublished > 0 && rank <= policy.KeepUnpublished:
+		case policy.KeepPublished && published:
+		case policy.KeepYoungerThan > 0 && now.Sub(e.UploadTime) < policy.KeepYoungerThan:
+		default:
+			ids = append(ids, e.URL)
+		}
+	}
+	return ids
+}
+
+// isPublished reports whether e has ever been published to a channel.
+func isPublished(e *mongodoc.Entity) bool {
+	for ch, published := range e.Published {
+		if published && ch != params.UnpublishedChannel {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneRevisions deletes, with DeleteEntity, all the entities returned
+// by RevisionsToPrune for the configured global retention policy. An
+// entity that cannot be deleted because it has been published or
+// deleted in the meantime is ignored. It returns the number of
+// entities deleted.
+func (s *Store) PruneRevisions(now time.Time) (int, error) {
+	ids, err := s.RevisionsToPrune(s.GlobalRetentionPolicy(), now)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	n := 0
+	for _, id := range ids {
+		err := s.DeleteEntity(&router.ResolvedURL{URL: *id, PromulgatedRevision: -1})
+		if err != nil {
+			if cause := errgo.Cause(err); cause == params.ErrForbidden || cause == params.ErrNotFound {
+				logger.Infof("not pruning %v: %v", id, err)
+				continue
+			}
+			return n, errgo.Notef(err, "cannot prune %v", id)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// revisionPruner implements the worker that periodically prunes old
+// revisions according to their retention policies.
+type revisionPruner struct {
+	tomb     tomb.Tomb
+	pool     *Pool
+	interval time.Duration
+}
+
+// newRevisionPruner returns a new running revision pruner worker that
+// prunes revisions at the given interval.
+func newRevisionPruner(pool *Pool, interval time.Duration) *revisionPruner {
+	p := &revisionPruner{
+		pool:     pool,
+		interval: interval,
+	}
+	p.tomb.Go(p.run)
+	return p
+}
+
+// Kill implements worker.Worker.Kill.
+func (p *revisionPruner) Kill() {
+	p.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (p *revisionPruner) Wait() error {
+	return p.tomb.Wait()
+}
+
+func (p *revisionPruner) run() error {
+	for {
+		if err := p.doPrune(); err != nil {
+			logger.Errorf("%v", err)
+		}
+		select {
+		case <-p.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+func (p *revisionPruner) doPrune() error {
+	store := p.pool.Store()
+	defer store.Close()
+	logger.Infof("starting revision pruning")
+	n, err := store.PruneRevisions(time.Now())
+	if err != nil {
+		return errgo.Notef(err, "revision pruning failed")
+	}
+	logger.Infof("completed revision pruning: %d revisions deleted", n)
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"fmt"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type retentionSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&retentionSuite{})
+
+var retentionEpoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var prunableEntitiesTests = []struct {
+	about   string
+	policy  mongodoc.RetentionPolicy
+	now     time.Time
+	current []string
+	expect  []string
+}{{
+	about:  "keep unpublished",
+	policy: mongodoc.RetentionPolicy{KeepUnpublished: 2},
+	expect: []string{"cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-2", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:   "current revisions are always kept",
+	policy:  mongodoc.RetentionPolicy{KeepUnpublished: 1},
+	current: []string{"cs:~bob/precise/wordpress-5", "cs:~bob/precise/wordpress-1"},
+	expect:  []string{"cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-2", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "keep published",
+	policy: mongodoc.RetentionPolicy{KeepUnpublished: 1, KeepPublished: true},
+	expect: []string{"cs:~bob/precise/wordpress-4", "cs:~bob/precise/wordpress-2", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "keep younger than",
+	policy: mongodoc.RetentionPolicy{KeepYoungerThan: 3 * time.Hour},
+	now:    retentionEpoch.Add(6 * time.Hour),
+	expect: []string{"cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-2", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "keep younger than or unpublished",
+	policy: mongodoc.RetentionPolicy{KeepUnpublished: 3, KeepYoungerThan: 2 * time.Hour},
+	now:    retentionEpoch.Add(6 * time.Hour),
+	expect: []string{"cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "published revisions do not count as unpublished",
+	policy: mongodoc.RetentionPolicy{KeepUnpublished: 3},
+	expect: []string{"cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "published revisions kept alongside unpublished ones",
+	policy: mongodoc.RetentionPolicy{KeepUnpublished: 3, KeepPublished: true},
+	expect: []string{"cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}, {
+	about:  "latest revision is always kept",
+	policy: mongodoc.RetentionPolicy{KeepYoungerThan: time.Hour},
+	now:    retentionEpoch.Add(24 * time.Hour),
+	expect: []string{"cs:~bob/precise/wordpress-4", "cs:~bob/precise/wordpress-3", "cs:~bob/precise/wordpress-2", "cs:~bob/precise/wordpress-1", "cs:~bob/precise/wordpress-0"},
+}}
+
+func (s *retentionSuite) TestPrunableEntities(c *gc.C) {
+	// Revision n was uploaded n hours after the epoch; revision
+	// 3 has been published to the edge channel.
+	var entities []*mongodoc.Entity
+	for rev := 5; rev >= 0; rev-- {
+		e := &mongodoc.Entity{
+			URL:        charm.MustParseURL("cs:~bob/precise/wordpress").WithRevision(rev),
+			UploadTime: retentionEpoch.Add(time.Duration(rev) * time.Hour),
+		}
+		if rev == 3 {
+			e.Published = map[params.Channel]bool{
+				params.EdgeChannel: true,
+			}
+		}
+		entities = append(entities, e)
+	}
+	for i, test := range prunableEntitiesTests {
+		c.Logf("test %d: %s", i, test.about)
+		be := &mongodoc.BaseEntity{
+			URL: charm.MustParseURL("cs:~bob/wordpress"),
+			ChannelEntities: map[params.Channel]map[string]*charm.URL{
+				params.StableChannel: {},
+			},
+		}
+		for i, id := range test.current {
+			be.ChannelEntities[params.StableChannel][fmt.Sprintf("series%d", i)] = charm.MustParseURL(id)
+		}
+		var expect []*charm.URL
+		for _, id := range test.expect {
+			expect = append(expect, charm.MustParseURL(id))
+		}
+		c.Assert(prunableEntities(be, entities, &test.policy, test.now), jc.DeepEquals, expect)
+	}
+}
+
+func (s *retentionSuite) TestRevisionsToPrune(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{
+		"cs:~bob/precise/wordpress-0",
+		"cs:~bob/precise/wordpress-1",
+		"cs:~bob/precise/wordpress-2",
+		"cs:~alice/precise/mysql-0",
+		"cs:~alice/precise/mysql-1",
+	} {
+		url := MustParseResolvedURL(id)
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.DB.Entities().UpdateId(&url.URL, bson.D{{
+			"$set", bson.D{{"uploadtime", retentionEpoch.Add(time.Duration(url.URL.Revision) * time.Hour)}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// With no policy, nothing is pruned.
+	ids, err := store.RevisionsToPrune(nil, retentionEpoch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, gc.HasLen, 0)
+
+	// The global policy applies to both base entities.
+	ids, err = store.RevisionsToPrune(&mongodoc.RetentionPolicy{KeepUnpublished: 1}, retentionEpoch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~alice/precise/mysql-0"),
+		charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+	})
+
+	// A base entity's own policy overrides the global policy.
+	err = store.UpdateBaseEntity(MustParseResolvedURL("cs:~alice/precise/mysql-0"), bson.D{{
+		"$set", bson.D{{"retentionpolicy", &mongodoc.RetentionPolicy{}}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateBaseEntity(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), bson.D{{
+		"$set", bson.D{{"retentionpolicy", &mongodoc.RetentionPolicy{KeepYoungerThan: 90 * time.Minute}}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	ids, err = store.RevisionsToPrune(&mongodoc.RetentionPolicy{KeepUnpublished: 1}, retentionEpoch.Add(2*time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+	})
+}
+
+func (s *retentionSuite) TestPruneRevisions(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		RetentionKeepUnpublished: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	c.Assert(store.GlobalRetentionPolicy(), jc.DeepEquals, &mongodoc.RetentionPolicy{
+		KeepUnpublished: 1,
+	})
+	for rev := 0; rev < 4; rev++ {
+		url := MustParseResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", rev))
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err = store.Publish(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.PruneRevisions(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 2)
+
+	// The pruned revisions have been deleted with DeleteEntity,
+	// so they can still be restored.
+	for _, rev := range []int{1, 2} {
+		_, err := store.FindEntity(MustParseResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", rev)), nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	for _, rev := range []int{0, 3} {
+		_, err := store.FindEntity(MustParseResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", rev)), nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+	_, err = store.RestoreEntity(charm.MustParseURL("cs:~bob/precise/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// scheduledPublishClaimTimeout holds how long a scheduled publish may
+// remain claimed by a server before another server may claim it. This
+// allows scheduled publishes to be made even when the server that
+// claimed one stopped before making it.
+const scheduledPublishClaimTimeout = 10 * time.Minute
+
+// SchedulePublish records that the entity with the given id is to be
+// published with the given resources to the given channels at the given
+// time, as if by PublishAs with the given user. The channels are
+// resolved, and the promotion policy checked, only when the entity is
+// published.
+//
+// If the time is not in the future, an error with a params.ErrBadRequest
+// cause is returned. If the given resources do not match those expected
+// or they're not found, an error with a ErrPublishResourceMismatch cause
+// is returned.
+func (s *Store) SchedulePublish(id *router.ResolvedURL, resources map[string]int, channels []params.Channel, t time.Time, user string) (*mongodoc.ScheduledPublish, error) {
+	if len(channels) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no channels provided")
+	}
+	for _, c := range channels {
+		if !ValidChannel(c) || c == params.UnpublishedChannel {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", c)
+		}
+	}
+	if !t.After(time.Now()) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "scheduled time %v is not in the future", t)
+	}
+	entity, err := s.FindEntity(id, FieldSelector("baseurl", "charmmeta"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.checkPublishedResources(entity, resources); err != nil {
+		return nil, errgo.WithCausef(err, ErrPublishResourceMismatch, "")
+	}
+	resourceDocs := make([]mongodoc.ResourceRevision, 0, len(resources))
+	for name, rev := range resources {
+		resourceDocs = append(resourceDocs, mongodoc.ResourceRevision{
+			Name:     name,
+			Revision: rev,
+		})
+	}
+	sort.Sort(resourceRevisionsByName(resourceDocs))
+	sp := &mongodoc.ScheduledPublish{
+		Id:        bson.NewObjectId(),
+		BaseURL:   entity.BaseURL,
+		URL:       entity.URL,
+		Channels:  channels,
+		Resources: resourceDocs,
+		User:      user,
+		Time:      t,
+		Status:    mongodoc.ScheduledPublishPending,
+	}
+	if err := s.DB.ScheduledPublishes().Insert(sp); err != nil {
+		return nil, errgo.Notef(err, "cannot schedule publish of %q", id)
+	}
+	return sp, nil
+}
+
+// ScheduledPublishes returns the scheduled publishes of the entity with
+// the given id that have not yet been made, including those that
+// failed, in order of their scheduled time.
+func (s *Store) ScheduledPublishes(id *charm.URL) ([]*mongodoc.ScheduledPublish, error) {
+	var sps []*mongodoc.ScheduledPublish
+	if err := s.DB.ScheduledPublishes().Find(bson.D{{"url", id}}).Sort("time", "_id").All(&sps); err != nil {
+		return nil, errgo.Notef(err, "cannot get scheduled publishes of %q", id)
+	}
+	return sps, nil
+}
+
+// FindScheduledPublish returns the scheduled publish with the given id.
+// If there is no such scheduled publish, an error with an ErrNotFound
+// cause is returned.
+func (s *Store) FindScheduledPublish(scheduleId string) (*mongodoc.ScheduledPublish, error) {
+	if !bson.IsObjectIdHex(scheduleId) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "scheduled publish %q not found", scheduleId)
+	}
+	var sp mongodoc.ScheduledPublish
+	if err := s.DB.ScheduledPublishes().FindId(bson.ObjectIdHex(scheduleId)).One(&sp); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "scheduled publish %q not found", scheduleId)
+		}
+		return nil, errgo.Notef(err, "cannot get scheduled publish %q", scheduleId)
+	}
+	return &sp, nil
+}
+
+// CancelScheduledPublish removes the scheduled publish with the given
+// id. A scheduled publish that is being made cannot be cancelled. If
+// there is no such scheduled publish that can be cancelled, an error
+// with an ErrNotFound cause is returned.
+func (s *Store) CancelScheduledPublish(scheduleId string) error {
+	if !bson.IsObjectIdHex(scheduleId) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publish %q not found", scheduleId)
+	}
+	err := s.DB.ScheduledPublishes().Remove(bson.D{
+		{"_id", bson.ObjectIdHex(scheduleId)},
+		{"status", bson.D{{"$ne", mongodoc.ScheduledPublishRunning}}},
+	})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publish %q not found", scheduleId)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot cancel scheduled publish %q", scheduleId)
+	}
+	return nil
+}
+
+// RunScheduledPublishes makes all the scheduled publishes that are due
+// at the given time. Each scheduled publish is claimed atomically
+// before it is made, so that it is made only once even when several
+// servers run scheduled publishes concurrently. Scheduled publishes
+// that are made are removed; those that fail are marked as failed and
+// are not retried. It returns the number of entities published.
+func (s *Store) RunScheduledPublishes(now time.Time) (int, error) {
+	n := 0
+	for {
+		sp, err := s.claimScheduledPublish(now)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		if sp == nil {
+			return n, nil
+		}
+		if err := s.runScheduledPublish(sp); err != nil {
+			logger.Errorf("scheduled publish %s of %v failed: %v", sp.Id.Hex(), sp.URL, err)
+			if err := s.DB.ScheduledPublishes().UpdateId(sp.Id, bson.D{{"$set", bson.D{
+				{"status", mongodoc.ScheduledPublishFailed},
+				{"error", err.Error()},
+			}}}); err != nil {
+				return n, errgo.Notef(err, "cannot update scheduled publish %s", sp.Id.Hex())
+			}
+			continue
+		}
+		if err := s.DB.ScheduledPublishes().RemoveId(sp.Id); err != nil {
+			return n, errgo.Notef(err, "cannot remove scheduled publish %s", sp.Id.Hex())
+		}
+		n++
+	}
+}
+
+// claimScheduledPublish claims the earliest scheduled publish that is
+// due at the given time and that no other server is making. It returns
+// nil if there is none.
+func (s *Store) claimScheduledPublish(now time.Time) (*mongodoc.ScheduledPublish, error) {
+	var sp mongodoc.ScheduledPublish
+	_, err := s.DB.ScheduledPublishes().Find(bson.D{
+		{"time", bson.D{{"$lte", now}}},
+		{"$or", []bson.D{{
+			{"status", mongodoc.ScheduledPublishPending},
+		}, {
+			{"status", mongodoc.ScheduledPublishRunning},
+			{"claimtime", bson.D{{"$lt", now.Add(-scheduledPublishClaimTimeout)}}},
+		}}},
+	}).Sort("time", "_id").Apply(mgo.Change{
+		Update: bson.D{{"$set", bson.D{
+			{"status", mongodoc.ScheduledPublishRunning},
+			{"claimtime", now},
+		}}},
+		ReturnNew: true,
+	}, &sp)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot claim scheduled publish")
+	}
+	return &sp, nil
+}
+
+// runScheduledPublish publishes the entity of the given scheduled
+// publish.
+func (s *Store) runScheduledPublish(sp *mongodoc.ScheduledPublish) error {
+	entity, err := s.FindEntity(&router.ResolvedURL{URL: *sp.URL, PromulgatedRevision: -1}, FieldSelector("promulgated-url"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resources := make(map[string]int, len(sp.Resources))
+	for _, r := range sp.Resources {
+		resources[r.Name] = r.Revision
+	}
+	return s.PublishAs(sp.User, EntityResolvedURL(entity), resources, sp.Channels...)
+}
+
+// transferScheduledPublishes moves the scheduled publishes of the base
+// URL from to the base URL to.
+func (s *Store) transferScheduledPublishes(from, to *charm.URL) error {
+	var sps []struct {
+		Id  bson.ObjectId `bson:"_id"`
+		URL *charm.URL
+	}
+	if err := s.DB.ScheduledPublishes().Find(bson.D{{"baseurl", from}}).Select(FieldSelector("url")).All(&sps); err != nil {
+		return errgo.Notef(err, "cannot get scheduled publishes for %q", from)
+	}
+	for _, sp := range sps {
+		if err := s.DB.ScheduledPublishes().UpdateId(sp.Id, bson.D{{"$set", bson.D{
+			{"baseurl", to},
+			{"url", transferURL(sp.URL, to)},
+		}}}); err != nil {
+			return errgo.Notef(err, "cannot transfer scheduled publishes")
+		}
+	}
+	return nil
+}
+
+// scheduledPublisher implements the worker that periodically makes
+// the scheduled publishes that are due.
+type scheduledPublisher struct {
+	tomb     tomb.Tomb
+	pool     *Pool
+	interval time.Duration
+}
+
+// newScheduledPublisher returns a new running scheduled publisher
+// worker that makes the scheduled publishes that are due at the given
+// interval.
+func newScheduledPublisher(pool *Pool, interval time.Duration) *scheduledPublisher {
+	p := &scheduledPublisher{
+		pool:     pool,
+		interval: interval,
+	}
+	p.tomb.Go(p.run)
+	return p
+}
+
+// Kill implements worker.Worker.Kill.
+func (p *scheduledPublisher) Kill() {
+	p.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (p *scheduledPublisher) Wait() error {
+	return p.tomb.Wait()
+}
+
+func (p *scheduledPublisher) run() error {
+	for {
+		if err := p.doPublish(); err != nil {
+			logger.Errorf("%v", err)
+		}
+		select {
+		case <-p.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+func (p *scheduledPublisher) doPublish() error {
+	store := p.pool.Store()
+	defer store.Close()
+	n, err := store.RunScheduledPublishes(time.Now())
+	if err != nil {
+		return errgo.Notef(err, "scheduled publishing failed")
+	}
+	if n > 0 {
+		logger.Infof("made %d scheduled publishes", n)
+	}
+	return nil
+}
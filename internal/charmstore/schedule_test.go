@@ -0,0 +1,225 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type scheduleSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&scheduleSuite{})
+
+func (s *scheduleSuite) TestSchedulePublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id, "someResource", "resource content")
+
+	now := time.Now()
+	sp, err := store.SchedulePublish(id, map[string]int{"someResource": 0}, []params.Channel{params.StableChannel}, now.Add(time.Hour), "bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sp.Status, gc.Equals, mongodoc.ScheduledPublishPending)
+
+	sps, err := store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sps, gc.HasLen, 1)
+	c.Assert(sps[0].Id, gc.Equals, sp.Id)
+	c.Assert(sps[0].Resources, jc.DeepEquals, []mongodoc.ResourceRevision{{Name: "someResource", Revision: 0}})
+
+	// Nothing is published before the scheduled time.
+	n, err := store.RunScheduledPublishes(now)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	e, err := store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published[params.StableChannel], gc.Equals, false)
+
+	n, err = store.RunScheduledPublishes(now.Add(2 * time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	e, err = store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Published[params.StableChannel], gc.Equals, true)
+	events, err := store.ChannelHistory(&id.URL, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, 1)
+	c.Assert(events[0].User, gc.Equals, "bob")
+	c.Assert(events[0].Resources, jc.DeepEquals, []mongodoc.ResourceRevision{{Name: "someResource", Revision: 0}})
+
+	// The scheduled publish is removed once it has been made.
+	sps, err = store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sps, gc.HasLen, 0)
+}
+
+func (s *scheduleSuite) TestSchedulePublishErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.SchedulePublish(id, nil, nil, time.Now(), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	_, err = store.SchedulePublish(id, nil, []params.Channel{params.UnpublishedChannel}, time.Now(), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	_, err = store.SchedulePublish(id, nil, []params.Channel{params.StableChannel}, time.Now().Add(-time.Minute), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	_, err = store.SchedulePublish(id, nil, []params.Channel{params.StableChannel}, time.Now().Add(time.Hour), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPublishResourceMismatch)
+	_, err = store.SchedulePublish(MustParseResolvedURL("cs:~bob/precise/wordpress-1"), nil, []params.Channel{params.StableChannel}, time.Now().Add(time.Hour), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *scheduleSuite) TestScheduledPublishFailure(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateBaseEntity(id, bson.D{{"$set", bson.D{{"promotionpolicy", &mongodoc.PromotionPolicy{
+		Channel:           params.StableChannel,
+		RequiredApprovals: 1,
+	}}}}})
+	c.Assert(err, gc.Equals, nil)
+
+	due := time.Now().Add(time.Minute)
+	_, err = store.SchedulePublish(id, nil, []params.Channel{params.StableChannel}, due, "bob")
+	c.Assert(err, gc.Equals, nil)
+	n, err := store.RunScheduledPublishes(due)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	sps, err := store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sps, gc.HasLen, 1)
+	c.Assert(sps[0].Status, gc.Equals, mongodoc.ScheduledPublishFailed)
+	c.Assert(sps[0].Error, gc.Equals, `"cs:~bob/precise/wordpress-0" has 0 of 1 required approvals for the stable channel`)
+
+	// Failed publishes are not retried but can be cancelled.
+	err = store.Approve(id, mongodoc.Approval{Channel: params.StableChannel, User: "alice"})
+	c.Assert(err, gc.Equals, nil)
+	n, err = store.RunScheduledPublishes(due.Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	err = store.CancelScheduledPublish(sps[0].Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	sps, err = store.ScheduledPublishes(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sps, gc.HasLen, 0)
+}
+
+func (s *scheduleSuite) TestCancelScheduledPublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	due := time.Now().Add(time.Minute)
+	sp, err := store.SchedulePublish(id, nil, []params.Channel{params.EdgeChannel}, due, "bob")
+	c.Assert(err, gc.Equals, nil)
+	sp1, err := store.FindScheduledPublish(sp.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sp1.URL, jc.DeepEquals, &id.URL)
+
+	err = store.CancelScheduledPublish(sp.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	n, err := store.RunScheduledPublishes(due)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	err = store.CancelScheduledPublish(sp.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.CancelScheduledPublish("bad-id")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindScheduledPublish(sp.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// A scheduled publish that is being made cannot be cancelled.
+	sp, err = store.SchedulePublish(id, nil, []params.Channel{params.EdgeChannel}, due, "bob")
+	c.Assert(err, gc.Equals, nil)
+	claimed, err := store.claimScheduledPublish(due)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(claimed.Id, gc.Equals, sp.Id)
+	c.Assert(claimed.Status, gc.Equals, mongodoc.ScheduledPublishRunning)
+	err = store.CancelScheduledPublish(sp.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *scheduleSuite) TestStaleClaimIsReclaimed(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	due := time.Now().Add(time.Minute)
+	_, err = store.SchedulePublish(id, nil, []params.Channel{params.EdgeChannel}, due, "bob")
+	c.Assert(err, gc.Equals, nil)
+	// Simulate a server that claimed the publish and then stopped.
+	_, err = store.claimScheduledPublish(due)
+	c.Assert(err, gc.Equals, nil)
+	n, err := store.RunScheduledPublishes(due.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.RunScheduledPublishes(due.Add(scheduledPublishClaimTimeout + time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *scheduleSuite) TestConcurrentRunsPublishOnce(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	const count = 10
+	due := time.Now().Add(time.Minute)
+	for i := 0; i < count; i++ {
+		id := MustParseResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", i))
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		_, err = store.SchedulePublish(id, nil, []params.Channel{params.EdgeChannel}, due, "bob")
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// Run the scheduled publishes from several stores at once,
+	// as several charm store servers would.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := store.Copy()
+			defer store.Close()
+			n, err := store.RunScheduledPublishes(due)
+			c.Check(err, gc.Equals, nil)
+			mu.Lock()
+			total += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	c.Assert(total, gc.Equals, count)
+	events, err := store.ChannelHistory(charm.MustParseURL("cs:~bob/wordpress"), params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(events, gc.HasLen, count)
+}
@@ -78,8 +78,8 @@ func (s *Store) UpdateSearchAsync(r *router.ResolvedURL) {
 
 // UpdateSearch updates the search record for the entity reference r. The
 // search index only includes the latest stable revision of each entity
-// so the latest stable revision of the charm specified by r will be
-// indexed.
+// in the default track of its base entity, so that revision of the charm
+// specified by r will be indexed.
 func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 	if s.ES == nil || s.ES.Database == nil {
 		return nil
@@ -97,7 +97,7 @@ func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot update search record for %q", &r.URL), errgo.Is(params.ErrNotFound))
 	}
 	series := r.URL.Series
-	entityURL := baseEntity.ChannelEntities[params.StableChannel][series]
+	entityURL := baseEntity.ChannelEntities[searchChannel(baseEntity)][series]
 	if entityURL == nil {
 		// There is no stable version of the entity to index.
 		return nil
@@ -123,7 +123,7 @@ func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
 	if err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot index %s", baseURL), errgo.Is(params.ErrNotFound))
 	}
-	stableEntities := baseEntity.ChannelEntities[params.StableChannel]
+	stableEntities := baseEntity.ChannelEntities[searchChannel(baseEntity)]
 	updated := make(map[string]bool, len(stableEntities))
 	for urlSeries, url := range stableEntities {
 		if !series.Series[urlSeries].SearchIndex {
@@ -141,6 +141,33 @@ func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
 			return errgo.Notef(err, "cannot update search record for %q", url)
 		}
 	}
+	if err := s.removeOtherTrackSearchRecords(baseEntity); err != nil {
+		return errgo.Notef(err, "cannot index %s", baseURL)
+	}
+	return nil
+}
+
+// removeOtherTrackSearchRecords removes any search records for the
+// stable entities in tracks other than the default track of baseEntity,
+// which are left behind when its default track changes.
+func (s *Store) removeOtherTrackSearchRecords(baseEntity *mongodoc.BaseEntity) error {
+	indexed := make(map[string]bool)
+	for _, id := range searchRecordIds(baseEntity) {
+		indexed[s.ES.getID(id)] = true
+	}
+	for ch := range baseEntity.ChannelEntities {
+		if _, risk, err := ParseChannel(ch); err != nil || risk != params.StableChannel || ch == searchChannel(baseEntity) {
+			continue
+		}
+		for _, id := range channelSearchRecordIds(baseEntity, ch) {
+			if indexed[s.ES.getID(id)] {
+				continue
+			}
+			if err := s.ES.delete(id); err != nil {
+				return errgo.Notef(err, "cannot remove search record for %q", id)
+			}
+		}
+	}
 	return nil
 }
 
@@ -149,6 +176,14 @@ func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if doc == nil {
+		// The entity must not be indexed, so remove any
+		// existing record for it.
+		if err := s.ES.deleteEntity(entity); err != nil {
+			return errgo.Notef(err, "cannot update search index")
+		}
+		return nil
+	}
 	if err := s.ES.update(doc); err != nil {
 		return errgo.Notef(err, "cannot update search index")
 	}
@@ -157,10 +192,14 @@ func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc
 
 // searchDocFromEntity performs the processing required to convert a
 // mongodoc.Entity and the corresponding mongodoc.BaseEntity to an esDoc
-// for indexing.
+// for indexing. It returns a nil document for deprecated and yanked
+// entities, which are not included in the search index.
 func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity) (*SearchDoc, error) {
+	if e.Deprecation != nil {
+		return nil, nil
+	}
 	doc := SearchDoc{Entity: e}
-	doc.ReadACLs = be.ChannelACLs[params.StableChannel].Read
+	doc.ReadACLs = ChannelACL(be, searchChannel(be)).Read
 	// There should only be one record for the promulgated entity, which
 	// should be the latest promulgated revision. In the case that the base
 	// entity is not promulgated assume that there is a later promulgated
@@ -225,6 +264,40 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 	return nil
 }
 
+// delete removes the search record for the entity with the given id
+// from elasticsearch if elasticsearch is configured. It is not an error
+// if there is no such record.
+func (si *SearchIndex) delete(id *charm.URL) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	err := si.DeleteDocument(si.Index, typeName, si.getID(id))
+	if err != nil && errgo.Cause(err) != elasticsearch.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// deleteEntity removes the search records for the given entity,
+// including those for each series supported by a multi-series
+// charm.
+func (si *SearchIndex) deleteEntity(e *mongodoc.Entity) error {
+	if err := si.delete(e.URL); err != nil {
+		return errgo.Mask(err)
+	}
+	if e.URL.Series != "" {
+		return nil
+	}
+	for _, series := range e.SupportedSeries {
+		u := *e.URL
+		u.Series = series
+		if err := si.delete(&u); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
 // getID returns an ID for the elasticsearch document based on the contents of the
 // mongoDB document. This is to allow elasticsearch documents to be replaced with
 // updated versions when charm data is changed.
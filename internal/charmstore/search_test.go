@@ -13,6 +13,7 @@ import (
 	gc "gopkg.in/check.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
@@ -239,6 +240,35 @@ func (s *StoreSearchSuite) TestNoExportDeprecated(c *gc.C) {
 	c.Assert(present, gc.Equals, false)
 }
 
+func (s *StoreSearchSuite) TestNoExportYankedOrDeprecatedEntity(c *gc.C) {
+	for _, state := range []mongodoc.DeprecationState{mongodoc.Deprecated, mongodoc.Yanked} {
+		c.Logf("state %s", state)
+		url := router.MustNewResolvedURL("cs:~openstack-charmers/xenial/mysql-7", 7)
+		err := s.store.UpdateEntity(url, bson.D{{
+			"$unset", bson.D{{"deprecation", nil}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.UpdateSearch(url)
+		c.Assert(err, gc.Equals, nil)
+		present, err := s.store.ES.HasDocument(s.TestIndex, typeName, s.store.ES.getID(&url.URL))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(present, gc.Equals, true)
+
+		err = s.store.UpdateEntity(url, bson.D{{
+			"$set", bson.D{{"deprecation", &mongodoc.Deprecation{
+				State:  state,
+				Reason: "broken",
+			}}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.UpdateSearch(url)
+		c.Assert(err, gc.Equals, nil)
+		present, err = s.store.ES.HasDocument(s.TestIndex, typeName, s.store.ES.getID(&url.URL))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(present, gc.Equals, false)
+	}
+}
+
 func (s *StoreSearchSuite) TestExportOnlyLatest(c *gc.C) {
 	charmArchive := storetesting.NewCharm(nil)
 	url := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-24", -1)
@@ -87,6 +87,10 @@ const reqStoreCacheSize = 50
 // of goroutines that will be started by Store.Go.
 const maxAsyncGoroutines = 50
 
+// defaultDeletedEntityRetention holds the default time
+// for which deleted entities are kept.
+const defaultDeletedEntityRetention = 30 * 24 * time.Hour
+
 // NewPool returns a Pool that uses the given database
 // and search index. If bakeryParams is not nil,
 // the Bakery field in the resulting Store will be set
@@ -98,6 +102,9 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if config.StatsCacheMaxAge == 0 {
 		config.StatsCacheMaxAge = time.Hour
 	}
+	if config.DeletedEntityRetention == 0 {
+		config.DeletedEntityRetention = defaultDeletedEntityRetention
+	}
 	if config.NewBlobBackend == nil {
 		config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
 			return blobstore.NewMongoBackend(db, "entitystore")
@@ -414,6 +421,53 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Revisions(),
 		mgo.Index{Key: []string{"baseurl"}},
+	}, {
+		s.DB.PublishHistory(),
+		mgo.Index{Key: []string{"baseurl", "channel", "-time"}},
+	}, {
+		s.DB.PublishHistory(),
+		mgo.Index{Key: []string{"time", "_id"}},
+	}, {
+		s.DB.PublishHistory(),
+		mgo.Index{Key: []string{"channel", "time", "_id"}},
+	}, {
+		s.DB.ScheduledPublishes(),
+		mgo.Index{Key: []string{"status", "time"}},
+	}, {
+		s.DB.ScheduledPublishes(),
+		mgo.Index{Key: []string{"url"}},
+	}, {
+		s.DB.Webhooks(),
+		mgo.Index{Key: []string{"user"}},
+	}, {
+		s.DB.Webhooks(),
+		mgo.Index{Key: []string{"baseurl"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"webhookid", "-createtime"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"status", "nextattempt"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"createtime"}, ExpireAfter: webhookDeliveryRetention},
+	}, {
+		s.DB.Changes(),
+		mgo.Index{Key: []string{"time"}, ExpireAfter: changeRetention},
+	}, {
+		s.DB.APITokens(),
+		mgo.Index{Key: []string{"hash"}, Unique: true},
+	}, {
+		s.DB.APITokens(),
+		mgo.Index{Key: []string{"user"}},
+	}, {
+		// Expired tokens are rejected when they are used,
+		// so they only need to be removed eventually.
+		s.DB.APITokens(),
+		mgo.Index{Key: []string{"expiretime"}, ExpireAfter: time.Second},
+	}, {
+		s.DB.Groups(),
+		mgo.Index{Key: []string{"members"}},
 	}}
 	for _, idx := range indexes {
 		err := idx.c.EnsureIndex(idx.i)
@@ -431,6 +485,35 @@ func (s *Store) ensureIndexes() error {
 // deleting all blobs that have not been referenced since
 // the given time.
 func (s *Store) BlobStoreGC(before time.Time) error {
+	refs, err := s.blobRefs()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	stats, err := s.BlobStore.GC(refs, before)
+	if err != nil {
+		return errgo.Notef(err, "blobstore GC failed")
+	}
+	monitoring.SetBlobStoreStats(stats)
+	return nil
+}
+
+// BlobStoreGCDryRun returns the blobs that BlobStoreGC would
+// delete if called with the same time, without deleting them.
+func (s *Store) BlobStoreGCDryRun(before time.Time) ([]blobstore.GarbageBlob, error) {
+	refs, err := s.blobRefs()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	garbage, err := s.BlobStore.GCDryRun(refs, before)
+	if err != nil {
+		return nil, errgo.Notef(err, "blobstore GC dry run failed")
+	}
+	return garbage, nil
+}
+
+// blobRefs returns the set of all blob hashes
+// referenced by entities and resources.
+func (s *Store) blobRefs() (*blobstore.Refs, error) {
 	// BEWARE: if this code does not add all the relevant blob
 	// hashes, they will be removed by the garbage collector!
 
@@ -438,11 +521,11 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	// measure of hash count.
 	entityCount, err := s.DB.Entities().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 	resourceCount, err := s.DB.Resources().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
 	}
 	// Assume non-multipart resources, v5 entities that need conversion,
 	// and a 20% duplication rate,
@@ -462,7 +545,26 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 		refs.Add(entity.BlobHash)
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
+		return nil, errgo.Mask(err)
+	}
+	// Deleted entities may still be restored,
+	// so their blobs must be kept too.
+	iter = s.DB.DeletedEntities().Find(nil).Select(FieldSelector(
+		"entity.prev5blobextrahash",
+		"entity.blobhash",
+	)).Iter()
+	var deleted mongodoc.DeletedEntity
+	for iter.Next(&deleted) {
+		if deleted.Entity != nil {
+			if deleted.Entity.PreV5BlobExtraHash != "" {
+				refs.Add(deleted.Entity.PreV5BlobExtraHash)
+			}
+			refs.Add(deleted.Entity.BlobHash)
+		}
+		deleted = mongodoc.DeletedEntity{}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errgo.Mask(err)
 	}
 	iter = s.DB.Resources().Find(nil).Select(FieldSelector(
 		"blobhash",
@@ -479,14 +581,9 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 		}
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
-	}
-	stats, err := s.BlobStore.GC(refs, before)
-	if err != nil {
-		return errgo.Notef(err, "blobstore GC failed")
+		return nil, errgo.Mask(err)
 	}
-	monitoring.SetBlobStoreStats(stats)
-	return nil
+	return refs, nil
 }
 
 // AddAudit adds the given entry to the audit log.
@@ -637,7 +734,10 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 //
 // If the URL does not contain a revision then the channel is searched
 // for the best match, here NoChannel will be treated as
-// params.StableChannel.
+// params.StableChannel. Yanked entities are skipped in this case.
+//
+// The channel may specify a track, as in "2/stable"; otherwise the
+// default track of the base entity is used.
 func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	if fields != nil {
 		// Make sure we have all the fields we need to make a decision.
@@ -649,6 +749,7 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 			"series":               1,
 			"revision":             1,
 			"published":            1,
+			"deprecation":          1,
 		}
 		for f := range fields {
 			nfields[f] = 1
@@ -666,8 +767,14 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 		// If a channel was specified make sure the entity is in that channel.
 		// This is crucial because if we don't do this, then the user could choose
 		// to use any chosen set of ACLs against any entity.
-		if params.ValidChannels[channel] && channel != params.UnpublishedChannel && !entity.Published[channel] {
-			return nil, errgo.WithCausef(nil, params.ErrNotFound, "%s not found in %s channel", url, channel)
+		if ValidChannel(channel) && channel != params.UnpublishedChannel {
+			ch, err := s.resolveChannel(entity.URL, channel)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			}
+			if !entity.Published[ch] {
+				return nil, errgo.WithCausef(nil, params.ErrNotFound, "%s not found in %s channel", url, channel)
+			}
 		}
 		return entity, nil
 	}
@@ -702,22 +809,41 @@ func (s *Store) findSingleEntity(url *charm.URL, fields map[string]int) (*mongod
 	return nil, errgo.Notef(err, "cannot find entities matching %s", url)
 }
 
+// resolveChannel returns the channel that ch refers to for the base
+// entity of url, taking into account the base entity's default track.
+// See ResolveChannel.
+func (s *Store) resolveChannel(url *charm.URL, ch params.Channel) (params.Channel, error) {
+	track, risk, err := ParseChannel(ch)
+	if err != nil || track != "" || risk == params.UnpublishedChannel {
+		// The base entity's default track makes no difference.
+		return ResolveChannel(ch, ""), nil
+	}
+	baseEntity, err := s.FindBaseEntity(url, FieldSelector("defaulttrack"))
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return ResolveChannel(ch, baseEntity.DefaultTrack), nil
+}
+
 // findEntityInChannel attempts to find an entity on the given channel. The
 // base entity for URL is retrieved and the series with the best match to
-// URL.Series is used as the resolved entity.
+// URL.Series is used as the resolved entity. If the channel does not
+// specify a track, the base entity's default track is used.
 func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	baseEntity, err := s.FindBaseEntity(url, map[string]int{
 		"_id":             1,
 		"channelentities": 1,
+		"defaulttrack":    1,
 	})
 	if errgo.Cause(err) == params.ErrNotFound {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
 	} else if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	ch = ResolveChannel(ch, baseEntity.DefaultTrack)
 	var entityURL *charm.URL
+	var entitySeries string
 	if url.Series == "" {
-		var entitySeries string
 		for s, u := range baseEntity.ChannelEntities[ch] {
 			// Determine the preferred URL from the available series.
 			//
@@ -740,12 +866,40 @@ func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields ma
 			}
 		}
 	} else {
+		entitySeries = url.Series
 		entityURL = baseEntity.ChannelEntities[ch][url.Series]
 	}
 	if entityURL == nil {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
 	}
-	return s.findSingleEntity(entityURL, fields)
+	entity, err := s.findSingleEntity(entityURL, fields)
+	if err != nil || !entity.IsYanked() {
+		return entity, err
+	}
+	// The current revision has been yanked, so fall back to
+	// the latest revision published to the channel that has not.
+	query := bson.D{
+		{"baseurl", baseEntity.URL},
+		{"published." + string(ch), true},
+		{"deprecation.state", bson.D{{"$ne", mongodoc.Yanked}}},
+	}
+	if entitySeries == "bundle" {
+		query = append(query, bson.DocElem{"series", "bundle"})
+	} else {
+		query = append(query, bson.DocElem{"supportedseries", entitySeries})
+	}
+	q := s.DB.Entities().Find(query).Sort("-revision")
+	if fields != nil {
+		q = q.Select(fields)
+	}
+	entity = new(mongodoc.Entity)
+	if err := q.One(entity); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
+		}
+		return nil, errgo.Notef(err, "cannot find entities matching %s", url)
+	}
+	return entity, nil
 }
 
 // findUnpublishedEntity attempts to find an entity on the unpublished
@@ -756,6 +910,15 @@ func (s *Store) findUnpublishedEntity(url *charm.URL, fields map[string]int) (*m
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	// Yanked entities are never chosen when resolving
+	// a URL without a revision.
+	available := entities[:0]
+	for _, e := range entities {
+		if !e.IsYanked() {
+			available = append(available, e)
+		}
+	}
+	entities = available
 	if len(entities) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
 	}
@@ -914,21 +1077,55 @@ var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect reso
 
 // Publish assigns channels to the entity corresponding to the given URL.
 // An error is returned if no channels are provided. See params.ValidChannels
-// for the list of supported channels. The unpublished channel cannot
-// be provided.
+// for the list of supported channels, each of which may be qualified with
+// a track as in "2/stable". The unpublished channel cannot be provided.
+// Channels without a track are resolved with the base entity's default
+// track. When a channel in a new track is first published to, it takes
+// the ACL of the channel with the same risk in the latest track.
 //
 // If the given resources do not match those expected or they're not
 // found, an error with a ErrPublichResourceMismatch cause will be returned.
+//
+// If the base entity has a promotion policy that the entity does not
+// satisfy, an error with an ErrPromotionDenied cause is returned.
+//
+// The publication is recorded in the publish history without a user;
+// use PublishAs to record the user responsible.
 func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
+	return s.PublishAs("", url, resources, channels...)
+}
+
+// PublishAs is like Publish except that the given user is recorded in
+// the publish history. Approvals made by the user do not count towards
+// those required by the promotion policy.
+func (s *Store) PublishAs(user string, url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
+	if err := s.checkPromotion(url, user, channels); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPromotionDenied))
+	}
+	return s.publish(url, resources, mongodoc.PublishEvent{User: user}, channels)
+}
+
+// publish implements Publish. The given event is used as a template for
+// the entries added to the publish history.
+func (s *Store) publish(url *router.ResolvedURL, resources map[string]int, event mongodoc.PublishEvent, channels []params.Channel) error {
+	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries", "charmmeta", "baseurl"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := s.FindBaseEntity(entity.BaseURL, FieldSelector("channelacls", "defaulttrack"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	var updateSearch bool
 	// Throw away any channels that we don't like.
 	actualChannels := make([]params.Channel, 0, len(channels))
 	for _, c := range channels {
-		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+		if !ValidChannel(c) || c == params.UnpublishedChannel {
 			continue
 		}
+		c = ResolveChannel(c, baseEntity.DefaultTrack)
 		actualChannels = append(actualChannels, c)
-		if c == params.StableChannel {
+		if c == searchChannel(baseEntity) {
 			updateSearch = true
 		}
 	}
@@ -936,10 +1133,6 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 	if len(channels) == 0 {
 		return errgo.Newf("cannot update %q: no valid channels provided", url)
 	}
-	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries", "charmmeta", "baseurl"))
-	if err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
-	}
 	resourceDocs := make([]mongodoc.ResourceRevision, 0, len(resources))
 	if err = s.checkPublishedResources(entity, resources); err != nil {
 		return errgo.WithCausef(err, ErrPublishResourceMismatch, "")
@@ -950,6 +1143,7 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 			Revision: rev,
 		})
 	}
+	sort.Sort(resourceRevisionsByName(resourceDocs))
 
 	series := entity.SupportedSeries
 	if len(series) == 0 {
@@ -971,11 +1165,29 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 			update = append(update, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", c, s), entity.URL})
 		}
 		update = append(update, bson.DocElem{fmt.Sprintf("channelresources.%s", c), resourceDocs})
+		if _, ok := baseEntity.ChannelACLs[c]; !ok {
+			update = append(update, bson.DocElem{fmt.Sprintf("channelacls.%s", c), ChannelACL(baseEntity, c)})
+		}
 	}
 	if err := s.UpdateBaseEntity(url, bson.D{{"$set", update}}); err != nil {
 		return errgo.Mask(err)
 	}
 
+	// Record the change in the publish history.
+	event.BaseURL = entity.BaseURL
+	event.URL = entity.URL
+	event.Series = series
+	event.Resources = resourceDocs
+	event.Time = time.Now()
+	for _, c := range channels {
+		event.Id = bson.NewObjectId()
+		event.Channel = c
+		if err := s.DB.PublishHistory().Insert(&event); err != nil {
+			return errgo.Notef(err, "cannot record publish history")
+		}
+	}
+	s.RecordEvent(mongodoc.EventPublish, entity.URL, channels)
+
 	if !updateSearch {
 		return nil
 	}
@@ -1051,6 +1263,7 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 		if err := s.UpdateSearchBaseURL(base); err != nil {
 			return errgo.Notef(err, "cannot update search entities for %q", base)
 		}
+		s.RecordEvent(mongodoc.EventUnpromulgate, base, nil)
 		return nil
 	}
 
@@ -1210,6 +1423,7 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	if err := s.UpdateSearchBaseURL(base); err != nil {
 		return errgo.Notef(err, "cannot update search entities for %q", base)
 	}
+	s.RecordEvent(mongodoc.EventPromulgate, base, nil)
 	return nil
 }
 
@@ -1291,6 +1505,10 @@ func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logTyp
 // the entity is the current published revision for any channel or the
 // last revision with the same base entity, it returns an error with an
 // ErrForbidden cause.
+//
+// The deleted entity is kept, along with its blobs, so that it can be
+// restored with RestoreEntity until it is permanently removed by
+// RemoveExpiredDeletedEntities.
 func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 	// Find all the entities that use the base URL of id so
 	// that we can refuse to delete the last reference to the
@@ -1336,6 +1554,23 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		sort.Strings(published)
 		return errgo.WithCausef(nil, params.ErrForbidden, "cannot delete %q because it is the current revision in channels %s", &id.URL, published)
 	}
+	// Move the entity to the deleted entities collection so that it
+	// can be restored until its retention period has expired.
+	var doc mongodoc.Entity
+	if err := s.DB.Entities().FindId(&id.URL).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			// Someone else got there first.
+			err = params.ErrNotFound
+		}
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := s.DB.DeletedEntities().UpsertId(&id.URL, &mongodoc.DeletedEntity{
+		URL:        &id.URL,
+		Entity:     &doc,
+		DeleteTime: time.Now(),
+	}); err != nil {
+		return errgo.Notef(err, "cannot save deleted entity")
+	}
 	// Remove the entity.
 	if err := s.DB.Entities().RemoveId(&id.URL); err != nil {
 		if err == mgo.ErrNotFound {
@@ -1344,10 +1579,86 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-
+	s.RecordEvent(mongodoc.EventDelete, &id.URL, nil)
 	return nil
 }
 
+// FindDeletedEntity returns the record of the entity with the given id
+// that was deleted with DeleteEntity. The id must hold a revision and
+// may be either the entity's id or its promulgated id. If there is no
+// such deleted entity, it returns an error with a params.ErrNotFound
+// cause.
+func (s *Store) FindDeletedEntity(id *charm.URL) (*mongodoc.DeletedEntity, error) {
+	if id.Revision == -1 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no revision specified")
+	}
+	query := bson.D{{"_id", id}}
+	if id.User == "" {
+		query = bson.D{{"entity.promulgated-url", id}}
+	}
+	var doc mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().Find(query).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no deleted entity %q", id)
+		}
+		return nil, errgo.Notef(err, "cannot get deleted entity")
+	}
+	return &doc, nil
+}
+
+// RestoreEntity restores the entity with the given id that was
+// previously deleted with DeleteEntity. The id must hold a revision and
+// may be either the entity's id or its promulgated id. It returns the
+// resolved id of the restored entity.
+//
+// If there is no such deleted entity, or its base entity no longer
+// exists, RestoreEntity returns an error with a params.ErrNotFound
+// cause. If the entity already exists, it returns an error with a
+// params.ErrDuplicateUpload cause. If restoring the entity would take
+// its namespace over quota, it returns an error with a
+// router.ErrQuotaExceeded cause.
+func (s *Store) RestoreEntity(id *charm.URL) (*router.ResolvedURL, error) {
+	doc, err := s.FindDeletedEntity(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := s.FindBaseEntity(doc.URL, FieldSelector("_id")); err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "base entity of %q no longer exists", doc.URL)
+		}
+		return nil, errgo.Mask(err)
+	}
+	if err := s.checkQuota(doc.URL.User, doc.Entity.Size, 1); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+	}
+	if err := s.DB.Entities().Insert(doc.Entity); err != nil {
+		if mgo.IsDup(err) {
+			return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "entity %q already exists", doc.URL)
+		}
+		return nil, errgo.Notef(err, "cannot restore entity")
+	}
+	if err := s.DB.DeletedEntities().RemoveId(doc.URL); err != nil && err != mgo.ErrNotFound {
+		// The entity has been restored, so just log the error;
+		// the stale record will be removed when it expires.
+		logger.Errorf("cannot remove deleted entity record for %v: %v", doc.URL, err)
+	}
+	return EntityResolvedURL(doc.Entity), nil
+}
+
+// RemoveExpiredDeletedEntities permanently removes all the
+// entities that were deleted before the given time, so that
+// their blobs can be garbage collected. It returns the number
+// of entities removed.
+func (s *Store) RemoveExpiredDeletedEntities(before time.Time) (int, error) {
+	info, err := s.DB.DeletedEntities().RemoveAll(bson.D{{
+		"deletetime", bson.D{{"$lt", before}},
+	}})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove expired deleted entities")
+	}
+	return info.Removed, nil
+}
+
 // StoreDatabase wraps an mgo.DB ands adds a few convenience methods.
 type StoreDatabase struct {
 	*mgo.Database
@@ -1413,18 +1724,104 @@ func (s StoreDatabase) Macaroons() *mgo.Collection {
 	return s.C("macaroons")
 }
 
+// PublishHistory returns the collection holding the history
+// of entity publishing.
+func (s StoreDatabase) PublishHistory() *mgo.Collection {
+	return s.C("publish_history")
+}
+
+// ScheduledPublishes returns the collection holding the
+// publishes that are to be made at a later time.
+func (s StoreDatabase) ScheduledPublishes() *mgo.Collection {
+	return s.C("scheduled_publishes")
+}
+
+// Webhooks returns the collection holding the webhook
+// subscriptions to store events.
+func (s StoreDatabase) Webhooks() *mgo.Collection {
+	return s.C("webhooks")
+}
+
+// WebhookDeliveries returns the collection holding the
+// deliveries of store events to webhooks.
+func (s StoreDatabase) WebhookDeliveries() *mgo.Collection {
+	return s.C("webhook_deliveries")
+}
+
+// Changes returns the collection holding the log of changes
+// to the store.
+func (s StoreDatabase) Changes() *mgo.Collection {
+	return s.C("changes")
+}
+
+// APITokens returns the collection holding the API tokens
+// that users have created.
+func (s StoreDatabase) APITokens() *mgo.Collection {
+	return s.C("api_tokens")
+}
+
+// Groups returns the collection holding the groups
+// managed by the charm store.
+func (s StoreDatabase) Groups() *mgo.Collection {
+	return s.C("groups")
+}
+
+// Sequences returns the collection holding the counters used to
+// number documents, such as the changes.
+func (s StoreDatabase) Sequences() *mgo.Collection {
+	return s.C("sequences")
+}
+
+// ScrubReports returns the collection holding the report
+// from the most recent run of the blob integrity scrubber.
+func (s StoreDatabase) ScrubReports() *mgo.Collection {
+	return s.C("scrubreports")
+}
+
+// DeletedEntities returns the collection holding entities that
+// have been deleted but may still be restored until their
+// retention period expires.
+func (s StoreDatabase) DeletedEntities() *mgo.Collection {
+	return s.C("deleted_entities")
+}
+
+// Redirects returns the collection holding the redirects left
+// behind when base entities are transferred to a new id.
+func (s StoreDatabase) Redirects() *mgo.Collection {
+	return s.C("redirects")
+}
+
+// Quotas returns the collection holding the storage quotas
+// of user namespaces, including the default quota that
+// applies to everyone.
+func (s StoreDatabase) Quotas() *mgo.Collection {
+	return s.C("quotas")
+}
+
 // allCollections holds for each collection used by the charm store a
 // function returns that collection.
 var allCollections = []func(StoreDatabase) *mgo.Collection{
+	StoreDatabase.APITokens,
 	StoreDatabase.BaseEntities,
+	StoreDatabase.Changes,
+	StoreDatabase.DeletedEntities,
 	StoreDatabase.Entities,
+	StoreDatabase.Groups,
 	StoreDatabase.Logs,
 	StoreDatabase.Macaroons,
 	StoreDatabase.Migrations,
+	StoreDatabase.PublishHistory,
+	StoreDatabase.Quotas,
+	StoreDatabase.Redirects,
 	StoreDatabase.Resources,
 	StoreDatabase.Revisions,
+	StoreDatabase.ScheduledPublishes,
+	StoreDatabase.ScrubReports,
+	StoreDatabase.Sequences,
 	StoreDatabase.StatCounters,
 	StoreDatabase.StatTokens,
+	StoreDatabase.WebhookDeliveries,
+	StoreDatabase.Webhooks,
 }
 
 // Collections returns a slice of all the collections used
@@ -1098,7 +1098,12 @@ func (s *StoreSuite) TestCollections(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 	// Some collections don't have indexes so they are created only when used.
 	createdOnUse := map[string]bool{
-		"migrations": true,
+		"deleted_entities": true,
+		"migrations":       true,
+		"quotas":           true,
+		"redirects":        true,
+		"scrubreports":     true,
+		"sequences":        true,
 	}
 	// Check that all collections mentioned by Collections are actually created.
 	for _, coll := range colls {
@@ -2492,6 +2497,57 @@ func (s *StoreSuite) TestFindBestEntity(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestFindBestEntityYanked(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for rev := 0; rev < 3; rev++ {
+		id := MustParseResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", rev))
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		if rev < 2 {
+			err = store.Publish(id, nil, params.StableChannel)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	setDeprecation := func(id string, state mongodoc.DeprecationState) {
+		err := store.UpdateEntity(MustParseResolvedURL(id), bson.D{{
+			"$set", bson.D{{"deprecation", &mongodoc.Deprecation{State: state}}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+	}
+	assertBest := func(url string, channel params.Channel, expect string) {
+		entity, err := store.FindBestEntity(charm.MustParseURL(url), channel, nil)
+		if expect == "" {
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			return
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.URL.String(), gc.Equals, expect)
+	}
+
+	// Yanking the current stable revision falls back to the
+	// previous stable revision.
+	setDeprecation("cs:~bob/precise/wordpress-1", mongodoc.Yanked)
+	assertBest("cs:~bob/wordpress", params.StableChannel, "cs:~bob/precise/wordpress-0")
+	assertBest("cs:~bob/precise/wordpress", params.StableChannel, "cs:~bob/precise/wordpress-0")
+	assertBest("cs:~bob/wordpress", params.UnpublishedChannel, "cs:~bob/precise/wordpress-2")
+
+	// A yanked revision can still be found by its revision.
+	assertBest("cs:~bob/precise/wordpress-1", params.StableChannel, "cs:~bob/precise/wordpress-1")
+
+	// Deprecated revisions are resolved as normal.
+	setDeprecation("cs:~bob/precise/wordpress-2", mongodoc.Deprecated)
+	assertBest("cs:~bob/wordpress", params.UnpublishedChannel, "cs:~bob/precise/wordpress-2")
+
+	setDeprecation("cs:~bob/precise/wordpress-2", mongodoc.Yanked)
+	assertBest("cs:~bob/wordpress", params.UnpublishedChannel, "cs:~bob/precise/wordpress-0")
+
+	// When all revisions are yanked, nothing is found.
+	setDeprecation("cs:~bob/precise/wordpress-0", mongodoc.Yanked)
+	assertBest("cs:~bob/wordpress", params.StableChannel, "")
+	assertBest("cs:~bob/wordpress", params.UnpublishedChannel, "")
+}
+
 var matchingInterfacesQueryTests = []struct {
 	required []string
 	provided []string
@@ -4175,9 +4231,20 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	_, err = store.FindEntity(url, nil)
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 
-	// Run blobstore garbage collection and check that
-	// the blob and the pre-v5 compatibility blob have been
-	// removed.
+	// The deleted entity can still be restored, so blobstore
+	// garbage collection leaves its blobs alone.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	r, _, err := store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// Once the deleted entity has expired, run blobstore garbage
+	// collection and check that the blob and the pre-v5
+	// compatibility blob have been removed.
+	n, err := store.RemoveExpiredDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
 	err = store.BlobStoreGC(time.Now())
 	c.Assert(err, gc.Equals, nil)
 
@@ -4188,6 +4255,169 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
 }
 
+func (s *StoreSuite) TestBlobStoreGCDryRun(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	url1 := *url
+	url1.URL.Revision = 13
+	err = store.AddCharmWithArchive(&url1, storetesting.NewCharm(&charm.Meta{
+		Summary: "another piece of content",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	garbage, err := store.BlobStoreGCDryRun(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(garbage, gc.HasLen, 0)
+
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.Equals, nil)
+
+	// The blobs of a deleted entity are kept
+	// until it has expired.
+	garbage, err = store.BlobStoreGCDryRun(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(garbage, gc.HasLen, 0)
+	_, err = store.RemoveExpiredDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	// The dry run reports the blob and the pre-v5
+	// compatibility blob of the deleted entity.
+	garbage, err = store.BlobStoreGCDryRun(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	sizes := make(map[string]int64)
+	for _, blob := range garbage {
+		sizes[blob.Hash] = blob.Size
+	}
+	c.Assert(sizes, jc.DeepEquals, map[string]int64{
+		entity.BlobHash:           entity.Size,
+		entity.PreV5BlobExtraHash: entity.PreV5BlobSize - entity.Size,
+	})
+
+	// Nothing has actually been removed.
+	r, _, err := store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// A time before the blobs were put excludes them.
+	garbage, err = store.BlobStoreGCDryRun(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(garbage, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestRestoreEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", 3)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	url1 := *url
+	url1.URL.Revision = 13
+	url1.PromulgatedRevision = 4
+	err = store.AddCharmWithArchive(&url1, storetesting.NewCharm(&charm.Meta{
+		Summary: "another piece of content",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.Equals, nil)
+
+	rurl, err := store.RestoreEntity(&url.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rurl, jc.DeepEquals, url)
+	restored, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(restored, jc.DeepEquals, entity)
+
+	// The entity can't be restored twice.
+	_, err = store.RestoreEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `no deleted entity "cs:~charmers/precise/wordpress-12"`)
+
+	// The entity can be restored by its promulgated id.
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.Equals, nil)
+	rurl, err = store.RestoreEntity(charm.MustParseURL("cs:precise/wordpress-3"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rurl, jc.DeepEquals, url)
+
+	// Once it has expired, it can no longer be restored.
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.Equals, nil)
+	n, err := store.RemoveExpiredDeletedEntities(time.Now().Add(-time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.RemoveExpiredDeletedEntities(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	_, err = store.RestoreEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRestoreEntityWithoutBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"~charmers/precise/wordpress-0", "~charmers/precise/wordpress-1"} {
+		err := store.AddCharmWithArchive(router.MustNewResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.DeleteEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.Equals, nil)
+
+	// Remove the rest of the charm, as a bulk delete does.
+	err = store.DB.Entities().RemoveId(charm.MustParseURL("cs:~charmers/precise/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	err = store.DB.BaseEntities().RemoveId(charm.MustParseURL("cs:~charmers/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.RestoreEntity(charm.MustParseURL("cs:~charmers/precise/wordpress-0"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `base entity of "cs:~charmers/precise/wordpress-0" no longer exists`)
+	_, err = store.FindEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRestoreEntityOverQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"~charmers/precise/wordpress-0", "~charmers/precise/wordpress-1"} {
+		err := store.AddCharmWithArchive(router.MustNewResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.DeleteEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetQuota(&mongodoc.Quota{
+		User:        "charmers",
+		MaxEntities: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.RestoreEntity(charm.MustParseURL("cs:~charmers/precise/wordpress-0"))
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+
+	// The deleted entity can still be restored once
+	// the quota allows it.
+	err = store.SetQuota(&mongodoc.Quota{
+		User:        "charmers",
+		MaxEntities: 2,
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.RestoreEntity(charm.MustParseURL("cs:~charmers/precise/wordpress-0"))
+	c.Assert(err, gc.Equals, nil)
+}
+
 func (s *StoreSuite) TestDeleteEntityWithOnlyOneRevision(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
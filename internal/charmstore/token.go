@@ -0,0 +1,143 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// apiTokenPrefix holds the prefix of every API token secret. It makes
+// leaked tokens easy to recognise.
+const apiTokenPrefix = "cst_"
+
+var validAPITokenScopes = map[mongodoc.APITokenScope]bool{
+	mongodoc.APITokenRead:    true,
+	mongodoc.APITokenUpload:  true,
+	mongodoc.APITokenPublish: true,
+}
+
+// AddAPIToken adds the given API token and returns its secret, which
+// is not stored and so cannot be retrieved later. The User and Scope
+// fields of tok must be set. The Id, Hash and CreateTime fields are
+// filled in.
+func (s *Store) AddAPIToken(tok *mongodoc.APIToken) (string, error) {
+	if tok.User == "" {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "API token user not specified")
+	}
+	if !validAPITokenScopes[tok.Scope] {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid API token scope %q", tok.Scope)
+	}
+	// API token users share a namespace with local groups in ACLs.
+	if _, err := s.Group(tok.User); err == nil {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "API token user %q clashes with a group", tok.User)
+	} else if errgo.Cause(err) != params.ErrNotFound {
+		return "", errgo.Mask(err)
+	}
+	now := time.Now()
+	if !tok.ExpireTime.IsZero() && !tok.ExpireTime.After(now) {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "API token expiry time is in the past")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Notef(err, "cannot generate API token")
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	tok.Id = bson.NewObjectId()
+	tok.Hash = apiTokenHash(secret)
+	tok.CreateTime = now
+	if err := s.DB.APITokens().Insert(tok); err != nil {
+		return "", errgo.Notef(err, "cannot add API token")
+	}
+	return secret, nil
+}
+
+// APITokenFromSecret returns the API token with the given secret and
+// records that it has been used. If there is no such token or it has
+// expired, an error with an ErrNotFound cause is returned.
+func (s *Store) APITokenFromSecret(secret string) (*mongodoc.APIToken, error) {
+	var tok mongodoc.APIToken
+	if err := s.DB.APITokens().Find(bson.D{{"hash", apiTokenHash(secret)}}).One(&tok); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "API token not found")
+		}
+		return nil, errgo.Notef(err, "cannot get API token")
+	}
+	now := time.Now()
+	if !tok.ExpireTime.IsZero() && !now.Before(tok.ExpireTime) {
+		// The token will be removed by the TTL index soon.
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "API token not found")
+	}
+	if err := s.DB.APITokens().UpdateId(tok.Id, bson.D{{"$set", bson.D{{"lastused", now}}}}); err != nil {
+		// The token is still valid, so just log the failure.
+		logger.Errorf("cannot record use of API token %s: %v", tok.Id.Hex(), err)
+	}
+	tok.LastUsed = now
+	return &tok, nil
+}
+
+// UserAPITokens returns the API tokens of the given user, oldest
+// first. Tokens that have expired but have not yet been removed are
+// not returned.
+func (s *Store) UserAPITokens(user string) ([]*mongodoc.APIToken, error) {
+	var toks []*mongodoc.APIToken
+	if err := s.DB.APITokens().Find(bson.D{
+		{"user", user},
+		{"$or", []bson.D{
+			{{"expiretime", bson.D{{"$exists", false}}}},
+			{{"expiretime", bson.D{{"$gt", time.Now()}}}},
+		}},
+	}).Sort("_id").All(&toks); err != nil {
+		return nil, errgo.Notef(err, "cannot get API tokens for %q", user)
+	}
+	return toks, nil
+}
+
+// FindAPIToken returns the API token with the given id. If there is
+// no such token, an error with an ErrNotFound cause is returned.
+func (s *Store) FindAPIToken(tokenId string) (*mongodoc.APIToken, error) {
+	if !bson.IsObjectIdHex(tokenId) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", tokenId)
+	}
+	var tok mongodoc.APIToken
+	if err := s.DB.APITokens().FindId(bson.ObjectIdHex(tokenId)).One(&tok); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", tokenId)
+		}
+		return nil, errgo.Notef(err, "cannot get API token %q", tokenId)
+	}
+	return &tok, nil
+}
+
+// RemoveAPIToken revokes the API token with the given id. If there is
+// no such token, an error with an ErrNotFound cause is returned.
+func (s *Store) RemoveAPIToken(tokenId string) error {
+	if !bson.IsObjectIdHex(tokenId) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", tokenId)
+	}
+	if err := s.DB.APITokens().RemoveId(bson.ObjectIdHex(tokenId)); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", tokenId)
+		}
+		return errgo.Notef(err, "cannot remove API token %q", tokenId)
+	}
+	return nil
+}
+
+// apiTokenHash returns the hash of the given API token secret
+// as stored in the API tokens collection.
+func apiTokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+type tokenSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&tokenSuite{})
+
+func (s *tokenSuite) TestAddAPIToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	tok := &mongodoc.APIToken{
+		User:        "bob",
+		Description: "ci",
+		Scope:       mongodoc.APITokenUpload,
+		Namespace:   "bob",
+	}
+	secret, err := store.AddAPIToken(tok)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(secret, jc.HasPrefix, apiTokenPrefix)
+	c.Assert(tok.Id, gc.Not(gc.Equals), bson.ObjectId(""))
+	c.Assert(tok.CreateTime.IsZero(), gc.Equals, false)
+
+	// Only the hash of the secret is stored.
+	var doc mongodoc.APIToken
+	err = store.DB.APITokens().FindId(tok.Id).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Hash, gc.Equals, apiTokenHash(secret))
+
+	got, err := store.APITokenFromSecret(secret)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(got.Id, gc.Equals, tok.Id)
+	c.Assert(got.User, gc.Equals, "bob")
+	c.Assert(got.Scope, gc.Equals, mongodoc.APITokenUpload)
+	c.Assert(got.Namespace, gc.Equals, "bob")
+	c.Assert(got.LastUsed.IsZero(), gc.Equals, false)
+
+	err = store.DB.APITokens().FindId(tok.Id).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.LastUsed.IsZero(), gc.Equals, false)
+
+	_, err = store.APITokenFromSecret(secret + "x")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *tokenSuite) TestAddAPITokenErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.AddAPIToken(&mongodoc.APIToken{
+		Scope: mongodoc.APITokenRead,
+	})
+	c.Assert(err, gc.ErrorMatches, `API token user not specified`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = store.AddAPIToken(&mongodoc.APIToken{
+		User:  "bob",
+		Scope: "admin",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid API token scope "admin"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = store.AddAPIToken(&mongodoc.APIToken{
+		User:       "bob",
+		Scope:      mongodoc.APITokenRead,
+		ExpireTime: time.Now().Add(-time.Minute),
+	})
+	c.Assert(err, gc.ErrorMatches, `API token expiry time is in the past`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *tokenSuite) TestExpiredAPIToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	tok := &mongodoc.APIToken{
+		User:       "bob",
+		Scope:      mongodoc.APITokenRead,
+		ExpireTime: time.Now().Add(time.Hour),
+	}
+	secret, err := store.AddAPIToken(tok)
+	c.Assert(err, gc.Equals, nil)
+	toks, err := store.UserAPITokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(toks, gc.HasLen, 1)
+
+	err = store.DB.APITokens().UpdateId(tok.Id, bson.D{{"$set", bson.D{{"expiretime", time.Now().Add(-time.Second)}}}})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.APITokenFromSecret(secret)
+	c.Assert(err, gc.ErrorMatches, `API token not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	toks, err = store.UserAPITokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(toks, gc.HasLen, 0)
+}
+
+func (s *tokenSuite) TestUserAPITokens(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	var ids []bson.ObjectId
+	for _, user := range []string{"bob", "alice", "bob"} {
+		tok := &mongodoc.APIToken{
+			User:  user,
+			Scope: mongodoc.APITokenRead,
+		}
+		_, err := store.AddAPIToken(tok)
+		c.Assert(err, gc.Equals, nil)
+		ids = append(ids, tok.Id)
+	}
+	toks, err := store.UserAPITokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(toks, gc.HasLen, 2)
+	c.Assert(toks[0].Id, gc.Equals, ids[0])
+	c.Assert(toks[1].Id, gc.Equals, ids[2])
+
+	tok, err := store.FindAPIToken(ids[1].Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tok.User, gc.Equals, "alice")
+
+	err = store.RemoveAPIToken(ids[0].Hex())
+	c.Assert(err, gc.Equals, nil)
+	toks, err = store.UserAPITokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(toks, gc.HasLen, 1)
+	c.Assert(toks[0].Id, gc.Equals, ids[2])
+
+	err = store.RemoveAPIToken(ids[0].Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindAPIToken(ids[0].Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindAPIToken("not-an-id")
+	c.Assert(err, gc.ErrorMatches, `API token "not-an-id" not found`)
+}
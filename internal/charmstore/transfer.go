@@ -0,0 +1,344 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// TransferBaseEntity moves the base entity with the id from, along with
+// all its entities, resources, revision counters, stats counters, publish
+// history, scheduled publishes and webhooks, to
+// the id to. Both ids must be base URLs with a user. A redirect is left
+// behind so that Redirect can map ids under the old base URL to the new
+// one.
+//
+// Promulgated base entities cannot be transferred. If a base entity
+// already exists with the id to, an error with an ErrDuplicateUpload
+// cause is returned. If the transfer would take the namespace of to
+// over its quota, an error with a router.ErrQuotaExceeded cause is
+// returned.
+func (s *Store) TransferBaseEntity(from, to *charm.URL) error {
+	for _, id := range []*charm.URL{from, to} {
+		if id.User == "" {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "user not specified in %q", id)
+		}
+		if id.Series != "" || id.Revision != -1 {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%q is not a base entity id", id)
+		}
+	}
+	if *from == *to {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot transfer %q to itself", from)
+	}
+	baseEntity, err := s.FindBaseEntity(from, nil)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if baseEntity.Promulgated {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot transfer promulgated %q", from)
+	}
+	if _, err := s.FindBaseEntity(to, FieldSelector("_id")); err == nil {
+		return errgo.WithCausef(nil, params.ErrDuplicateUpload, "%q already exists", to)
+	} else if errgo.Cause(err) != params.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", from}}).All(&entities); err != nil {
+		return errgo.Notef(err, "cannot get entities for %q", from)
+	}
+	if to.User != from.User {
+		size, err := s.transferSize(from, entities)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := s.checkQuota(to.User, size, len(entities)); err != nil {
+			return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
+		}
+	}
+
+	// Insert the new documents first so that, if anything goes
+	// wrong, the original base entity remains intact.
+	newBaseEntity := *baseEntity
+	newBaseEntity.URL = to
+	newBaseEntity.User = to.User
+	newBaseEntity.Name = to.Name
+	newBaseEntity.ChannelEntities = make(map[params.Channel]map[string]*charm.URL)
+	for ch, ids := range baseEntity.ChannelEntities {
+		newIds := make(map[string]*charm.URL)
+		for series, id := range ids {
+			newIds[series] = transferURL(id, to)
+		}
+		newBaseEntity.ChannelEntities[ch] = newIds
+	}
+	if err := s.DB.BaseEntities().Insert(&newBaseEntity); err != nil {
+		if mgo.IsDup(err) {
+			return errgo.WithCausef(nil, params.ErrDuplicateUpload, "%q already exists", to)
+		}
+		return errgo.Notef(err, "cannot insert base entity %q", to)
+	}
+	// Stats for multi-series charms are recorded with an empty
+	// series, so those are always transferred.
+	seriesSet := map[string]bool{"": true}
+	for _, e := range entities {
+		newEntity := *e
+		newEntity.URL = transferURL(e.URL, to)
+		newEntity.BaseURL = to
+		newEntity.User = to.User
+		newEntity.Name = to.Name
+		// The new base entity is not promulgated.
+		newEntity.PromulgatedURL = nil
+		newEntity.PromulgatedRevision = -1
+		if err := s.DB.Entities().Insert(&newEntity); err != nil {
+			s.removeTransferred(to)
+			return errgo.Notef(err, "cannot insert entity %q", newEntity.URL)
+		}
+		seriesSet[e.URL.Series] = true
+		for _, series := range e.SupportedSeries {
+			seriesSet[series] = true
+		}
+	}
+	var revisions []*mongodoc.LatestRevision
+	if err := s.DB.Revisions().Find(bson.D{{"baseurl", from}}).All(&revisions); err != nil {
+		s.removeTransferred(to)
+		return errgo.Notef(err, "cannot get revisions for %q", from)
+	}
+	for _, r := range revisions {
+		// The revision documents for the old id are left in place
+		// so that its revision numbers are never reused.
+		if _, err := s.DB.Revisions().UpsertId(transferURL(r.URL, to), &mongodoc.LatestRevision{
+			URL:      transferURL(r.URL, to),
+			BaseURL:  to,
+			Revision: r.Revision,
+		}); err != nil {
+			s.removeTransferred(to)
+			return errgo.Notef(err, "cannot update revision for %q", to)
+		}
+	}
+
+	// The new documents are in place, so move everything else
+	// across and remove the originals.
+	if _, err := s.DB.Resources().UpdateAll(bson.D{{"baseurl", from}}, bson.D{{"$set", bson.D{{"baseurl", to}}}}); err != nil {
+		return errgo.Notef(err, "cannot transfer resources")
+	}
+	if err := s.transferDeletedEntities(from, to); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.transferPublishHistory(from, to); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.transferScheduledPublishes(from, to); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := s.DB.Webhooks().UpdateAll(bson.D{{"baseurl", from}}, bson.D{{"$set", bson.D{{"baseurl", to}}}}); err != nil {
+		return errgo.Notef(err, "cannot transfer webhooks")
+	}
+	for series := range seriesSet {
+		if err := s.transferStats(from, to, series); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if _, err := s.DB.Redirects().UpsertId(from, &mongodoc.Redirect{
+		From: from,
+		To:   to,
+		Time: time.Now(),
+	}); err != nil {
+		return errgo.Notef(err, "cannot add redirect")
+	}
+	// Keep earlier redirects pointing at the current id, and drop
+	// any redirect away from the new id, which now exists again.
+	if _, err := s.DB.Redirects().UpdateAll(bson.D{{"to", from}}, bson.D{{"$set", bson.D{{"to", to}}}}); err != nil {
+		return errgo.Notef(err, "cannot update redirects")
+	}
+	if err := s.DB.Redirects().RemoveId(to); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove redirect")
+	}
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", from}}); err != nil {
+		return errgo.Notef(err, "cannot remove entities for %q", from)
+	}
+	if err := s.DB.BaseEntities().RemoveId(from); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove base entity %q", from)
+	}
+	for _, id := range searchRecordIds(baseEntity) {
+		if err := s.ES.delete(id); err != nil {
+			return errgo.Notef(err, "cannot remove search record for %q", id)
+		}
+	}
+	if err := s.UpdateSearchBaseURL(to); err != nil {
+		return errgo.Notef(err, "cannot update search record for %q", to)
+	}
+	return nil
+}
+
+// transferSize returns the number of bytes that transferring the given
+// entities of the base URL from, along with its resources, adds to the
+// namespace they are transferred to.
+func (s *Store) transferSize(from *charm.URL, entities []*mongodoc.Entity) (int64, error) {
+	var size int64
+	for _, e := range entities {
+		size += e.Size
+	}
+	var total struct {
+		Size int64
+	}
+	err := s.DB.Resources().Pipe([]bson.D{
+		{{"$match", bson.D{{"baseurl", from}}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}}},
+	}).One(&total)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, errgo.Notef(err, "cannot get resource usage for %q", from)
+	}
+	return size + total.Size, nil
+}
+
+// removeTransferred removes the entities and base entity inserted
+// by a failed call to TransferBaseEntity.
+func (s *Store) removeTransferred(to *charm.URL) {
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", to}}); err != nil {
+		logger.Errorf("cannot remove entities for %q: %v", to, err)
+	}
+	if err := s.DB.BaseEntities().RemoveId(to); err != nil {
+		logger.Errorf("cannot remove base entity %q: %v", to, err)
+	}
+}
+
+// transferDeletedEntities moves the deleted entities for the base URL
+// from to the base URL to, so that they can still be restored.
+func (s *Store) transferDeletedEntities(from, to *charm.URL) error {
+	var deleted []*mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().Find(bson.D{{"entity.baseurl", from}}).All(&deleted); err != nil {
+		return errgo.Notef(err, "cannot get deleted entities for %q", from)
+	}
+	for _, d := range deleted {
+		newURL := transferURL(d.URL, to)
+		e := *d.Entity
+		e.URL = newURL
+		e.BaseURL = to
+		e.User = to.User
+		e.Name = to.Name
+		e.PromulgatedURL = nil
+		e.PromulgatedRevision = -1
+		if _, err := s.DB.DeletedEntities().UpsertId(newURL, &mongodoc.DeletedEntity{
+			URL:        newURL,
+			Entity:     &e,
+			DeleteTime: d.DeleteTime,
+		}); err != nil {
+			return errgo.Notef(err, "cannot transfer deleted entity %q", d.URL)
+		}
+		if err := s.DB.DeletedEntities().RemoveId(d.URL); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove deleted entity %q", d.URL)
+		}
+	}
+	return nil
+}
+
+// transferPublishHistory moves the publish history of the base URL
+// from to the base URL to.
+func (s *Store) transferPublishHistory(from, to *charm.URL) error {
+	var events []struct {
+		Id             bson.ObjectId `bson:"_id"`
+		URL            *charm.URL
+		RolledBackFrom *charm.URL
+	}
+	if err := s.DB.PublishHistory().Find(bson.D{{"baseurl", from}}).Select(FieldSelector("url", "rolledbackfrom")).All(&events); err != nil {
+		return errgo.Notef(err, "cannot get publish history for %q", from)
+	}
+	for _, e := range events {
+		update := bson.D{
+			{"baseurl", to},
+			{"url", transferURL(e.URL, to)},
+		}
+		if e.RolledBackFrom != nil {
+			update = append(update, bson.DocElem{"rolledbackfrom", transferURL(e.RolledBackFrom, to)})
+		}
+		if err := s.DB.PublishHistory().UpdateId(e.Id, bson.D{{"$set", update}}); err != nil {
+			return errgo.Notef(err, "cannot transfer publish history")
+		}
+	}
+	return nil
+}
+
+// transferStats adds the stats counters recorded for the given series
+// of the base URL from to the counters of the base URL to. The
+// original counters are left untouched.
+func (s *Store) transferStats(from, to *charm.URL, series string) error {
+	// Entity stats keys are of the form kind:series:name:user:revision,
+	// so the counters to copy are those with any kind token followed
+	// by the series, name and user tokens of from.
+	oldKey, err := s.stats.key(s.DB, []string{series, from.Name, from.User}, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// No stats have ever been recorded.
+		return nil
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot get stats key")
+	}
+	newKey, err := s.stats.key(s.DB, []string{series, to.Name, to.User}, true)
+	if err != nil {
+		return errgo.Notef(err, "cannot make stats key")
+	}
+	counters := s.DB.StatCounters()
+	iter := counters.Find(bson.D{{
+		"k", bson.D{{"$regex", "^[0-9a-v]+:" + regexp.QuoteMeta(oldKey)}},
+	}}).Iter()
+	var counter struct {
+		Key   string `bson:"k"`
+		Time  int32  `bson:"t"`
+		Count int64  `bson:"c"`
+	}
+	for iter.Next(&counter) {
+		kind := counter.Key[:strings.Index(counter.Key, ":")+1]
+		rest := counter.Key[len(kind)+len(oldKey):]
+		if _, err := counters.Upsert(bson.D{
+			{"k", kind + newKey + rest},
+			{"t", counter.Time},
+		}, bson.D{{"$inc", bson.D{{"c", counter.Count}}}}); err != nil {
+			iter.Close()
+			return errgo.Notef(err, "cannot copy stats counter")
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate stats counters")
+	}
+	return nil
+}
+
+// Redirect returns the id that id now refers to if its base entity
+// has been transferred with TransferBaseEntity. If there is no such
+// redirect, it returns an error with an ErrNotFound cause.
+func (s *Store) Redirect(id *charm.URL) (*charm.URL, error) {
+	if id.User == "" {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	var r mongodoc.Redirect
+	if err := s.DB.Redirects().FindId(mongodoc.BaseURL(id)).One(&r); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+		}
+		return nil, errgo.Notef(err, "cannot get redirect for %q", id)
+	}
+	return transferURL(id, r.To), nil
+}
+
+// transferURL returns a copy of id with its user and name replaced by
+// those of the base URL to.
+func transferURL(id, to *charm.URL) *charm.URL {
+	newURL := *id
+	newURL.User = to.User
+	newURL.Name = to.Name
+	return &newURL
+}
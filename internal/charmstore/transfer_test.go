@@ -0,0 +1,283 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type transferSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&transferSuite{})
+
+func (s *transferSuite) TestTransferBaseEntity(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~alice/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "someResource", "resource content")
+	id1 := MustParseResolvedURL("cs:~alice/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&id1.URL, "stable.read", "everyone")
+	c.Assert(err, gc.Equals, nil)
+	err = store.UpdateBaseEntity(id1, bson.D{{
+		"$set", bson.D{{"commoninfo.homepage", []byte(`"http://example.com"`)}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncCounterAtTime(EntityStatsKey(&id1.URL, params.StatsArchiveDownload), time.Now())
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncCounterAtTime(EntityStatsKey(&id1.URL, params.StatsArchiveDownload), time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	from := charm.MustParseURL("cs:~alice/wordpress")
+	to := charm.MustParseURL("cs:~team/wp")
+	err = store.TransferBaseEntity(from, to)
+	c.Assert(err, gc.Equals, nil)
+
+	// The entities have moved.
+	for _, id := range []string{"cs:~team/precise/wp-0", "cs:~team/precise/wp-1"} {
+		e, err := store.FindEntity(MustParseResolvedURL(id), nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.BaseURL, jc.DeepEquals, to)
+		c.Assert(e.User, gc.Equals, "team")
+		c.Assert(e.Name, gc.Equals, "wp")
+	}
+	for _, id := range []*charm.URL{&id0.URL, &id1.URL} {
+		_, err := store.FindEntity(MustParseResolvedURL(id.String()), nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+
+	// The base entity has moved, keeping its ACLs and extra-info.
+	_, err = store.FindBaseEntity(from, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	be, err := store.FindBaseEntity(to, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.User, gc.Equals, "team")
+	c.Assert(be.Name, gc.Equals, "wp")
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, []string{"everyone"})
+	c.Assert(be.CommonInfo, jc.DeepEquals, map[string][]byte{
+		"homepage": []byte(`"http://example.com"`),
+	})
+	c.Assert(be.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		"precise": charm.MustParseURL("cs:~team/precise/wp-1"),
+	})
+
+	// The resources have moved.
+	n, err := store.DB.Resources().Find(bson.D{{"baseurl", from}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	var resources []*mongodoc.Resource
+	err = store.DB.Resources().Find(bson.D{{"baseurl", to}}).All(&resources)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Name, gc.Equals, "someResource")
+
+	// The stats counters have been copied.
+	cs, err := store.Counters(&CounterRequest{
+		Key: EntityStatsKey(charm.MustParseURL("cs:~team/precise/wp-1"), params.StatsArchiveDownload),
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(cs, gc.HasLen, 1)
+	c.Assert(cs[0].Count, gc.Equals, int64(2))
+
+	// The search records have moved.
+	present, err := store.ES.HasDocument(s.TestIndex, typeName, store.ES.getID(&id1.URL))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(present, gc.Equals, false)
+	present, err = store.ES.HasDocument(s.TestIndex, typeName, store.ES.getID(charm.MustParseURL("cs:~team/precise/wp-1")))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(present, gc.Equals, true)
+
+	// The old ids redirect to the new ones.
+	newURL, err := store.Redirect(&id0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newURL, jc.DeepEquals, charm.MustParseURL("cs:~team/precise/wp-0"))
+	newURL, err = store.Redirect(charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newURL, jc.DeepEquals, to)
+	_, err = store.Redirect(charm.MustParseURL("cs:~alice/mysql"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *transferSuite) TestTransferBaseEntityMultiSeriesStats(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~alice/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncCounterAtTime(EntityStatsKey(&id.URL, params.StatsArchiveDownload), time.Now())
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), charm.MustParseURL("cs:~bob/wp"))
+	c.Assert(err, gc.Equals, nil)
+	cs, err := store.Counters(&CounterRequest{
+		Key: EntityStatsKey(charm.MustParseURL("cs:~bob/wp-0"), params.StatsArchiveDownload),
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(cs, gc.HasLen, 1)
+	c.Assert(cs[0].Count, gc.Equals, int64(1))
+}
+
+func (s *transferSuite) TestTransferBaseEntityOverQuota(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.AddCharmWithArchive(MustParseResolvedURL("cs:~alice/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/mysql-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetQuota(&mongodoc.Quota{
+		User:        "bob",
+		MaxEntities: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `entity quota exceeded for user "bob" \(limit 1 entities\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrQuotaExceeded)
+	_, err = store.FindBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Renaming within a namespace does not use any more quota.
+	err = store.SetQuota(&mongodoc.Quota{
+		User:        "alice",
+		MaxEntities: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), charm.MustParseURL("cs:~alice/wp"))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *transferSuite) TestTransferBaseEntityDeletedEntities(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, id := range []string{"cs:~alice/precise/wordpress-0", "cs:~alice/precise/wordpress-1"} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.DeleteEntity(MustParseResolvedURL("cs:~alice/precise/wordpress-0"))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	// The deleted entity can be restored under its new id.
+	_, err = store.RestoreEntity(charm.MustParseURL("cs:~alice/precise/wordpress-0"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	rid, err := store.RestoreEntity(charm.MustParseURL("cs:~bob/precise/wordpress-0"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rid.URL.String(), gc.Equals, "cs:~bob/precise/wordpress-0")
+}
+
+func (s *transferSuite) TestTransferBaseEntityChainedRedirects(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.AddCharmWithArchive(MustParseResolvedURL("cs:~alice/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~alice/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), charm.MustParseURL("cs:~carol/wp"))
+	c.Assert(err, gc.Equals, nil)
+
+	for _, id := range []string{"cs:~alice/precise/wordpress-0", "cs:~bob/precise/wordpress-0"} {
+		newURL, err := store.Redirect(charm.MustParseURL(id))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(newURL.String(), gc.Equals, "cs:~carol/precise/wp-0")
+	}
+
+	// Transferring back to an old id removes its redirect.
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~carol/wp"), charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.Redirect(charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	newURL, err := store.Redirect(charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newURL.String(), gc.Equals, "cs:~alice/wordpress")
+}
+
+var transferBaseEntityErrorTests = []struct {
+	about       string
+	from        string
+	to          string
+	expectError string
+	expectCause error
+}{{
+	about:       "source not found",
+	from:        "cs:~alice/mysql",
+	to:          "cs:~bob/mysql",
+	expectError: `base entity not found`,
+	expectCause: params.ErrNotFound,
+}, {
+	about:       "target exists",
+	from:        "cs:~alice/wordpress",
+	to:          "cs:~bob/wordpress",
+	expectError: `"cs:~bob/wordpress" already exists`,
+	expectCause: params.ErrDuplicateUpload,
+}, {
+	about:       "promulgated source",
+	from:        "cs:~charmers/wordpress",
+	to:          "cs:~bob/wp",
+	expectError: `cannot transfer promulgated "cs:~charmers/wordpress"`,
+	expectCause: params.ErrForbidden,
+}, {
+	about:       "no user",
+	from:        "cs:~alice/wordpress",
+	to:          "cs:wp",
+	expectError: `user not specified in "cs:wp"`,
+	expectCause: params.ErrBadRequest,
+}, {
+	about:       "not a base entity",
+	from:        "cs:~alice/precise/wordpress-0",
+	to:          "cs:~bob/wp",
+	expectError: `"cs:~alice/precise/wordpress-0" is not a base entity id`,
+	expectCause: params.ErrBadRequest,
+}, {
+	about:       "same id",
+	from:        "cs:~alice/wordpress",
+	to:          "cs:~alice/wordpress",
+	expectError: `cannot transfer "cs:~alice/wordpress" to itself`,
+	expectCause: params.ErrBadRequest,
+}}
+
+func (s *transferSuite) TestTransferBaseEntityErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, id := range []string{"cs:~alice/precise/wordpress-0", "cs:~bob/precise/wordpress-0", "0 cs:~charmers/precise/wordpress-0"} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for i, test := range transferBaseEntityErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.TransferBaseEntity(charm.MustParseURL(test.from), charm.MustParseURL(test.to))
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, test.expectCause)
+	}
+	// Nothing has moved.
+	for _, id := range []string{"cs:~alice/precise/wordpress-0", "cs:~bob/precise/wordpress-0", "cs:~charmers/precise/wordpress-0"} {
+		_, err := store.FindEntity(MustParseResolvedURL(id), nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
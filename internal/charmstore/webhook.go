@@ -0,0 +1,568 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	tomb "gopkg.in/tomb.v2"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+const (
+	// WebhookEventHeader holds the name of the header holding the
+	// event in a webhook delivery.
+	WebhookEventHeader = "X-Charmstore-Event"
+
+	// WebhookDeliveryHeader holds the name of the header holding
+	// the id of a webhook delivery.
+	WebhookDeliveryHeader = "X-Charmstore-Delivery"
+
+	// WebhookSignatureHeader holds the name of the header holding
+	// the signature of a webhook delivery. It holds "sha256="
+	// followed by the hex-encoded HMAC-SHA256 of the request
+	// body keyed with the webhook secret.
+	WebhookSignatureHeader = "X-Charmstore-Signature"
+)
+
+// webhookDeliveryClaimTimeout holds how long a webhook delivery may
+// remain claimed by a server before another server may claim it.
+const webhookDeliveryClaimTimeout = 5 * time.Minute
+
+// webhookRetryDelay holds the delay before the first retry of a failed
+// webhook delivery. The delay doubles with each further retry.
+const webhookRetryDelay = time.Minute
+
+// maxWebhookAttempts holds the number of attempts made to deliver an
+// event before the delivery is marked as failed.
+const maxWebhookAttempts = 5
+
+// webhookDeliveryRetention holds how long webhook deliveries are kept
+// in the delivery log.
+const webhookDeliveryRetention = 30 * 24 * time.Hour
+
+// webhookClient holds the HTTP client used to deliver webhook events.
+// It refuses to connect to private addresses.
+var webhookClient = newWebhookClient(false)
+
+// privateWebhookClient holds the HTTP client used to deliver webhook
+// events when the server has been configured to allow deliveries to
+// private addresses.
+var privateWebhookClient = newWebhookClient(true)
+
+// newWebhookClient returns an HTTP client suitable for delivering
+// webhook events. Redirects are never followed. Unless allowPrivate is
+// true, connections to loopback, link-local, private and unspecified
+// addresses are refused. The check is made on the addresses that the
+// client actually connects to, so that it cannot be circumvented by a
+// host name that resolves to such an address.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.Dial
+	if !allowPrivate {
+		dial = func(network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			for _, ip := range ips {
+				if isPrivateIP(ip) {
+					return nil, errgo.Newf("webhook address %s is not allowed", ip)
+				}
+			}
+			if len(ips) == 0 {
+				return nil, errgo.Newf("no addresses found for %q", host)
+			}
+			return dialer.Dial(network, net.JoinHostPort(ips[0].String(), port))
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial:                dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+// privateNets holds the address ranges that webhooks may not be
+// delivered to unless the server allows it.
+var privateNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// isPrivateIP reports whether ip is a loopback, link-local, private or
+// unspecified address.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload holds the JSON body posted to webhooks.
+type WebhookPayload struct {
+	// Event holds the kind of event that occurred.
+	Event mongodoc.StoreEvent
+
+	// Id holds the id of the charm or bundle affected.
+	// It is the base URL for promulgation events and
+	// is omitted for ping events.
+	Id *charm.URL `json:",omitempty"`
+
+	// Channels holds the channels published to
+	// for publish events.
+	Channels []params.Channel `json:",omitempty"`
+
+	// Time holds when the event occurred.
+	Time time.Time
+}
+
+// AddWebhook adds the given webhook. Exactly one of wh.User and
+// wh.BaseURL must be set. If wh.Secret is empty, a random secret is
+// generated. The Id and CreateTime fields of wh are filled in if they
+// are not set.
+func (s *Store) AddWebhook(wh *mongodoc.Webhook) error {
+	if (wh.User == "") == (wh.BaseURL == nil) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "exactly one of user and entity must be specified")
+	}
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid webhook URL %q", wh.URL)
+	}
+	for _, e := range wh.Events {
+		if !validWebhookEvents[e] {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid webhook event %q", e)
+		}
+	}
+	if wh.Secret == "" {
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			return errgo.Notef(err, "cannot generate webhook secret")
+		}
+		wh.Secret = hex.EncodeToString(secret)
+	}
+	if wh.Id == "" {
+		wh.Id = bson.NewObjectId()
+	}
+	if wh.CreateTime.IsZero() {
+		wh.CreateTime = time.Now()
+	}
+	if err := s.DB.Webhooks().Insert(wh); err != nil {
+		return errgo.Notef(err, "cannot add webhook")
+	}
+	return nil
+}
+
+var validWebhookEvents = map[mongodoc.StoreEvent]bool{
+	mongodoc.EventUpload:       true,
+	mongodoc.EventPublish:      true,
+	mongodoc.EventPromulgate:   true,
+	mongodoc.EventUnpromulgate: true,
+	mongodoc.EventPerm:         true,
+	mongodoc.EventDelete:       true,
+}
+
+// NamespaceWebhooks returns the webhooks subscribed to the events in
+// the namespace of the given user, oldest first.
+func (s *Store) NamespaceWebhooks(user string) ([]*mongodoc.Webhook, error) {
+	var whs []*mongodoc.Webhook
+	if err := s.DB.Webhooks().Find(bson.D{{"user", user}}).Sort("_id").All(&whs); err != nil {
+		return nil, errgo.Notef(err, "cannot get webhooks for %q", user)
+	}
+	return whs, nil
+}
+
+// EntityWebhooks returns the webhooks subscribed to the events of the
+// base entity of the given id, oldest first.
+func (s *Store) EntityWebhooks(id *charm.URL) ([]*mongodoc.Webhook, error) {
+	baseURL := mongodoc.BaseURL(id)
+	var whs []*mongodoc.Webhook
+	if err := s.DB.Webhooks().Find(bson.D{{"baseurl", baseURL}}).Sort("_id").All(&whs); err != nil {
+		return nil, errgo.Notef(err, "cannot get webhooks for %q", baseURL)
+	}
+	return whs, nil
+}
+
+// FindWebhook returns the webhook with the given id. If there is no
+// such webhook, an error with an ErrNotFound cause is returned.
+func (s *Store) FindWebhook(webhookId string) (*mongodoc.Webhook, error) {
+	if !bson.IsObjectIdHex(webhookId) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", webhookId)
+	}
+	var wh mongodoc.Webhook
+	if err := s.DB.Webhooks().FindId(bson.ObjectIdHex(webhookId)).One(&wh); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", webhookId)
+		}
+		return nil, errgo.Notef(err, "cannot get webhook %q", webhookId)
+	}
+	return &wh, nil
+}
+
+// RemoveWebhook removes the webhook with the given id along with its
+// deliveries. If there is no such webhook, an error with an
+// ErrNotFound cause is returned.
+func (s *Store) RemoveWebhook(webhookId string) error {
+	if !bson.IsObjectIdHex(webhookId) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", webhookId)
+	}
+	id := bson.ObjectIdHex(webhookId)
+	if err := s.DB.Webhooks().RemoveId(id); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", webhookId)
+		}
+		return errgo.Notef(err, "cannot remove webhook %q", webhookId)
+	}
+	if _, err := s.DB.WebhookDeliveries().RemoveAll(bson.D{{"webhookid", id}}); err != nil {
+		return errgo.Notef(err, "cannot remove deliveries of webhook %q", webhookId)
+	}
+	return nil
+}
+
+// WebhookDeliveries returns at most limit of the most recent
+// deliveries to the webhook with the given id, newest first. If limit
+// is zero, all the deliveries are returned.
+func (s *Store) WebhookDeliveries(webhookId string, limit int) ([]*mongodoc.WebhookDelivery, error) {
+	if !bson.IsObjectIdHex(webhookId) {
+		return nil, nil
+	}
+	var ds []*mongodoc.WebhookDelivery
+	q := s.DB.WebhookDeliveries().Find(bson.D{{"webhookid", bson.ObjectIdHex(webhookId)}}).Sort("-createtime", "-_id")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.All(&ds); err != nil {
+		return nil, errgo.Notef(err, "cannot get deliveries of webhook %q", webhookId)
+	}
+	return ds, nil
+}
+
+// notifyWebhooks queues the delivery of the given event affecting the
+// entity with the given id to each webhook subscribed to it. The
+// channels are only relevant to publish events. Failures are logged
+// rather than returned because the event has already happened.
+func (s *Store) notifyWebhooks(event mongodoc.StoreEvent, id *charm.URL, channels []params.Channel) {
+	var whs []*mongodoc.Webhook
+	err := s.DB.Webhooks().Find(bson.D{{"$or", []bson.D{
+		{{"user", id.User}},
+		{{"baseurl", mongodoc.BaseURL(id)}},
+	}}}).Select(FieldSelector("events")).All(&whs)
+	if err != nil {
+		logger.Errorf("cannot get webhooks for %v: %v", id, err)
+		return
+	}
+	if len(whs) == 0 {
+		return
+	}
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{
+		Event:    event,
+		Id:       id,
+		Channels: channels,
+		Time:     now.UTC(),
+	})
+	if err != nil {
+		logger.Errorf("cannot marshal webhook payload: %v", err)
+		return
+	}
+	for _, wh := range whs {
+		if !webhookWants(wh, event) {
+			continue
+		}
+		if err := s.DB.WebhookDeliveries().Insert(&mongodoc.WebhookDelivery{
+			Id:          bson.NewObjectId(),
+			WebhookId:   wh.Id,
+			Event:       event,
+			Payload:     payload,
+			Status:      mongodoc.WebhookDeliveryPending,
+			NextAttempt: now,
+			CreateTime:  now,
+		}); err != nil {
+			logger.Errorf("cannot queue %s delivery to webhook %s: %v", event, wh.Id.Hex(), err)
+		}
+	}
+}
+
+// webhookWants reports whether the given webhook is subscribed to the
+// given event.
+func webhookWants(wh *mongodoc.Webhook, event mongodoc.StoreEvent) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// PingWebhook delivers a ping event to the webhook with the given id
+// immediately and returns the resulting delivery. A ping that fails is
+// not retried. If there is no such webhook, an error with an
+// ErrNotFound cause is returned.
+func (s *Store) PingWebhook(webhookId string) (*mongodoc.WebhookDelivery, error) {
+	wh, err := s.FindWebhook(webhookId)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{
+		Event: mongodoc.EventPing,
+		Time:  now.UTC(),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	d := &mongodoc.WebhookDelivery{
+		Id:          bson.NewObjectId(),
+		WebhookId:   wh.Id,
+		Event:       mongodoc.EventPing,
+		Payload:     payload,
+		Status:      mongodoc.WebhookDeliveryRunning,
+		NextAttempt: now,
+		ClaimTime:   now,
+		CreateTime:  now,
+	}
+	if err := s.DB.WebhookDeliveries().Insert(d); err != nil {
+		return nil, errgo.Notef(err, "cannot add ping delivery")
+	}
+	if err := s.attemptWebhookDelivery(wh, d, now); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return d, nil
+}
+
+// RunWebhookDeliveries attempts all the webhook deliveries that are due
+// at the given time. Each delivery is claimed atomically before it is
+// attempted, so that several servers may run deliveries concurrently.
+// A delivery that fails is retried after a delay that doubles with each
+// attempt, until maxWebhookAttempts attempts have been made. It returns
+// the number of attempts made.
+func (s *Store) RunWebhookDeliveries(now time.Time) (int, error) {
+	n := 0
+	for {
+		d, err := s.claimWebhookDelivery(now)
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		if d == nil {
+			return n, nil
+		}
+		wh, err := s.FindWebhook(d.WebhookId.Hex())
+		if errgo.Cause(err) == params.ErrNotFound {
+			// The webhook was removed after the event was queued.
+			if err := s.DB.WebhookDeliveries().RemoveId(d.Id); err != nil && err != mgo.ErrNotFound {
+				return n, errgo.Notef(err, "cannot remove webhook delivery %s", d.Id.Hex())
+			}
+			continue
+		}
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		if err := s.attemptWebhookDelivery(wh, d, now); err != nil {
+			return n, errgo.Mask(err)
+		}
+		n++
+	}
+}
+
+// claimWebhookDelivery claims the earliest webhook delivery that is due
+// at the given time and that no other server is attempting. It returns
+// nil if there is none.
+func (s *Store) claimWebhookDelivery(now time.Time) (*mongodoc.WebhookDelivery, error) {
+	var d mongodoc.WebhookDelivery
+	_, err := s.DB.WebhookDeliveries().Find(bson.D{{"$or", []bson.D{{
+		{"status", mongodoc.WebhookDeliveryPending},
+		{"nextattempt", bson.D{{"$lte", now}}},
+	}, {
+		{"status", mongodoc.WebhookDeliveryRunning},
+		{"claimtime", bson.D{{"$lt", now.Add(-webhookDeliveryClaimTimeout)}}},
+	}}}}).Sort("nextattempt", "_id").Apply(mgo.Change{
+		Update: bson.D{{"$set", bson.D{
+			{"status", mongodoc.WebhookDeliveryRunning},
+			{"claimtime", now},
+		}}},
+		ReturnNew: true,
+	}, &d)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot claim webhook delivery")
+	}
+	return &d, nil
+}
+
+// attemptWebhookDelivery makes one attempt to deliver d to wh at the
+// given time and records the outcome in d and in the database.
+func (s *Store) attemptWebhookDelivery(wh *mongodoc.Webhook, d *mongodoc.WebhookDelivery, now time.Time) error {
+	attempt := mongodoc.WebhookAttempt{
+		Time: now,
+	}
+	client := webhookClient
+	if s.pool.config.WebhookAllowPrivateAddresses {
+		client = privateWebhookClient
+	}
+	code, err := postWebhook(client, wh, d)
+	attempt.StatusCode = code
+	d.Attempts = append(d.Attempts, attempt)
+	switch {
+	case err == nil:
+		d.Status = mongodoc.WebhookDeliveryDelivered
+	case d.Event == mongodoc.EventPing || len(d.Attempts) >= maxWebhookAttempts:
+		d.Attempts[len(d.Attempts)-1].Error = err.Error()
+		d.Status = mongodoc.WebhookDeliveryFailed
+	default:
+		d.Attempts[len(d.Attempts)-1].Error = err.Error()
+		d.Status = mongodoc.WebhookDeliveryPending
+		d.NextAttempt = now.Add(webhookRetryDelay << uint(len(d.Attempts)-1))
+	}
+	if err != nil {
+		logger.Infof("delivery %s to webhook %s failed: %v", d.Id.Hex(), wh.Id.Hex(), err)
+	}
+	if err := s.DB.WebhookDeliveries().UpdateId(d.Id, bson.D{
+		{"$set", bson.D{
+			{"status", d.Status},
+			{"nextattempt", d.NextAttempt},
+		}},
+		{"$push", bson.D{{"attempts", d.Attempts[len(d.Attempts)-1]}}},
+	}); err != nil {
+		return errgo.Notef(err, "cannot update webhook delivery %s", d.Id.Hex())
+	}
+	return nil
+}
+
+// postWebhook uses the given client to post the payload of d to wh,
+// signed with the webhook secret. It returns the status code of the
+// response, if any. A redirect response is treated as a failure.
+func postWebhook(client *http.Client, wh *mongodoc.Webhook, d *mongodoc.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(d.Event))
+	req.Header.Set(WebhookDeliveryHeader, d.Id.Hex())
+	req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(wh.Secret, d.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errgo.Newf("unexpected response status %q", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookSignature returns the hex-encoded HMAC-SHA256 of the given
+// payload keyed with the given secret.
+func WebhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliverer implements the worker that periodically attempts
+// the webhook deliveries that are due.
+type webhookDeliverer struct {
+	tomb     tomb.Tomb
+	pool     *Pool
+	interval time.Duration
+}
+
+// newWebhookDeliverer returns a new running webhook deliverer worker
+// that attempts the webhook deliveries that are due at the given
+// interval.
+func newWebhookDeliverer(pool *Pool, interval time.Duration) *webhookDeliverer {
+	d := &webhookDeliverer{
+		pool:     pool,
+		interval: interval,
+	}
+	d.tomb.Go(d.run)
+	return d
+}
+
+// Kill implements worker.Worker.Kill.
+func (d *webhookDeliverer) Kill() {
+	d.tomb.Kill(nil)
+}
+
+// Wait implements worker.Worker.Wait.
+func (d *webhookDeliverer) Wait() error {
+	return d.tomb.Wait()
+}
+
+func (d *webhookDeliverer) run() error {
+	for {
+		if err := d.doDeliver(); err != nil {
+			logger.Errorf("%v", err)
+		}
+		select {
+		case <-d.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+func (d *webhookDeliverer) doDeliver() error {
+	store := d.pool.Store()
+	defer store.Close()
+	if _, err := store.RunWebhookDeliveries(time.Now()); err != nil {
+		return errgo.Notef(err, "webhook delivery failed")
+	}
+	return nil
+}
@@ -0,0 +1,508 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+)
+
+type webhookSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&webhookSuite{})
+
+// webhookRequest holds a request received by a webhookServer.
+type webhookRequest struct {
+	header  http.Header
+	payload []byte
+}
+
+// webhookServer is an HTTP server that records the webhook
+// deliveries it receives and responds with a configurable status.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []webhookRequest
+}
+
+func newWebhookServer() *webhookServer {
+	srv := &webhookServer{
+		status: http.StatusOK,
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.requests = append(srv.requests, webhookRequest{
+			header:  req.Header,
+			payload: body,
+		})
+		w.WriteHeader(srv.status)
+	}))
+	return srv
+}
+
+func (srv *webhookServer) setStatus(status int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.status = status
+}
+
+func (srv *webhookServer) received() []webhookRequest {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]webhookRequest(nil), srv.requests...)
+}
+
+func (s *webhookSuite) TestNamespaceWebhookEvents(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	wh := &mongodoc.Webhook{
+		User:   "bob",
+		URL:    srv.URL,
+		Secret: "s3cret",
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+
+	id0 := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	id1 := MustParseResolvedURL("cs:~bob/precise/wordpress-1")
+	for _, id := range []*router.ResolvedURL{id0, id1} {
+		err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err = store.Publish(id1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(id1, true)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DeleteEntity(id0)
+	c.Assert(err, gc.Equals, nil)
+
+	// Events in other namespaces are not delivered.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~alice/precise/mysql-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.RunWebhookDeliveries(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 5)
+
+	reqs := srv.received()
+	c.Assert(reqs, gc.HasLen, 5)
+	var payloads []WebhookPayload
+	for _, req := range reqs {
+		c.Assert(req.header.Get("Content-Type"), gc.Equals, "application/json")
+		c.Assert(req.header.Get(WebhookSignatureHeader), gc.Equals, "sha256="+WebhookSignature("s3cret", req.payload))
+		var p WebhookPayload
+		err := json.Unmarshal(req.payload, &p)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(req.header.Get(WebhookEventHeader), gc.Equals, string(p.Event))
+		c.Assert(p.Time.IsZero(), gc.Equals, false)
+		p.Time = time.Time{}
+		payloads = append(payloads, p)
+	}
+	c.Assert(payloads, jc.DeepEquals, []WebhookPayload{{
+		Event: mongodoc.EventUpload,
+		Id:    &id0.URL,
+	}, {
+		Event: mongodoc.EventUpload,
+		Id:    &id1.URL,
+	}, {
+		Event:    mongodoc.EventPublish,
+		Id:       &id1.URL,
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		Event: mongodoc.EventPromulgate,
+		Id:    charm.MustParseURL("cs:~bob/wordpress"),
+	}, {
+		Event: mongodoc.EventDelete,
+		Id:    &id0.URL,
+	}})
+
+	ds, err := store.WebhookDeliveries(wh.Id.Hex(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds, gc.HasLen, 5)
+	for i, d := range ds {
+		c.Assert(d.Status, gc.Equals, mongodoc.WebhookDeliveryDelivered)
+		c.Assert(d.Attempts, gc.HasLen, 1)
+		c.Assert(d.Attempts[0].StatusCode, gc.Equals, http.StatusOK)
+		// The deliveries are returned newest first.
+		c.Assert(reqs[len(reqs)-1-i].header.Get(WebhookDeliveryHeader), gc.Equals, d.Id.Hex())
+	}
+
+	// Nothing more is delivered.
+	n, err = store.RunWebhookDeliveries(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *webhookSuite) TestEntityWebhookEvents(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	id := MustParseResolvedURL("cs:~bob/precise/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	wh := &mongodoc.Webhook{
+		BaseURL: charm.MustParseURL("cs:~bob/wordpress"),
+		URL:     srv.URL,
+		Events:  []mongodoc.StoreEvent{mongodoc.EventPublish},
+	}
+	err = store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(wh.Secret, gc.Not(gc.Equals), "")
+
+	// Other base entities and events are not delivered.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/mysql-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-1"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	n, err := store.RunWebhookDeliveries(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	reqs := srv.received()
+	c.Assert(reqs, gc.HasLen, 1)
+	c.Assert(reqs[0].header.Get(WebhookEventHeader), gc.Equals, "publish")
+	c.Assert(reqs[0].header.Get(WebhookSignatureHeader), gc.Equals, "sha256="+WebhookSignature(wh.Secret, reqs[0].payload))
+
+	whs, err := store.EntityWebhooks(charm.MustParseURL("cs:~bob/precise/wordpress-3"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whs, gc.HasLen, 1)
+	c.Assert(whs[0].Id, gc.Equals, wh.Id)
+	whs, err = store.NamespaceWebhooks("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whs, gc.HasLen, 0)
+}
+
+func (s *webhookSuite) TestWebhookDeliveryRetries(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+	srv.setStatus(http.StatusInternalServerError)
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	now := time.Now()
+	n, err := store.RunWebhookDeliveries(now)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	ds, err := store.WebhookDeliveries(wh.Id.Hex(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds, gc.HasLen, 1)
+	c.Assert(ds[0].Status, gc.Equals, mongodoc.WebhookDeliveryPending)
+	c.Assert(ds[0].Attempts, gc.HasLen, 1)
+	c.Assert(ds[0].Attempts[0].StatusCode, gc.Equals, http.StatusInternalServerError)
+	c.Assert(ds[0].Attempts[0].Error, gc.Equals, `unexpected response status "500 Internal Server Error"`)
+	c.Assert(ds[0].NextAttempt.Equal(now.Add(webhookRetryDelay).Truncate(time.Millisecond)), gc.Equals, true)
+
+	// The delivery is not retried until the delay has passed.
+	n, err = store.RunWebhookDeliveries(now)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	// The delay doubles with each attempt.
+	delay := webhookRetryDelay
+	for i := 1; i < maxWebhookAttempts; i++ {
+		now = now.Add(delay)
+		n, err = store.RunWebhookDeliveries(now)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(n, gc.Equals, 1)
+		delay *= 2
+	}
+	c.Assert(srv.received(), gc.HasLen, maxWebhookAttempts)
+	ds, err = store.WebhookDeliveries(wh.Id.Hex(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds[0].Status, gc.Equals, mongodoc.WebhookDeliveryFailed)
+	c.Assert(ds[0].Attempts, gc.HasLen, maxWebhookAttempts)
+
+	// Failed deliveries are not retried.
+	n, err = store.RunWebhookDeliveries(now.Add(24 * time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *webhookSuite) TestWebhookDeliveryRecovers(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+	srv.setStatus(http.StatusServiceUnavailable)
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	now := time.Now()
+	_, err = store.RunWebhookDeliveries(now)
+	c.Assert(err, gc.Equals, nil)
+	srv.setStatus(http.StatusNoContent)
+	n, err := store.RunWebhookDeliveries(now.Add(webhookRetryDelay))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	ds, err := store.WebhookDeliveries(wh.Id.Hex(), 1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds, gc.HasLen, 1)
+	c.Assert(ds[0].Status, gc.Equals, mongodoc.WebhookDeliveryDelivered)
+	c.Assert(ds[0].Attempts, gc.HasLen, 2)
+	c.Assert(ds[0].Attempts[1].StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(ds[0].Attempts[1].Error, gc.Equals, "")
+}
+
+func (s *webhookSuite) TestPingWebhook(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+
+	d, err := store.PingWebhook(wh.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(d.Event, gc.Equals, mongodoc.EventPing)
+	c.Assert(d.Status, gc.Equals, mongodoc.WebhookDeliveryDelivered)
+	reqs := srv.received()
+	c.Assert(reqs, gc.HasLen, 1)
+	c.Assert(reqs[0].header.Get(WebhookEventHeader), gc.Equals, "ping")
+
+	// A failed ping is not retried.
+	srv.setStatus(http.StatusNotFound)
+	d, err = store.PingWebhook(wh.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(d.Status, gc.Equals, mongodoc.WebhookDeliveryFailed)
+	c.Assert(d.Attempts, gc.HasLen, 1)
+	c.Assert(d.Attempts[0].StatusCode, gc.Equals, http.StatusNotFound)
+	n, err := store.RunWebhookDeliveries(time.Now().Add(24 * time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	ds, err := store.WebhookDeliveries(wh.Id.Hex(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds, gc.HasLen, 2)
+
+	_, err = store.PingWebhook("bad-id")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *webhookSuite) TestWebhookPrivateAddressRejected(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, ServerParams{})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err = store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+
+	d, err := store.PingWebhook(wh.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(d.Status, gc.Equals, mongodoc.WebhookDeliveryFailed)
+	c.Assert(d.Attempts, gc.HasLen, 1)
+	c.Assert(d.Attempts[0].StatusCode, gc.Equals, 0)
+	c.Assert(d.Attempts[0].Error, gc.Matches, `.*webhook address 127\.0\.0\.1 is not allowed`)
+	c.Assert(srv.received(), gc.HasLen, 0)
+}
+
+func (s *webhookSuite) TestWebhookRedirectNotFollowed(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	target := newWebhookServer()
+	defer target.Close()
+	srv := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer srv.Close()
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+
+	d, err := store.PingWebhook(wh.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(d.Status, gc.Equals, mongodoc.WebhookDeliveryFailed)
+	c.Assert(d.Attempts, gc.HasLen, 1)
+	c.Assert(d.Attempts[0].StatusCode, gc.Equals, http.StatusFound)
+	c.Assert(target.received(), gc.HasLen, 0)
+}
+
+var isPrivateIPTests = []struct {
+	ip     string
+	expect bool
+}{
+	{"127.0.0.1", true},
+	{"::1", true},
+	{"169.254.169.254", true},
+	{"fe80::1", true},
+	{"10.1.2.3", true},
+	{"172.16.0.1", true},
+	{"192.168.1.1", true},
+	{"fd00::1", true},
+	{"0.0.0.0", true},
+	{"8.8.8.8", false},
+	{"172.32.0.1", false},
+	{"2001:4860:4860::8888", false},
+}
+
+func (s *webhookSuite) TestIsPrivateIP(c *gc.C) {
+	for i, test := range isPrivateIPTests {
+		c.Logf("test %d: %s", i, test.ip)
+		c.Assert(isPrivateIP(net.ParseIP(test.ip)), gc.Equals, test.expect)
+	}
+}
+
+func (s *webhookSuite) TestRemoveWebhook(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	wh := &mongodoc.Webhook{
+		User: "bob",
+		URL:  srv.URL,
+	}
+	err := store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.RemoveWebhook(wh.Id.Hex())
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.FindWebhook(wh.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	ds, err := store.WebhookDeliveries(wh.Id.Hex(), 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ds, gc.HasLen, 0)
+
+	// Queued deliveries are not made.
+	n, err := store.RunWebhookDeliveries(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(srv.received(), gc.HasLen, 0)
+
+	err = store.RemoveWebhook(wh.Id.Hex())
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *webhookSuite) TestTransferMovesWebhooks(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.AddCharmWithArchive(MustParseResolvedURL("cs:~bob/precise/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	wh := &mongodoc.Webhook{
+		BaseURL: charm.MustParseURL("cs:~bob/wordpress"),
+		URL:     "http://0.1.2.3/hook",
+	}
+	err = store.AddWebhook(wh)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	whs, err := store.EntityWebhooks(charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(whs, gc.HasLen, 1)
+	c.Assert(whs[0].Id, gc.Equals, wh.Id)
+}
+
+var addWebhookErrorTests = []struct {
+	about       string
+	webhook     mongodoc.Webhook
+	expectError string
+}{{
+	about: "no subject",
+	webhook: mongodoc.Webhook{
+		URL: "http://0.1.2.3/hook",
+	},
+	expectError: `exactly one of user and entity must be specified`,
+}, {
+	about: "both subjects",
+	webhook: mongodoc.Webhook{
+		User:    "bob",
+		BaseURL: charm.MustParseURL("cs:~bob/wordpress"),
+		URL:     "http://0.1.2.3/hook",
+	},
+	expectError: `exactly one of user and entity must be specified`,
+}, {
+	about: "no URL",
+	webhook: mongodoc.Webhook{
+		User: "bob",
+	},
+	expectError: `invalid webhook URL ""`,
+}, {
+	about: "bad scheme",
+	webhook: mongodoc.Webhook{
+		User: "bob",
+		URL:  "ftp://0.1.2.3/hook",
+	},
+	expectError: `invalid webhook URL "ftp://0.1.2.3/hook"`,
+}, {
+	about: "bad event",
+	webhook: mongodoc.Webhook{
+		User:   "bob",
+		URL:    "https://0.1.2.3/hook",
+		Events: []mongodoc.StoreEvent{mongodoc.EventPing},
+	},
+	expectError: `invalid webhook event "ping"`,
+}}
+
+func (s *webhookSuite) TestAddWebhookErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for i, test := range addWebhookErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.AddWebhook(&test.webhook)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+}
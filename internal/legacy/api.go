@@ -197,6 +197,12 @@ func (h *reqHandler) serveCharmInfo(_ http.Header, req *http.Request) (interface
 		var entity *mongodoc.Entity
 		if err == nil {
 			entity, err = h.store.FindBestEntity(curl, params.UnpublishedChannel, nil)
+			if errgo.Cause(err) == params.ErrNotFound {
+				// The charm may have been transferred to a new id.
+				if newURL, rerr := h.store.Redirect(curl); rerr == nil {
+					entity, err = h.store.FindBestEntity(newURL, params.UnpublishedChannel, nil)
+				}
+			}
 			if errgo.Cause(err) == params.ErrNotFound {
 				// The old API actually returned "entry not found"
 				// on *any* error, but it seems reasonable to be
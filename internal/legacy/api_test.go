@@ -256,6 +256,29 @@ func (s *APISuite) TestServeCharmInfo(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestServeCharmInfoTransferred(c *gc.C) {
+	_, wordpress := s.addPublicCharm(c, "wordpress", "cs:~bob/precise/wordpress-1")
+	hashSum := fileSHA256(c, wordpress.Path)
+	err := s.store.TransferBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), charm.MustParseURL("cs:~alice/wp"))
+	c.Assert(err, gc.Equals, nil)
+
+	// The old ids resolve to the transferred charm.
+	for _, url := range []string{"cs:~bob/precise/wordpress-1", "cs:~bob/wordpress"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          "/charm-info?charms=" + url,
+			ExpectStatus: http.StatusOK,
+			ExpectBody: map[string]charmrepo.InfoResponse{
+				url: {
+					CanonicalURL: "cs:~alice/precise/wp-1",
+					Sha256:       hashSum,
+					Revision:     1,
+				},
+			},
+		})
+	}
+}
+
 func (s *APISuite) TestCharmInfoCounters(c *gc.C) {
 	if !storetesting.MongoJSEnabled() {
 		c.Skip("MongoDB JavaScript not available")
@@ -137,6 +137,67 @@ type Entity struct {
 
 	// Published holds whether the entity has been published on a channel.
 	Published map[params.Channel]bool `json:",omitempty" bson:",omitempty"`
+
+	// Deprecation holds the deprecation state of the entity. It is
+	// nil if the entity has been neither deprecated nor yanked.
+	Deprecation *Deprecation `json:",omitempty" bson:",omitempty"`
+
+	// Approvals holds the decisions made by approvers on promoting
+	// the entity to the channel gated by the base entity's
+	// promotion policy. Each user has at most one decision for
+	// each channel.
+	Approvals []Approval `json:",omitempty" bson:",omitempty"`
+}
+
+// Approval holds an approver's decision on promoting an entity to a
+// gated channel.
+type Approval struct {
+	// Channel holds the channel the decision applies to.
+	Channel params.Channel
+
+	// User holds the name of the user that made the decision.
+	User string
+
+	// Rejected holds whether the promotion was rejected
+	// rather than approved.
+	Rejected bool `bson:",omitempty"`
+
+	// Comment holds an optional remark by the user.
+	Comment string `bson:",omitempty"`
+
+	// Time holds when the decision was made.
+	Time time.Time
+}
+
+// IsYanked reports whether the entity has been yanked.
+func (e *Entity) IsYanked() bool {
+	return e.Deprecation != nil && e.Deprecation.State == Yanked
+}
+
+// DeprecationState holds whether an entity is deprecated or yanked.
+type DeprecationState string
+
+const (
+	// Deprecated marks an entity that should no longer be used
+	// but that is still resolved as normal.
+	Deprecated DeprecationState = "deprecated"
+
+	// Yanked marks an entity that is broken. Yanked entities are
+	// only resolved when their revision is given explicitly.
+	Yanked DeprecationState = "yanked"
+)
+
+// Deprecation holds the deprecation state of an entity.
+type Deprecation struct {
+	// State holds whether the entity is deprecated or yanked.
+	State DeprecationState
+
+	// Reason holds why the entity was deprecated or yanked.
+	Reason string `json:",omitempty" bson:",omitempty"`
+
+	// Replacement holds the id of the entity suggested
+	// in its place, if any.
+	Replacement *charm.URL `json:",omitempty" bson:",omitempty"`
 }
 
 // PreferredURL returns the preferred way to refer to this entity. If
@@ -154,6 +215,335 @@ func (e *Entity) PreferredURL(usePromulgated bool) *charm.URL {
 	return &u
 }
 
+// DeletedEntity holds an entry in the deleted entities collection.
+// When an entity is deleted, it is moved there so that it can be
+// restored until its retention period has expired.
+type DeletedEntity struct {
+	// URL holds the id of the deleted entity.
+	URL *charm.URL `bson:"_id"`
+
+	// Entity holds the entity document as it was
+	// when the entity was deleted.
+	Entity *Entity
+
+	// DeleteTime holds when the entity was deleted.
+	DeleteTime time.Time
+}
+
+// Redirect holds an entry in the redirects collection. When a base
+// entity is transferred to a new id, a redirect is left so that the
+// old id continues to resolve.
+type Redirect struct {
+	// From holds the base URL that the base entity was
+	// transferred from.
+	From *charm.URL `bson:"_id"`
+
+	// To holds the base URL that the base entity was
+	// transferred to.
+	To *charm.URL
+
+	// Time holds when the transfer happened.
+	Time time.Time
+}
+
+// PublishEvent holds an entry in the publish history collection. An
+// entry is recorded for each channel every time an entity is published.
+type PublishEvent struct {
+	// Id holds the unique id of the event.
+	Id bson.ObjectId `bson:"_id,omitempty"`
+
+	// BaseURL holds the base URL of the published entity.
+	BaseURL *charm.URL
+
+	// URL holds the id of the published entity.
+	URL *charm.URL
+
+	// Channel holds the channel the entity was published to.
+	Channel params.Channel
+
+	// Series holds the series for which the entity became
+	// the current revision in the channel.
+	Series []string
+
+	// Resources holds the resource revisions published
+	// with the entity.
+	Resources []ResourceRevision `bson:",omitempty"`
+
+	// User holds the name of the user that published the entity.
+	// It is empty when the entity was published by the charm store
+	// itself.
+	User string `bson:",omitempty"`
+
+	// Time holds when the entity was published.
+	Time time.Time
+
+	// RolledBackFrom holds the id of the entity that was current
+	// before a rollback. It is nil if the event was not a rollback.
+	RolledBackFrom *charm.URL `bson:",omitempty"`
+}
+
+// ScheduledPublish holds an entry in the scheduled publishes
+// collection. It records a publish of an entity that is to be made by
+// the scheduled publisher worker at a later time.
+type ScheduledPublish struct {
+	// Id holds the unique id of the scheduled publish.
+	Id bson.ObjectId `bson:"_id"`
+
+	// BaseURL holds the base URL of the entity to publish.
+	BaseURL *charm.URL
+
+	// URL holds the id of the entity to publish.
+	URL *charm.URL
+
+	// Channels holds the channels to publish the entity to, as
+	// provided when the publish was scheduled. Channels without a
+	// track are resolved when the entity is published.
+	Channels []params.Channel
+
+	// Resources holds the resource revisions to publish
+	// the entity with.
+	Resources []ResourceRevision `bson:",omitempty"`
+
+	// User holds the name of the user that scheduled the publish.
+	User string `bson:",omitempty"`
+
+	// Time holds when the entity is to be published.
+	Time time.Time
+
+	// Status holds the progress of the scheduled publish.
+	Status ScheduledPublishStatus
+
+	// ClaimTime holds when the scheduled publish was claimed
+	// by a charm store server for publishing.
+	ClaimTime time.Time `bson:",omitempty"`
+
+	// Error holds why the publish failed when Status
+	// is ScheduledPublishFailed.
+	Error string `bson:",omitempty"`
+}
+
+// ScheduledPublishStatus holds the progress of a scheduled publish.
+type ScheduledPublishStatus string
+
+const (
+	// ScheduledPublishPending marks a scheduled publish
+	// that has not yet been made.
+	ScheduledPublishPending ScheduledPublishStatus = "pending"
+
+	// ScheduledPublishRunning marks a scheduled publish that has
+	// been claimed by a charm store server and is being made.
+	ScheduledPublishRunning ScheduledPublishStatus = "running"
+
+	// ScheduledPublishFailed marks a scheduled publish
+	// that could not be made.
+	ScheduledPublishFailed ScheduledPublishStatus = "failed"
+)
+
+// Webhook holds an entry in the webhooks collection. It records a
+// subscription to the events affecting either the entities in a
+// namespace or those of a single base entity.
+type Webhook struct {
+	// Id holds the unique id of the webhook.
+	Id bson.ObjectId `bson:"_id"`
+
+	// User holds the namespace whose events are delivered.
+	// It is empty when BaseURL is set.
+	User string `bson:",omitempty"`
+
+	// BaseURL holds the base entity whose events are delivered.
+	// It is nil when User is set.
+	BaseURL *charm.URL `bson:",omitempty"`
+
+	// URL holds the URL that events are posted to.
+	URL string
+
+	// Secret holds the key used to sign the delivered payloads.
+	Secret string
+
+	// Events holds the events that are delivered. If it is
+	// empty, all events are delivered.
+	Events []StoreEvent `bson:",omitempty"`
+
+	// Creator holds the name of the user that created the webhook.
+	Creator string `bson:",omitempty"`
+
+	// CreateTime holds when the webhook was created.
+	CreateTime time.Time
+}
+
+// StoreEvent holds the kind of an event affecting the entities in
+// the store. Events are delivered to webhooks and, for some kinds,
+// recorded in the changes collection.
+type StoreEvent string
+
+const (
+	EventUpload       StoreEvent = "upload"
+	EventPublish      StoreEvent = "publish"
+	EventPromulgate   StoreEvent = "promulgate"
+	EventUnpromulgate StoreEvent = "unpromulgate"
+	EventPerm         StoreEvent = "perm"
+	EventDelete       StoreEvent = "delete"
+
+	// EventPing is only delivered when a webhook is tested.
+	EventPing StoreEvent = "ping"
+)
+
+// Change holds an entry in the changes collection. It records an
+// upload, publish, permission change or deletion so that clients
+// can follow the changes to the store.
+type Change struct {
+	// Id holds the sequence number of the change. Changes are
+	// numbered in the order they are recorded, starting at 1.
+	Id int64 `bson:"_id"`
+
+	// Event holds the kind of change.
+	Event StoreEvent
+
+	// URL holds the id of the entity changed.
+	URL *charm.URL
+
+	// Channels holds the channels published to
+	// for publish events.
+	Channels []params.Channel `bson:",omitempty"`
+
+	// Time holds when the change was recorded.
+	Time time.Time
+}
+
+// WebhookDelivery holds an entry in the webhook deliveries collection.
+// It records the delivery of an event to a webhook, including each
+// attempt made to deliver it.
+type WebhookDelivery struct {
+	// Id holds the unique id of the delivery.
+	Id bson.ObjectId `bson:"_id"`
+
+	// WebhookId holds the id of the webhook delivered to.
+	WebhookId bson.ObjectId
+
+	// Event holds the kind of event delivered.
+	Event StoreEvent
+
+	// Payload holds the JSON-encoded body that is posted.
+	Payload []byte
+
+	// Status holds the progress of the delivery.
+	Status WebhookDeliveryStatus
+
+	// Attempts holds the attempts made to deliver the event,
+	// oldest first.
+	Attempts []WebhookAttempt `bson:",omitempty"`
+
+	// NextAttempt holds the earliest time that the next attempt
+	// may be made.
+	NextAttempt time.Time
+
+	// ClaimTime holds when the delivery was claimed by a
+	// charm store server for an attempt.
+	ClaimTime time.Time `bson:",omitempty"`
+
+	// CreateTime holds when the event occurred.
+	CreateTime time.Time
+}
+
+// WebhookAttempt holds the outcome of an attempt to deliver an event.
+type WebhookAttempt struct {
+	// Time holds when the attempt was made.
+	Time time.Time
+
+	// StatusCode holds the HTTP status code of the response,
+	// or zero if no response was received.
+	StatusCode int `bson:",omitempty"`
+
+	// Error holds why the attempt failed, if it did.
+	Error string `bson:",omitempty"`
+}
+
+// WebhookDeliveryStatus holds the progress of a webhook delivery.
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryPending marks a delivery that is
+	// waiting for its next attempt.
+	WebhookDeliveryPending WebhookDeliveryStatus = "pending"
+
+	// WebhookDeliveryRunning marks a delivery that has been claimed
+	// by a charm store server and is being attempted.
+	WebhookDeliveryRunning WebhookDeliveryStatus = "running"
+
+	// WebhookDeliveryDelivered marks a delivery that
+	// has succeeded.
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+
+	// WebhookDeliveryFailed marks a delivery that failed
+	// on every attempt allowed.
+	WebhookDeliveryFailed WebhookDeliveryStatus = "failed"
+)
+
+// Group holds an entry in the groups collection. Groups in the
+// collection may be used in ACLs in the same way as the groups
+// known to the identity manager.
+type Group struct {
+	// Name holds the name of the group.
+	Name string `bson:"_id"`
+
+	// Members holds the names of the users in the group.
+	Members []string
+
+	// CreateTime holds when the group was created.
+	CreateTime time.Time
+}
+
+// APIToken holds an entry in the API tokens collection. An API token
+// lets a non-interactive client act as the user that created it, within
+// the limits of its scope.
+type APIToken struct {
+	// Id holds the unique id of the token.
+	Id bson.ObjectId `bson:"_id"`
+
+	// User holds the name of the user that the token acts as.
+	User string
+
+	// Description holds a description of what the token is used for.
+	Description string `bson:",omitempty"`
+
+	// Hash holds the hex-encoded SHA256 hash of the token secret.
+	// The secret itself is never stored.
+	Hash string
+
+	// Scope holds what the token may be used for.
+	Scope APITokenScope
+
+	// Namespace holds the only namespace that the token may be
+	// used to access, if it is restricted to one.
+	Namespace string `bson:",omitempty"`
+
+	// CreateTime holds when the token was created.
+	CreateTime time.Time
+
+	// ExpireTime holds when the token expires. It is
+	// zero if the token does not expire.
+	ExpireTime time.Time `bson:",omitempty"`
+
+	// LastUsed holds when the token was last used, if ever.
+	LastUsed time.Time `bson:",omitempty"`
+}
+
+// APITokenScope holds what an API token may be used for.
+type APITokenScope string
+
+const (
+	// APITokenRead allows a token to be used for reading only.
+	APITokenRead APITokenScope = "read"
+
+	// APITokenUpload allows a token to be used for reading and
+	// for uploading charms, bundles and resources.
+	APITokenUpload APITokenScope = "upload"
+
+	// APITokenPublish allows a token to be used for any
+	// operation that its user may perform.
+	APITokenPublish APITokenScope = "publish"
+)
+
 // BaseEntity holds metadata for a charm or bundle
 // independent of any specific uploaded revision or series.
 type BaseEntity struct {
@@ -180,7 +570,8 @@ type BaseEntity struct {
 
 	// ChannelACLs holds a map from an entity channel to the ACLs
 	// that apply to entities that use this base entity that are associated
-	// with the given channel.
+	// with the given channel. Channels in a track other than the latest
+	// track are keyed by "<track>/<risk>".
 	ChannelACLs map[params.Channel]ACL
 
 	// ChannelEntities holds a set of channels, each containing a set
@@ -198,6 +589,66 @@ type BaseEntity struct {
 	// at present, this signifies that someone has taken over control from
 	// the ingester.
 	NoIngest bool `bson:",omitempty"`
+
+	// RetentionPolicy holds the revision retention policy for the
+	// base entity. If it is nil, the global policy applies.
+	RetentionPolicy *RetentionPolicy `bson:",omitempty" json:",omitempty"`
+
+	// DefaultTrack holds the track used to resolve channels that
+	// do not specify a track. If it is empty, the latest track
+	// is used.
+	DefaultTrack string `bson:",omitempty" json:",omitempty"`
+
+	// PromotionPolicy holds the conditions that entities must meet
+	// before they can be published to a gated channel. If it is
+	// nil, publishing is not restricted beyond the channel ACLs.
+	PromotionPolicy *PromotionPolicy `bson:",omitempty" json:",omitempty"`
+}
+
+// PromotionPolicy holds the conditions that an entity must meet before
+// it can be published to a gated channel.
+type PromotionPolicy struct {
+	// Channel holds the gated channel. Channels without a track
+	// refer to the base entity's default track.
+	Channel params.Channel
+
+	// SourceChannel holds the channel that an entity must have been
+	// published to before it can be published to the gated channel.
+	// If it is empty, there is no such requirement.
+	SourceChannel params.Channel `bson:",omitempty"`
+
+	// MinSoak holds how long an entity must have been published in
+	// SourceChannel before it can be published to the gated channel.
+	MinSoak time.Duration `bson:",omitempty"`
+
+	// Approvers holds the users and groups that may approve
+	// promotions. If it is empty, anyone with write permission
+	// on the gated channel may approve.
+	Approvers []string `bson:",omitempty"`
+
+	// RequiredApprovals holds the number of approvals required
+	// from users other than the publisher.
+	RequiredApprovals int `bson:",omitempty"`
+}
+
+// RetentionPolicy holds a policy deciding which old revisions of a
+// base entity are pruned. The current revision in any channel is
+// never pruned, nor is the latest revision. A policy with neither
+// KeepUnpublished nor KeepYoungerThan set prunes nothing.
+type RetentionPolicy struct {
+	// KeepUnpublished holds the number of most recently uploaded
+	// revisions that have never been published and are not current
+	// in any channel to keep. If it is zero, revisions are not
+	// pruned because of their number.
+	KeepUnpublished int `bson:",omitempty"`
+
+	// KeepPublished holds whether to keep all revisions that have
+	// ever been published to a channel.
+	KeepPublished bool `bson:",omitempty"`
+
+	// KeepYoungerThan holds the age below which revisions are kept.
+	// If it is zero, revisions are not pruned because of their age.
+	KeepYoungerThan time.Duration `bson:",omitempty"`
 }
 
 // LatestRevision holds an entry in the revisions collection.
@@ -0,0 +1,21 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+// Quota holds the storage limits for the entities and
+// resources in a user's namespace.
+type Quota struct {
+	// User holds the name of the user that the quota applies
+	// to. The quota for the user "everyone" applies to all users
+	// that do not have a quota of their own.
+	User string `bson:"_id"`
+
+	// MaxBytes holds the maximum total size of the archives and
+	// resources in the user's namespace. Zero means no limit.
+	MaxBytes int64 `bson:",omitempty"`
+
+	// MaxEntities holds the maximum number of entities in
+	// the user's namespace. Zero means no limit.
+	MaxEntities int `bson:",omitempty"`
+}
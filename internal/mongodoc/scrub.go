@@ -0,0 +1,61 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mongodoc
+
+import (
+	"time"
+
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// ScrubReport holds the result of a run of the
+// blob integrity scrubber.
+type ScrubReport struct {
+	// Id holds the id of the report. Only the most
+	// recent report is kept, with the id "blobs".
+	Id string `bson:"_id"`
+
+	// StartTime and EndTime hold the times the scrub
+	// started and finished.
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Checked holds the number of distinct blobs that were
+	// read and verified.
+	Checked int
+
+	// Missing and Corrupt hold the number of entities and
+	// resources with missing and corrupt blobs respectively.
+	Missing int
+	Corrupt int
+
+	// Problems holds details of the entities and
+	// resources with missing or corrupt blobs. It
+	// may be truncated, in which case Truncated is true.
+	Problems  []ScrubProblem `bson:",omitempty"`
+	Truncated bool           `bson:",omitempty"`
+}
+
+// ScrubProblem describes a problem found with the blob of
+// an entity or resource.
+type ScrubProblem struct {
+	// URL holds the id of the entity, or the base
+	// URL of the charm that the resource belongs to.
+	URL *charm.URL
+
+	// Resource holds the name and revision of the
+	// resource, in the form "name/revision". It is empty
+	// if the problem is with an entity's archive.
+	Resource string `bson:",omitempty"`
+
+	// Hash holds the hash of the blob with the problem.
+	Hash string
+
+	// Missing holds whether the blob could not be found.
+	// Otherwise the blob's content did not match its hash.
+	Missing bool `bson:",omitempty"`
+
+	// Message holds a description of the problem.
+	Message string
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Canonical Ltd.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	blobCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "blobcache",
+		Name:      "hits",
+		Help:      "The number of blob reads served from the local disk cache.",
+	})
+
+	blobCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "blobcache",
+		Name:      "misses",
+		Help:      "The number of blob reads that were fetched from the blob store backend.",
+	})
+
+	blobCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "blobcache",
+		Name:      "evictions",
+		Help:      "The number of blobs evicted from the local disk cache.",
+	})
+
+	blobCacheEvictedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "charmstore",
+		Subsystem: "blobcache",
+		Name:      "evicted_bytes",
+		Help:      "The total size of the blobs evicted from the local disk cache.",
+	})
+
+	blobCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "blobcache",
+		Name:      "size_bytes",
+		Help:      "The current total size of the blobs in the local disk cache.",
+	})
+)
+
+// BlobCacheHit records that a blob was read from the local disk cache.
+func BlobCacheHit() {
+	blobCacheHits.Inc()
+}
+
+// BlobCacheMiss records that a blob had to be fetched
+// from the backend because it was not in the local disk cache.
+func BlobCacheMiss() {
+	blobCacheMisses.Inc()
+}
+
+// BlobCacheEvicted records that a blob of the
+// given size was evicted from the local disk cache.
+func BlobCacheEvicted(size int64) {
+	blobCacheEvictions.Inc()
+	blobCacheEvictedBytes.Add(float64(size))
+}
+
+// SetBlobCacheSize records the current total
+// size of the local disk cache.
+func SetBlobCacheSize(size int64) {
+	blobCacheSize.Set(float64(size))
+}
+
+func init() {
+	prometheus.MustRegister(blobCacheHits)
+	prometheus.MustRegister(blobCacheMisses)
+	prometheus.MustRegister(blobCacheEvictions)
+	prometheus.MustRegister(blobCacheEvictedBytes)
+	prometheus.MustRegister(blobCacheSize)
+}
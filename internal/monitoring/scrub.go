@@ -0,0 +1,83 @@
+// Copyright 2017 Canonical Ltd.
+
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	blobScrubDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_duration",
+		Help:      "The processing duration of a blob integrity scrub in seconds.",
+	})
+
+	blobScrubChecked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_checked",
+		Help:      "The number of blobs verified by the last blob integrity scrub.",
+	})
+
+	blobScrubMissing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_missing",
+		Help:      "The number of entities and resources found with missing blobs by the last blob integrity scrub.",
+	})
+
+	blobScrubCorrupt = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_corrupt",
+		Help:      "The number of entities and resources found with corrupt blobs by the last blob integrity scrub.",
+	})
+
+	blobScrubTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "charmstore",
+		Subsystem: "archive",
+		Name:      "blob_scrub_completion_time",
+		Help:      "The time the last blob integrity scrub completed, in seconds since the Unix epoch.",
+	})
+)
+
+// ScrubStats holds the results of a blob integrity scrub.
+type ScrubStats struct {
+	// Checked holds the number of blobs verified.
+	Checked int
+	// Missing holds the number of entities and
+	// resources whose blobs could not be found.
+	Missing int
+	// Corrupt holds the number of entities and
+	// resources whose blobs did not match their hash.
+	Corrupt int
+	// Time holds the time the scrub completed.
+	Time time.Time
+}
+
+// SetBlobScrubStats records the results of a blob integrity scrub.
+func SetBlobScrubStats(s ScrubStats) {
+	blobScrubChecked.Set(float64(s.Checked))
+	blobScrubMissing.Set(float64(s.Missing))
+	blobScrubCorrupt.Set(float64(s.Corrupt))
+	blobScrubTime.Set(float64(s.Time.Unix()))
+}
+
+// NewBlobScrubDuration returns a new
+// Duration to be used for measuring the time taken
+// to run the blob integrity scrubber.
+func NewBlobScrubDuration() *Duration {
+	return newDuration(blobScrubDuration)
+}
+
+func init() {
+	prometheus.MustRegister(blobScrubDuration)
+	prometheus.MustRegister(blobScrubChecked)
+	prometheus.MustRegister(blobScrubMissing)
+	prometheus.MustRegister(blobScrubCorrupt)
+	prometheus.MustRegister(blobScrubTime)
+}
@@ -60,6 +60,11 @@ func HandleErrors(h ErrorHandler) http.Handler {
 	})
 }
 
+// ErrQuotaExceeded is the error code returned when an upload would take
+// a user's namespace over its storage quota. The params package does
+// not define this code, so it is defined here.
+const ErrQuotaExceeded params.ErrorCode = "quota exceeded"
+
 var errorToResp httprequest.ErrorMapper = func(err error) (int, interface{}) {
 	status, body := errorToResp1(err)
 	logger.Infof("error response %d; %s", status, errgo.Details(err))
@@ -79,7 +84,7 @@ func errorToResp1(err error) (int, interface{}) {
 		status = http.StatusNotFound
 	case params.ErrBadRequest, params.ErrInvalidEntity:
 		status = http.StatusBadRequest
-	case params.ErrForbidden, params.ErrEntityIdNotAllowed:
+	case params.ErrForbidden, params.ErrEntityIdNotAllowed, ErrQuotaExceeded:
 		status = http.StatusForbidden
 	case params.ErrUnauthorized:
 		status = http.StatusUnauthorized
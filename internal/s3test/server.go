@@ -0,0 +1,199 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The s3test package provides an in-process stand-in for an
+// S3-compatible object store, suitable for testing the S3 blob store
+// backend. It implements only the subset of the API that the backend
+// uses: path-style HEAD, GET (including byte ranges), PUT and DELETE
+// of objects.
+package s3test // import "gopkg.in/juju/charmstore.v5-unstable/internal/s3test"
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server represents a running S3 stand-in.
+type Server struct {
+	// URL holds the endpoint URL of the server.
+	URL string
+
+	accessKey string
+	srv       *httptest.Server
+
+	mu           sync.Mutex
+	buckets      map[string]map[string][]byte
+	ranges       []string
+	ignoreRanges bool
+}
+
+// NewServer starts a new server which accepts requests
+// signed with the given access key.
+func NewServer(accessKey string) *Server {
+	s := &Server{
+		accessKey: accessKey,
+		buckets:   make(map[string]map[string][]byte),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// CreateBucket creates a bucket with the given name.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[name] == nil {
+		s.buckets[name] = make(map[string][]byte)
+	}
+}
+
+// Objects returns the names of all the objects in the given bucket.
+func (s *Server) Objects(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.buckets[bucket] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Ranges returns the Range headers of all the GET requests
+// made to the server, in order.
+func (s *Server) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// SetIgnoreRanges sets whether the server ignores the Range
+// header of GET requests and returns the whole object, as
+// some S3-compatible stores do.
+func (s *Server) SetIgnoreRanges(ignore bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ignoreRanges = ignore
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "invalid access key")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "bucket operations not supported")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := s.buckets[parts[0]]
+	if bucket == nil {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "bucket not found")
+		return
+	}
+	key := parts[1]
+	switch req.Method {
+	case "HEAD", "GET":
+		data, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "object not found")
+			return
+		}
+		status := http.StatusOK
+		r := req.Header.Get("Range")
+		if r != "" && req.Method == "GET" {
+			s.ranges = append(s.ranges, r)
+		}
+		if r != "" && req.Method == "GET" && !s.ignoreRanges {
+			start, end, ok := parseRange(r, int64(len(data)))
+			if !ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "invalid range")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+			data = data[start:end]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		if req.ContentLength < 0 {
+			// Like S3, refuse chunked uploads.
+			writeError(w, http.StatusLengthRequired, "MissingContentLength", "you must provide the Content-Length HTTP header")
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if int64(len(data)) != req.ContentLength {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", "body does not match content length")
+			return
+		}
+		bucket[key] = data
+	case "DELETE":
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+// parseRange parses a single byte range of the form "bytes=start-" or
+// "bytes=start-end" and returns the half-open interval it refers to.
+func parseRange(r string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(r, "bytes=") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if parts[1] != "" {
+		last, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < size {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/juju/httprequest"
 	"github.com/juju/loggo"
@@ -97,7 +98,7 @@ func (h *Handler) NewReqHandler(req *http.Request) (ReqHandler, error) {
 	// TODO Why is the v4 API accepting a channel parameter anyway? We
 	// should probably always use "stable".
 	for _, ch := range req.Form["channel"] {
-		if !params.ValidChannels[params.Channel(ch)] {
+		if !charmstore.ValidChannel(params.Channel(ch)) {
 			return ReqHandler{}, badRequestf(nil, "invalid channel %q specified in request", ch)
 		}
 	}
@@ -128,6 +129,7 @@ func newReqHandler() ReqHandler {
 	authId := h.AuthIdHandler
 	handlers := v5.RouterHandlers(h.ReqHandler)
 	handlers.Global["search"] = router.HandleJSON(h.serveSearch)
+	handlers.Global["changes/published"] = router.HandleJSON(h.serveChangesPublished)
 	handlers.Meta["bundle-metadata"] = h.EntityHandler(h.metaBundleMetadata, "bundledata")
 	handlers.Meta["charm-related"] = h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces")
 	handlers.Meta["charm-metadata"] = h.EntityHandler(h.metaCharmMetadata, "charmmeta")
@@ -141,6 +143,12 @@ func newReqHandler() ReqHandler {
 
 	// Delete new endpoints that we don't want to provide in v4.
 	delete(handlers.Id, "publish")
+	delete(handlers.Id, "restore")
+	delete(handlers.Id, "transfer")
+	delete(handlers.Id, "rollback")
+	delete(handlers.Id, "approve")
+	delete(handlers.Id, "scheduled-publish")
+	delete(handlers.Id, "scheduled-publish/")
 	delete(handlers.Meta, "published")
 	delete(handlers.Id, "resource")
 	delete(handlers.Meta, "resources")
@@ -149,6 +157,23 @@ func newReqHandler() ReqHandler {
 	delete(handlers.Meta, "can-write")
 	delete(handlers.Global, "upload")
 	delete(handlers.Global, "upload/")
+	delete(handlers.Global, "quota")
+	delete(handlers.Global, "quota/")
+	delete(handlers.Global, "retention/preview")
+	delete(handlers.Global, "webhook")
+	delete(handlers.Global, "webhook/")
+	delete(handlers.Global, "changes/stream")
+	delete(handlers.Global, "token")
+	delete(handlers.Global, "token/")
+	delete(handlers.Global, "group")
+	delete(handlers.Global, "group/")
+	delete(handlers.Meta, "retention-policy")
+	delete(handlers.Meta, "deprecation")
+	delete(handlers.Meta, "channel-history")
+	delete(handlers.Meta, "default-track")
+	delete(handlers.Meta, "promotion-policy")
+	delete(handlers.Meta, "approvals")
+	delete(handlers.Meta, "scheduled-publish")
 
 	h.Router = router.New(handlers, h)
 	return h
@@ -346,6 +371,70 @@ func (h ReqHandler) serveExpandId(id *router.ResolvedURL, w http.ResponseWriter,
 	return httprequest.WriteJSON(w, http.StatusOK, response)
 }
 
+// GET changes/published[?limit=$count][&start=$fromdate][&stop=$todate]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changespublished
+//
+// Unlike the v5 endpoint, this returns one entry for each entity,
+// ordered by upload time.
+func (h ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (interface{}, error) {
+	start, stop, err := v5.ParseDateRange(r.Form)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	limit := -1
+	if limitStr := r.Form.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, badRequestf(nil, "invalid 'limit' value")
+		}
+	}
+	var tquery bson.D
+	if !start.IsZero() {
+		tquery = make(bson.D, 0, 2)
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$gte",
+			Value: start,
+		})
+	}
+	if !stop.IsZero() {
+		tquery = append(tquery, bson.DocElem{
+			Name:  "$lte",
+			Value: stop,
+		})
+	}
+	var findQuery bson.D
+	if len(tquery) > 0 {
+		findQuery = bson.D{{"uploadtime", tquery}}
+	}
+	query := h.Store.DB.Entities().
+		Find(findQuery).
+		Sort("-uploadtime")
+	iter := h.Cache.Iter(query, charmstore.FieldSelector("uploadtime"))
+
+	results := []params.Published{}
+	var count int
+	for iter.Next() {
+		entity := iter.Entity()
+		// Ignore entities that aren't readable by the current user.
+		if err := h.AuthorizeEntityForOp(charmstore.EntityResolvedURL(entity), r, v5.OpReadWithNoTerms); err != nil {
+			continue
+		}
+		results = append(results, params.Published{
+			Id:          entity.URL,
+			PublishTime: entity.UploadTime.UTC(),
+		})
+		count++
+		if limit > 0 && limit <= count {
+			iter.Close()
+			break
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return results, nil
+}
+
 // expandMultiSeries calls the provided append function once for every
 // supported series of each entry in the given entities slice. The series
 // argument will be passed as that series and the doc argument will point
@@ -24,10 +24,10 @@ func (h ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{},
 	if err != nil {
 		logger.Infof("authorization failed on search request, granting no privileges: %v", err)
 	}
-	sp.Admin = auth.Admin
+	sp.Admin = auth.HasRole(v5.RoleAuditor)
 	if auth.Username != "" {
 		sp.Groups = append(sp.Groups, auth.Username)
-		groups, err := auth.User.Groups()
+		groups, err := h.UserGroups(auth)
 		if err != nil {
 			logger.Infof("cannot get groups for user %q, assuming no groups: %v", auth.Username, err)
 		}
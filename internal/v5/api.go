@@ -6,7 +6,9 @@ package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -73,6 +75,14 @@ type Handler struct {
 	// parameters of the search. It should only be used for searches
 	// from unauthenticated users.
 	searchCache *cache.Cache
+
+	// changeStreams holds a value for each followed change
+	// stream being served, limiting how many there can be.
+	changeStreams chan struct{}
+
+	// closed is closed when the handler is closed, so that
+	// long-lived requests can end.
+	closed chan struct{}
 }
 
 // ReqHandler holds the context for a single HTTP request.
@@ -97,6 +107,15 @@ type ReqHandler struct {
 	// has been done on this request.
 	auth Authorization
 
+	// apiToken holds the API token that the request holds,
+	// once it has been retrieved.
+	apiToken *mongodoc.APIToken
+
+	// groups holds the groups in the store's group registry
+	// that users are members of, once they have been retrieved,
+	// keyed by user name.
+	groups map[string][]string
+
 	// cache holds the per-request entity cache.
 	Cache *entitycache.Cache
 }
@@ -114,11 +133,13 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams, rootPath string)
 	bclient := httpbakery.NewClient()
 	bclient.Key = config.AgentKey
 	h := &Handler{
-		Pool:        pool,
-		config:      config,
-		rootPath:    rootPath,
-		searchCache: cache.New(config.SearchCacheMaxAge),
-		locator:     config.PublicKeyLocator,
+		Pool:          pool,
+		config:        config,
+		rootPath:      rootPath,
+		searchCache:   cache.New(config.SearchCacheMaxAge),
+		locator:       config.PublicKeyLocator,
+		changeStreams: make(chan struct{}, maxChangeStreams),
+		closed:        make(chan struct{}),
 	}
 	if config.IdentityLocation != "" {
 		idmClient, err := idmclient.New(idmclient.NewParams{
@@ -136,6 +157,7 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams, rootPath string)
 
 // Close closes the Handler.
 func (h *Handler) Close() {
+	close(h.closed)
 }
 
 var (
@@ -155,6 +177,7 @@ var (
 		"channelacls",
 		"channelentities",
 		"promulgated",
+		"defaulttrack",
 	)
 )
 
@@ -185,7 +208,7 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 	// most endpoints will only ever use the first one.
 	// PUT to an archive is the notable exception.
 	for _, ch := range req.Form["channel"] {
-		if !params.ValidChannels[params.Channel(ch)] {
+		if !charmstore.ValidChannel(params.Channel(ch)) {
 			return nil, badRequestf(nil, "invalid channel %q specified in request", ch)
 		}
 	}
@@ -202,12 +225,17 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 		Store:   store,
 		Channel: params.Channel(req.Form.Get("channel")),
 	}
-	rh.Cache = entitycache.New(rh.Store)
-	rh.Cache.AddEntityFields(RequiredEntityFields)
-	rh.Cache.AddBaseEntityFields(RequiredBaseEntityFields)
+	rh.newCache()
 	return rh, nil
 }
 
+// newCache sets h.Cache to a new entity cache using h.Store.
+func (h *ReqHandler) newCache() {
+	h.Cache = entitycache.New(h.Store)
+	h.Cache.AddEntityFields(RequiredEntityFields)
+	h.Cache.AddBaseEntityFields(RequiredBaseEntityFields)
+}
+
 // RouterHandlers returns router handlers that will route requests to
 // the given ReqHandler. This is provided so that different API versions
 // can override selected parts of the handlers to serve their own API
@@ -218,11 +246,16 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 	return &router.Handlers{
 		Global: map[string]http.Handler{
 			"changes/published":    router.HandleJSON(h.serveChangesPublished),
+			"changes/stream":       router.HandleErrors(h.serveChangesStream),
 			"debug":                http.HandlerFunc(h.serveDebug),
+			"debug/blobstore-gc":   router.HandleJSON(h.serveDebugBlobStoreGC),
 			"debug/pprof/":         newPprofHandler(h),
 			"debug/status":         router.HandleJSON(h.serveDebugStatus),
 			"list":                 router.HandleJSON(h.serveList),
 			"log":                  router.HandleErrors(h.serveLog),
+			"quota":                router.HandleJSON(h.serveQuota),
+			"quota/":               router.HandleJSON(h.serveQuota),
+			"retention/preview":    router.HandleJSON(h.serveRetentionPreview),
 			"logout":               http.HandlerFunc(logout),
 			"search":               router.HandleJSON(h.serveSearch),
 			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
@@ -235,19 +268,32 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"whoami":               router.HandleJSON(h.serveWhoAmI),
 			"upload":               router.HandleErrors(h.serveUploadId),
 			"upload/":              router.HandleErrors(h.serveUploadPart),
+			"webhook":              router.HandleJSON(h.serveWebhook),
+			"webhook/":             router.HandleJSON(h.serveWebhook),
+			"token":                router.HandleJSON(h.serveToken),
+			"token/":               router.HandleJSON(h.serveToken),
+			"group":                router.HandleJSON(h.serveGroup),
+			"group/":               router.HandleJSON(h.serveGroup),
 		},
 		Id: map[string]router.IdHandler{
-			"archive":     h.serveArchive,
-			"archive/":    resolveId(authId(h.serveArchiveFile), "blobhash", "blobhash"),
-			"diagram.svg": resolveId(authId(h.serveDiagram), "bundledata"),
-			"expand-id":   resolveId(authId(h.serveExpandId)),
-			"icon.svg":    resolveId(authId(h.serveIcon), "contents", "blobhash"),
-			"publish":     resolveId(h.servePublish),
-			"promulgate":  resolveId(h.servePromulgate),
-			"readme":      resolveId(authId(h.serveReadMe), "contents", "blobhash"),
-			"resource/":   reqBodyReadHandler(resolveId(authId(h.serveResources), "charmmeta")),
+			"approve":            resolveId(h.serveApprove),
+			"archive":            h.serveArchive,
+			"archive/":           resolveId(authId(h.serveArchiveFile), "blobhash", "blobhash"),
+			"diagram.svg":        resolveId(authId(h.serveDiagram), "bundledata"),
+			"expand-id":          resolveId(authId(h.serveExpandId)),
+			"icon.svg":           resolveId(authId(h.serveIcon), "contents", "blobhash"),
+			"publish":            resolveId(h.servePublish),
+			"promulgate":         resolveId(h.servePromulgate),
+			"readme":             resolveId(authId(h.serveReadMe), "contents", "blobhash"),
+			"restore":            h.serveRestore,
+			"rollback":           resolveId(h.serveRollback),
+			"scheduled-publish":  resolveId(h.serveScheduledPublish),
+			"scheduled-publish/": resolveId(h.serveScheduledPublish),
+			"transfer":           h.serveTransfer,
+			"resource/":          reqBodyReadHandler(resolveId(h.serveResources, "charmmeta")),
 		},
 		Meta: map[string]router.BulkIncludeHandler{
+			"approvals":            h.EntityHandler(h.metaApprovals, "approvals"),
 			"archive-size":         h.EntityHandler(h.metaArchiveSize, "size"),
 			"archive-upload-time":  h.EntityHandler(h.metaArchiveUploadTime, "uploadtime"),
 			"bundle-machine-count": h.EntityHandler(h.metaBundleMachineCount, "bundlemachinecount"),
@@ -260,6 +306,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"charm-metadata":       h.EntityHandler(h.metaCharmMetadata, "charmmeta"),
 			"charm-metrics":        h.EntityHandler(h.metaCharmMetrics, "charmmetrics"),
 			"charm-related":        h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
+			"channel-history":      router.SingleIncludeHandler(h.metaChannelHistory),
 			"common-info": h.puttableBaseEntityHandler(
 				h.metaCommonInfo,
 				h.putMetaCommonInfo,
@@ -270,6 +317,16 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				h.putMetaCommonInfoWithKey,
 				"commoninfo",
 			),
+			"default-track": h.puttableBaseEntityHandler(
+				h.metaDefaultTrack,
+				h.putMetaDefaultTrack,
+				"defaulttrack",
+			),
+			"deprecation": h.puttableEntityHandler(
+				h.metaDeprecation,
+				h.putMetaDeprecation,
+				"deprecation",
+			),
 			"extra-info": h.puttableEntityHandler(
 				h.metaExtraInfo,
 				h.putMetaExtraInfo,
@@ -280,27 +337,30 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				h.putMetaExtraInfoWithKey,
 				"extrainfo",
 			),
-			"hash":             h.EntityHandler(h.metaHash, "blobhash"),
-			"hash256":          h.EntityHandler(h.metaHash256, "blobhash256"),
-			"id":               h.EntityHandler(h.metaId, "_id"),
-			"id-name":          h.EntityHandler(h.metaIdName, "_id"),
-			"id-user":          h.EntityHandler(h.metaIdUser, "_id"),
-			"id-revision":      h.EntityHandler(h.metaIdRevision, "_id"),
-			"id-series":        h.EntityHandler(h.metaIdSeries, "_id"),
-			"manifest":         h.EntityHandler(h.metaManifest, "blobhash"),
-			"owner":            h.EntityHandler(h.metaOwner, "_id"),
-			"perm":             h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
-			"perm/":            h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
-			"promulgated":      h.baseEntityHandler(h.metaPromulgated, "promulgated"),
-			"can-ingest":       h.baseEntityHandler(h.metaCanIngest, "noingest"),
-			"can-write":        h.baseEntityHandler(h.metaCanWrite),
-			"resources":        h.EntityHandler(h.metaResources, "charmmeta"),
-			"resources/":       h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
-			"revision-info":    router.SingleIncludeHandler(h.metaRevisionInfo),
-			"stats":            h.EntityHandler(h.metaStats, "supportedseries"),
-			"supported-series": h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
-			"tags":             h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
-			"terms":            h.EntityHandler(h.metaTerms, "charmmeta"),
+			"hash":              h.EntityHandler(h.metaHash, "blobhash"),
+			"hash256":           h.EntityHandler(h.metaHash256, "blobhash256"),
+			"id":                h.EntityHandler(h.metaId, "_id"),
+			"id-name":           h.EntityHandler(h.metaIdName, "_id"),
+			"id-user":           h.EntityHandler(h.metaIdUser, "_id"),
+			"id-revision":       h.EntityHandler(h.metaIdRevision, "_id"),
+			"id-series":         h.EntityHandler(h.metaIdSeries, "_id"),
+			"manifest":          h.EntityHandler(h.metaManifest, "blobhash"),
+			"owner":             h.EntityHandler(h.metaOwner, "_id"),
+			"perm":              h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
+			"perm/":             h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
+			"promotion-policy":  h.puttableBaseEntityHandler(h.metaPromotionPolicy, h.putMetaPromotionPolicy, "promotionpolicy"),
+			"promulgated":       h.baseEntityHandler(h.metaPromulgated, "promulgated"),
+			"can-ingest":        h.baseEntityHandler(h.metaCanIngest, "noingest"),
+			"can-write":         h.baseEntityHandler(h.metaCanWrite),
+			"resources":         h.EntityHandler(h.metaResources, "charmmeta"),
+			"resources/":        h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
+			"retention-policy":  h.puttableBaseEntityHandler(h.metaRetentionPolicy, h.putMetaRetentionPolicy, "retentionpolicy"),
+			"revision-info":     router.SingleIncludeHandler(h.metaRevisionInfo),
+			"scheduled-publish": router.SingleIncludeHandler(h.metaScheduledPublish),
+			"stats":             h.EntityHandler(h.metaStats, "supportedseries"),
+			"supported-series":  h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
+			"tags":              h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
+			"terms":             h.EntityHandler(h.metaTerms, "charmmeta"),
 
 			// endpoints not yet implemented:
 			// "color": router.SingleIncludeHandler(h.metaColor),
@@ -350,12 +410,25 @@ func NewAPIHandler(pool *charmstore.Pool, config charmstore.ServerParams, rootPa
 // Close closes the ReqHandler. This should always be called when the
 // ReqHandler is done with.
 func (h *ReqHandler) Close() {
-	h.Store.Close()
-	h.Cache.Close()
+	if h.Store.Store != nil {
+		h.Store.Close()
+		h.Cache.Close()
+	}
 	h.Reset()
 	reqHandlerPool.Put(h)
 }
 
+// releaseStore closes the request's store and entity cache before
+// the request is done, so that a handler that waits for long periods
+// does not hold one of the stores limited by MaxMgoSessions. Close
+// does not close them again.
+func (h *ReqHandler) releaseStore() {
+	h.Cache.Close()
+	h.Store.Close()
+	h.Cache = nil
+	h.Store.Store = nil
+}
+
 // Reset resets the request-specific fields of the ReqHandler
 // so that it's suitable for putting back into a pool for reuse.
 func (h *ReqHandler) Reset() {
@@ -363,11 +436,17 @@ func (h *ReqHandler) Reset() {
 	h.Handler = nil
 	h.Cache = nil
 	h.auth = Authorization{}
+	h.apiToken = nil
+	h.groups = nil
 }
 
 // ResolveURL implements router.Context.ResolveURL.
 func (h *ReqHandler) ResolveURL(url *charm.URL) (*router.ResolvedURL, error) {
-	return resolveURL(h.Cache, url)
+	rurl, err := resolveURL(h.Cache, url)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return h.resolveRedirect(url, err)
+	}
+	return rurl, err
 }
 
 // ResolveURL implements router.Context.ResolveURLs.
@@ -377,6 +456,9 @@ func (h *ReqHandler) ResolveURLs(urls []*charm.URL) ([]*router.ResolvedURL, erro
 	for i, url := range urls {
 		var err error
 		rurls[i], err = resolveURL(h.Cache, url)
+		if errgo.Cause(err) == params.ErrNotFound {
+			rurls[i], err = h.resolveRedirect(url, err)
+		}
 		if err != nil && errgo.Cause(err) != params.ErrNotFound {
 			return nil, err
 		}
@@ -384,6 +466,20 @@ func (h *ReqHandler) ResolveURLs(urls []*charm.URL) ([]*router.ResolvedURL, erro
 	return rurls, nil
 }
 
+// resolveRedirect resolves url by following the redirect left when
+// its base entity was transferred. If there is no redirect, it returns
+// notFoundErr, the error from the original lookup.
+func (h *ReqHandler) resolveRedirect(url *charm.URL, notFoundErr error) (*router.ResolvedURL, error) {
+	newURL, err := h.Store.Redirect(url)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return nil, notFoundErr
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return resolveURL(h.Cache, newURL)
+}
+
 // WillIncludeMetadata implements router.Context.WillIncludeMetadata.
 func (h *ReqHandler) WillIncludeMetadata(includes []string) {
 	for _, inc := range includes {
@@ -499,6 +595,14 @@ func (h *ReqHandler) updateBaseEntity(id *router.ResolvedURL, fields map[string]
 		return errgo.Notef(err, "cannot update base entity %q", id)
 	}
 	h.processEntries(entries)
+	for _, e := range entries {
+		if e.Op == audit.OpSetPerm {
+			// Record a single event however many
+			// permissions were changed.
+			h.Store.RecordEvent(mongodoc.EventPerm, &id.URL, nil)
+			break
+		}
+	}
 	return nil
 }
 
@@ -1061,7 +1165,7 @@ func (h *ReqHandler) metaPerm(entity *mongodoc.BaseEntity, id *router.ResolvedUR
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	acls := entity.ChannelACLs[ch]
+	acls := charmstore.ChannelACL(entity, ch)
 	return params.PermResponse{
 		Read:  acls.Read,
 		Write: acls.Write,
@@ -1133,7 +1237,7 @@ func (h *ReqHandler) metaPermWithKey(entity *mongodoc.BaseEntity, id *router.Res
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	acls := entity.ChannelACLs[ch]
+	acls := charmstore.ChannelACL(entity, ch)
 	switch path {
 	case "/read":
 		return acls.Read, nil
@@ -1154,38 +1258,54 @@ func (h *ReqHandler) putMetaPermWithKey(id *router.ResolvedURL, path string, val
 	if err := json.Unmarshal(*val, &perms); err != nil {
 		return errgo.Mask(err)
 	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	acl := charmstore.ChannelACL(baseEntity, ch)
+	var field string
+	var value interface{}
+	var auditACL audit.ACL
 	switch path {
 	case "/read":
-		updater.UpdateField(string("channelacls."+ch+".read"), perms, &audit.Entry{
-			Op:     audit.OpSetPerm,
-			Entity: &id.URL,
-			ACL: &audit.ACL{
-				Read: perms,
-			},
-		})
-		updater.UpdateSearch()
-		return nil
+		acl.Read = perms
+		field, value, auditACL.Read = "read", perms, perms
 	case "/write":
-		updater.UpdateField(string("channelacls."+ch+".write"), perms, &audit.Entry{
-			Op:     audit.OpSetPerm,
-			Entity: &id.URL,
-			ACL: &audit.ACL{
-				Write: perms,
-			},
-		})
-		return nil
+		acl.Write = perms
+		field, value, auditACL.Write = "write", perms, perms
+	default:
+		return errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
+	}
+	if _, ok := baseEntity.ChannelACLs[ch]; !ok {
+		// The channel is in a track that has no ACL of its own
+		// yet, so set the whole ACL starting from the one it
+		// currently uses.
+		field, value = "", acl
+	}
+	key := "channelacls." + string(ch)
+	if field != "" {
+		key += "." + field
+	}
+	updater.UpdateField(key, value, &audit.Entry{
+		Op:     audit.OpSetPerm,
+		Entity: &id.URL,
+		ACL:    &auditACL,
+	})
+	if path == "/read" {
+		updater.UpdateSearch()
 	}
-	return errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
+	return nil
 }
 
 // GET id/meta/published
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetapublished
 func (h *ReqHandler) metaPublished(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
-	baseEntity, err := h.Cache.BaseEntity(entity.URL, charmstore.FieldSelector("channelentities"))
+	baseEntity, err := h.Cache.BaseEntity(entity.URL, charmstore.FieldSelector("channelentities", "defaulttrack"))
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	results := make(map[params.Channel]params.PublishedInfo, len(entity.Published))
+	channels := make([]params.Channel, 0, len(entity.Published))
 	for channel, published := range entity.Published {
 		if !published {
 			continue
@@ -1201,13 +1321,12 @@ func (h *ReqHandler) metaPublished(entity *mongodoc.Entity, id *router.ResolvedU
 			Channel: channel,
 			Current: current,
 		}
+		channels = append(channels, channel)
 	}
-	// Reorder results by stability level.
+	// Reorder results by track and stability level.
 	info := make([]params.PublishedInfo, 0, len(results))
-	for _, channel := range params.OrderedChannels {
-		if result, ok := results[channel]; ok {
-			info = append(info, result)
-		}
+	for _, channel := range charmstore.OrderedChannels(channels, baseEntity.DefaultTrack) {
+		info = append(info, results[channel])
 	}
 	return &params.PublishedResponse{
 		Info: info,
@@ -1222,10 +1341,53 @@ func (h *ReqHandler) metaArchiveUploadTime(entity *mongodoc.Entity, id *router.R
 	}, nil
 }
 
-// GET changes/published[?limit=$count][&start=$fromdate][&stop=$todate]
+// publishedSettleDelay holds how long a publish event must have been
+// recorded before it is returned in a page of published changes. This
+// ensures that an event recorded concurrently by another server with
+// an earlier time is not skipped by a cursor that has moved past it.
+const publishedSettleDelay = 10 * time.Second
+
+// defaultPublishedPageSize holds the number of entries returned in a
+// page of published changes when no limit is specified.
+const defaultPublishedPageSize = 100
+
+// Published holds an entry in the response body of GET
+// changes/published. It records the publish of an entity to a channel.
+type Published struct {
+	// Id holds the id of the published entity.
+	Id *charm.URL
+
+	// PublishTime holds when the entity was published.
+	PublishTime time.Time
+
+	// Channel holds the channel the entity was published to.
+	Channel params.Channel
+
+	// Series holds the series for which the entity became
+	// the current revision in the channel.
+	Series []string `json:",omitempty"`
+
+	// Publisher holds the name of the user that published
+	// the entity. It is omitted when the entity was published
+	// by the charm store itself.
+	Publisher string `json:",omitempty"`
+}
+
+// PublishedPage holds the response body of GET changes/published
+// when a cursor is specified.
+type PublishedPage struct {
+	// Published holds the publish events, oldest first.
+	Published []Published
+
+	// Cursor holds the cursor to specify to retrieve
+	// the following events.
+	Cursor string
+}
+
+// GET changes/published[?limit=$count][&start=$fromdate][&stop=$todate][&channel=$channel][&cursor=$cursor]
 // https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-changespublished
 func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (interface{}, error) {
-	start, stop, err := parseDateRange(r.Form)
+	start, stop, err := ParseDateRange(r.Form)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
@@ -1236,6 +1398,37 @@ func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (inte
 			return nil, badRequestf(nil, "invalid 'limit' value")
 		}
 	}
+	var findQuery bson.D
+	if v := r.Form.Get("channel"); v != "" {
+		channel := charmstore.ResolveChannel(params.Channel(v), "")
+		if !charmstore.ValidChannel(channel) || channel == params.UnpublishedChannel {
+			return nil, badRequestf(nil, "invalid 'channel' value %q", v)
+		}
+		findQuery = append(findQuery, bson.DocElem{"channel", channel})
+	}
+	// When a cursor is specified, even an empty one, the events are
+	// returned oldest first in pages.
+	_, paged := r.Form["cursor"]
+	var after *mongodoc.PublishEvent
+	if paged {
+		if limit == -1 {
+			limit = defaultPublishedPageSize
+		}
+		if v := r.Form.Get("cursor"); v != "" {
+			after, err = parsePublishedCursor(v)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+			}
+			findQuery = append(findQuery, bson.DocElem{"$or", []bson.D{
+				{{"time", bson.D{{"$gt", after.Time}}}},
+				{{"time", after.Time}, {"_id", bson.D{{"$gt", after.Id}}}},
+			}})
+		}
+		settled := timeNow().Add(-publishedSettleDelay)
+		if stop.IsZero() || stop.After(settled) {
+			stop = settled
+		}
+	}
 	var tquery bson.D
 	if !start.IsZero() {
 		tquery = make(bson.D, 0, 2)
@@ -1250,37 +1443,89 @@ func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (inte
 			Value: stop,
 		})
 	}
-	var findQuery bson.D
 	if len(tquery) > 0 {
-		findQuery = bson.D{{"uploadtime", tquery}}
+		findQuery = append(findQuery, bson.DocElem{"time", tquery})
+	}
+	query := h.Store.DB.PublishHistory().Find(findQuery)
+	if paged {
+		query = query.Sort("time", "_id")
+	} else {
+		query = query.Sort("-time", "-_id")
 	}
-	query := h.Store.DB.Entities().
-		Find(findQuery).
-		Sort("-uploadtime")
-	iter := h.Cache.Iter(query, charmstore.FieldSelector("uploadtime"))
+	iter := query.Iter()
 
-	results := []params.Published{}
+	results := []Published{}
 	var count int
-	for iter.Next() {
-		entity := iter.Entity()
+	for {
+		var event mongodoc.PublishEvent
+		if !iter.Next(&event) {
+			break
+		}
+		// Move the cursor past the event even when it is not
+		// returned, so that the next page continues after it.
+		after = &event
 		// Ignore entities that aren't readable by the current user.
-		if err := h.AuthorizeEntityForOp(charmstore.EntityResolvedURL(entity), r, OpReadWithNoTerms); err != nil {
+		if err := h.AuthorizeEntityForOp(&router.ResolvedURL{
+			URL:                 *event.URL,
+			PromulgatedRevision: -1,
+		}, r, OpReadWithNoTerms); err != nil {
 			continue
 		}
-		results = append(results, params.Published{
-			Id:          entity.URL,
-			PublishTime: entity.UploadTime.UTC(),
+		results = append(results, Published{
+			Id:          event.URL,
+			PublishTime: event.Time.UTC(),
+			Channel:     event.Channel,
+			Series:      event.Series,
+			Publisher:   event.User,
 		})
 		count++
 		if limit > 0 && limit <= count {
-			iter.Close()
 			break
 		}
 	}
-	if err := iter.Err(); err != nil {
+	if err := iter.Close(); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return results, nil
+	if !paged {
+		return results, nil
+	}
+	return PublishedPage{
+		Published: results,
+		Cursor:    publishedCursor(after),
+	}, nil
+}
+
+// publishedCursor returns the cursor that refers to the position
+// after the given publish event. If the event is nil, it returns the
+// cursor that refers to the start of the publish history.
+func publishedCursor(e *mongodoc.PublishEvent) string {
+	if e == nil {
+		return ""
+	}
+	t := e.Time.UnixNano() / int64(time.Millisecond)
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%s", t, e.Id.Hex())))
+}
+
+// parsePublishedCursor parses a cursor returned by publishedCursor. It
+// returns a publish event holding the time and id that the cursor
+// refers to.
+func parsePublishedCursor(cursor string) (*mongodoc.PublishEvent, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, badRequestf(nil, "invalid 'cursor' value")
+	}
+	parts := strings.SplitN(string(data), ".", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return nil, badRequestf(nil, "invalid 'cursor' value")
+	}
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, badRequestf(nil, "invalid 'cursor' value")
+	}
+	return &mongodoc.PublishEvent{
+		Id:   bson.ObjectIdHex(parts[1]),
+		Time: time.Unix(0, t*int64(time.Millisecond)),
+	}, nil
 }
 
 // GET /macaroon
@@ -1310,7 +1555,7 @@ func (h *ReqHandler) serveDelegatableMacaroon(_ http.Header, req *http.Request)
 		if err != nil {
 			return nil, errgo.Mask(err, errgo.Any)
 		}
-		if auth.User == nil {
+		if auth.Username == "" {
 			return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon is not obtainable using admin credentials")
 		}
 		// TODO propagate expiry time from macaroons in request.
@@ -1356,7 +1601,7 @@ func (h *ReqHandler) serveDelegatableMacaroon(_ http.Header, req *http.Request)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
-	if auth.User == nil {
+	if auth.Username == "" {
 		if !auth.Admin {
 			return nil, errgo.WithCausef(nil, params.ErrForbidden, "delegatable macaroon cannot be obtained for public entities")
 		}
@@ -1390,10 +1635,10 @@ func (h *ReqHandler) serveWhoAmI(_ http.Header, req *http.Request) (interface{},
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
-	if auth.Admin {
+	if auth.Username == "" {
 		return nil, errgo.WithCausef(nil, params.ErrForbidden, "admin credentials used")
 	}
-	groups, err := auth.User.Groups()
+	groups, err := h.UserGroups(auth)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
@@ -1406,12 +1651,13 @@ func (h *ReqHandler) serveWhoAmI(_ http.Header, req *http.Request) (interface{},
 // PUT id/promulgate
 // See https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idpromulgate
 func (h *ReqHandler) servePromulgate(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
-	// Note: the promulgator must be in the promulgators group but
-	// doesn't need write access to the entity.
+	// Note: the promulgator must be in the promulgators group or
+	// have the promulgator role but doesn't need write access to
+	// the entity.
 	if _, err := h.authorize(authorizeParams{
 		req: req,
 		acls: []mongodoc.ACL{{
-			Write: []string{PromulgatorsGroup},
+			Write: append([]string{h.promulgatorsGroup()}, h.roleACL(RolePromulgator)...),
 		}},
 		ops:              []string{OpWrite},
 		entityIds:        []*router.ResolvedURL{id},
@@ -1441,7 +1687,7 @@ func (h *ReqHandler) servePromulgate(id *router.ResolvedURL, w http.ResponseWrit
 		// responsible of reviewing and publishing subsequent
 		// revisions of this entity.
 		if err := h.updateBaseEntity(id, map[string]interface{}{
-			"channelacls.stable.write": []string{PromulgatorsGroup},
+			"channelacls.stable.write": []string{h.promulgatorsGroup()},
 		}, nil); err != nil {
 			return errgo.Notef(err, "cannot set permissions for %q", id)
 		}
@@ -1477,6 +1723,29 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 		return badRequestf(err, "cannot unmarshal publish request body")
 	}
 	chans := publish.Channels
+	if err := checkPublishChannels(chans); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := h.authorizePublish(id, req, chans); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	if err := h.Store.PublishAs(h.authUsername(), id, publish.Resources, chans...); err != nil {
+		switch errgo.Cause(err) {
+		case charmstore.ErrPublishResourceMismatch:
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		case charmstore.ErrPromotionDenied:
+			return errgo.WithCausef(err, params.ErrForbidden, "")
+		}
+		return errgo.NoteMask(err, "cannot publish charm or bundle", errgo.Is(params.ErrNotFound))
+	}
+	// TODO add publish audit
+	return nil
+}
+
+// checkPublishChannels checks that chans holds channels that
+// can be published to.
+func checkPublishChannels(chans []params.Channel) error {
 	if len(chans) == 0 {
 		return badRequestf(nil, "no channels provided")
 	}
@@ -1484,16 +1753,21 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 		if c == params.NoChannel {
 			return badRequestf(nil, "cannot publish to an empty channel")
 		}
-		if !params.ValidChannels[c] {
+		if !charmstore.ValidChannel(c) {
 			return badRequestf(nil, "unrecognized channel %q", c)
 		}
 		if c == params.UnpublishedChannel {
 			return badRequestf(nil, "cannot publish to the unpublished channel")
 		}
 	}
+	return nil
+}
 
+// authorizePublish checks that the request is allowed to publish
+// the entity with the given id to the given channels.
+func (h *ReqHandler) authorizePublish(id *router.ResolvedURL, req *http.Request, chans []params.Channel) error {
 	// Retrieve the base entity so that we can check permissions.
-	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls", "defaulttrack"))
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -1502,7 +1776,7 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	// on all the channels being published to.
 	acls := make([]mongodoc.ACL, 0, len(chans))
 	for _, c := range chans {
-		acls = append(acls, baseEntity.ChannelACLs[c])
+		acls = append(acls, charmstore.ChannelACL(baseEntity, charmstore.ResolveChannel(c, baseEntity.DefaultTrack)))
 	}
 	if _, err := h.authorize(authorizeParams{
 		req:              req,
@@ -1513,14 +1787,6 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	}); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-
-	if err := h.Store.Publish(id, publish.Resources, chans...); err != nil {
-		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
-			return errgo.WithCausef(err, params.ErrBadRequest, "")
-		}
-		return errgo.NoteMask(err, "cannot publish charm or bundle", errgo.Is(params.ErrNotFound))
-	}
-	// TODO add publish audit
 	return nil
 }
 
@@ -1609,19 +1875,26 @@ var testAddAuditCallback func(e audit.Entry)
 // addAudit delegates an audit entry to the store to record an audit log after
 // it has set correctly the user doing the action.
 func (h *ReqHandler) addAudit(e audit.Entry) {
-	if h.auth.User == nil && !h.auth.Admin {
+	if h.auth.Username == "" && !h.auth.Admin {
 		panic("No auth set in ReqHandler")
 	}
-	e.User = h.auth.Username
-	if h.auth.Admin && e.User == "" {
-		e.User = "admin"
-	}
+	e.User = h.authUsername()
 	h.Store.AddAudit(e)
 	if testAddAuditCallback != nil {
 		testAddAuditCallback(e)
 	}
 }
 
+// authUsername returns the name of the authorized user,
+// or "admin" if the request was authorized with the admin
+// credentials.
+func (h *ReqHandler) authUsername() string {
+	if h.auth.Admin && h.auth.Username == "" {
+		return "admin"
+	}
+	return h.auth.Username
+}
+
 // logout handles the GET /v5/logout endpoint that is used to log out of
 // charmstore.
 func logout(w http.ResponseWriter, r *http.Request) {
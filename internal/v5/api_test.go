@@ -512,6 +512,194 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.Equals, params.PromulgatedResponse{Promulgated: false})
 	},
+}, {
+	name: "retention-policy",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindBaseEntity(&url.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if e.RetentionPolicy == nil {
+			return nil, nil
+		}
+		return &v5.RetentionPolicy{
+			KeepUnpublished: e.RetentionPolicy.KeepUnpublished,
+			KeepPublished:   e.RetentionPolicy.KeepPublished,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.RetentionPolicy{
+			KeepUnpublished: 5,
+		})
+	},
+}, {
+	name: "default-track",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindBaseEntity(&url.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		track := e.DefaultTrack
+		if track == "" {
+			track = "latest"
+		}
+		return &v5.DefaultTrack{
+			Track: track,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.DefaultTrack{
+			Track: "latest",
+		})
+	},
+}, {
+	name: "deprecation",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindEntity(url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if e.Deprecation == nil {
+			return nil, nil
+		}
+		return &v5.Deprecation{
+			State:       string(e.Deprecation.State),
+			Reason:      e.Deprecation.Reason,
+			Replacement: e.Deprecation.Replacement,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.Deprecation{
+			State:       "deprecated",
+			Reason:      "use the promulgated charm",
+			Replacement: charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+		})
+	},
+}, {
+	name: "promotion-policy",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindBaseEntity(&url.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if e.PromotionPolicy == nil {
+			return nil, nil
+		}
+		return &v5.PromotionPolicy{
+			Channel:           e.PromotionPolicy.Channel,
+			SourceChannel:     e.PromotionPolicy.SourceChannel,
+			MinSoak:           e.PromotionPolicy.MinSoak.String(),
+			Approvers:         e.PromotionPolicy.Approvers,
+			RequiredApprovals: e.PromotionPolicy.RequiredApprovals,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.PromotionPolicy{
+			Channel:           "stable",
+			SourceChannel:     "candidate",
+			MinSoak:           "72h0m0s",
+			Approvers:         []string{"qa"},
+			RequiredApprovals: 1,
+		})
+	},
+}, {
+	name: "approvals",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindEntity(url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(e.Approvals) == 0 {
+			return nil, nil
+		}
+		approvals := make([]v5.Approval, len(e.Approvals))
+		for i, a := range e.Approvals {
+			approvals[i] = v5.Approval{
+				Channel:  a.Channel,
+				User:     a.User,
+				Rejected: a.Rejected,
+				Comment:  a.Comment,
+				Time:     a.Time.UTC(),
+			}
+		}
+		return approvals, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, []v5.Approval{{
+			Channel: "stable",
+			User:    "alice",
+			Comment: "looks good",
+			Time:    time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		}})
+	},
+}, {
+	name: "scheduled-publish",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		sps, err := store.ScheduledPublishes(&url.URL)
+		if err != nil {
+			return nil, err
+		}
+		if len(sps) == 0 {
+			return nil, nil
+		}
+		result := make([]v5.ScheduledPublish, len(sps))
+		for i, sp := range sps {
+			result[i] = v5.ScheduledPublish{
+				ScheduleId: sp.Id.Hex(),
+				Id:         sp.URL,
+				Channels:   sp.Channels,
+				User:       sp.User,
+				Time:       sp.Time.UTC(),
+				Status:     string(sp.Status),
+			}
+		}
+		return result, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		sps := data.([]v5.ScheduledPublish)
+		c.Assert(sps, gc.HasLen, 1)
+		c.Assert(sps[0], jc.DeepEquals, v5.ScheduledPublish{
+			ScheduleId: sps[0].ScheduleId,
+			Id:         charm.MustParseURL("cs:~bob/utopic/wordpress-2"),
+			Channels:   []params.Channel{params.EdgeChannel},
+			User:       "bob",
+			Time:       time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			Status:     "pending",
+		})
+	},
+}, {
+	name: "channel-history",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		events, err := store.ChannelHistory(&url.URL, params.NoChannel)
+		if err != nil {
+			return nil, err
+		}
+		history := make([]v5.PublishEvent, len(events))
+		for i, e := range events {
+			history[i] = v5.PublishEvent{
+				Id:      e.URL,
+				Channel: e.Channel,
+				Series:  e.Series,
+				User:    e.User,
+				Time:    e.Time,
+			}
+		}
+		return history, nil
+	},
+	checkURL: newResolvedURL("cs:~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		history := data.([]v5.PublishEvent)
+		c.Assert(history, gc.HasLen, 1)
+		c.Assert(history[0].Id, jc.DeepEquals, charm.MustParseURL("cs:~bob/utopic/wordpress-2"))
+		c.Assert(history[0].Channel, gc.Equals, params.StableChannel)
+		c.Assert(history[0].Series, jc.DeepEquals, []string{"utopic"})
+	},
 }, {
 	name: "can-ingest",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
@@ -747,6 +935,35 @@ func (s *APISuite) addTestEntities(c *gc.C) []*router.ResolvedURL {
 		s.assertPutAsAdmin(c, key, "value "+e.URL.String())
 		s.assertPutAsAdmin(c, commonkey, "value "+e.URL.String())
 	}
+	// Give one of the entities a retention policy.
+	s.assertPutAsAdmin(c, "~bob/utopic/wordpress-2/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 5,
+	})
+	// Deprecate one of the entities.
+	s.assertPutAsAdmin(c, "~bob/utopic/wordpress-2/meta/deprecation", v5.Deprecation{
+		State:       "deprecated",
+		Reason:      "use the promulgated charm",
+		Replacement: charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+	})
+	// Gate the stable channel of one of the entities
+	// and approve its promotion.
+	s.assertPutAsAdmin(c, "~bob/utopic/wordpress-2/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		SourceChannel:     "candidate",
+		MinSoak:           "72h0m0s",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+	err := s.store.Approve(newResolvedURL("cs:~bob/utopic/wordpress-2", -1), mongodoc.Approval{
+		Channel: "stable",
+		User:    "alice",
+		Comment: "looks good",
+		Time:    time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+	})
+	c.Assert(err, gc.Equals, nil)
+	// Schedule a publish of one of the entities.
+	_, err = s.store.SchedulePublish(newResolvedURL("cs:~bob/utopic/wordpress-2", -1), nil, []params.Channel{params.EdgeChannel}, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), "bob")
+	c.Assert(err, gc.Equals, nil)
 	return testEntities
 }
 
@@ -2939,12 +3156,17 @@ type publishSpec struct {
 	acl  []string
 }
 
-func (p publishSpec) published() params.Published {
+func (p publishSpec) published() v5.Published {
 	t, err := time.Parse("2006-01-02 15:04", p.time)
 	if err != nil {
 		panic(err)
 	}
-	return params.Published{&p.id.URL, t}
+	return v5.Published{
+		Id:          &p.id.URL,
+		PublishTime: t,
+		Channel:     params.StableChannel,
+		Series:      []string{p.id.URL.Series},
+	}
 }
 
 var publishedCharms = []publishSpec{{
@@ -3006,7 +3228,7 @@ func (s *APISuite) TestChangesPublished(c *gc.C) {
 	s.publishCharmsAtKnownTimes(c, publishedCharms)
 	for i, test := range changesPublishedTests {
 		c.Logf("test %d: %q", i, test.args)
-		expect := make([]params.Published, len(test.expect))
+		expect := make([]v5.Published, len(test.expect))
 		for j, index := range test.expect {
 			expect[j] = publishedCharms[index].published()
 		}
@@ -3020,7 +3242,7 @@ func (s *APISuite) TestChangesPublished(c *gc.C) {
 
 func (s *APISuite) TestChangesPublishedAdmin(c *gc.C) {
 	s.publishCharmsAtKnownTimes(c, publishedCharms)
-	expect := make([]params.Published, len(publishedCharms))
+	expect := make([]v5.Published, len(publishedCharms))
 	for i := range expect {
 		expect[i] = publishedCharms[len(publishedCharms)-(i+1)].published()
 	}
@@ -3072,6 +3294,28 @@ var changesPublishedErrorsTests = []struct {
 		Message: `invalid 'stop' value "baddate": parsing time "baddate" as "2006-01-02": cannot parse "baddate" as "2006"`,
 	},
 	status: http.StatusBadRequest,
+}, {
+	args: "?channel=unpublished",
+	expect: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'channel' value "unpublished"`,
+	},
+	status: http.StatusBadRequest,
+}, {
+	args: "?cursor=not-base64!",
+	expect: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'cursor' value`,
+	},
+	status: http.StatusBadRequest,
+}, {
+	// "12345.xyz"
+	args: "?cursor=MTIzNDUueHl6",
+	expect: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'cursor' value`,
+	},
+	status: http.StatusBadRequest,
 }}
 
 func (s *APISuite) TestChangesPublishedErrors(c *gc.C) {
@@ -3087,6 +3331,98 @@ func (s *APISuite) TestChangesPublishedErrors(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestChangesPublishedCursor(c *gc.C) {
+	s.publishCharmsAtKnownTimes(c, publishedCharms)
+	now := time.Date(5433, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.PatchValue(v5.TimeNow, func() time.Time {
+		return now
+	})
+	getPage := func(args string) v5.PublishedPage {
+		var page v5.PublishedPage
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL("changes/published") + args,
+			ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+				err := json.Unmarshal(m, &page)
+				c.Assert(err, gc.Equals, nil)
+			}),
+		})
+		return page
+	}
+	expect := func(indexes ...int) []v5.Published {
+		ps := make([]v5.Published, len(indexes))
+		for i, index := range indexes {
+			ps[i] = publishedCharms[index].published()
+		}
+		return ps
+	}
+
+	// An empty cursor starts at the oldest event.
+	page := getPage("?cursor=&limit=4")
+	c.Assert(page.Published, jc.DeepEquals, expect(0, 1, 2, 3))
+	c.Assert(page.Cursor, gc.Not(gc.Equals), "")
+
+	// The cursor moves past events that cannot be read.
+	page = getPage("?limit=4&cursor=" + page.Cursor)
+	c.Assert(page.Published, jc.DeepEquals, expect(4, 5))
+	cursor := page.Cursor
+
+	// When there are no more events, the cursor is unchanged.
+	page = getPage("?cursor=" + cursor)
+	c.Assert(page.Published, jc.DeepEquals, []v5.Published{})
+	c.Assert(page.Cursor, gc.Equals, cursor)
+
+	// Events are only returned once they have settled.
+	now = time.Date(5432, 10, 13, 0, 0, 5, 0, time.UTC)
+	page = getPage("?cursor=")
+	c.Assert(page.Published, jc.DeepEquals, expect(0, 1, 2))
+	now = now.Add(10 * time.Second)
+	page = getPage("?cursor=" + page.Cursor)
+	c.Assert(page.Published, jc.DeepEquals, expect(3))
+}
+
+func (s *APISuite) TestChangesPublishedChannel(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-1", -1))
+	err := s.store.PublishAs("bob", id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	getPublished := func(args string) []v5.Published {
+		var ps []v5.Published
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  s.srv,
+			URL:      storeURL("changes/published") + args,
+			Username: testUsername,
+			Password: testPassword,
+			ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+				err := json.Unmarshal(m, &ps)
+				c.Assert(err, gc.Equals, nil)
+			}),
+		})
+		for i := range ps {
+			c.Assert(ps[i].PublishTime.IsZero(), gc.Equals, false)
+			ps[i].PublishTime = time.Time{}
+		}
+		return ps
+	}
+	// Each publish to a channel is reported.
+	c.Assert(getPublished(""), jc.DeepEquals, []v5.Published{{
+		Id:        &id.URL,
+		Channel:   params.EdgeChannel,
+		Series:    []string{"precise"},
+		Publisher: "bob",
+	}, {
+		Id:      &id.URL,
+		Channel: params.StableChannel,
+		Series:  []string{"precise"},
+	}})
+	c.Assert(getPublished("?channel=edge"), jc.DeepEquals, []v5.Published{{
+		Id:        &id.URL,
+		Channel:   params.EdgeChannel,
+		Series:    []string{"precise"},
+		Publisher: "bob",
+	}})
+}
+
 var publishErrorsTests = []struct {
 	about        string
 	method       string
@@ -3454,7 +3790,7 @@ func (s *APISuite) publishCharmsAtKnownTimes(c *gc.C, charms []publishSpec) {
 	for _, ch := range publishedCharms {
 		id, _ := s.addPublicCharmFromRepo(c, "wordpress", ch.id)
 		t := ch.published().PublishTime
-		err := s.store.UpdateEntity(id, bson.D{{"$set", bson.D{{"uploadtime", t}}}})
+		_, err := s.store.DB.PublishHistory().UpdateAll(bson.D{{"url", &id.URL}}, bson.D{{"$set", bson.D{{"time", t}}}})
 		c.Assert(err, gc.Equals, nil)
 		if len(ch.acl) > 0 {
 			err := s.store.SetPerms(&id.URL, "unpublished.read", ch.acl...)
@@ -96,9 +96,11 @@ func (h *ReqHandler) authorizeUpload(id *charm.URL, req *http.Request) error {
 	// is-entity first-party caveats to be allowed when uploading
 	// at which point we will need to rethink this a little.
 	if _, err := h.authorize(authorizeParams{
-		req:  req,
-		acls: []mongodoc.ACL{acl},
-		ops:  []string{OpWrite},
+		req:        req,
+		acls:       []mongodoc.ACL{acl},
+		ops:        []string{OpWrite},
+		upload:     true,
+		namespaces: []string{id.User},
 	}); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -146,6 +148,42 @@ func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseW
 	return nil
 }
 
+// POST id/restore
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-idrestore
+func (h *ReqHandler) serveRestore(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.Revision == -1 {
+		return badRequestf(nil, "revision not specified in %q", id)
+	}
+	ownerId := id
+	if id.User == "" {
+		// The entity is being restored by its promulgated id,
+		// so authorize against the id of the deleted entity.
+		doc, err := h.Store.FindDeletedEntity(id)
+		if err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot restore %q", id), errgo.Is(params.ErrNotFound))
+		}
+		ownerId = doc.URL
+	}
+	if err := h.authorizeUpload(ownerId, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	rid, err := h.Store.RestoreEntity(ownerId)
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot restore %q", id),
+			errgo.Is(params.ErrNotFound),
+			errgo.Is(params.ErrDuplicateUpload),
+			errgo.Is(router.ErrQuotaExceeded),
+		)
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
+		Id:            &rid.URL,
+		PromulgatedId: rid.PromulgatedURL(),
+	})
+}
+
 func (h *ReqHandler) updateStatsArchiveUpload(id *charm.URL, err *error) {
 	// Upload stats don't include revision: it is assumed that each
 	// entity revision is only uploaded once.
@@ -200,6 +238,7 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrQuotaExceeded),
 		)
 	}
 	if ingesting, _ := router.ParseBool(req.Form.Get("ingest")); !ingesting {
@@ -247,7 +286,7 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 	var chans []params.Channel
 	for _, c := range req.Form["channel"] {
 		c := params.Channel(c)
-		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+		if !charmstore.ValidChannel(c) || c == params.UnpublishedChannel {
 			return badRequestf(nil, "cannot put entity into channel %q", c)
 		}
 		chans = append(chans, c)
@@ -290,6 +329,7 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrQuotaExceeded),
 		)
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
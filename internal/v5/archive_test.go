@@ -1237,6 +1237,113 @@ func (s *ArchiveSuite) TestDelete(c *gc.C) {
 	c.Assert(count, gc.Equals, 0)
 }
 
+func (s *ArchiveSuite) TestRestore(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", -1))
+
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL(id.URL.Path() + "/archive"),
+			Method:  "DELETE",
+		})
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL(id.URL.Path() + "/restore"),
+			Method:  "POST",
+			ExpectBody: params.ArchiveUploadResponse{
+				Id: &id.URL,
+			},
+		})
+	})
+
+	// The entity has been restored.
+	count, err := s.store.DB.Entities().FindId(&id.URL).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *ArchiveSuite) TestRestorePromulgated(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", 10))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", 11))
+	err := s.store.DeleteEntity(id)
+	c.Assert(err, gc.Equals, nil)
+
+	// Only the owner of the deleted entity can restore it.
+	s.doAsUser("bob", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(nil),
+			URL:          storeURL("utopic/mysql-10/restore"),
+			Method:       "POST",
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: `access denied for user "bob"`,
+			},
+		})
+	})
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL("utopic/mysql-10/restore"),
+			Method:  "POST",
+			ExpectBody: params.ArchiveUploadResponse{
+				Id:            &id.URL,
+				PromulgatedId: id.PromulgatedURL(),
+			},
+		})
+	})
+
+	// The entity has been restored.
+	count, err := s.store.DB.Entities().FindId(&id.URL).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *ArchiveSuite) TestRestoreNotDeleted(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(nil),
+			URL:          storeURL(id.URL.Path() + "/restore"),
+			Method:       "POST",
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrNotFound,
+				Message: `cannot restore "cs:~charmers/utopic/mysql-42": no deleted entity "cs:~charmers/utopic/mysql-42"`,
+			},
+		})
+	})
+}
+
+func (s *ArchiveSuite) TestRestoreUnauthorized(c *gc.C) {
+	id, _ := s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-42", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/utopic/mysql-43", -1))
+	err := s.store.DeleteEntity(id)
+	c.Assert(err, gc.Equals, nil)
+	s.doAsUser("bob", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(nil),
+			URL:          storeURL(id.URL.Path() + "/restore"),
+			Method:       "POST",
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: `access denied for user "bob"`,
+			},
+		})
+	})
+	count, err := s.store.DB.Entities().FindId(&id.URL).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, 0)
+}
+
 func (s *ArchiveSuite) TestDeleteSpecificCharm(c *gc.C) {
 	// Add a couple of charms to the database.
 	for _, id := range []string{"~charmers/trusty/mysql-42", "~charmers/utopic/mysql-42", "~charmers/utopic/mysql-47"} {
@@ -26,18 +26,73 @@ import (
 // Authorization contains authorization information extracted from an HTTP request.
 // The zero value for a authorization contains no privileges.
 type Authorization struct {
+	// Admin holds whether the request was made with the admin
+	// credentials or by a user with the super-admin role.
 	Admin    bool
 	User     *idmclient.User
 	Username string
+
+	// Token holds the API token that the request was
+	// authenticated with, if any.
+	Token *mongodoc.APIToken
+
+	// Roles holds the roles that the authenticated user
+	// has been given.
+	Roles []string
+}
+
+// HasRole reports whether the authorization grants the given
+// role. A request with admin rights has all roles.
+func (a Authorization) HasRole(role string) bool {
+	if a.Admin {
+		return true
+	}
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 const (
+	// PromulgatorsGroup holds the name of the group whose members
+	// may promulgate charms and bundles when no other group has
+	// been configured.
 	PromulgatorsGroup = "charmers"
 
 	defaultMacaroonExpiry   = 24 * time.Hour
 	shortTermMacaroonExpiry = time.Minute
 )
 
+// These roles can be given to users and groups with the
+// roles configuration setting.
+const (
+	// RoleSuperAdmin allows anything that the admin
+	// credentials allow.
+	RoleSuperAdmin = "super-admin"
+
+	// RolePromulgator allows charms and bundles to be
+	// promulgated, as membership of the promulgators group does.
+	RolePromulgator = "promulgator"
+
+	// RoleStatsWriter allows download statistics to be updated.
+	RoleStatsWriter = "stats-writer"
+
+	// RoleAuditor allows anything to be read, including
+	// logs, quotas and other admin-only information, but
+	// nothing to be changed.
+	RoleAuditor = "auditor"
+)
+
+// roles holds all the roles in the order they are checked.
+var roles = []string{
+	RoleSuperAdmin,
+	RolePromulgator,
+	RoleStatsWriter,
+	RoleAuditor,
+}
+
 // These operations represent categories of operation by the user on
 // the charm store. All the operations should be
 // mutually distinct.
@@ -78,14 +133,17 @@ var timeNow = time.Now
 //
 // This method implements router.Context.AuthorizeEntity.
 func (h *ReqHandler) AuthorizeEntity(id *router.ResolvedURL, req *http.Request) error {
-	var op string
-	switch req.Method {
+	return h.AuthorizeEntityForOp(id, req, opForMethod(req.Method))
+}
+
+// opForMethod returns the operation performed by a request
+// with the given HTTP method.
+func opForMethod(method string) string {
+	switch method {
 	case "GET", "HEAD", "OPTIONS":
-		op = OpReadWithNoTerms
-	default:
-		op = OpWrite
+		return OpReadWithNoTerms
 	}
-	return h.AuthorizeEntityForOp(id, req, op)
+	return OpWrite
 }
 
 // Authenticate is a convenience method that calls authorize to check
@@ -116,20 +174,38 @@ func (h *ReqHandler) AuthorizeEntityForOp(id *router.ResolvedURL, req *http.Requ
 	return nil
 }
 
-// authenticateAdmin checks that the given request has admin credentials.
+// authenticateAdmin checks that the given request has admin credentials
+// or is made by a user with the super-admin role.
 func (h *ReqHandler) authenticateAdmin(req *http.Request) error {
-	if _, err := h.authorize(authorizeParams{
-		req: req,
-		ops: []string{OpReadWithNoTerms},
-		// Provide an empty ACL, which means that only a request
-		// with admin credentials can be authorized.
-		acls: []mongodoc.ACL{{}},
-	}); err != nil {
+	if _, err := h.authenticateRole(req, RoleSuperAdmin); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	return nil
 }
 
+// authenticateRole checks that the given request is authenticated
+// for a user with the given role. As with AuthorizeEntity, the
+// operation being authorized is chosen based on the request method.
+func (h *ReqHandler) authenticateRole(req *http.Request, role string) (Authorization, error) {
+	auth, err := h.authorize(authorizeParams{
+		req: req,
+		acls: []mongodoc.ACL{{
+			Read:  []string{params.Everyone},
+			Write: []string{params.Everyone},
+		}},
+		ops:           []string{opForMethod(req.Method)},
+		authnRequired: true,
+	})
+	if err != nil {
+		return Authorization{}, errgo.Mask(err, errgo.Any)
+	}
+	if !auth.HasRole(role) {
+		h.auth = Authorization{}
+		return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "access denied for user %q", auth.Username)
+	}
+	return auth, nil
+}
+
 // authorizeParams holds parameters for an Authorize request.
 type authorizeParams struct {
 	// req holds the client HTTP request.
@@ -159,6 +235,22 @@ type authorizeParams struct {
 	// authenticated even if the ACLs are open to everyone.
 	// This automatically applies to non-read requests.
 	authnRequired bool
+
+	// upload holds whether the request uploads a charm, bundle
+	// or resource. An API token with the upload scope can only
+	// be used to write when this is set.
+	upload bool
+
+	// namespaces holds any namespaces accessed by the request
+	// other than those of entityIds. It is used to check API
+	// tokens restricted to a namespace.
+	namespaces []string
+
+	// noNamespace holds whether the request writes to no namespace
+	// at all, as when creating a pending upload. API tokens
+	// restricted to a namespace may then be used for writing
+	// even though no namespaces are specified.
+	noNamespace bool
 }
 
 // authorize checks that the current user is authorized to perform
@@ -169,8 +261,12 @@ type authorizeParams struct {
 // - by checking that the request header's HTTP basic auth credentials match
 //   the auth credentials stored in the API handler;
 //
+// - by checking that the request header holds a bearer API token that
+//   allows the request;
+//
 // - by checking that there is a valid macaroon in the request's cookies.
-// A params.ErrUnauthorized error is returned if superuser credentials fail;
+// A params.ErrUnauthorized error is returned if superuser credentials or
+// an API token fail;
 // otherwise a macaroon is minted and a httpbakery discharge-required
 // error is returned holding the macaroon.
 //
@@ -224,9 +320,13 @@ func (h *ReqHandler) authorize(p authorizeParams) (Authorization, error) {
 	}
 	auth, verr := h.checkRequest(p)
 	if verr == nil {
+		auth, err = h.addRoles(auth)
+		if err != nil {
+			return Authorization{}, errgo.Mask(err)
+		}
 		// The request is OK. Now check that the user associated with
 		// the verified macaroons is part of the ACL.
-		if err := set.check(auth, p.ops); err != nil {
+		if err := set.check(auth, p.ops, h.localGroups); err != nil {
 			return Authorization{}, errgo.WithCausef(err, params.ErrUnauthorized, "")
 		}
 		h.auth = auth
@@ -355,6 +455,9 @@ var errActiveTimeExpired = errgo.New("active time expired")
 // valued authorization is returned. It also checks any first party
 // caveats. It does not check ACLs.
 func (h *ReqHandler) checkRequest(p authorizeParams) (Authorization, error) {
+	if secret, ok := bearerToken(p.req); ok {
+		return h.checkAPIToken(secret, p)
+	}
 	user, passwd, err := parseCredentials(p.req)
 	if err == nil {
 		if user != h.Handler.config.AuthUsername || passwd != h.Handler.config.AuthPassword {
@@ -429,6 +532,83 @@ func (h *ReqHandler) checkRequest(p authorizeParams) (Authorization, error) {
 	return Authorization{}, h.newDischargeRequiredError(newm, errgo.New("active lifetime expired; renew macaroon"), p.req, false)
 }
 
+// checkAPIToken checks that the API token with the given secret allows
+// the request with the given authorization parameters and returns the
+// authorization of the user that the token acts as. It does not check
+// ACLs. When no identity manager has been configured, the returned
+// authorization has no User and the user's groups are only those in the
+// store's group registry.
+func (h *ReqHandler) checkAPIToken(secret string, p authorizeParams) (Authorization, error) {
+	if h.apiToken == nil {
+		tok, err := h.Store.APITokenFromSecret(secret)
+		if err != nil {
+			if errgo.Cause(err) == params.ErrNotFound {
+				return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid API token")
+			}
+			return Authorization{}, errgo.Mask(err)
+		}
+		h.apiToken = tok
+	}
+	tok := h.apiToken
+	if err := checkAPITokenScope(tok, p); err != nil {
+		return Authorization{}, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	if h.Handler.idmClient == nil {
+		return Authorization{
+			Username: tok.User,
+			Token:    tok,
+		}, nil
+	}
+	ident, err := h.Handler.idmClient.DeclaredIdentity(map[string]string{
+		"username": tok.User,
+	})
+	if err != nil {
+		return Authorization{}, errgo.Notef(err, "cannot infer identity")
+	}
+	return Authorization{
+		User:     ident.(*idmclient.User),
+		Username: tok.User,
+		Token:    tok,
+	}, nil
+}
+
+// checkAPITokenScope checks that the scope and namespace of the given
+// API token allow the request with the given authorization parameters.
+func checkAPITokenScope(tok *mongodoc.APIToken, p authorizeParams) error {
+	write := false
+	for _, op := range p.ops {
+		switch op {
+		case OpReadWithTerms:
+			// Terms can only be agreed to interactively.
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "API token cannot be used to read entities with terms")
+		case OpWrite:
+			write = true
+			if tok.Scope == mongodoc.APITokenPublish || tok.Scope == mongodoc.APITokenUpload && p.upload {
+				continue
+			}
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "API token with %s scope cannot be used for this operation", tok.Scope)
+		}
+	}
+	if tok.Namespace == "" {
+		return nil
+	}
+	namespaces := make([]string, 0, len(p.namespaces)+len(p.entityIds))
+	namespaces = append(namespaces, p.namespaces...)
+	for _, id := range p.entityIds {
+		namespaces = append(namespaces, id.URL.User)
+	}
+	if write && len(namespaces) == 0 && !p.noNamespace {
+		// We cannot tell which namespace would be changed.
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "API token restricted to namespace %q", tok.Namespace)
+	}
+	for _, ns := range namespaces {
+		if ns != tok.Namespace {
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "API token restricted to namespace %q", tok.Namespace)
+		}
+	}
+	return nil
+}
+
 // entityACLs calculates the ACLs for the specified entity. If the channel has
 // been specified via the "?channel=" query then the corresponding channel ACLs
 // are used. Otherwise, if the entity has been published to a channel then ACLs
@@ -443,7 +623,7 @@ func (h *ReqHandler) entityACLs(id *router.ResolvedURL) (mongodoc.ACL, error) {
 	if err != nil {
 		return mongodoc.ACL{}, errgo.Notef(err, "cannot retrieve base entity %q for authorization", id)
 	}
-	return baseEntity.ChannelACLs[ch], nil
+	return charmstore.ChannelACL(baseEntity, ch), nil
 }
 
 // entitiesRequiredTerms returns the set of terms that the user must have
@@ -546,10 +726,19 @@ func (c isEntityChecker) Check(_, args string) error {
 // mentioned a channel, that channel is used; otherwise
 // a channel will be selected from the channels that the
 // entity has been published to: in order of preference,
-// stable, edge and unpublished.
+// stable, edge and unpublished, with channels in the base
+// entity's default track preferred over those in other tracks.
+// The returned channel is resolved as by charmstore.ResolveChannel.
 func (h *ReqHandler) entityChannel(id *router.ResolvedURL) (params.Channel, error) {
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("defaulttrack"))
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return params.NoChannel, errgo.WithCausef(nil, params.ErrNotFound, "entity %q not found", id)
+		}
+		return params.NoChannel, errgo.Notef(err, "cannot retrieve base entity %q for authorization", id)
+	}
 	if h.Store.Channel != params.NoChannel {
-		return h.Store.Channel, nil
+		return charmstore.ResolveChannel(h.Store.Channel, baseEntity.DefaultTrack), nil
 	}
 	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("published"))
 	if err != nil {
@@ -558,11 +747,15 @@ func (h *ReqHandler) entityChannel(id *router.ResolvedURL) (params.Channel, erro
 		}
 		return params.NoChannel, errgo.Notef(err, "cannot retrieve entity %q for authorization", id)
 	}
-	for _, ch := range params.OrderedChannels {
-		if entity.Published[ch] {
-			return ch, nil
+	published := make([]params.Channel, 0, len(entity.Published))
+	for ch, ok := range entity.Published {
+		if ok {
+			published = append(published, ch)
 		}
 	}
+	if chans := charmstore.OrderedChannels(published, baseEntity.DefaultTrack); len(chans) > 0 {
+		return chans[0], nil
+	}
 	return params.UnpublishedChannel, nil
 }
 
@@ -633,6 +826,16 @@ func parseCredentials(req *http.Request) (username, password string, err error)
 	return tokens[0], tokens[1], nil
 }
 
+// bearerToken returns the API token secret held in the given request's
+// Authorization header, and reports whether there is one.
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.Fields(req.Header.Get("Authorization"))
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
 const condActiveTimeBefore = "active-time-before"
 
 // activeTimeBeforeCaveat returns a caveat that will be satisfied
@@ -669,19 +872,24 @@ func (s *aclSet) add(acl mongodoc.ACL) {
 
 // check checks that the request with the given authorization
 // is allowed to perform all the given operations with respect
-// to all the ACLs in the set. It uses the allow function to check
-// individual ACL membership.
-func (s *aclSet) check(auth Authorization, ops []string) error {
+// to all the ACLs in the set. Membership of an ACL is checked with
+// the identity manager and then, if that fails, with the groups that
+// localGroups returns for the user. A user with the auditor role
+// may read regardless of the ACLs.
+func (s *aclSet) check(auth Authorization, ops []string, localGroups func(user string) ([]string, error)) error {
 	if auth.Admin {
 		return nil
 	}
-	if auth.User == nil {
+	if auth.HasRole(RoleAuditor) && isReadOnly(ops) {
+		return nil
+	}
+	if auth.Username == "" {
 		return errgo.New("no authenticated identity")
 	}
 	logger.Infof("check username %q; ops %q; acls: %#v", auth.Username, ops, s.acls)
 	for _, acl := range s.acls {
 		for _, op := range ops {
-			ok, err := auth.User.Allow(aclForOp(acl, op))
+			ok, err := isMember(auth, aclForOp(acl, op), localGroups)
 			if err != nil {
 				return errgo.Mask(err)
 			}
@@ -705,6 +913,17 @@ func aclForOp(acls mongodoc.ACL, op string) []string {
 	return nil
 }
 
+// isReadOnly reports whether none of the given operations
+// changes anything.
+func isReadOnly(ops []string) bool {
+	for _, op := range ops {
+		if op == OpWrite {
+			return false
+		}
+	}
+	return true
+}
+
 func isPublicACL(acl []string) bool {
 	for _, u := range acl {
 		if u == params.Everyone {
@@ -714,19 +933,137 @@ func isPublicACL(acl []string) bool {
 	return false
 }
 
-type noGroupCache struct{}
+// isMember reports whether the user with the given authorization is
+// a member of the given ACL, either directly or through a group known
+// to the identity manager or returned by localGroups. When the user
+// was not authenticated by the identity manager, only the user name
+// and the groups returned by localGroups are checked.
+func isMember(auth Authorization, acl []string, localGroups func(user string) ([]string, error)) (bool, error) {
+	if auth.User != nil {
+		ok, err := auth.User.Allow(acl)
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		if ok {
+			return true, nil
+		}
+	} else {
+		for _, name := range acl {
+			if name == params.Everyone || name == auth.Username {
+				return true, nil
+			}
+		}
+	}
+	return inLocalGroup(auth.Username, acl, localGroups)
+}
+
+// inLocalGroup reports whether the given user is a member of any of
+// the groups in the given ACL that localGroups returns for the user.
+func inLocalGroup(user string, acl []string, localGroups func(user string) ([]string, error)) (bool, error) {
+	groups, err := localGroups(user)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, g := range groups {
+		for _, name := range acl {
+			if name == g {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// localGroups returns the groups in the store's group registry that
+// the given user is a member of. The groups of each user are only
+// retrieved once for each request.
+func (h *ReqHandler) localGroups(user string) ([]string, error) {
+	if groups, ok := h.groups[user]; ok {
+		return groups, nil
+	}
+	groups, err := h.Store.UserGroups(user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if h.groups == nil {
+		h.groups = make(map[string][]string)
+	}
+	h.groups[user] = groups
+	return groups, nil
+}
 
-func (noGroupCache) Groups(username string) ([]string, error) {
-	return nil, nil
+// UserGroups returns the groups that the user with the given
+// authorization is a member of: those known to the identity manager,
+// if the user was authenticated by it, followed by any others in the
+// store's group registry.
+func (h *ReqHandler) UserGroups(auth Authorization) ([]string, error) {
+	if auth.Username == "" {
+		return nil, nil
+	}
+	var groups []string
+	if auth.User != nil {
+		var err error
+		groups, err = auth.User.Groups()
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	local, err := h.localGroups(auth.Username)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	known := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		known[g] = true
+	}
+	for _, g := range local {
+		if !known[g] {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// promulgatorsGroup returns the name of the group whose members may
+// promulgate charms and bundles.
+func (h *ReqHandler) promulgatorsGroup() string {
+	if g := h.Handler.config.PromulgatorsGroup; g != "" {
+		return g
+	}
+	return PromulgatorsGroup
 }
 
-type noGroupsPermChecker struct{}
+// roleACL returns the users and groups that have been given the
+// given role.
+func (h *ReqHandler) roleACL(role string) []string {
+	return h.Handler.config.Roles[role]
+}
 
-func (noGroupsPermChecker) Allow(username string, acl []string) (bool, error) {
-	for _, name := range acl {
-		if name == username || name == params.Everyone {
-			return true, nil
+// addRoles returns the given authorization with the roles that have
+// been given to its user. A user with the super-admin role is given
+// admin rights. No roles are given to a request made with an API
+// token, so that a token cannot be used to act with more than the
+// rights of its scope.
+func (h *ReqHandler) addRoles(auth Authorization) (Authorization, error) {
+	if auth.Username == "" || auth.Token != nil {
+		return auth, nil
+	}
+	for _, role := range roles {
+		acl := h.roleACL(role)
+		if len(acl) == 0 {
+			continue
+		}
+		ok, err := isMember(auth, acl, h.localGroups)
+		if err != nil {
+			return Authorization{}, errgo.Notef(err, "cannot check role %q", role)
+		}
+		if !ok {
+			continue
+		}
+		auth.Roles = append(auth.Roles, role)
+		if role == RoleSuperAdmin {
+			auth.Admin = true
 		}
 	}
-	return false, nil
+	return auth, nil
 }
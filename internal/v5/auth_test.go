@@ -94,9 +94,8 @@ func (s *commonSuite) testMacaroonAuth(c *gc.C, p httptesting.JSONCallParams) {
 
 	// Check that the call gives us the correct "authentication
 	// denied response" without simple auth that a cookie is stored
-	// at the correct location.
-	// TODO when we allow admin access via macaroon creds,
-	// change this test to expect success.
+	// at the correct location. Bob has not been given any
+	// roles, so is denied access.
 	c.Log("macaroon unauthorized error")
 	p.Username, p.Password = "", ""
 	p.ExpectStatus = http.StatusUnauthorized
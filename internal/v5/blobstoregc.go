@@ -0,0 +1,48 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+)
+
+// BlobStoreGCResponse holds the response body of
+// GET /debug/blobstore-gc.
+type BlobStoreGCResponse struct {
+	// TotalSize holds the total size of the blobs
+	// that would be removed.
+	TotalSize int64
+
+	// Blobs holds the blobs that would be removed.
+	Blobs []blobstore.GarbageBlob
+}
+
+// GET /debug/blobstore-gc
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-debugblobstore-gc
+func (h *ReqHandler) serveDebugBlobStoreGC(_ http.Header, req *http.Request) (interface{}, error) {
+	if _, err := h.authenticateRole(req, RoleAuditor); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	garbage, err := h.Store.BlobStoreGCDryRun(time.Now().Add(-charmstore.BlobStoreGCGracePeriod))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &BlobStoreGCResponse{
+		Blobs: garbage,
+	}
+	for _, blob := range garbage {
+		resp.TotalSize += blob.Size
+	}
+	return resp, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestDebugBlobStoreGC(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-2", 2))
+
+	// Add one unreferenced blob that is old enough to be
+	// collected and another that is too recent.
+	oldContent := "old garbage"
+	putTime := time.Now().Add(-time.Hour)
+	err := s.store.BlobStore.PutAtTime(strings.NewReader(oldContent), hashOfString(oldContent), int64(len(oldContent)), putTime)
+	c.Assert(err, gc.Equals, nil)
+	newContent := "new garbage"
+	err = s.store.BlobStore.Put(strings.NewReader(newContent), hashOfString(newContent), int64(len(newContent)))
+	c.Assert(err, gc.Equals, nil)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("debug/blobstore-gc"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var resp v5.BlobStoreGCResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.TotalSize, gc.Equals, int64(len(oldContent)))
+	c.Assert(resp.Blobs, gc.HasLen, 1)
+	c.Assert(resp.Blobs[0].Hash, gc.Equals, hashOfString(oldContent))
+	c.Assert(resp.Blobs[0].Size, gc.Equals, int64(len(oldContent)))
+	c.Assert(resp.Blobs[0].PutTime, jc.TimeBetween(putTime.Add(-time.Second), putTime.Add(time.Second)))
+
+	// The blob has not been removed.
+	r, _, err := s.store.BlobStore.Open(hashOfString(oldContent), nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+}
+
+func (s *APISuite) TestDebugBlobStoreGCUnauthorized(c *gc.C) {
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("debug/blobstore-gc"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.BlobStoreGCResponse{
+			Blobs: []blobstore.GarbageBlob{},
+		},
+	})
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// changeStreamPollInterval holds how often a followed change stream
+// checks for new changes. It is a variable so that it can be changed
+// by tests.
+var changeStreamPollInterval = time.Second
+
+// changeStreamKeepAlive holds how long an event stream may be idle
+// before a comment is sent to keep the connection open.
+const changeStreamKeepAlive = 30 * time.Second
+
+// changeStreamBatchSize holds the maximum number of changes read from
+// the store at a time.
+const changeStreamBatchSize = 100
+
+// maxChangeStreams holds the maximum number of followed change
+// streams that may be served at once. It is a variable so that it
+// can be changed by tests.
+var maxChangeStreams = 50
+
+// ChangeEvent holds an event sent by GET changes/stream.
+type ChangeEvent struct {
+	// EventId holds the id of the event. It may be used to
+	// resume the stream after the event.
+	EventId int64
+
+	// Event holds one of "upload", "publish", "perm" or "delete".
+	Event string
+
+	// Id holds the id of the charm or bundle changed.
+	Id *charm.URL
+
+	// Channels holds the channels published to
+	// for publish events.
+	Channels []params.Channel `json:",omitempty"`
+
+	// Time holds when the change was made.
+	Time time.Time
+}
+
+// GET changes/stream[?since=event-id][&follow=0][&format=sse|json]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-changesstream
+func (h *ReqHandler) serveChangesStream(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	since, err := h.changeStreamStart(req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	follow := true
+	if v := req.Form.Get("follow"); v != "" {
+		follow, err = strconv.ParseBool(v)
+		if err != nil {
+			return badRequestf(nil, "invalid 'follow' value")
+		}
+	}
+	var sse bool
+	switch req.Form.Get("format") {
+	case "":
+		sse = strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	case "sse":
+		sse = true
+	case "json":
+	default:
+		return badRequestf(nil, "invalid 'format' value")
+	}
+	if follow {
+		select {
+		case h.Handler.changeStreams <- struct{}{}:
+			defer func() {
+				<-h.Handler.changeStreams
+			}()
+		default:
+			return errgo.WithCausef(nil, params.ErrServiceUnavailable, "too many change streams")
+		}
+	}
+	changes, more, err := h.readableChanges(since, req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if follow {
+		// The stream may be followed for a long time, so
+		// don't hold the request's store while waiting;
+		// pollChanges takes a store for each poll instead.
+		h.releaseStore()
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	lastWrite := time.Now()
+	for {
+		for _, c := range changes {
+			since = c.Id
+			if !c.readable {
+				continue
+			}
+			if err := writeChangeEvent(w, c.Change, sse); err != nil {
+				// The client has gone away.
+				return nil
+			}
+			lastWrite = time.Now()
+		}
+		flush()
+		if !more {
+			if !follow {
+				return nil
+			}
+			if sse && time.Since(lastWrite) >= changeStreamKeepAlive {
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+				flush()
+				lastWrite = time.Now()
+			}
+			select {
+			case <-closed:
+				return nil
+			case <-h.Handler.closed:
+				return nil
+			case <-time.After(changeStreamPollInterval):
+			}
+		}
+		if follow {
+			changes, more, err = h.pollChanges(since, req)
+		} else {
+			changes, more, err = h.readableChanges(since, req)
+		}
+		if err != nil {
+			// The response has already started, so the
+			// error cannot be returned to the client.
+			logger.Errorf("cannot get changes: %v", err)
+			return nil
+		}
+	}
+}
+
+// streamChange holds a change read for a change stream.
+type streamChange struct {
+	*mongodoc.Change
+
+	// readable holds whether the client may see the change.
+	readable bool
+}
+
+// readableChanges returns the next batch of changes after since,
+// noting which of them the client making req may see. It also
+// reports whether there may be more changes to read straight away.
+func (h *ReqHandler) readableChanges(since int64, req *http.Request) ([]streamChange, bool, error) {
+	changes, err := h.Store.Changes(since, changeStreamBatchSize)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	result := make([]streamChange, len(changes))
+	for i, c := range changes {
+		result[i] = streamChange{
+			Change:   c,
+			readable: h.changeReadable(c, req),
+		}
+	}
+	return result, len(changes) == changeStreamBatchSize, nil
+}
+
+// pollChanges is like readableChanges except that it is called after
+// the request's store has been released. It uses a store taken from
+// the pool for just the duration of the call, and a new entity cache
+// so that permission changes affect the events that follow.
+func (h *ReqHandler) pollChanges(since int64, req *http.Request) ([]streamChange, bool, error) {
+	h.Store.Store = h.Handler.Pool.Store()
+	h.newCache()
+	h.groups = nil
+	defer h.releaseStore()
+	return h.readableChanges(since, req)
+}
+
+// changeStreamStart returns the id of the change that the stream
+// requested by req starts after. It is taken from the since parameter
+// or, when an event stream is reconnecting, from the Last-Event-ID
+// header. If neither is present, the stream starts with the next change.
+func (h *ReqHandler) changeStreamStart(req *http.Request) (int64, error) {
+	v := req.Form.Get("since")
+	if v == "" {
+		v = req.Header.Get("Last-Event-ID")
+	}
+	if v == "" {
+		since, err := h.Store.LatestChangeId()
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		return since, nil
+	}
+	since, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || since < 0 {
+		return 0, badRequestf(nil, "invalid 'since' value")
+	}
+	return since, nil
+}
+
+// changeReadable reports whether the client making the given request
+// may see the given change. A change is visible to those that can read
+// the entity changed. As a deleted entity can no longer be read, its
+// deletion is visible to those that can read the unpublished channel of
+// its base entity, if that remains.
+func (h *ReqHandler) changeReadable(c *mongodoc.Change, req *http.Request) bool {
+	if c.Event == mongodoc.EventDelete {
+		_, err := h.Cache.Entity(c.URL, charmstore.FieldSelector("published"))
+		if errgo.Cause(err) == params.ErrNotFound {
+			baseEntity, err := h.Cache.BaseEntity(c.URL, charmstore.FieldSelector("channelacls"))
+			if err != nil {
+				return false
+			}
+			_, err = h.authorize(authorizeParams{
+				req:  req,
+				ops:  []string{OpReadWithNoTerms},
+				acls: []mongodoc.ACL{baseEntity.ChannelACLs[params.UnpublishedChannel]},
+			})
+			return err == nil
+		}
+	}
+	err := h.AuthorizeEntityForOp(&router.ResolvedURL{
+		URL:                 *c.URL,
+		PromulgatedRevision: -1,
+	}, req, OpReadWithNoTerms)
+	return err == nil
+}
+
+// writeChangeEvent writes the given change to w as a server-sent
+// event if sse is true, or as a line of JSON otherwise.
+func writeChangeEvent(w io.Writer, c *mongodoc.Change, sse bool) error {
+	data, err := json.Marshal(ChangeEvent{
+		EventId:  c.Id,
+		Event:    string(c.Event),
+		Id:       c.URL,
+		Channels: c.Channels,
+		Time:     c.Time.UTC(),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if sse {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Id, c.Event, data)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", data)
+	}
+	return err
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestChangesStream(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for _, id := range []string{"cs:~bob/precise/mysql-0", "cs:~bob/precise/mysql-1"} {
+		err := s.store.AddCharmWithArchive(newResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := s.store.DeleteEntity(newResolvedURL("cs:~bob/precise/mysql-0", -1))
+	c.Assert(err, gc.Equals, nil)
+
+	allEvents := []v5.ChangeEvent{{
+		EventId: 1,
+		Event:   "upload",
+		Id:      charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+	}, {
+		EventId:  2,
+		Event:    "publish",
+		Id:       charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		EventId: 3,
+		Event:   "upload",
+		Id:      charm.MustParseURL("cs:~bob/precise/mysql-0"),
+	}, {
+		EventId: 4,
+		Event:   "upload",
+		Id:      charm.MustParseURL("cs:~bob/precise/mysql-1"),
+	}, {
+		EventId: 5,
+		Event:   "delete",
+		Id:      charm.MustParseURL("cs:~bob/precise/mysql-0"),
+	}}
+
+	// Anonymous users only see the changes to public entities.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("changes/stream?since=0&follow=0"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/x-ndjson")
+	c.Assert(parseChangeEvents(c, rec.Body.Bytes()), jc.DeepEquals, allEvents[0:2])
+
+	// Users that can read the unpublished channel also see the
+	// changes to private entities. The upload of a deleted entity
+	// is not shown because the entity can no longer be read, but
+	// its deletion is.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("changes/stream?since=0&follow=0"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(parseChangeEvents(c, rec.Body.Bytes()), jc.DeepEquals, []v5.ChangeEvent{
+		allEvents[0],
+		allEvents[1],
+		allEvents[3],
+		allEvents[4],
+	})
+
+	// The stream can be resumed.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("changes/stream?since=3&follow=0"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(parseChangeEvents(c, rec.Body.Bytes()), jc.DeepEquals, allEvents[3:])
+
+	// By default, the stream starts with the next change.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("changes/stream?follow=0"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Equals, "")
+}
+
+func (s *APISuite) TestChangesStreamEventSource(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+
+	// An event source reconnecting sends the id of
+	// the last event it received.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("changes/stream?follow=0"),
+		Header: http.Header{
+			"Accept":        {"text/event-stream"},
+			"Last-Event-ID": {"1"},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/event-stream")
+	lines := strings.Split(rec.Body.String(), "\n")
+	c.Assert(lines, gc.HasLen, 5)
+	c.Assert(lines[0], gc.Equals, "id: 2")
+	c.Assert(lines[1], gc.Equals, "event: publish")
+	c.Assert(lines[2], jc.HasPrefix, "data: ")
+	c.Assert(lines[3:], jc.DeepEquals, []string{"", ""})
+	c.Assert(parseChangeEvents(c, []byte(strings.TrimPrefix(lines[2], "data: "))), jc.DeepEquals, []v5.ChangeEvent{{
+		EventId:  2,
+		Event:    "publish",
+		Id:       charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		Channels: []params.Channel{params.StableChannel},
+	}})
+
+	// The format can be chosen explicitly.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("changes/stream?follow=0&since=1&format=sse"),
+	})
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/event-stream")
+	c.Assert(rec.Body.String(), jc.HasPrefix, "id: 2\n")
+}
+
+func (s *APISuite) TestChangesStreamFollow(c *gc.C) {
+	s.PatchValue(v5.ChangeStreamPollInterval, 10*time.Millisecond)
+	srv := httptest.NewServer(s.srv)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+storeURL("changes/stream"), nil)
+	c.Assert(err, gc.Equals, nil)
+	req.SetBasicAuth(testUsername, testPassword)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	events := make(chan v5.ChangeEvent)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			var e v5.ChangeEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for _, expect := range []string{"upload", "publish"} {
+		select {
+		case e, ok := <-events:
+			c.Assert(ok, gc.Equals, true)
+			c.Assert(e.Event, gc.Equals, expect)
+			c.Assert(e.Id, jc.DeepEquals, charm.MustParseURL("cs:~bob/precise/wordpress-0"))
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for %s event", expect)
+		}
+	}
+}
+
+func (s *APISuite) TestChangesStreamLimits(c *gc.C) {
+	s.PatchValue(v5.ChangeStreamPollInterval, 10*time.Millisecond)
+	s.PatchValue(v5.MaxChangeStreams, 1)
+	config := s.srvParams
+	config.MaxMgoSessions = 1
+	csrv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	closed := false
+	defer func() {
+		if !closed {
+			csrv.Close()
+		}
+	}()
+	srv := httptest.NewServer(csrv)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + storeURL("changes/stream"))
+	c.Assert(err, gc.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+
+	// The followed stream does not hold the only store
+	// available to requests.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: csrv,
+		URL:     storeURL("changes/stream?follow=0"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+
+	// Only one stream may be followed at once.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      csrv,
+		URL:          storeURL("changes/stream"),
+		ExpectStatus: http.StatusServiceUnavailable,
+		ExpectBody: params.Error{
+			Code:    params.ErrServiceUnavailable,
+			Message: "too many change streams",
+		},
+	})
+
+	// Closing the server ends the stream.
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	csrv.Close()
+	closed = true
+	select {
+	case err := <-done:
+		c.Assert(err, gc.Equals, nil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("stream not ended when the server was closed")
+	}
+}
+
+var changesStreamErrorTests = []struct {
+	about        string
+	method       string
+	args         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid since",
+	args:         "?since=foo",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'since' value`,
+	},
+}, {
+	about:        "negative since",
+	args:         "?since=-1",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'since' value`,
+	},
+}, {
+	about:        "invalid follow",
+	args:         "?follow=sometimes",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'follow' value`,
+	},
+}, {
+	about:        "invalid format",
+	args:         "?format=xml",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'format' value`,
+	},
+}, {
+	about:        "post not allowed",
+	method:       "POST",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `POST not allowed`,
+	},
+}}
+
+func (s *APISuite) TestChangesStreamErrors(c *gc.C) {
+	for i, test := range changesStreamErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL("changes/stream") + test.args,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+// parseChangeEvents parses the given newline-delimited change events,
+// checking and then zeroing their times.
+func parseChangeEvents(c *gc.C, data []byte) []v5.ChangeEvent {
+	var events []v5.ChangeEvent
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e v5.ChangeEvent
+		err := json.Unmarshal(line, &e)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.Time.IsZero(), gc.Equals, false)
+		e.Time = time.Time{}
+		events = append(events, e)
+	}
+	return events
+}
@@ -180,6 +180,8 @@ func (s *commonSuite) startServer(c *gc.C) {
 		MaxMgoSessions:    s.maxMgoSessions,
 		MinUploadPartSize: 10,
 		NewBlobBackend:    s.newBlobBackend,
+		// The webhook tests deliver to local HTTP servers.
+		WebhookAllowPrivateAddresses: true,
 	}
 	keyring := httpbakery.NewPublicKeyRing(nil, nil)
 	keyring.AllowInsecure()
@@ -0,0 +1,76 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// Deprecation holds the response body of GET id/meta/deprecation
+// and the request body of PUT id/meta/deprecation.
+type Deprecation struct {
+	// State holds either "deprecated" or "yanked". A yanked
+	// entity is not resolved unless its revision is given.
+	State string
+
+	// Reason holds why the entity was deprecated or yanked.
+	Reason string `json:",omitempty"`
+
+	// Replacement holds the id of an entity to use instead.
+	Replacement *charm.URL `json:",omitempty"`
+}
+
+// GET id/meta/deprecation
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetadeprecation
+func (h *ReqHandler) metaDeprecation(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.Deprecation == nil {
+		return nil, nil
+	}
+	return &Deprecation{
+		State:       string(entity.Deprecation.State),
+		Reason:      entity.Deprecation.Reason,
+		Replacement: entity.Deprecation.Replacement,
+	}, nil
+}
+
+// PUT id/meta/deprecation
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetadeprecation
+func (h *ReqHandler) putMetaDeprecation(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	// If the user puts null, the entity is no longer
+	// deprecated or yanked.
+	if val == nil || bytes.Equal(*val, nullBytes) {
+		updater.UpdateField("deprecation", nil, nil)
+		// The entity may now be included in the search index.
+		updater.UpdateSearch()
+		return nil
+	}
+	var d Deprecation
+	if err := json.Unmarshal(*val, &d); err != nil {
+		return badRequestf(err, "cannot unmarshal deprecation")
+	}
+	state := mongodoc.DeprecationState(d.State)
+	if state != mongodoc.Deprecated && state != mongodoc.Yanked {
+		return badRequestf(nil, "invalid deprecation state %q", d.State)
+	}
+	if d.Replacement != nil && *d.Replacement == id.URL {
+		return badRequestf(nil, "entity cannot replace itself")
+	}
+	updater.UpdateField("deprecation", &mongodoc.Deprecation{
+		State:       state,
+		Reason:      d.Reason,
+		Replacement: d.Replacement,
+	}, nil)
+	// Deprecated and yanked entities are removed from the
+	// search index.
+	updater.UpdateSearch()
+	return nil
+}
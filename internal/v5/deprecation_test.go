@@ -0,0 +1,125 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestPutDeprecation(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	s.assertPut(c, "~bob/precise/wordpress-0/meta/deprecation", v5.Deprecation{
+		State:       "yanked",
+		Reason:      "data loss on upgrade",
+		Replacement: charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+	})
+	e, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Deprecation, jc.DeepEquals, &mongodoc.Deprecation{
+		State:       mongodoc.Yanked,
+		Reason:      "data loss on upgrade",
+		Replacement: charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+	})
+	s.assertGet(c, "~bob/precise/wordpress-0/meta/deprecation", v5.Deprecation{
+		State:       "yanked",
+		Reason:      "data loss on upgrade",
+		Replacement: charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+	})
+
+	// Putting null clears the deprecation.
+	s.assertPut(c, "~bob/precise/wordpress-0/meta/deprecation", nil)
+	e, err = s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Deprecation, gc.IsNil)
+}
+
+func (s *APISuite) TestPutDeprecationUnauthorized(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.idmServer.SetDefaultUser("alice")
+	s.assertPutIsUnauthorized(c, "~bob/precise/wordpress-0/meta/deprecation", v5.Deprecation{
+		State: "deprecated",
+	}, `access denied for user "alice"`)
+}
+
+var putDeprecationErrorTests = []struct {
+	about         string
+	body          interface{}
+	expectMessage string
+}{{
+	about: "invalid state",
+	body: v5.Deprecation{
+		State: "broken",
+	},
+	expectMessage: `invalid deprecation state "broken"`,
+}, {
+	about: "no state",
+	body: v5.Deprecation{
+		Reason: "broken",
+	},
+	expectMessage: `invalid deprecation state ""`,
+}, {
+	about: "replaced by itself",
+	body: v5.Deprecation{
+		State:       "deprecated",
+		Replacement: charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+	},
+	expectMessage: `entity cannot replace itself`,
+}}
+
+func (s *APISuite) TestPutDeprecationErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range putDeprecationErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "PUT",
+			URL:          storeURL("~bob/precise/wordpress-0/meta/deprecation"),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
+func (s *APISuite) TestYankedRevisionNotResolved(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-1", -1))
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+	s.assertPutAsAdmin(c, "~bob/precise/wordpress-1/meta/deprecation", v5.Deprecation{
+		State: "yanked",
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 0,
+	})
+	// The yanked revision is still available by its full id.
+	s.assertGet(c, "~bob/precise/wordpress-1/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+
+	// A deprecated revision is still resolved.
+	s.assertPutAsAdmin(c, "~bob/precise/wordpress-1/meta/deprecation", v5.Deprecation{
+		State: "deprecated",
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+}
@@ -12,4 +12,6 @@ var (
 	ResolveURL                = resolveURL
 	RenewMacaroon             = renewMacaroon
 	TimeNow                   = &timeNow
+	ChangeStreamPollInterval  = &changeStreamPollInterval
+	MaxChangeStreams          = &maxChangeStreams
 )
@@ -0,0 +1,135 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// Group holds the response body of GET /group/name
+// and an entry in the response body of GET /group.
+type Group struct {
+	// Name holds the name of the group.
+	Name string
+
+	// Members holds the names of the users in the group.
+	Members []string
+
+	// CreateTime holds when the group was created.
+	CreateTime time.Time
+}
+
+// GroupRequest holds the request body of PUT /group/name.
+type GroupRequest struct {
+	// Members holds the names of the users in the group.
+	Members []string
+}
+
+// GroupMembersRequest holds the request body of
+// POST /group/name/members.
+type GroupMembersRequest struct {
+	// Add holds the names of the users to add to the group.
+	Add []string `json:",omitempty"`
+
+	// Remove holds the names of the users to remove
+	// from the group.
+	Remove []string `json:",omitempty"`
+}
+
+// GET /group
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-group
+//
+// GET /group/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-groupname
+//
+// PUT /group/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-groupname
+//
+// DELETE /group/name
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-groupname
+//
+// POST /group/name/members
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-groupnamemembers
+func (h *ReqHandler) serveGroup(_ http.Header, req *http.Request) (interface{}, error) {
+	role := RoleSuperAdmin
+	if req.Method == "GET" {
+		role = RoleAuditor
+	}
+	if _, err := h.authenticateRole(req, role); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" {
+		if req.Method != "GET" {
+			return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+		}
+		gs, err := h.Store.Groups()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result := make([]Group, len(gs))
+		for i, g := range gs {
+			result[i] = groupResponse(g)
+		}
+		return result, nil
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1:
+	case len(parts) == 2 && parts[1] == "members":
+		if req.Method != "POST" {
+			return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+		}
+		var r GroupMembersRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			return nil, badRequestf(err, "cannot unmarshal group members request")
+		}
+		if err := h.Store.UpdateGroupMembers(parts[0], r.Add, r.Remove); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrNotFound))
+		}
+		return nil, nil
+	default:
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	name := parts[0]
+	switch req.Method {
+	case "GET":
+		g, err := h.Store.Group(name)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return groupResponse(g), nil
+	case "PUT":
+		var r GroupRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			return nil, badRequestf(err, "cannot unmarshal group request")
+		}
+		if err := h.Store.SetGroup(name, r.Members); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		return nil, nil
+	case "DELETE":
+		if err := h.Store.RemoveGroup(name); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return nil, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+func groupResponse(g *mongodoc.Group) Group {
+	return Group{
+		Name:       g.Name,
+		Members:    g.Members,
+		CreateTime: g.CreateTime.UTC(),
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestGroupLifecycle(c *gc.C) {
+	s.assertPutAsAdmin(c, "group/qa", v5.GroupRequest{
+		Members: []string{"bob", "alice"},
+	})
+	s.assertPutAsAdmin(c, "group/ci", v5.GroupRequest{})
+
+	var g v5.Group
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("group/qa"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &g)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(g.CreateTime.IsZero(), gc.Equals, false)
+	c.Assert(g.Name, gc.Equals, "qa")
+	c.Assert(g.Members, jc.DeepEquals, []string{"bob", "alice"})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("group/qa/members"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.GroupMembersRequest{
+			Add:    []string{"carol"},
+			Remove: []string{"bob"},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("group"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			var gs []v5.Group
+			err := json.Unmarshal(m, &gs)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(gs, gc.HasLen, 2)
+			c.Assert(gs[0].Name, gc.Equals, "ci")
+			c.Assert(gs[0].Members, jc.DeepEquals, []string{})
+			c.Assert(gs[1].Name, gc.Equals, "qa")
+			c.Assert(gs[1].Members, jc.DeepEquals, []string{"alice", "carol"})
+		}),
+	})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "DELETE",
+		URL:      storeURL("group/ci"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("group/ci"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `group "ci" not found`,
+		},
+	})
+}
+
+func (s *APISuite) TestLocalGroupACL(c *gc.C) {
+	id := newResolvedURL("cs:~alice/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "alice", "qa")
+	c.Assert(err, gc.Equals, nil)
+
+	s.idmServer.AddUser("bob")
+	p := httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~alice/precise/wordpress-0/meta/id-revision"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	}
+	httptesting.AssertJSONCall(c, p)
+
+	// Membership of a local group grants access.
+	err = s.store.SetGroup("qa", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	p.ExpectStatus = http.StatusOK
+	p.ExpectBody = params.IdRevisionResponse{Revision: 0}
+	httptesting.AssertJSONCall(c, p)
+}
+
+func (s *APISuite) TestWhoAmIWithLocalGroups(c *gc.C) {
+	s.idmServer.AddUser("bob", "idm-group", "qa")
+	err := s.store.SetGroup("qa", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetGroup("ci", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("whoami"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		ExpectBody: params.WhoAmIResponse{
+			User:   "bob",
+			Groups: []string{"idm-group", "qa", "ci"},
+		},
+	})
+}
+
+func (s *APISuite) TestConfiguredPromulgatorsGroup(c *gc.C) {
+	config := s.srvParams
+	config.PromulgatorsGroup = "promulgators"
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	s.idmServer.AddUser("alice", "charmers")
+	s.idmServer.AddUser("carol")
+	err = s.store.SetGroup("promulgators", []string{"carol"})
+	c.Assert(err, gc.Equals, nil)
+
+	// Members of the default group can no longer promulgate.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      srv,
+		Method:       "PUT",
+		URL:          storeURL("~bob/precise/wordpress/promulgate"),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		JSONBody:     params.PromulgateRequest{Promulgated: true},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  srv,
+		Method:   "PUT",
+		URL:      storeURL("~bob/precise/wordpress/promulgate"),
+		Do:       bakeryDo(s.idmServer.Client("carol")),
+		JSONBody: params.PromulgateRequest{Promulgated: true},
+	})
+	e, err := s.store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.Promulgated, gc.Equals, true)
+	c.Assert(e.ChannelACLs[params.StableChannel].Write, jc.DeepEquals, []string{"promulgators"})
+}
+
+var groupErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid group name",
+	method:       "PUT",
+	url:          "group/Bad!",
+	body:         v5.GroupRequest{},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid group name "Bad!"`,
+	},
+}, {
+	about:        "invalid member name",
+	method:       "PUT",
+	url:          "group/qa",
+	body:         v5.GroupRequest{Members: []string{"everyone"}},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid user name "everyone"`,
+	},
+}, {
+	about:        "group as its own member",
+	method:       "PUT",
+	url:          "group/qa",
+	body:         v5.GroupRequest{Members: []string{"bob", "qa"}},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `user name "qa" clashes with a group`,
+	},
+}, {
+	about:        "update unknown group",
+	method:       "POST",
+	url:          "group/unknown/members",
+	body:         v5.GroupMembersRequest{Add: []string{"bob"}},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `group "unknown" not found`,
+	},
+}, {
+	about:        "delete unknown group",
+	method:       "DELETE",
+	url:          "group/unknown",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `group "unknown" not found`,
+	},
+}, {
+	about:        "post to group not allowed",
+	method:       "POST",
+	url:          "group/qa",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `POST not allowed`,
+	},
+}, {
+	about:        "get members not allowed",
+	url:          "group/qa/members",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `GET not allowed`,
+	},
+}, {
+	about:        "unknown path",
+	url:          "group/qa/foo",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `not found`,
+	},
+}}
+
+func (s *APISuite) TestGroupErrors(c *gc.C) {
+	for i, test := range groupErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			JSONBody:     test.body,
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) TestGroupAdminOnly(c *gc.C) {
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL: storeURL("group"),
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// PublishEvent holds a single entry in the response body of
+// GET id/meta/channel-history.
+type PublishEvent struct {
+	// Id holds the id of the published charm or bundle.
+	Id *charm.URL
+
+	// Channel holds the channel it was published to.
+	Channel params.Channel
+
+	// Series holds the series it was published for.
+	Series []string `json:",omitempty"`
+
+	// Resources holds the resource revisions it was
+	// published with, keyed by resource name.
+	Resources map[string]int `json:",omitempty"`
+
+	// User holds the name of the user that published it.
+	User string `json:",omitempty"`
+
+	// Time holds when it was published.
+	Time time.Time
+
+	// RolledBackFrom holds the id that was current in the
+	// channel if the publish was a rollback.
+	RolledBackFrom *charm.URL `json:",omitempty"`
+}
+
+// RollbackRequest holds the request body of POST id/rollback.
+type RollbackRequest struct {
+	// Channel holds the channel to roll back.
+	Channel params.Channel
+}
+
+// GET id/meta/channel-history[?channel=channel]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetachannel-history
+func (h *ReqHandler) metaChannelHistory(id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	channel := params.Channel(flags.Get("channel"))
+	if channel != params.NoChannel && !charmstore.ValidChannel(channel) {
+		return nil, badRequestf(nil, "invalid channel %q", channel)
+	}
+	events, err := h.Store.ChannelHistory(&id.URL, channel)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	history := make([]PublishEvent, len(events))
+	for i, e := range events {
+		history[i] = publishEventFromDoc(e)
+	}
+	return history, nil
+}
+
+// POST id/rollback
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-idrollback
+func (h *ReqHandler) serveRollback(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var rollback struct {
+		RollbackRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &rollback); err != nil {
+		return badRequestf(err, "cannot unmarshal rollback request body")
+	}
+	channel := rollback.Channel
+	if channel == params.NoChannel {
+		return badRequestf(nil, "no channel provided")
+	}
+	if !charmstore.ValidChannel(channel) || channel == params.UnpublishedChannel {
+		return badRequestf(nil, "cannot roll back the %q channel", channel)
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls", "defaulttrack"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// A rollback is a publish, so it requires the same
+	// permission as publishing to the channel.
+	if _, err := h.authorize(authorizeParams{
+		req:              req,
+		acls:             []mongodoc.ACL{charmstore.ChannelACL(baseEntity, charmstore.ResolveChannel(channel, baseEntity.DefaultTrack))},
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	event, err := h.Store.Rollback(&id.URL, channel, h.authUsername())
+	if err != nil {
+		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		return errgo.NoteMask(err, fmt.Sprintf("cannot roll back %q", mongodoc.BaseURL(&id.URL)),
+			errgo.Is(params.ErrNotFound),
+			errgo.Is(params.ErrBadRequest),
+		)
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, publishEventFromDoc(event))
+}
+
+func publishEventFromDoc(e *mongodoc.PublishEvent) PublishEvent {
+	event := PublishEvent{
+		Id:             e.URL,
+		Channel:        e.Channel,
+		Series:         e.Series,
+		User:           e.User,
+		Time:           e.Time,
+		RolledBackFrom: e.RolledBackFrom,
+	}
+	if len(e.Resources) > 0 {
+		event.Resources = make(map[string]int, len(e.Resources))
+		for _, r := range e.Resources {
+			event.Resources[r.Name] = r.Revision
+		}
+	}
+	return event
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestChannelHistory(c *gc.C) {
+	id0 := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id0)
+	id1 := newResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	err := s.store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/precise/wordpress-1/publish", params.PublishRequest{
+		Channels: []params.Channel{params.EdgeChannel},
+	})
+
+	history := s.getChannelHistory(c, "~bob/wordpress/meta/channel-history")
+	c.Assert(history, gc.HasLen, 2)
+	c.Assert(history[0].Id, jc.DeepEquals, &id1.URL)
+	c.Assert(history[0].Channel, gc.Equals, params.EdgeChannel)
+	c.Assert(history[0].User, gc.Equals, "bob")
+	c.Assert(history[1].Id, jc.DeepEquals, &id0.URL)
+	c.Assert(history[1].Channel, gc.Equals, params.StableChannel)
+	c.Assert(history[1].User, gc.Equals, "")
+
+	history = s.getChannelHistory(c, "~bob/wordpress/meta/channel-history?channel=stable")
+	c.Assert(history, gc.HasLen, 1)
+	c.Assert(history[0].Id, jc.DeepEquals, &id0.URL)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/wordpress/meta/channel-history?channel=bad"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "bad"`,
+		},
+	})
+}
+
+func (s *APISuite) TestRollback(c *gc.C) {
+	id0 := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id0)
+	id1 := newResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id1)
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("~bob/wordpress/rollback"),
+		Do:       bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.RollbackRequest{Channel: params.StableChannel},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var event v5.PublishEvent
+	err := json.Unmarshal(rec.Body.Bytes(), &event)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(event.Id, jc.DeepEquals, &id0.URL)
+	c.Assert(event.Channel, gc.Equals, params.StableChannel)
+	c.Assert(event.User, gc.Equals, "bob")
+	c.Assert(event.RolledBackFrom, jc.DeepEquals, &id1.URL)
+
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 0,
+	})
+	history := s.getChannelHistory(c, "~bob/wordpress/meta/channel-history?channel=stable")
+	c.Assert(history, gc.HasLen, 3)
+	c.Assert(history[0].RolledBackFrom, jc.DeepEquals, &id1.URL)
+}
+
+func (s *APISuite) TestRollbackUnauthorized(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-1", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL("~bob/wordpress/rollback"),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		JSONBody:     v5.RollbackRequest{Channel: params.StableChannel},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+}
+
+var rollbackErrorTests = []struct {
+	about        string
+	url          string
+	method       string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no channel",
+	url:          "~bob/wordpress/rollback",
+	method:       "POST",
+	body:         v5.RollbackRequest{},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `no channel provided`,
+	},
+}, {
+	about:        "unpublished channel",
+	url:          "~bob/wordpress/rollback",
+	method:       "POST",
+	body:         v5.RollbackRequest{Channel: params.UnpublishedChannel},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot roll back the "unpublished" channel`,
+	},
+}, {
+	about:        "nothing to roll back to",
+	url:          "~bob/wordpress/rollback",
+	method:       "POST",
+	body:         v5.RollbackRequest{Channel: params.StableChannel},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `cannot roll back "cs:~bob/wordpress": no earlier revision of "cs:~bob/wordpress" to roll back to in the stable channel`,
+	},
+}, {
+	about:        "never published",
+	url:          "~bob/wordpress/rollback",
+	method:       "POST",
+	body:         v5.RollbackRequest{Channel: params.EdgeChannel},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `cannot roll back "cs:~bob/wordpress": "cs:~bob/wordpress" has not been published to the edge channel`,
+	},
+}, {
+	about:        "bad method",
+	url:          "~bob/wordpress/rollback",
+	method:       "PUT",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `PUT not allowed`,
+	},
+}}
+
+func (s *APISuite) TestRollbackErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range rollbackErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) getChannelHistory(c *gc.C, path string) []v5.PublishEvent {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(path),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var history []v5.PublishEvent
+	err := json.Unmarshal(rec.Body.Bytes(), &history)
+	c.Assert(err, gc.Equals, nil)
+	return history
+}
@@ -23,7 +23,11 @@ import (
 // POST /log
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#post-log
 func (h *ReqHandler) serveLog(w http.ResponseWriter, req *http.Request) error {
-	if err := h.authenticateAdmin(req); err != nil {
+	role := RoleSuperAdmin
+	if req.Method == "GET" {
+		role = RoleAuditor
+	}
+	if _, err := h.authenticateRole(req, role); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	switch req.Method {
@@ -0,0 +1,312 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// PromotionPolicy holds the response body of
+// GET id/meta/promotion-policy and the request body of
+// PUT id/meta/promotion-policy.
+type PromotionPolicy struct {
+	// Channel holds the gated channel.
+	Channel params.Channel
+
+	// SourceChannel holds the channel that an entity must
+	// have been published to before being published to
+	// the gated channel.
+	SourceChannel params.Channel `json:",omitempty"`
+
+	// MinSoak holds how long, as a duration such as "72h",
+	// an entity must have been in the source channel.
+	MinSoak string `json:",omitempty"`
+
+	// Approvers holds the users and groups that may approve
+	// promotions to the gated channel.
+	Approvers []string `json:",omitempty"`
+
+	// RequiredApprovals holds the number of approvals required
+	// from users other than the publisher.
+	RequiredApprovals int `json:",omitempty"`
+}
+
+// ApprovalRequest holds the request body of POST id/approve.
+type ApprovalRequest struct {
+	// Reject holds whether the promotion is rejected
+	// rather than approved.
+	Reject bool `json:",omitempty"`
+
+	// Comment holds an optional remark.
+	Comment string `json:",omitempty"`
+}
+
+// Approval holds an entry in the response body of
+// GET id/meta/approvals and the response body of POST id/approve.
+type Approval struct {
+	// Channel holds the gated channel the decision applies to.
+	Channel params.Channel
+
+	// User holds the user that made the decision.
+	User string
+
+	// Rejected holds whether the promotion was rejected.
+	Rejected bool `json:",omitempty"`
+
+	// Comment holds the remark made with the decision, if any.
+	Comment string `json:",omitempty"`
+
+	// Time holds when the decision was made.
+	Time time.Time
+}
+
+// GET id/meta/promotion-policy
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetapromotion-policy
+func (h *ReqHandler) metaPromotionPolicy(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.PromotionPolicy == nil {
+		return nil, nil
+	}
+	return promotionPolicyResponse(entity.PromotionPolicy), nil
+}
+
+// PUT id/meta/promotion-policy
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetapromotion-policy
+func (h *ReqHandler) putMetaPromotionPolicy(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("promotionpolicy", "defaulttrack"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := h.authorizePolicyChange(id, baseEntity.PromotionPolicy, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	// If the user puts null, publishing is no
+	// longer restricted.
+	if val == nil || bytes.Equal(*val, nullBytes) {
+		if baseEntity.PromotionPolicy == nil {
+			return nil
+		}
+		if err := h.Store.ClearApprovals(&id.URL); err != nil {
+			return errgo.Mask(err)
+		}
+		updater.UpdateField("promotionpolicy", nil, &audit.Entry{
+			Op:      audit.OpSetPromotionPolicy,
+			Entity:  &id.URL,
+			Channel: string(baseEntity.PromotionPolicy.Channel),
+		})
+		return nil
+	}
+	var p PromotionPolicy
+	if err := json.Unmarshal(*val, &p); err != nil {
+		return badRequestf(err, "cannot unmarshal promotion policy")
+	}
+	policy, err := promotionPolicyFromParams(p, baseEntity.DefaultTrack)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// Decisions made under a policy with a different gated
+	// channel or different approvers no longer count.
+	if old := baseEntity.PromotionPolicy; old != nil && (old.Channel != policy.Channel || !sameStrings(old.Approvers, policy.Approvers)) {
+		if err := h.Store.ClearApprovals(&id.URL); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	updater.UpdateField("promotionpolicy", policy, &audit.Entry{
+		Op:      audit.OpSetPromotionPolicy,
+		Entity:  &id.URL,
+		Channel: string(policy.Channel),
+	})
+	return nil
+}
+
+// authorizePolicyChange checks that the request may change the
+// promotion policy of the base entity of id, or anything else that
+// would let it be circumvented, such as the default track. When there
+// is a policy, it restricts those with write access to the entity, so
+// they may not change it; only its approvers may, or a super-admin if
+// it has none.
+func (h *ReqHandler) authorizePolicyChange(id *router.ResolvedURL, policy *mongodoc.PromotionPolicy, req *http.Request) error {
+	if policy == nil {
+		return nil
+	}
+	_, err := h.authorize(authorizeParams{
+		req: req,
+		acls: []mongodoc.ACL{{
+			Write: policy.Approvers,
+		}},
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpWrite},
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// GET id/meta/approvals
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetaapprovals
+func (h *ReqHandler) metaApprovals(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if len(entity.Approvals) == 0 {
+		return nil, nil
+	}
+	approvals := make([]Approval, len(entity.Approvals))
+	for i, a := range entity.Approvals {
+		approvals[i] = approvalResponse(a)
+	}
+	return approvals, nil
+}
+
+// POST id/approve
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-idapprove
+func (h *ReqHandler) serveApprove(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var approve struct {
+		ApprovalRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &approve); err != nil {
+		return badRequestf(err, "cannot unmarshal approval request body")
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls", "defaulttrack", "promotionpolicy"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	policy := baseEntity.PromotionPolicy
+	if policy == nil {
+		return badRequestf(nil, "%q has no promotion policy", mongodoc.BaseURL(&id.URL))
+	}
+	gated := policy.Channel
+	acl := charmstore.ChannelACL(baseEntity, gated)
+	if len(policy.Approvers) > 0 {
+		acl = mongodoc.ACL{
+			Write: policy.Approvers,
+		}
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:              req,
+		acls:             []mongodoc.ACL{acl},
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpWrite},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	approval := mongodoc.Approval{
+		Channel:  gated,
+		User:     h.authUsername(),
+		Rejected: approve.Reject,
+		Comment:  approve.Comment,
+		Time:     time.Now(),
+	}
+	if err := h.Store.Approve(id, approval); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot record approval of %q", &id.URL), errgo.Is(params.ErrNotFound))
+	}
+	op := audit.OpApprove
+	if approval.Rejected {
+		op = audit.OpReject
+	}
+	h.addAudit(audit.Entry{
+		Op:      op,
+		Entity:  &id.URL,
+		Channel: string(gated),
+	})
+	return httprequest.WriteJSON(w, http.StatusOK, approvalResponse(approval))
+}
+
+// promotionPolicyFromParams converts p to a promotion policy, checking
+// that it is valid. Channels without a track are resolved with the
+// given default track, so that the policy keeps gating the same channel
+// if the default track is changed later.
+func promotionPolicyFromParams(p PromotionPolicy, defaultTrack string) (*mongodoc.PromotionPolicy, error) {
+	if !charmstore.ValidChannel(p.Channel) || p.Channel == params.UnpublishedChannel {
+		return nil, badRequestf(nil, "invalid channel %q", p.Channel)
+	}
+	policy := &mongodoc.PromotionPolicy{
+		Channel:           charmstore.ResolveChannel(p.Channel, defaultTrack),
+		Approvers:         p.Approvers,
+		RequiredApprovals: p.RequiredApprovals,
+	}
+	if p.SourceChannel != params.NoChannel {
+		if !charmstore.ValidChannel(p.SourceChannel) || p.SourceChannel == params.UnpublishedChannel {
+			return nil, badRequestf(nil, "invalid source channel %q", p.SourceChannel)
+		}
+		policy.SourceChannel = charmstore.ResolveChannel(p.SourceChannel, defaultTrack)
+		if policy.SourceChannel == policy.Channel {
+			return nil, badRequestf(nil, "source channel cannot be the gated channel")
+		}
+	}
+	if p.RequiredApprovals < 0 {
+		return nil, badRequestf(nil, "negative RequiredApprovals value")
+	}
+	if p.MinSoak != "" {
+		if p.SourceChannel == params.NoChannel {
+			return nil, badRequestf(nil, "MinSoak specified without a source channel")
+		}
+		d, err := time.ParseDuration(p.MinSoak)
+		if err != nil {
+			return nil, badRequestf(err, "invalid MinSoak value")
+		}
+		if d < 0 {
+			return nil, badRequestf(nil, "negative MinSoak value")
+		}
+		policy.MinSoak = d
+	}
+	return policy, nil
+}
+
+// promotionPolicyResponse converts policy to its API representation.
+func promotionPolicyResponse(policy *mongodoc.PromotionPolicy) *PromotionPolicy {
+	p := &PromotionPolicy{
+		Channel:           policy.Channel,
+		SourceChannel:     policy.SourceChannel,
+		Approvers:         policy.Approvers,
+		RequiredApprovals: policy.RequiredApprovals,
+	}
+	if policy.MinSoak > 0 {
+		p.MinSoak = policy.MinSoak.String()
+	}
+	return p
+}
+
+// approvalResponse converts a to its API representation.
+func approvalResponse(a mongodoc.Approval) Approval {
+	return Approval{
+		Channel:  a.Channel,
+		User:     a.User,
+		Rejected: a.Rejected,
+		Comment:  a.Comment,
+		Time:     a.Time.UTC(),
+	}
+}
+
+// sameStrings reports whether a and b hold the same strings,
+// regardless of order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, x := range a {
+		count[x]++
+	}
+	for _, x := range b {
+		if count[x] == 0 {
+			return false
+		}
+		count[x]--
+	}
+	return true
+}
@@ -0,0 +1,451 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestGatedPromotion(c *gc.C) {
+	var calledEntities []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		calledEntities = append(calledEntities, e)
+	})
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/precise/wordpress-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("alice", "qa")
+
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		SourceChannel:     "candidate",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+	s.assertPut(c, "~bob/precise/wordpress-1/publish", params.PublishRequest{
+		Channels: []params.Channel{"candidate"},
+	})
+
+	// Without an approval, bob cannot publish to stable.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{"stable"},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `"cs:~bob/precise/wordpress-1" has 0 of 1 required approvals for the stable channel`,
+		},
+	})
+
+	// Bob is not an approver.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL("~bob/precise/wordpress-1/approve"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		JSONBody:     v5.ApprovalRequest{},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+
+	// Alice, in the qa group, approves.
+	var approval v5.Approval
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/precise/wordpress-1/approve"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.ApprovalRequest{
+			Comment: "tested on trusty too",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &approval)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(approval.Time.IsZero(), gc.Equals, false)
+	c.Assert(approval, jc.DeepEquals, v5.Approval{
+		Channel: "stable",
+		User:    "alice",
+		Comment: "tested on trusty too",
+		Time:    approval.Time,
+	})
+	// MongoDB stores times with millisecond precision.
+	stored := approval
+	stored.Time = stored.Time.Truncate(time.Millisecond)
+	s.assertGet(c, "~bob/precise/wordpress-1/meta/approvals", []v5.Approval{stored})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+		User:    "bob",
+		Op:      audit.OpSetPromotionPolicy,
+		Entity:  charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		Channel: "stable",
+	}, {
+		User:    "alice",
+		Op:      audit.OpApprove,
+		Entity:  charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		Channel: "stable",
+	}})
+
+	s.assertPut(c, "~bob/precise/wordpress-1/publish", params.PublishRequest{
+		Channels: []params.Channel{"stable"},
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+}
+
+func (s *APISuite) TestRejectPromotion(c *gc.C) {
+	var calledEntities []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		calledEntities = append(calledEntities, e)
+	})
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/precise/wordpress-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.assertPutAsAdmin(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel: "stable",
+	})
+
+	// Without approvers, anyone who can write to
+	// the stable channel may reject.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/precise/wordpress-1/approve"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.ApprovalRequest{
+			Reject:  true,
+			Comment: "not yet",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {}),
+	})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+		User:    "admin",
+		Op:      audit.OpSetPromotionPolicy,
+		Entity:  charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+		Channel: "stable",
+	}, {
+		User:    "bob",
+		Op:      audit.OpReject,
+		Entity:  charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		Channel: "stable",
+	}})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("~bob/precise/wordpress-1/publish"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{"stable"},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `promotion of "cs:~bob/precise/wordpress-1" to the stable channel rejected by bob`,
+		},
+	})
+}
+
+func (s *APISuite) TestChangePromotionPolicy(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.SetPerms(&id.URL, "stable.write", "bob", "alice")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("alice", "qa")
+	s.idmServer.AddUser("bob")
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 2,
+	})
+
+	// Once there is a policy, bob may neither weaken
+	// nor remove it, although he can write to the entity.
+	for _, body := range []interface{}{
+		v5.PromotionPolicy{Channel: "stable"},
+		nil,
+	} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "PUT",
+			URL:          storeURL("~bob/wordpress/meta/promotion-policy"),
+			Do:           bakeryDo(s.idmServer.Client("bob")),
+			JSONBody:     body,
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: `access denied for user "bob"`,
+			},
+		})
+	}
+
+	// An approver with write access may change it.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/wordpress/meta/promotion-policy"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.PromotionPolicy{
+			Channel:           "stable",
+			RequiredApprovals: 1,
+		},
+	})
+	s.assertGet(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		RequiredApprovals: 1,
+	})
+
+	// Now that the policy has no approvers, only
+	// an admin may change it.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("~bob/wordpress/meta/promotion-policy"),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		JSONBody:     nil,
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+	s.assertPutAsAdmin(c, "~bob/wordpress/meta/promotion-policy", nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/wordpress/meta/promotion-policy"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: "metadata not found",
+		},
+	})
+}
+
+func (s *APISuite) TestPromotionPolicyDefaultTrack(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.SetPerms(&id.URL, "stable.write", "bob", "alice")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("alice", "qa")
+	s.idmServer.AddUser("bob")
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/wordpress/meta/default-track", v5.DefaultTrack{Track: "2"})
+
+	// Channels without a track are resolved when the
+	// policy is set.
+	s.assertPut(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		SourceChannel:     "candidate",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "2/stable",
+		SourceChannel:     "2/candidate",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+
+	// Once there is a policy, only its approvers may
+	// change the default track.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("~bob/wordpress/meta/default-track"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		JSONBody:     v5.DefaultTrack{Track: "3"},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("~bob/wordpress/meta/default-track"),
+		Do:       bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.DefaultTrack{Track: "3"},
+	})
+
+	// The policy still gates the same channel.
+	s.assertGet(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "2/stable",
+		SourceChannel:     "2/candidate",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-0/publish"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{"2/stable"},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `"cs:~bob/precise/wordpress-0" has not been published to the 2/candidate channel`,
+		},
+	})
+}
+
+func (s *APISuite) TestChangeApproversClearsApprovals(c *gc.C) {
+	id, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.SetPerms(&id.URL, "stable.write", "bob", "alice")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("alice", "qa")
+	s.idmServer.AddUser("bob")
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/wordpress/meta/promotion-policy", v5.PromotionPolicy{
+		Channel:           "stable",
+		Approvers:         []string{"qa"},
+		RequiredApprovals: 1,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("~bob/precise/wordpress-0/approve"),
+		Do:       bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.ApprovalRequest{},
+	})
+
+	// Changing something other than the approvers
+	// keeps the approvals.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/wordpress/meta/promotion-policy"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.PromotionPolicy{
+			Channel:           "stable",
+			Approvers:         []string{"qa"},
+			RequiredApprovals: 2,
+		},
+	})
+	entity, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Approvals, gc.HasLen, 1)
+
+	// Approvals made by approvers that have since
+	// been removed no longer count.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/wordpress/meta/promotion-policy"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.PromotionPolicy{
+			Channel:           "stable",
+			Approvers:         []string{"release-team"},
+			RequiredApprovals: 1,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/precise/wordpress-0/meta/approvals"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: "metadata not found",
+		},
+	})
+}
+
+func (s *APISuite) TestApproveWithoutPolicy(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL("~bob/precise/wordpress-0/approve"),
+		Username:     testUsername,
+		Password:     testPassword,
+		JSONBody:     v5.ApprovalRequest{},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `"cs:~bob/wordpress" has no promotion policy`,
+		},
+	})
+}
+
+var putPromotionPolicyErrorTests = []struct {
+	about         string
+	body          v5.PromotionPolicy
+	expectMessage string
+}{{
+	about:         "no channel",
+	body:          v5.PromotionPolicy{},
+	expectMessage: `invalid channel ""`,
+}, {
+	about:         "unpublished channel",
+	body:          v5.PromotionPolicy{Channel: "unpublished"},
+	expectMessage: `invalid channel "unpublished"`,
+}, {
+	about:         "invalid source channel",
+	body:          v5.PromotionPolicy{Channel: "stable", SourceChannel: "bad"},
+	expectMessage: `invalid source channel "bad"`,
+}, {
+	about:         "source is gated channel",
+	body:          v5.PromotionPolicy{Channel: "stable", SourceChannel: "stable"},
+	expectMessage: `source channel cannot be the gated channel`,
+}, {
+	about:         "soak without source",
+	body:          v5.PromotionPolicy{Channel: "stable", MinSoak: "1h"},
+	expectMessage: `MinSoak specified without a source channel`,
+}, {
+	about:         "invalid soak",
+	body:          v5.PromotionPolicy{Channel: "stable", SourceChannel: "edge", MinSoak: "forever"},
+	expectMessage: `invalid MinSoak value: time: invalid duration "?forever"?`,
+}, {
+	about:         "negative approvals",
+	body:          v5.PromotionPolicy{Channel: "stable", RequiredApprovals: -1},
+	expectMessage: `negative RequiredApprovals value`,
+}}
+
+func (s *APISuite) TestPutPromotionPolicyErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range putPromotionPolicyErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "PUT",
+			URL:          storeURL("~bob/wordpress/meta/promotion-policy"),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+				var e params.Error
+				err := json.Unmarshal(m, &e)
+				c.Assert(err, gc.Equals, nil)
+				c.Assert(e.Code, gc.Equals, params.ErrBadRequest)
+				c.Assert(e.Message, gc.Matches, test.expectMessage)
+			}),
+		})
+	}
+}
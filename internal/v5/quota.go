@@ -0,0 +1,121 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// QuotaResponse holds the response body of GET /quota
+// and GET /quota/user.
+type QuotaResponse struct {
+	// User holds the name of the user whose
+	// namespace is described.
+	User string
+
+	// Bytes holds the total size of the archives and
+	// resources in the user's namespace.
+	Bytes int64
+
+	// Entities holds the number of entities in the
+	// user's namespace.
+	Entities int
+
+	// MaxBytes and MaxEntities hold the limits that apply
+	// to the user's namespace. They are omitted when there
+	// is no limit.
+	MaxBytes    int64 `json:",omitempty"`
+	MaxEntities int   `json:",omitempty"`
+}
+
+// QuotaLimits holds the request body of PUT /quota/user.
+type QuotaLimits struct {
+	// MaxBytes holds the maximum total size of the
+	// archives and resources in the user's namespace.
+	// Zero means no limit.
+	MaxBytes int64
+
+	// MaxEntities holds the maximum number of entities
+	// in the user's namespace. Zero means no limit.
+	MaxEntities int
+}
+
+// GET /quota
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-quota
+//
+// GET /quota/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-quotauser
+//
+// PUT /quota/user
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-quotauser
+func (h *ReqHandler) serveQuota(_ http.Header, req *http.Request) (interface{}, error) {
+	user := strings.TrimPrefix(req.URL.Path, "/")
+	if strings.Contains(user, "/") {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	switch req.Method {
+	case "GET":
+		auth, err := h.Authenticate(req)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if user == "" {
+			if auth.Username == "" {
+				return nil, errgo.WithCausef(nil, params.ErrForbidden, "admin credentials used")
+			}
+			user = auth.Username
+		} else if !auth.HasRole(RoleAuditor) && user != auth.Username {
+			return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot get quota for %q", user)
+		}
+		return h.quotaResponse(user)
+	case "PUT":
+		if err := h.authenticateAdmin(req); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if user == "" {
+			return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+		}
+		var limits QuotaLimits
+		if err := json.NewDecoder(req.Body).Decode(&limits); err != nil {
+			return nil, badRequestf(err, "cannot unmarshal quota limits")
+		}
+		if err := h.Store.SetQuota(&mongodoc.Quota{
+			User:        user,
+			MaxBytes:    limits.MaxBytes,
+			MaxEntities: limits.MaxEntities,
+		}); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		return h.quotaResponse(user)
+	default:
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+}
+
+// quotaResponse returns the quota and current usage
+// of the given user's namespace.
+func (h *ReqHandler) quotaResponse(user string) (*QuotaResponse, error) {
+	quota, err := h.Store.Quota(user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	usage, err := h.Store.QuotaUsage(user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &QuotaResponse{
+		User:        user,
+		Bytes:       usage.Bytes,
+		Entities:    usage.Entities,
+		MaxBytes:    quota.MaxBytes,
+		MaxEntities: quota.MaxEntities,
+	}, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestGetQuota(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	entity, err := s.store.FindEntity(newResolvedURL("cs:~bob/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetQuota(&mongodoc.Quota{
+		User:        "bob",
+		MaxEntities: 10,
+	})
+	c.Assert(err, gc.Equals, nil)
+	expect := v5.QuotaResponse{
+		User:        "bob",
+		Bytes:       entity.Size,
+		Entities:    1,
+		MaxEntities: 10,
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("quota"),
+		Do:         bakeryDo(s.idmServer.Client("bob")),
+		ExpectBody: expect,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("quota/bob"),
+		Do:         bakeryDo(s.idmServer.Client("bob")),
+		ExpectBody: expect,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("quota/bob"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: expect,
+	})
+}
+
+func (s *APISuite) TestGetQuotaOtherUser(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("quota/alice"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `cannot get quota for "alice"`,
+		},
+	})
+}
+
+func (s *APISuite) TestGetQuotaFailsWithNoMacaroon(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("quota"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestPutQuota(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("quota/everyone"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.QuotaLimits{
+			MaxBytes: 1000,
+		},
+		ExpectBody: v5.QuotaResponse{
+			User:     "everyone",
+			MaxBytes: 1000,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("quota/bob"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.QuotaLimits{
+			MaxEntities: 3,
+		},
+		ExpectBody: v5.QuotaResponse{
+			User:        "bob",
+			MaxEntities: 3,
+		},
+	})
+	q, err := s.store.Quota("alice")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q.MaxBytes, gc.Equals, int64(1000))
+	q, err = s.store.Quota("bob")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(q.MaxEntities, gc.Equals, 3)
+	c.Assert(q.MaxBytes, gc.Equals, int64(0))
+}
+
+func (s *APISuite) TestPutQuotaNotAdmin(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("quota/bob"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		JSONBody:     v5.QuotaLimits{},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+}
+
+func (s *ArchiveSuite) TestPostArchiveOverQuota(c *gc.C) {
+	err := s.store.SetQuota(&mongodoc.Quota{
+		User:        "bob",
+		MaxEntities: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.assertUploadCharmError(
+		c,
+		"POST",
+		charm.MustParseURL("~bob/precise/wordpress-1"),
+		nil,
+		"wordpress",
+		nil,
+		http.StatusForbidden,
+		params.Error{
+			Message: `entity quota exceeded for user "bob" (limit 1 entities)`,
+			Code:    router.ErrQuotaExceeded,
+		},
+	)
+}
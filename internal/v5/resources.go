@@ -32,8 +32,21 @@ func (h *ReqHandler) serveResources(id *router.ResolvedURL, w http.ResponseWrite
 	// TODO(ericsnow) Support DELETE to remove a resource (like serveArchive)?
 	switch req.Method {
 	case "GET":
+		if err := h.AuthorizeEntityForOp(id, req, OpReadWithNoTerms); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
 		return h.serveDownloadResource(id, w, req)
 	case "POST":
+		// The request is authorized as an upload so that
+		// API tokens with the upload scope can be used.
+		if _, err := h.authorize(authorizeParams{
+			req:       req,
+			ops:       []string{OpWrite},
+			entityIds: []*router.ResolvedURL{id},
+			upload:    true,
+		}); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
 		return h.serveUploadResource(id, w, req)
 	default:
 		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
@@ -112,7 +125,7 @@ func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.Response
 		rdoc, err = h.Store.UploadResource(id, name, req.Body, hash, req.ContentLength)
 	}
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(router.ErrQuotaExceeded))
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ResourceUploadResponse{
 		Revision: rdoc.Revision,
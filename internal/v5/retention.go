@@ -0,0 +1,153 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// RetentionPolicy holds the response body of
+// GET id/meta/retention-policy and the request body of
+// PUT id/meta/retention-policy.
+type RetentionPolicy struct {
+	// KeepUnpublished holds the number of most recently uploaded
+	// revisions that are not current in any channel to keep.
+	// Zero means no limit.
+	KeepUnpublished int `json:",omitempty"`
+
+	// KeepPublished holds whether to keep all revisions
+	// that have ever been published to a channel.
+	KeepPublished bool `json:",omitempty"`
+
+	// KeepYoungerThan holds the age, as a duration such
+	// as "720h", below which revisions are kept.
+	KeepYoungerThan string `json:",omitempty"`
+}
+
+// RetentionPreviewResponse holds the response body of
+// GET /retention/preview.
+type RetentionPreviewResponse struct {
+	// Entities holds the ids of the entities that
+	// would be pruned.
+	Entities []*charm.URL
+}
+
+// GET id/meta/retention-policy
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetaretention-policy
+func (h *ReqHandler) metaRetentionPolicy(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.RetentionPolicy == nil {
+		return nil, nil
+	}
+	return retentionPolicyResponse(entity.RetentionPolicy), nil
+}
+
+// PUT id/meta/retention-policy
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetaretention-policy
+func (h *ReqHandler) putMetaRetentionPolicy(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	// If the user puts null, the base entity reverts
+	// to the global policy.
+	if val == nil || bytes.Equal(*val, nullBytes) {
+		updater.UpdateField("retentionpolicy", nil, nil)
+		return nil
+	}
+	var p RetentionPolicy
+	if err := json.Unmarshal(*val, &p); err != nil {
+		return badRequestf(err, "cannot unmarshal retention policy")
+	}
+	policy, err := retentionPolicyFromParams(p)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	updater.UpdateField("retentionpolicy", policy, nil)
+	return nil
+}
+
+// GET /retention/preview
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-retentionpreview
+func (h *ReqHandler) serveRetentionPreview(_ http.Header, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if _, err := h.authenticateRole(req, RoleAuditor); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, badRequestf(err, "")
+	}
+	global := h.Store.GlobalRetentionPolicy()
+	if len(req.Form) > 0 {
+		// Preview the given global policy instead of
+		// the configured one.
+		var p RetentionPolicy
+		var err error
+		if v := req.Form.Get("keep-unpublished"); v != "" {
+			if p.KeepUnpublished, err = strconv.Atoi(v); err != nil {
+				return nil, badRequestf(err, "invalid keep-unpublished value")
+			}
+		}
+		if v := req.Form.Get("keep-published"); v != "" {
+			if p.KeepPublished, err = strconv.ParseBool(v); err != nil {
+				return nil, badRequestf(err, "invalid keep-published value")
+			}
+		}
+		p.KeepYoungerThan = req.Form.Get("keep-younger-than")
+		if global, err = retentionPolicyFromParams(p); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+	}
+	ids, err := h.Store.RevisionsToPrune(global, time.Now())
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &RetentionPreviewResponse{
+		Entities: ids,
+	}, nil
+}
+
+// retentionPolicyFromParams converts p to a retention policy, checking
+// that it is valid.
+func retentionPolicyFromParams(p RetentionPolicy) (*mongodoc.RetentionPolicy, error) {
+	if p.KeepUnpublished < 0 {
+		return nil, badRequestf(nil, "negative KeepUnpublished value")
+	}
+	policy := &mongodoc.RetentionPolicy{
+		KeepUnpublished: p.KeepUnpublished,
+		KeepPublished:   p.KeepPublished,
+	}
+	if p.KeepYoungerThan != "" {
+		d, err := time.ParseDuration(p.KeepYoungerThan)
+		if err != nil {
+			return nil, badRequestf(err, "invalid KeepYoungerThan value")
+		}
+		if d < 0 {
+			return nil, badRequestf(nil, "negative KeepYoungerThan value")
+		}
+		policy.KeepYoungerThan = d
+	}
+	return policy, nil
+}
+
+// retentionPolicyResponse converts policy to its API representation.
+func retentionPolicyResponse(policy *mongodoc.RetentionPolicy) *RetentionPolicy {
+	p := &RetentionPolicy{
+		KeepUnpublished: policy.KeepUnpublished,
+		KeepPublished:   policy.KeepPublished,
+	}
+	if policy.KeepYoungerThan > 0 {
+		p.KeepYoungerThan = policy.KeepYoungerThan.String()
+	}
+	return p
+}
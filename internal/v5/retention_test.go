@@ -0,0 +1,125 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestPutRetentionPolicy(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.assertPutAsAdmin(c, "~bob/wordpress/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepPublished:   true,
+		KeepYoungerThan: "720h",
+	})
+	be, err := s.store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.RetentionPolicy, jc.DeepEquals, &mongodoc.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepPublished:   true,
+		KeepYoungerThan: 720 * time.Hour,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/retention-policy", v5.RetentionPolicy{
+		KeepUnpublished: 3,
+		KeepPublished:   true,
+		KeepYoungerThan: "720h0m0s",
+	})
+
+	// Putting null reverts to the global policy.
+	s.assertPutAsAdmin(c, "~bob/wordpress/meta/retention-policy", nil)
+	be, err = s.store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.RetentionPolicy, gc.IsNil)
+}
+
+func (s *APISuite) TestPutRetentionPolicyInvalid(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("~bob/wordpress/meta/retention-policy"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.RetentionPolicy{
+			KeepYoungerThan: "-1h",
+		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "negative KeepYoungerThan value",
+		},
+	})
+}
+
+func (s *APISuite) TestRetentionPreview(c *gc.C) {
+	for i := 0; i < 4; i++ {
+		s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL(fmt.Sprintf("cs:~bob/precise/wordpress-%d", i), -1))
+	}
+	// With no policies configured, nothing is pruned.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("retention/preview"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: v5.RetentionPreviewResponse{},
+	})
+	// The latest revision is current in the stable channel, and
+	// the others have all been published, so none of them counts
+	// towards keep-unpublished and all of them are pruned.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("retention/preview?keep-unpublished=1"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: v5.RetentionPreviewResponse{
+			Entities: []*charm.URL{
+				charm.MustParseURL("cs:~bob/precise/wordpress-2"),
+				charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+				charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+			},
+		},
+	})
+	// Previewing does not delete anything.
+	_, err := s.store.FindEntity(newResolvedURL("cs:~bob/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *APISuite) TestRetentionPreviewNotAdmin(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("retention/preview"),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+}
+
+func (s *APISuite) TestRetentionPreviewBadParameter(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("retention/preview?keep-unpublished=-1"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "negative KeepUnpublished value",
+		},
+	})
+}
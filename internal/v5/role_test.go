@@ -0,0 +1,235 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+var roles = map[string][]string{
+	v5.RoleSuperAdmin:  {"admins"},
+	v5.RolePromulgator: {"reviewers"},
+	v5.RoleStatsWriter: {"statsbot"},
+	v5.RoleAuditor:     {"auditors"},
+}
+
+// newRoleServer returns a server that gives users the roles above.
+func (s *APISuite) newRoleServer(c *gc.C) *charmstore.Server {
+	config := s.srvParams
+	config.Roles = roles
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	return srv
+}
+
+var roleTests = []struct {
+	about  string
+	method string
+	url    string
+	body   interface{}
+	// expectOK holds the users that may make the request. The
+	// requests of the other users are expected to be denied
+	// with deniedStatus, or http.StatusUnauthorized if
+	// that is zero.
+	expectOK     []string
+	deniedStatus int
+}{{
+	about:    "get log",
+	url:      "log",
+	expectOK: []string{"alice", "carol"},
+}, {
+	about:        "get quota of another user",
+	url:          "quota/bob",
+	expectOK:     []string{"alice", "carol"},
+	deniedStatus: http.StatusForbidden,
+}, {
+	about:    "set quota",
+	method:   "PUT",
+	url:      "quota/bob",
+	body:     v5.QuotaLimits{MaxEntities: 10},
+	expectOK: []string{"alice"},
+}, {
+	about:    "list groups",
+	url:      "group",
+	expectOK: []string{"alice", "carol"},
+}, {
+	about:    "set group",
+	method:   "PUT",
+	url:      "group/qa",
+	body:     v5.GroupRequest{Members: []string{"bob"}},
+	expectOK: []string{"alice"},
+}, {
+	about:    "blob store garbage",
+	url:      "debug/blobstore-gc",
+	expectOK: []string{"alice", "carol"},
+}, {
+	about:    "list API tokens of another user",
+	url:      "token?user=bob",
+	expectOK: []string{"alice", "carol"},
+}, {
+	about:    "read unpublished entity of another user",
+	url:      "~bob/precise/wordpress-0/meta/id-revision",
+	expectOK: []string{"alice", "carol"},
+}, {
+	about:    "change permissions of another user's entity",
+	method:   "PUT",
+	url:      "~bob/precise/wordpress-0/meta/perm/read",
+	body:     []string{"bob"},
+	expectOK: []string{"alice"},
+}, {
+	about:    "promulgate",
+	method:   "PUT",
+	url:      "~bob/precise/wordpress-0/promulgate",
+	body:     params.PromulgateRequest{Promulgated: false},
+	expectOK: []string{"alice", "dave"},
+}, {
+	about:  "update stats",
+	method: "PUT",
+	url:    "stats/update",
+	body: params.StatsUpdateRequest{
+		Entries: []params.StatsUpdateEntry{{
+			Timestamp:      time.Now(),
+			CharmReference: charm.MustParseURL("~charmers/precise/wordpress-23"),
+		}},
+	},
+	expectOK: []string{"alice", "statsbot"},
+}}
+
+func (s *APISuite) TestRoles(c *gc.C) {
+	srv := s.newRoleServer(c)
+	defer srv.Close()
+
+	id := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.write", "bob")
+	c.Assert(err, gc.Equals, nil)
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-23", 23))
+
+	// Alice is a super-admin through a group known to the
+	// identity manager, and carol an auditor through a group
+	// held by the charm store.
+	s.idmServer.AddUser("alice", "admins")
+	s.idmServer.AddUser("carol")
+	err = s.store.SetGroup("auditors", []string{"carol"})
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("dave", "reviewers")
+	s.idmServer.AddUser("statsbot")
+	s.idmServer.AddUser("eve")
+	users := []string{"alice", "carol", "dave", "statsbot", "eve"}
+
+	for i, test := range roleTests {
+		c.Logf("test %d: %s", i, test.about)
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		deniedStatus := test.deniedStatus
+		if deniedStatus == 0 {
+			deniedStatus = http.StatusUnauthorized
+		}
+		expectOK := make(map[string]bool)
+		for _, user := range test.expectOK {
+			expectOK[user] = true
+		}
+		for _, user := range users {
+			c.Logf("user %s", user)
+			rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+				Handler:  srv,
+				Method:   method,
+				URL:      storeURL(test.url),
+				JSONBody: test.body,
+				Do:       bakeryDo(s.idmServer.Client(user)),
+			})
+			if expectOK[user] {
+				c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+			} else {
+				c.Assert(rec.Code, gc.Equals, deniedStatus, gc.Commentf("body: %s", rec.Body.Bytes()))
+			}
+		}
+	}
+}
+
+func (s *APISuite) TestRoleDenied(c *gc.C) {
+	srv := s.newRoleServer(c)
+	defer srv.Close()
+
+	s.idmServer.AddUser("carol", "auditors")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      srv,
+		Method:       "PUT",
+		URL:          storeURL("quota/bob"),
+		JSONBody:     v5.QuotaLimits{MaxEntities: 10},
+		Do:           bakeryDo(s.idmServer.Client("carol")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "carol"`,
+		},
+	})
+}
+
+func (s *APISuite) TestSuperAdminWhoAmI(c *gc.C) {
+	srv := s.newRoleServer(c)
+	defer srv.Close()
+
+	// Unlike the admin credentials, a super-admin is a user
+	// in their own right.
+	s.idmServer.AddUser("alice", "admins")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: srv,
+		URL:     storeURL("whoami"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		ExpectBody: params.WhoAmIResponse{
+			User:   "alice",
+			Groups: []string{"admins"},
+		},
+	})
+}
+
+func (s *APISuite) TestRolesWithAPIToken(c *gc.C) {
+	srv := s.newRoleServer(c)
+	defer srv.Close()
+
+	s.idmServer.AddUser("alice", "admins")
+	call := func(scope mongodoc.APITokenScope, namespace string, method string, expectStatus int) {
+		secret, err := s.store.AddAPIToken(&mongodoc.APIToken{
+			User:      "alice",
+			Scope:     scope,
+			Namespace: namespace,
+		})
+		c.Assert(err, gc.Equals, nil)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: srv,
+			Method:  method,
+			URL:     storeURL("log"),
+			Header: http.Header{
+				"Authorization": {"Bearer " + secret},
+				"Content-Type":  {"application/json"},
+			},
+			JSONBody: []params.Log{},
+		})
+		c.Assert(rec.Code, gc.Equals, expectStatus, gc.Commentf("body: %s", rec.Body.Bytes()))
+	}
+	// A request made with a token has none of the roles
+	// of the token's user, whatever the token's scope.
+	call(mongodoc.APITokenRead, "", "GET", http.StatusUnauthorized)
+	call(mongodoc.APITokenRead, "", "POST", http.StatusUnauthorized)
+	call(mongodoc.APITokenPublish, "", "POST", http.StatusUnauthorized)
+	call(mongodoc.APITokenUpload, "", "POST", http.StatusUnauthorized)
+	call(mongodoc.APITokenPublish, "alice", "GET", http.StatusUnauthorized)
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// SchedulePublishRequest holds the request body of
+// POST id/scheduled-publish.
+type SchedulePublishRequest struct {
+	// Channels holds the channels to publish to.
+	Channels []params.Channel
+
+	// Resources holds the resource revisions to
+	// publish with, keyed by resource name.
+	Resources map[string]int `json:",omitempty"`
+
+	// Time holds when to publish.
+	Time time.Time
+}
+
+// ScheduledPublish holds an entry in the response body of
+// GET id/meta/scheduled-publish and the response body of
+// POST id/scheduled-publish.
+type ScheduledPublish struct {
+	// ScheduleId holds the id of the scheduled publish,
+	// used to cancel it.
+	ScheduleId string
+
+	// Id holds the id of the charm or bundle to publish.
+	Id *charm.URL
+
+	// Channels holds the channels to publish to.
+	Channels []params.Channel
+
+	// Resources holds the resource revisions to
+	// publish with, keyed by resource name.
+	Resources map[string]int `json:",omitempty"`
+
+	// User holds the user that scheduled the publish.
+	User string `json:",omitempty"`
+
+	// Time holds when the publish is scheduled for.
+	Time time.Time
+
+	// Status holds one of "pending", "running" or "failed".
+	Status string
+
+	// Error holds why the publish failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// GET id/meta/scheduled-publish
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetascheduled-publish
+func (h *ReqHandler) metaScheduledPublish(id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	sps, err := h.Store.ScheduledPublishes(&id.URL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(sps) == 0 {
+		return nil, nil
+	}
+	result := make([]ScheduledPublish, len(sps))
+	for i, sp := range sps {
+		result[i] = scheduledPublishResponse(sp)
+	}
+	return result, nil
+}
+
+// POST id/scheduled-publish
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-idscheduled-publish
+//
+// DELETE id/scheduled-publish/schedule-id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-idscheduled-publishschedule-id
+func (h *ReqHandler) serveScheduledPublish(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	scheduleId := strings.TrimPrefix(req.URL.Path, "/")
+	switch {
+	case req.Method == "POST" && scheduleId == "":
+		return h.serveSchedulePublish(id, w, req)
+	case req.Method == "DELETE" && scheduleId != "":
+		return h.serveCancelScheduledPublish(id, scheduleId, w, req)
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+func (h *ReqHandler) serveSchedulePublish(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	var schedule struct {
+		SchedulePublishRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &schedule); err != nil {
+		return badRequestf(err, "cannot unmarshal schedule request body")
+	}
+	chans := schedule.Channels
+	if err := checkPublishChannels(chans); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if schedule.Time.IsZero() {
+		return badRequestf(nil, "no time provided")
+	}
+	if err := h.authorizePublish(id, req, chans); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	sp, err := h.Store.SchedulePublish(id, schedule.Resources, chans, schedule.Time, h.authUsername())
+	if err != nil {
+		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
+			return errgo.WithCausef(err, params.ErrBadRequest, "")
+		}
+		return errgo.NoteMask(err, "cannot schedule publish", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, scheduledPublishResponse(sp))
+}
+
+func (h *ReqHandler) serveCancelScheduledPublish(id *router.ResolvedURL, scheduleId string, w http.ResponseWriter, req *http.Request) error {
+	sp, err := h.Store.FindScheduledPublish(scheduleId)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if *sp.URL != id.URL {
+		return errgo.WithCausef(nil, params.ErrNotFound, "scheduled publish %q not found", scheduleId)
+	}
+	// Cancelling requires the same permission
+	// as making the publish.
+	if err := h.authorizePublish(id, req, sp.Channels); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.Store.CancelScheduledPublish(scheduleId); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+func scheduledPublishResponse(sp *mongodoc.ScheduledPublish) ScheduledPublish {
+	r := ScheduledPublish{
+		ScheduleId: sp.Id.Hex(),
+		Id:         sp.URL,
+		Channels:   sp.Channels,
+		User:       sp.User,
+		Time:       sp.Time.UTC(),
+		Status:     string(sp.Status),
+		Error:      sp.Error,
+	}
+	if len(sp.Resources) > 0 {
+		r.Resources = make(map[string]int, len(sp.Resources))
+		for _, res := range sp.Resources {
+			r.Resources[res.Name] = res.Revision
+		}
+	}
+	return r
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestScheduledPublish(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/precise/wordpress-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.SetDefaultUser("bob")
+
+	t := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	var sp v5.ScheduledPublish
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/precise/wordpress-1/scheduled-publish"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.SchedulePublishRequest{
+			Channels: []params.Channel{params.StableChannel},
+			Time:     t,
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &sp)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	expect := v5.ScheduledPublish{
+		ScheduleId: sp.ScheduleId,
+		Id:         charm.MustParseURL("cs:~bob/precise/wordpress-1"),
+		Channels:   []params.Channel{params.StableChannel},
+		User:       "bob",
+		Time:       t,
+		Status:     "pending",
+	}
+	c.Assert(sp, jc.DeepEquals, expect)
+	s.assertGet(c, "~bob/precise/wordpress-1/meta/scheduled-publish", []v5.ScheduledPublish{expect})
+
+	// The publish is made when it is due.
+	n, err := s.store.RunScheduledPublishes(t)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+	s.assertNoScheduledPublish(c, "~bob/precise/wordpress-1")
+}
+
+func (s *APISuite) TestCancelScheduledPublish(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	sp, err := s.store.SchedulePublish(newResolvedURL("cs:~bob/precise/wordpress-0", -1), nil, []params.Channel{params.EdgeChannel}, time.Now().Add(time.Hour), "bob")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.SetDefaultUser("bob")
+	path := "~bob/precise/wordpress-0/scheduled-publish/" + sp.Id.Hex()
+
+	// Alice cannot publish, so she cannot cancel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(path),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+
+	// The schedule id must belong to the given entity.
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~bob/precise/mysql-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("~bob/precise/mysql-0/scheduled-publish/" + sp.Id.Hex()),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `scheduled publish "` + sp.Id.Hex() + `" not found`,
+		},
+	})
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL(path),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	s.assertNoScheduledPublish(c, "~bob/precise/wordpress-0")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL(path),
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `scheduled publish "` + sp.Id.Hex() + `" not found`,
+		},
+	})
+}
+
+var schedulePublishErrorTests = []struct {
+	about        string
+	url          string
+	method       string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no channels",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "POST",
+	body:         v5.SchedulePublishRequest{Time: time.Now()},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `no channels provided`,
+	},
+}, {
+	about:        "unpublished channel",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "POST",
+	body:         v5.SchedulePublishRequest{Channels: []params.Channel{params.UnpublishedChannel}, Time: time.Now()},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot publish to the unpublished channel`,
+	},
+}, {
+	about:        "no time",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "POST",
+	body:         v5.SchedulePublishRequest{Channels: []params.Channel{params.StableChannel}},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `no time provided`,
+	},
+}, {
+	about:        "time in the past",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "POST",
+	body:         v5.SchedulePublishRequest{Channels: []params.Channel{params.StableChannel}, Time: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot schedule publish: scheduled time 2017-01-01 00:00:00 +0000 UTC is not in the future`,
+	},
+}, {
+	about:        "get not allowed",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "GET",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `GET not allowed`,
+	},
+}, {
+	about:        "delete without schedule id",
+	url:          "~bob/precise/wordpress-0/scheduled-publish",
+	method:       "DELETE",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `DELETE not allowed`,
+	},
+}, {
+	about:        "unknown schedule id",
+	url:          "~bob/precise/wordpress-0/scheduled-publish/bad-id",
+	method:       "DELETE",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `scheduled publish "bad-id" not found`,
+	},
+}}
+
+func (s *APISuite) TestSchedulePublishErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range schedulePublishErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+// assertNoScheduledPublish asserts that the entity with the given id
+// has no scheduled publishes.
+func (s *APISuite) assertNoScheduledPublish(c *gc.C, id string) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(nil),
+		URL:          storeURL(id + "/meta/scheduled-publish"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+}
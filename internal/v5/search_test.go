@@ -753,6 +753,43 @@ func (s *SearchSuite) TestSearchWithAdminCredentials(c *gc.C) {
 	assertResultSet(c, sr, expected)
 }
 
+func (s *SearchSuite) TestSearchExcludesYankedEntities(c *gc.C) {
+	search := func(expected ...*router.ResolvedURL) {
+		err := s.esSuite.ES.RefreshIndex(s.esSuite.TestIndex)
+		c.Assert(err, gc.Equals, nil)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("search"),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		var sr params.SearchResponse
+		err = json.Unmarshal(rec.Body.Bytes(), &sr)
+		c.Assert(err, gc.Equals, nil)
+		assertResultSet(c, sr, expected)
+	}
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-23/meta/deprecation", v5.Deprecation{
+		State: "yanked",
+	})
+	search(
+		exportTestCharms["mysql"],
+		exportTestCharms["riak"],
+		exportTestCharms["varnish"],
+		exportTestBundles["wordpress-simple"],
+	)
+
+	// The entity is indexed again when the deprecation is removed.
+	s.assertPutAsAdmin(c, "~charmers/precise/wordpress-23/meta/deprecation", nil)
+	search(
+		exportTestCharms["mysql"],
+		exportTestCharms["wordpress"],
+		exportTestCharms["riak"],
+		exportTestCharms["varnish"],
+		exportTestBundles["wordpress-simple"],
+	)
+}
+
 func (s *SearchSuite) TestSearchWithUserMacaroon(c *gc.C) {
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler: s.srv,
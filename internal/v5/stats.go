@@ -19,9 +19,9 @@ import (
 
 const dateFormat = "2006-01-02"
 
-// parseDateRange parses a date range as specified in an http
+// ParseDateRange parses a date range as specified in an http
 // request. The returned times will be zero if not specified.
-func parseDateRange(form url.Values) (start, stop time.Time, err error) {
+func ParseDateRange(form url.Values) (start, stop time.Time, err error) {
 	if v := form.Get("start"); v != "" {
 		var err error
 		start, err = time.Parse(dateFormat, v)
@@ -68,7 +68,7 @@ func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interfac
 		By:   by,
 	}
 	var err error
-	req.Start, req.Stop, err = parseDateRange(r.Form)
+	req.Start, req.Stop, err = ParseDateRange(r.Form)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
@@ -119,7 +119,7 @@ func (h *ReqHandler) serveStatsUpdate(w http.ResponseWriter, r *http.Request) er
 	if _, err := h.authorize(authorizeParams{
 		req: r,
 		acls: []mongodoc.ACL{{
-			Write: []string{"statsupdate@cs"},
+			Write: append([]string{"statsupdate@cs"}, h.roleACL(RoleStatsWriter)...),
 		}},
 		ops: []string{OpWrite},
 	}); err != nil {
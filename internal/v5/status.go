@@ -12,6 +12,7 @@ import (
 
 	"github.com/juju/utils/debugstatus"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
@@ -28,6 +29,7 @@ func (h *ReqHandler) serveDebugStatus(_ http.Header, req *http.Request) (interfa
 		h.checkElasticSearch,
 		h.checkEntities,
 		h.checkBaseEntities,
+		h.checkBlobScrub,
 	), nil
 }
 
@@ -94,6 +96,32 @@ func (h *ReqHandler) checkBaseEntities() (key string, result debugstatus.CheckRe
 	return resultKey, result
 }
 
+func (h *ReqHandler) checkBlobScrub() (key string, result debugstatus.CheckResult) {
+	key = "blob_scrub"
+	result.Name = "Blob integrity"
+	report, err := h.Store.BlobScrubReport()
+	if errgo.Cause(err) == mgo.ErrNotFound {
+		result.Value = "Blob integrity scrub has not been run"
+		result.Passed = true
+		return key, result
+	}
+	if err != nil {
+		result.Value = "Cannot get blob scrub report: " + err.Error()
+		return key, result
+	}
+	result.Value = fmt.Sprintf("%d blobs checked; %d missing; %d corrupt (completed %s)", report.Checked, report.Missing, report.Corrupt, report.EndTime.UTC().Format(time.RFC3339))
+	if len(report.Problems) > 0 {
+		p := report.Problems[0]
+		id := p.URL.String()
+		if p.Resource != "" {
+			id += " resource " + p.Resource
+		}
+		result.Value += fmt.Sprintf("; first problem: %s: %s", id, p.Message)
+	}
+	result.Passed = report.Missing == 0 && report.Corrupt == 0
+	return key, result
+}
+
 // findTimesInLogs goes through logs in reverse order finding when the start and
 // end messages were last added.
 func (h *ReqHandler) findTimesInLogs(logType mongodoc.LogType, startPrefix, endPrefix string) (start, end time.Time, err error) {
@@ -69,6 +69,11 @@ func (s *APISuite) TestStatus(c *gc.C) {
 			Value:  now.String(),
 			Passed: true,
 		},
+		"blob_scrub": {
+			Name:   "Blob integrity",
+			Value:  "Blob integrity scrub has not been run",
+			Passed: true,
+		},
 	})
 }
 
@@ -90,6 +95,31 @@ func (s *APISuite) TestStatusBaseEntitiesError(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestStatusBlobScrubProblems(c *gc.C) {
+	err := s.store.DB.ScrubReports().Insert(&mongodoc.ScrubReport{
+		Id:        "blobs",
+		StartTime: time.Date(2017, 1, 2, 3, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Checked:   10,
+		Missing:   1,
+		Problems: []mongodoc.ScrubProblem{{
+			URL:     charm.MustParseURL("cs:~charmers/precise/wordpress-1"),
+			Hash:    "1234",
+			Missing: true,
+			Message: "blob not found",
+		}},
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	s.AssertDebugStatus(c, false, map[string]params.DebugStatus{
+		"blob_scrub": {
+			Name:   "Blob integrity",
+			Value:  "10 blobs checked; 1 missing; 0 corrupt (completed 2017-01-02T03:04:05Z); first problem: cs:~charmers/precise/wordpress-1: blob not found",
+			Passed: false,
+		},
+	})
+}
+
 // AssertDebugStatus asserts that the current /debug/status endpoint
 // matches the given status, ignoring status duration.
 // If complete is true, it fails if the results contain
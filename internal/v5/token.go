@@ -0,0 +1,221 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// APITokenRequest holds the request body of POST /token.
+type APITokenRequest struct {
+	// Description holds a description of what the
+	// token will be used for.
+	Description string `json:",omitempty"`
+
+	// Scope holds one of "read", "upload" or "publish".
+	Scope string
+
+	// Namespace holds the only namespace that the token
+	// may be used to access. If it is empty, the token
+	// may be used to access any namespace.
+	Namespace string `json:",omitempty"`
+
+	// ExpireTime holds when the token expires. If it
+	// is nil, the token does not expire.
+	ExpireTime *time.Time `json:",omitempty"`
+
+	// User holds the user that the token will act as. It
+	// must be specified when authenticated with admin
+	// credentials and may only be specified by admins,
+	// which allows tokens to be issued to users when
+	// there is no identity manager.
+	User string `json:",omitempty"`
+}
+
+// APIToken holds the response body of POST /token and an entry
+// in the response body of GET /token.
+type APIToken struct {
+	// TokenId holds the id of the token. It is used
+	// to revoke the token.
+	TokenId string
+
+	// Token holds the secret to send in a bearer
+	// Authorization header. It is only returned
+	// when the token is created.
+	Token string `json:",omitempty"`
+
+	// User holds the user that the token acts as.
+	User string
+
+	// Description holds a description of what the
+	// token is used for.
+	Description string `json:",omitempty"`
+
+	// Scope holds one of "read", "upload" or "publish".
+	Scope string
+
+	// Namespace holds the only namespace that the
+	// token may be used to access, if any.
+	Namespace string `json:",omitempty"`
+
+	// CreateTime holds when the token was created.
+	CreateTime time.Time
+
+	// ExpireTime holds when the token expires, if it does.
+	ExpireTime *time.Time `json:",omitempty"`
+
+	// LastUsed holds when the token was last used, if ever.
+	LastUsed *time.Time `json:",omitempty"`
+}
+
+// GET /token[?user=user]
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-token
+//
+// POST /token
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-token
+//
+// DELETE /token/token-id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-tokentoken-id
+func (h *ReqHandler) serveToken(_ http.Header, req *http.Request) (interface{}, error) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" {
+		switch req.Method {
+		case "GET":
+			return h.serveListAPITokens(req)
+		case "POST":
+			return h.serveAddAPIToken(req)
+		}
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if strings.Contains(path, "/") {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	if req.Method != "DELETE" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	auth, err := h.authenticateTokenManager(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	tok, err := h.Store.FindAPIToken(path)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if !auth.Admin && tok.User != auth.Username {
+		// Do not reveal that the token exists.
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", path)
+	}
+	if err := h.Store.RemoveAPIToken(path); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil, nil
+}
+
+func (h *ReqHandler) serveListAPITokens(req *http.Request) (interface{}, error) {
+	auth, err := h.authenticateTokenManager(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, badRequestf(err, "")
+	}
+	user := req.Form.Get("user")
+	switch {
+	case auth.Username == "" && user == "":
+		return nil, badRequestf(nil, "user not specified")
+	case user == "":
+		user = auth.Username
+	case !auth.HasRole(RoleAuditor) && user != auth.Username:
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "cannot list the API tokens of another user")
+	}
+	toks, err := h.Store.UserAPITokens(user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := make([]APIToken, len(toks))
+	for i, tok := range toks {
+		result[i] = apiTokenResponse(tok)
+	}
+	return result, nil
+}
+
+func (h *ReqHandler) serveAddAPIToken(req *http.Request) (interface{}, error) {
+	auth, err := h.authenticateTokenManager(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var r APITokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, badRequestf(err, "cannot unmarshal API token request")
+	}
+	user := auth.Username
+	switch {
+	case r.User == "" && user == "":
+		return nil, badRequestf(nil, "user not specified")
+	case r.User == "" || r.User == user:
+	case !auth.Admin:
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "cannot create API tokens for another user")
+	default:
+		user = r.User
+	}
+	tok := &mongodoc.APIToken{
+		User:        user,
+		Description: r.Description,
+		Scope:       mongodoc.APITokenScope(r.Scope),
+		Namespace:   r.Namespace,
+	}
+	if r.ExpireTime != nil {
+		tok.ExpireTime = *r.ExpireTime
+	}
+	secret, err := h.Store.AddAPIToken(tok)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	resp := apiTokenResponse(tok)
+	resp.Token = secret
+	return resp, nil
+}
+
+// authenticateTokenManager checks that the request is authenticated
+// with admin credentials or as a user. API tokens cannot be used to
+// manage API tokens, so that a token cannot be used to outlive its
+// expiry or to gain a wider scope.
+func (h *ReqHandler) authenticateTokenManager(req *http.Request) (Authorization, error) {
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		return Authorization{}, errgo.Mask(err, errgo.Any)
+	}
+	if auth.Token != nil {
+		return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "API tokens cannot be used to manage API tokens")
+	}
+	return auth, nil
+}
+
+func apiTokenResponse(tok *mongodoc.APIToken) APIToken {
+	r := APIToken{
+		TokenId:     tok.Id.Hex(),
+		User:        tok.User,
+		Description: tok.Description,
+		Scope:       string(tok.Scope),
+		Namespace:   tok.Namespace,
+		CreateTime:  tok.CreateTime.UTC(),
+	}
+	if !tok.ExpireTime.IsZero() {
+		t := tok.ExpireTime.UTC()
+		r.ExpireTime = &t
+	}
+	if !tok.LastUsed.IsZero() {
+		t := tok.LastUsed.UTC()
+		r.LastUsed = &t
+	}
+	return r
+}
@@ -0,0 +1,508 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestAPITokenLifecycle(c *gc.C) {
+	s.idmServer.AddUser("bob")
+	expire := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	tok := s.newAPIToken(c, "bob", v5.APITokenRequest{
+		Description: "ci",
+		Scope:       "upload",
+		ExpireTime:  &expire,
+	})
+	c.Assert(tok.Token, gc.Not(gc.Equals), "")
+	c.Assert(tok.User, gc.Equals, "bob")
+	c.Assert(tok.Scope, gc.Equals, "upload")
+	c.Assert(tok.ExpireTime, jc.DeepEquals, &expire)
+
+	// The token authenticates its user.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("whoami"),
+		Header:  bearerHeader(tok),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			var resp params.WhoAmIResponse
+			err := json.Unmarshal(m, &resp)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(resp.User, gc.Equals, "bob")
+		}),
+	})
+
+	// The secret is only returned when the token is created.
+	var listed []v5.APIToken
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("token"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &listed)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(listed, gc.HasLen, 1)
+	c.Assert(listed[0].LastUsed, gc.NotNil)
+	listed[0].LastUsed = nil
+	expect := tok
+	expect.Token = ""
+	expect.CreateTime = tok.CreateTime.Truncate(time.Millisecond)
+	c.Assert(listed[0], jc.DeepEquals, expect)
+
+	// Admins can list the tokens of any user.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("token?user=bob"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			var toks []v5.APIToken
+			err := json.Unmarshal(m, &toks)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(toks, gc.HasLen, 1)
+			c.Assert(toks[0].TokenId, gc.Equals, tok.TokenId)
+		}),
+	})
+
+	// Other users cannot revoke the token.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("token/" + tok.TokenId),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `API token "` + tok.TokenId + `" not found`,
+		},
+	})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL("token/" + tok.TokenId),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+	})
+
+	// A revoked token cannot be used.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("whoami"),
+		Header:       bearerHeader(tok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid API token",
+		},
+	})
+}
+
+func (s *APISuite) TestAPITokenScopes(c *gc.C) {
+	readTok := s.newAPIToken(c, "bob", v5.APITokenRequest{Scope: "read"})
+	uploadTok := s.newAPIToken(c, "bob", v5.APITokenRequest{Scope: "upload"})
+	publishTok := s.newAPIToken(c, "bob", v5.APITokenRequest{Scope: "publish"})
+
+	// Read tokens cannot upload.
+	s.assertTokenUpload(c, readTok, "~bob/precise/wordpress", http.StatusUnauthorized, params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: "API token with read scope cannot be used for this operation",
+	})
+
+	// Upload tokens can upload.
+	s.assertTokenUpload(c, uploadTok, "~bob/precise/wordpress", http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+	})
+
+	// All tokens can read private entities that their user can read.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~bob/precise/wordpress-0/meta/id-revision"),
+		Header:     bearerHeader(readTok),
+		ExpectBody: params.IdRevisionResponse{Revision: 0},
+	})
+
+	// Only publish tokens can publish.
+	publish := params.PublishRequest{
+		Channels: []params.Channel{params.StableChannel},
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("~bob/precise/wordpress-0/publish"),
+		Header:       bearerHeader(uploadTok),
+		JSONBody:     publish,
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "API token with upload scope cannot be used for this operation",
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL("~bob/precise/wordpress-0/publish"),
+		Header:   bearerHeader(publishTok),
+		JSONBody: publish,
+	})
+
+	// Tokens cannot be used to manage tokens.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("token"),
+		Header:       bearerHeader(publishTok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "API tokens cannot be used to manage API tokens",
+		},
+	})
+}
+
+func (s *APISuite) TestAPITokenNamespace(c *gc.C) {
+	s.idmServer.AddUser("bob", "bobgroup")
+	tok := s.newAPIToken(c, "bob", v5.APITokenRequest{
+		Scope:     "upload",
+		Namespace: "bobgroup",
+	})
+	s.assertTokenUpload(c, tok, "~bobgroup/precise/wordpress", http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseURL("cs:~bobgroup/precise/wordpress-0"),
+	})
+	// The token cannot be used outside its namespace, even
+	// though its user could.
+	s.assertTokenUpload(c, tok, "~bob/precise/wordpress", http.StatusUnauthorized, params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `API token restricted to namespace "bobgroup"`,
+	})
+}
+
+func (s *APISuite) TestAPITokenUploadScope(c *gc.C) {
+	readTok := s.newAPIToken(c, "bob", v5.APITokenRequest{Scope: "read"})
+	uploadTok := s.newAPIToken(c, "bob", v5.APITokenRequest{Scope: "upload"})
+	readErr := params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: "API token with read scope cannot be used for this operation",
+	}
+
+	// Read tokens cannot create uploads.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL("upload"),
+		Header:       bearerHeader(readTok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   readErr,
+	})
+
+	// Upload tokens can.
+	var uploadResp params.NewUploadResponse
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("upload"),
+		Header:  bearerHeader(uploadTok),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	err := json.Unmarshal(rec.Body.Bytes(), &uploadResp)
+	c.Assert(err, gc.Equals, nil)
+
+	// Read tokens cannot upload parts, finish or delete the upload.
+	part := "0123456789"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		Method:        "PUT",
+		URL:           storeURL("upload/" + uploadResp.UploadId + "/0?hash=" + hashOfString(part)),
+		Header:        bearerHeader(readTok),
+		Body:          strings.NewReader(part),
+		ContentLength: int64(len(part)),
+		ExpectStatus:  http.StatusUnauthorized,
+		ExpectBody:    readErr,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("upload/" + uploadResp.UploadId),
+		Header:       bearerHeader(readTok),
+		JSONBody:     params.Parts{},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   readErr,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("upload/" + uploadResp.UploadId),
+		Header:       bearerHeader(readTok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   readErr,
+	})
+
+	// Read tokens can still list uploads.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("upload"),
+		Header:  bearerHeader(readTok),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+
+	// Upload tokens can delete the upload.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL("upload/" + uploadResp.UploadId),
+		Header:  bearerHeader(uploadTok),
+	})
+}
+
+func (s *APISuite) TestExpiredAPIToken(c *gc.C) {
+	expire := time.Now().Add(time.Hour)
+	tok := s.newAPIToken(c, "bob", v5.APITokenRequest{
+		Scope:      "read",
+		ExpireTime: &expire,
+	})
+	err := s.store.DB.APITokens().UpdateId(bson.ObjectIdHex(tok.TokenId), bson.D{{"$set", bson.D{{"expiretime", time.Now().Add(-time.Second)}}}})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("whoami"),
+		Header:       bearerHeader(tok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid API token",
+		},
+	})
+}
+
+func (s *APISuite) TestAPITokenWithoutIdentityManager(c *gc.C) {
+	// The noMacaroonSrv server has no identity manager, so users
+	// can only be authenticated with API tokens issued by an admin,
+	// and their groups are those held by the charm store.
+	id := newResolvedURL("cs:~alice/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "alice", "qa")
+	c.Assert(err, gc.Equals, nil)
+
+	var tok v5.APIToken
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.noMacaroonSrv,
+		Method:   "POST",
+		URL:      storeURL("token"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.APITokenRequest{
+			Scope: "read",
+			User:  "bob",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &tok)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(tok.User, gc.Equals, "bob")
+
+	p := httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("~alice/precise/wordpress-0/meta/id-revision"),
+		Header:       bearerHeader(tok),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	}
+	httptesting.AssertJSONCall(c, p)
+
+	err = s.store.SetGroup("qa", []string{"bob"})
+	c.Assert(err, gc.Equals, nil)
+	p.ExpectStatus = http.StatusOK
+	p.ExpectBody = params.IdRevisionResponse{Revision: 0}
+	httptesting.AssertJSONCall(c, p)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.noMacaroonSrv,
+		URL:     storeURL("whoami"),
+		Header:  bearerHeader(tok),
+		ExpectBody: params.WhoAmIResponse{
+			User:   "bob",
+			Groups: []string{"qa"},
+		},
+	})
+}
+
+var pastTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var apiTokenErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	body         interface{}
+	asAdmin      bool
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid scope",
+	method:       "POST",
+	url:          "token",
+	body:         v5.APITokenRequest{Scope: "admin"},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid API token scope "admin"`,
+	},
+}, {
+	about:        "expiry in the past",
+	method:       "POST",
+	url:          "token",
+	body:         v5.APITokenRequest{Scope: "read", ExpireTime: &pastTime},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `API token expiry time is in the past`,
+	},
+}, {
+	about:        "admin create without user",
+	method:       "POST",
+	url:          "token",
+	body:         v5.APITokenRequest{Scope: "read"},
+	asAdmin:      true,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `user not specified`,
+	},
+}, {
+	about:        "create for other user",
+	method:       "POST",
+	url:          "token",
+	body:         v5.APITokenRequest{Scope: "read", User: "alice"},
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `cannot create API tokens for another user`,
+	},
+}, {
+	about:        "admin list without user",
+	url:          "token",
+	asAdmin:      true,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `user not specified`,
+	},
+}, {
+	about:        "list other user",
+	url:          "token?user=alice",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `cannot list the API tokens of another user`,
+	},
+}, {
+	about:        "delete unknown token",
+	method:       "DELETE",
+	url:          "token/unknown",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `API token "unknown" not found`,
+	},
+}, {
+	about:        "put not allowed",
+	method:       "PUT",
+	url:          "token",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `PUT not allowed`,
+	},
+}, {
+	about:        "get token not allowed",
+	url:          "token/" + bson.NewObjectId().Hex(),
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `GET not allowed`,
+	},
+}}
+
+func (s *APISuite) TestAPITokenErrors(c *gc.C) {
+	for i, test := range apiTokenErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		p := httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		}
+		if test.asAdmin {
+			p.Username = testUsername
+			p.Password = testPassword
+		} else {
+			p.Do = bakeryDo(s.idmServer.Client("bob"))
+		}
+		httptesting.AssertJSONCall(c, p)
+	}
+}
+
+// newAPIToken creates an API token as the given user.
+func (s *APISuite) newAPIToken(c *gc.C, user string, r v5.APITokenRequest) v5.APIToken {
+	var tok v5.APIToken
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("token"),
+		Do:       bakeryDo(s.idmServer.Client(user)),
+		JSONBody: r,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &tok)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	return tok
+}
+
+// assertTokenUpload uploads the wordpress testing charm to the given
+// id using the given API token.
+func (s *APISuite) assertTokenUpload(c *gc.C, tok v5.APIToken, id string, expectStatus int, expectBody interface{}) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	data, err := ioutil.ReadFile(ch.Path)
+	c.Assert(err, gc.Equals, nil)
+	header := bearerHeader(tok)
+	header.Set("Content-Type", "application/zip")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		Method:        "POST",
+		URL:           storeURL(id + "/archive?hash=" + hashOfBytes(data)),
+		ContentLength: int64(len(data)),
+		Header:        header,
+		Body:          bytes.NewReader(data),
+		ExpectStatus:  expectStatus,
+		ExpectBody:    expectBody,
+	})
+}
+
+func bearerHeader(tok v5.APIToken) http.Header {
+	return http.Header{
+		"Authorization": {"Bearer " + tok.Token},
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// DefaultTrack holds the response body of GET id/meta/default-track
+// and the request body of PUT id/meta/default-track.
+type DefaultTrack struct {
+	// Track holds the track that channels without
+	// a track refer to, for instance "latest" or "2".
+	Track string
+}
+
+// GET id/meta/default-track
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-idmetadefault-track
+func (h *ReqHandler) metaDefaultTrack(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	track := entity.DefaultTrack
+	if track == "" {
+		track = charmstore.LatestTrack
+	}
+	return &DefaultTrack{
+		Track: track,
+	}, nil
+}
+
+// PUT id/meta/default-track
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#put-idmetadefault-track
+func (h *ReqHandler) putMetaDefaultTrack(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	// Changing the default track changes the channel that
+	// channels without a track refer to, so it is restricted
+	// like a change to the promotion policy.
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("promotionpolicy"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := h.authorizePolicyChange(id, baseEntity.PromotionPolicy, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var t DefaultTrack
+	if val != nil && !bytes.Equal(*val, nullBytes) {
+		if err := json.Unmarshal(*val, &t); err != nil {
+			return badRequestf(err, "cannot unmarshal default track")
+		}
+		if !charmstore.ValidTrack(t.Track) {
+			return badRequestf(nil, "invalid track %q", t.Track)
+		}
+	}
+	// The latest track is the default when none is set.
+	if t.Track == "" || t.Track == charmstore.LatestTrack {
+		updater.UpdateField("defaulttrack", nil, nil)
+	} else {
+		updater.UpdateField("defaulttrack", t.Track, nil)
+	}
+	// The search index holds the stable entities in the
+	// default track.
+	updater.UpdateSearch()
+	return nil
+}
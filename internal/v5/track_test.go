@@ -0,0 +1,146 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestPublishToTrack(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/precise/wordpress-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/precise/wordpress-1/publish", params.PublishRequest{
+		Channels: []params.Channel{"2/stable", "2/edge"},
+	})
+
+	// The 2 track has taken the ACLs of the latest track, so
+	// everyone can read it.
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 0,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision?channel=latest/stable", params.IdRevisionResponse{
+		Revision: 0,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision?channel=2/stable", params.IdRevisionResponse{
+		Revision: 1,
+	})
+	s.assertGet(c, "~bob/precise/wordpress-1/meta/published", params.PublishedResponse{
+		Info: []params.PublishedInfo{{
+			Channel: "2/stable",
+			Current: true,
+		}, {
+			Channel: "2/edge",
+			Current: true,
+		}},
+	})
+
+	// Make the 2 track the default.
+	s.assertPut(c, "~bob/wordpress/meta/default-track", v5.DefaultTrack{
+		Track: "2",
+	})
+	s.assertGet(c, "~bob/wordpress/meta/default-track", v5.DefaultTrack{
+		Track: "2",
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 1,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision?channel=stable", params.IdRevisionResponse{
+		Revision: 1,
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision?channel=latest/stable", params.IdRevisionResponse{
+		Revision: 0,
+	})
+
+	// Putting null reverts to the latest track.
+	s.assertPut(c, "~bob/wordpress/meta/default-track", nil)
+	s.assertGet(c, "~bob/wordpress/meta/default-track", v5.DefaultTrack{
+		Track: "latest",
+	})
+	s.assertGet(c, "~bob/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 0,
+	})
+}
+
+func (s *APISuite) TestTrackPerms(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.idmServer.SetDefaultUser("bob")
+	s.assertPut(c, "~bob/precise/wordpress-0/publish", params.PublishRequest{
+		Channels: []params.Channel{"2/stable"},
+	})
+
+	// Restricting the track's ACL leaves the latest track alone.
+	s.assertPut(c, "~bob/wordpress/meta/perm/read?channel=2/stable", []string{"bob"})
+	s.assertGet(c, "~bob/wordpress/meta/perm?channel=2/stable", params.PermResponse{
+		Read:  []string{"bob"},
+		Write: []string{"bob"},
+	})
+	s.assertGet(c, "~bob/wordpress/meta/perm?channel=stable", params.PermResponse{
+		Read:  []string{params.Everyone, "bob"},
+		Write: []string{"bob"},
+	})
+
+	// A track that has not been published to uses
+	// the latest track's ACLs until it has its own.
+	s.assertGet(c, "~bob/wordpress/meta/perm?channel=3/stable", params.PermResponse{
+		Read:  []string{params.Everyone, "bob"},
+		Write: []string{"bob"},
+	})
+}
+
+var putDefaultTrackErrorTests = []struct {
+	about         string
+	body          interface{}
+	expectMessage string
+}{{
+	about:         "invalid track",
+	body:          v5.DefaultTrack{Track: "1.x"},
+	expectMessage: `invalid track "1.x"`,
+}, {
+	about:         "empty track",
+	body:          v5.DefaultTrack{},
+	expectMessage: `invalid track ""`,
+}}
+
+func (s *APISuite) TestPutDefaultTrackErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range putDefaultTrackErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       "PUT",
+			URL:          storeURL("~bob/wordpress/meta/default-track"),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
+func (s *APISuite) TestInvalidTrackChannel(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/wordpress/meta/id?channel=2/unpublished"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "2/unpublished" specified in request`,
+		},
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/router"
+)
+
+// TransferRequest holds the request body of POST id/transfer.
+type TransferRequest struct {
+	// NewId holds the base id, including the user, that
+	// the charm or bundle is transferred to.
+	NewId *charm.URL
+}
+
+// TransferResponse holds the response body of POST id/transfer.
+type TransferResponse struct {
+	// Id holds the new base id of the charm or bundle.
+	Id *charm.URL
+}
+
+// POST id/transfer
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-idtransfer
+func (h *ReqHandler) serveTransfer(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.Series != "" || id.Revision != -1 {
+		return badRequestf(nil, "%q is not a base entity id", id)
+	}
+	var transfer struct {
+		TransferRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &transfer); err != nil {
+		return badRequestf(err, "cannot unmarshal transfer request body")
+	}
+	newId := transfer.NewId
+	if newId == nil {
+		return badRequestf(nil, "new id not specified")
+	}
+	if newId.Series != "" || newId.Revision != -1 {
+		return badRequestf(nil, "%q is not a base entity id", newId)
+	}
+	// The user must be able to write to both the existing
+	// charm or bundle and the namespace it is moving to.
+	if err := h.authorizeUpload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.authorizeUpload(newId, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.Store.TransferBaseEntity(id, newId); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot transfer %q", id),
+			errgo.Is(params.ErrNotFound),
+			errgo.Is(params.ErrBadRequest),
+			errgo.Is(params.ErrForbidden),
+			errgo.Is(params.ErrDuplicateUpload),
+			errgo.Is(router.ErrQuotaExceeded),
+		)
+	}
+	h.addAudit(audit.Entry{
+		Op:        audit.OpTransfer,
+		Entity:    id,
+		NewEntity: newId,
+	})
+	return httprequest.WriteJSON(w, http.StatusOK, &TransferResponse{
+		Id: newId,
+	})
+}
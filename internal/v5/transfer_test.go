@@ -0,0 +1,158 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/audit"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestTransfer(c *gc.C) {
+	var calledEntities []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		calledEntities = append(calledEntities, e)
+	})
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("~bob/wordpress/transfer"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.TransferRequest{
+			NewId: charm.MustParseURL("cs:~alice/wp"),
+		},
+		ExpectBody: v5.TransferResponse{
+			Id: charm.MustParseURL("cs:~alice/wp"),
+		},
+	})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+		User:      "admin",
+		Op:        audit.OpTransfer,
+		Entity:    charm.MustParseURL("cs:~bob/wordpress"),
+		NewEntity: charm.MustParseURL("cs:~alice/wp"),
+	}})
+
+	// The new id and the old one both resolve to the new entity.
+	expectId := params.IdResponse{
+		Id:       charm.MustParseURL("cs:~alice/precise/wp-0"),
+		User:     "alice",
+		Series:   "precise",
+		Name:     "wp",
+		Revision: 0,
+	}
+	s.assertGet(c, "~alice/precise/wp-0/meta/id", expectId)
+	s.assertGet(c, "~bob/precise/wordpress-0/meta/id", expectId)
+	s.assertGet(c, "~bob/wordpress/meta/id", expectId)
+	s.assertGet(c, "meta/id?id=~bob/wordpress", map[string]params.IdResponse{
+		"~bob/wordpress": expectId,
+	})
+}
+
+func (s *APISuite) TestTransferUnauthorized(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	// Bob can write to ~bob/wordpress but not to the alice namespace.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("~bob/wordpress/transfer"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.TransferRequest{
+			NewId: charm.MustParseURL("cs:~alice/wp"),
+		},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+	s.assertGet(c, "~bob/precise/wordpress-0/meta/id-name", params.IdNameResponse{
+		Name: "wordpress",
+	})
+}
+
+var transferErrorTests = []struct {
+	about        string
+	url          string
+	method       string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "not a base entity",
+	url:          "~bob/precise/wordpress-0/transfer",
+	method:       "POST",
+	body:         v5.TransferRequest{NewId: charm.MustParseURL("cs:~alice/wp")},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `"cs:~bob/precise/wordpress-0" is not a base entity id`,
+	},
+}, {
+	about:        "no new id",
+	url:          "~bob/wordpress/transfer",
+	method:       "POST",
+	body:         v5.TransferRequest{},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `new id not specified`,
+	},
+}, {
+	about:        "target exists",
+	url:          "~bob/wordpress/transfer",
+	method:       "POST",
+	body:         v5.TransferRequest{NewId: charm.MustParseURL("cs:~bob/mysql")},
+	expectStatus: http.StatusInternalServerError,
+	expectBody: params.Error{
+		Code:    params.ErrDuplicateUpload,
+		Message: `cannot transfer "cs:~bob/wordpress": "cs:~bob/mysql" already exists`,
+	},
+}, {
+	about:        "not found",
+	url:          "~bob/varnish/transfer",
+	method:       "POST",
+	body:         v5.TransferRequest{NewId: charm.MustParseURL("cs:~bob/cache")},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `cannot transfer "cs:~bob/varnish": base entity not found`,
+	},
+}, {
+	about:        "bad method",
+	url:          "~bob/wordpress/transfer",
+	method:       "PUT",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `PUT not allowed`,
+	},
+}}
+
+func (s *APISuite) TestTransferErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~bob/precise/mysql-0", -1))
+	for i, test := range transferErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
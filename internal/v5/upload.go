@@ -17,6 +17,7 @@ import (
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
 )
 
 const (
@@ -24,13 +25,51 @@ const (
 	maxUploadExpiryDuration     = 24 * time.Hour
 )
 
-// POST /upload?expiry=expiry-duration
+// UploadsResponse holds the response from a GET /upload request.
+type UploadsResponse struct {
+	Uploads []UploadInfo
+}
+
+// UploadInfo holds information on one multipart upload.
+type UploadInfo struct {
+	UploadId string
+	Expires  time.Time
+	// Hash holds the hash of the entire upload. It is
+	// empty until the upload has been completed.
+	Hash  string `json:",omitempty"`
+	Parts params.Parts
+}
+
+// POST /upload?expiry=expiry-duration or GET /upload
 func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) error {
-	_, err := h.Authenticate(req)
+	auth, err := h.authenticateUpload(req)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	switch req.Method {
+	case "GET":
+		// List the uploads created by the authenticated user.
+		// An admin or auditor sees all uploads.
+		creator := auth.Username
+		if auth.HasRole(RoleAuditor) {
+			creator = ""
+		}
+		infos, err := h.Store.BlobStore.Uploads(creator)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		uploads := make([]UploadInfo, len(infos))
+		for i, info := range infos {
+			uploads[i] = UploadInfo{
+				UploadId: info.Id,
+				Expires:  info.Expires,
+				Hash:     info.Hash,
+				Parts:    uploadParts(info.Parts),
+			}
+		}
+		return httprequest.WriteJSON(w, http.StatusOK, &UploadsResponse{
+			Uploads: uploads,
+		})
 	case "POST":
 		expires := defaultUploadExpiryDuration
 		if expiresStr := req.Form.Get("expires"); expiresStr != "" {
@@ -44,7 +83,7 @@ func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) err
 			expires = exp
 		}
 		expireTime := time.Now().Add(expires)
-		uploadId, err := h.Store.BlobStore.NewUpload(expireTime)
+		uploadId, err := h.Store.BlobStore.NewUpload(expireTime, auth.Username)
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -61,7 +100,8 @@ func (h *ReqHandler) serveUploadId(w http.ResponseWriter, req *http.Request) err
 	}
 }
 
-// PUT /upload/upload-id/part-number or GET /upload/upload-id
+// PUT /upload/upload-id/part-number, GET /upload/upload-id
+// or DELETE /upload/upload-id
 func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) error {
 	// Make sure we consume the full request body, before responding.
 	//
@@ -72,7 +112,7 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 	// TODO: investigate using 100-Continue statuses to prevent
 	// unnecessary uploads.
 	defer io.Copy(ioutil.Discard, req.Body)
-	_, err := h.Authenticate(req)
+	auth, err := h.authenticateUpload(req)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
@@ -142,25 +182,74 @@ func (h *ReqHandler) serveUploadPart(w http.ResponseWriter, req *http.Request) e
 		if err != nil {
 			return errgo.WithCausef(nil, params.ErrNotFound, "")
 		}
-		var parts params.Parts
-		parts.Parts = make([]params.Part, len(uploadInfo.Parts))
-		for i, part := range uploadInfo.Parts {
-			parts.Parts[i] = params.Part{
-				Complete: part.Complete,
-				Hash:     part.Hash,
-				Size:     part.Size,
-			}
-
-		}
 		return httprequest.WriteJSON(w, http.StatusOK, params.UploadInfoResponse{
 			Expires: uploadInfo.Expires,
-			Parts:   parts,
+			Parts:   uploadParts(uploadInfo.Parts),
 		})
-		return nil
 	case "DELETE":
-		// TODO
-		return errgo.New("delete not yet implemented")
+		elems := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if len(elems) != 1 {
+			return errgo.WithCausef(nil, params.ErrNotFound, "")
+		}
+		uploadId := elems[0]
+		uploadInfo, err := h.Store.BlobStore.UploadInfo(uploadId)
+		if errgo.Cause(err) == blobstore.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "upload %q not found", uploadId)
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !auth.Admin && (uploadInfo.Creator == "" || uploadInfo.Creator != auth.Username) {
+			return errgo.WithCausef(nil, params.ErrForbidden, "upload %q not created by %q", uploadId, auth.Username)
+		}
+		if err := h.Store.BlobStore.RemoveUpload(uploadId); err != nil {
+			return errgo.Notef(err, "cannot remove upload")
+		}
+		return nil
 	default:
 		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
 	}
 }
+
+// uploadParts returns the API representation of the given upload
+// parts. Parts that have not been uploaded yet are nil and are
+// returned as the zero Part.
+func uploadParts(parts []*blobstore.PartInfo) params.Parts {
+	pparts := params.Parts{
+		Parts: make([]params.Part, len(parts)),
+	}
+	for i, part := range parts {
+		if part == nil {
+			continue
+		}
+		pparts.Parts[i] = params.Part{
+			Complete: part.Complete,
+			Hash:     part.Hash,
+			Size:     part.Size,
+		}
+	}
+	return pparts
+}
+
+// authenticateUpload authenticates a request to the /upload endpoint.
+// Requests that change an upload require write access with
+// the upload scope when an API token is used.
+func (h *ReqHandler) authenticateUpload(req *http.Request) (Authorization, error) {
+	if req.Method == "GET" {
+		return h.Authenticate(req)
+	}
+	// The upload is not attached to any namespace until it is
+	// used to create an entity, at which point the namespace
+	// is checked.
+	return h.authorize(authorizeParams{
+		req: req,
+		acls: []mongodoc.ACL{{
+			Read:  []string{params.Everyone},
+			Write: []string{params.Everyone},
+		}},
+		ops:           []string{OpWrite},
+		authnRequired: true,
+		upload:        true,
+		noNamespace:   true,
+	})
+}
@@ -14,7 +14,11 @@ import (
 	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
 )
 
 func (s *APISuite) TestPostUploadFailsWithNoMacaroon(c *gc.C) {
@@ -556,3 +560,142 @@ func (s *dataSource) Read(buf []byte) (int, error) {
 	}
 	return total, nil
 }
+
+func (s *APISuite) TestListUploads(c *gc.C) {
+	bobId := s.newUpload(c, "bob")
+	part := "0123456789"
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload/" + bobId + "/0?hash=" + hashOfString(part)),
+		Body:    strings.NewReader(part),
+	})
+	aliceId := s.newUpload(c, "alice")
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	var uploads v5.UploadsResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploads)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(uploads.Uploads, gc.HasLen, 1)
+	c.Assert(uploads.Uploads[0].UploadId, gc.Equals, bobId)
+	c.Assert(uploads.Uploads[0].Hash, gc.Equals, "")
+	c.Assert(uploads.Uploads[0].Parts, jc.DeepEquals, params.Parts{
+		Parts: []params.Part{{
+			Hash:     hashOfString(part),
+			Size:     int64(len(part)),
+			Complete: true,
+		}},
+	})
+
+	// An admin can see all the uploads.
+	resp = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("upload"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	uploads = v5.UploadsResponse{}
+	err = json.Unmarshal(resp.Body.Bytes(), &uploads)
+	c.Assert(err, gc.Equals, nil)
+	ids := make(map[string]bool)
+	for _, u := range uploads.Uploads {
+		ids[u.UploadId] = true
+	}
+	c.Assert(ids, jc.DeepEquals, map[string]bool{
+		bobId:   true,
+		aliceId: true,
+	})
+}
+
+func (s *APISuite) TestListUploadsFailsWithNoMacaroon(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		Method:       "GET",
+		URL:          storeURL("upload"),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestDeleteUpload(c *gc.C) {
+	uploadId := s.newUpload(c, "bob")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("upload/" + uploadId),
+	})
+	_, err := s.store.BlobStore.UploadInfo(uploadId)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *APISuite) TestDeleteUploadByAdmin(c *gc.C) {
+	uploadId := s.newUpload(c, "bob")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+		URL:      storeURL("upload/" + uploadId),
+	})
+	_, err := s.store.BlobStore.UploadInfo(uploadId)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *APISuite) TestDeleteUploadNotCreator(c *gc.C) {
+	uploadId := s.newUpload(c, "bob")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		URL:          storeURL("upload/" + uploadId),
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `upload "` + uploadId + `" not created by "alice"`,
+		},
+	})
+	_, err := s.store.BlobStore.UploadInfo(uploadId)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *APISuite) TestDeleteUploadNotFound(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		URL:          storeURL("upload/nothing"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `upload "nothing" not found`,
+		},
+	})
+}
+
+// newUpload starts a new upload as the given user
+// and returns its id.
+func (s *APISuite) newUpload(c *gc.C, user string) string {
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "POST",
+		Do:      bakeryDo(s.idmServer.Client(user)),
+		URL:     storeURL("upload"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", resp.Body.Bytes()))
+	var uploadResp params.NewUploadResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &uploadResp)
+	c.Assert(err, gc.Equals, nil)
+	return uploadResp.UploadId
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/mongodoc"
+)
+
+// WebhookRequest holds the request body of POST /webhook.
+type WebhookRequest struct {
+	// User holds the namespace whose events are delivered.
+	User string `json:",omitempty"`
+
+	// Entity holds the charm or bundle whose events are
+	// delivered. Exactly one of User and Entity must be set.
+	Entity *charm.URL `json:",omitempty"`
+
+	// URL holds the http or https URL that events are posted to.
+	URL string
+
+	// Secret holds the key used to sign the delivered payloads.
+	// If it is empty, a random secret is generated.
+	Secret string `json:",omitempty"`
+
+	// Events holds the events to deliver. If it is empty,
+	// all events are delivered.
+	Events []string `json:",omitempty"`
+}
+
+// Webhook holds the response body of GET /webhook/webhook-id
+// and an entry in the response body of GET /webhook.
+type Webhook struct {
+	// WebhookId holds the id of the webhook.
+	WebhookId string
+
+	// User holds the namespace whose events are delivered.
+	User string `json:",omitempty"`
+
+	// Entity holds the base entity whose events are delivered.
+	Entity *charm.URL `json:",omitempty"`
+
+	// URL holds the URL that events are posted to.
+	URL string
+
+	// Secret holds the key used to sign the delivered payloads.
+	// It is only returned when the webhook is created.
+	Secret string `json:",omitempty"`
+
+	// Events holds the events delivered. If it is empty,
+	// all events are delivered.
+	Events []string `json:",omitempty"`
+
+	// Creator holds the user that created the webhook.
+	Creator string `json:",omitempty"`
+
+	// CreateTime holds when the webhook was created.
+	CreateTime time.Time
+}
+
+// WebhookDelivery holds an entry in the response body of
+// GET /webhook/webhook-id/deliveries and the response body of
+// POST /webhook/webhook-id/ping.
+type WebhookDelivery struct {
+	// DeliveryId holds the id of the delivery, as sent in the
+	// X-Charmstore-Delivery header.
+	DeliveryId string
+
+	// Event holds the kind of event delivered.
+	Event string
+
+	// Payload holds the body that is posted.
+	Payload json.RawMessage
+
+	// Status holds one of "pending", "running", "delivered"
+	// or "failed".
+	Status string
+
+	// Attempts holds the attempts made to deliver the
+	// event, oldest first.
+	Attempts []WebhookAttempt `json:",omitempty"`
+
+	// NextAttempt holds when the next attempt will be made
+	// if the delivery is pending.
+	NextAttempt *time.Time `json:",omitempty"`
+
+	// Time holds when the event occurred.
+	Time time.Time
+}
+
+// WebhookAttempt holds the outcome of an attempt to
+// deliver an event to a webhook.
+type WebhookAttempt struct {
+	Time       time.Time
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// GET /webhook?user=user|entity=id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-webhook
+//
+// POST /webhook
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-webhook
+//
+// GET /webhook/webhook-id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-webhookwebhook-id
+//
+// DELETE /webhook/webhook-id
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#delete-webhookwebhook-id
+//
+// GET /webhook/webhook-id/deliveries
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#get-webhookwebhook-iddeliveries
+//
+// POST /webhook/webhook-id/ping
+// https://github.com/juju/charmstore/blob/v5-unstable/docs/API.md#post-webhookwebhook-idping
+func (h *ReqHandler) serveWebhook(_ http.Header, req *http.Request) (interface{}, error) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" {
+		switch req.Method {
+		case "GET":
+			return h.serveListWebhooks(req)
+		case "POST":
+			return h.serveAddWebhook(req)
+		}
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	wh, err := h.Store.FindWebhook(parts[0])
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := h.authorizeWebhook(req, wh.User, wh.BaseURL); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var op string
+	if len(parts) == 2 {
+		op = parts[1]
+	}
+	switch {
+	case op == "" && req.Method == "GET":
+		return webhookResponse(wh), nil
+	case op == "" && req.Method == "DELETE":
+		if err := h.Store.RemoveWebhook(parts[0]); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return nil, nil
+	case op == "deliveries" && req.Method == "GET":
+		return h.serveWebhookDeliveries(parts[0], req)
+	case op == "ping" && req.Method == "POST":
+		d, err := h.Store.PingWebhook(parts[0])
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return webhookDeliveryResponse(d), nil
+	case op == "" || op == "deliveries" || op == "ping":
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+}
+
+func (h *ReqHandler) serveListWebhooks(req *http.Request) (interface{}, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, badRequestf(err, "")
+	}
+	user, baseURL, err := webhookSubject(req.Form.Get("user"), req.Form.Get("entity"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := h.authorizeWebhook(req, user, baseURL); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var whs []*mongodoc.Webhook
+	if baseURL != nil {
+		whs, err = h.Store.EntityWebhooks(baseURL)
+	} else {
+		whs, err = h.Store.NamespaceWebhooks(user)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := make([]Webhook, len(whs))
+	for i, wh := range whs {
+		result[i] = webhookResponse(wh)
+	}
+	return result, nil
+}
+
+func (h *ReqHandler) serveAddWebhook(req *http.Request) (interface{}, error) {
+	var r WebhookRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, badRequestf(err, "cannot unmarshal webhook request")
+	}
+	var entity string
+	if r.Entity != nil {
+		entity = r.Entity.String()
+	}
+	user, baseURL, err := webhookSubject(r.User, entity)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if err := h.authorizeWebhook(req, user, baseURL); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	wh := &mongodoc.Webhook{
+		User:    user,
+		BaseURL: baseURL,
+		URL:     r.URL,
+		Secret:  r.Secret,
+		Creator: h.authUsername(),
+	}
+	for _, e := range r.Events {
+		wh.Events = append(wh.Events, mongodoc.StoreEvent(e))
+	}
+	if err := h.Store.AddWebhook(wh); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	resp := webhookResponse(wh)
+	resp.Secret = wh.Secret
+	return resp, nil
+}
+
+func (h *ReqHandler) serveWebhookDeliveries(webhookId string, req *http.Request) (interface{}, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, badRequestf(err, "")
+	}
+	limit := 0
+	if v := req.Form.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, badRequestf(nil, "invalid 'limit' value")
+		}
+	}
+	ds, err := h.Store.WebhookDeliveries(webhookId, limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := make([]WebhookDelivery, len(ds))
+	for i, d := range ds {
+		result[i] = webhookDeliveryResponse(d)
+	}
+	return result, nil
+}
+
+// webhookSubject returns the namespace or base entity that a webhook
+// request refers to. Exactly one of user and entity must be non-empty.
+func webhookSubject(user, entity string) (string, *charm.URL, error) {
+	if (user == "") == (entity == "") {
+		return "", nil, badRequestf(nil, "exactly one of user and entity must be specified")
+	}
+	if user != "" {
+		return user, nil, nil
+	}
+	id, err := charm.ParseURL(entity)
+	if err != nil {
+		return "", nil, badRequestf(err, "")
+	}
+	if id.User == "" {
+		return "", nil, badRequestf(nil, "user not specified in entity %q", id)
+	}
+	return "", mongodoc.BaseURL(id), nil
+}
+
+// authorizeWebhook checks that the request is allowed to manage the
+// webhooks of the namespace of the given user or, if baseURL is not
+// nil, of the base entity with that id. Managing the webhooks of a
+// namespace requires being that user or a member of that group;
+// managing those of a base entity requires write permission on its
+// unpublished channel.
+func (h *ReqHandler) authorizeWebhook(req *http.Request, user string, baseURL *charm.URL) error {
+	acl := mongodoc.ACL{
+		Write: []string{user},
+	}
+	namespace := user
+	if baseURL != nil {
+		namespace = baseURL.User
+		baseEntity, err := h.Cache.BaseEntity(baseURL, charmstore.FieldSelector("channelacls"))
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		acl = baseEntity.ChannelACLs[params.UnpublishedChannel]
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:        req,
+		acls:       []mongodoc.ACL{acl},
+		ops:        []string{OpWrite},
+		namespaces: []string{namespace},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+func webhookResponse(wh *mongodoc.Webhook) Webhook {
+	r := Webhook{
+		WebhookId:  wh.Id.Hex(),
+		User:       wh.User,
+		Entity:     wh.BaseURL,
+		URL:        wh.URL,
+		Creator:    wh.Creator,
+		CreateTime: wh.CreateTime.UTC(),
+	}
+	for _, e := range wh.Events {
+		r.Events = append(r.Events, string(e))
+	}
+	return r
+}
+
+func webhookDeliveryResponse(d *mongodoc.WebhookDelivery) WebhookDelivery {
+	r := WebhookDelivery{
+		DeliveryId: d.Id.Hex(),
+		Event:      string(d.Event),
+		Payload:    json.RawMessage(d.Payload),
+		Status:     string(d.Status),
+		Time:       d.CreateTime.UTC(),
+	}
+	if d.Status == mongodoc.WebhookDeliveryPending {
+		t := d.NextAttempt.UTC()
+		r.NextAttempt = &t
+	}
+	for _, a := range d.Attempts {
+		r.Attempts = append(r.Attempts, WebhookAttempt{
+			Time:       a.Time.UTC(),
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+		})
+	}
+	return r
+}
@@ -0,0 +1,377 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+	"gopkg.in/juju/charmrepo.v2-unstable/csclient/params"
+
+	"gopkg.in/juju/charmstore.v5-unstable/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5-unstable/internal/v5"
+)
+
+func (s *APISuite) TestWebhookLifecycle(c *gc.C) {
+	var mu sync.Mutex
+	var received []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, req.Header)
+	}))
+	defer srv.Close()
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+
+	var wh v5.Webhook
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("webhook"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.WebhookRequest{
+			Entity: charm.MustParseURL("~bob/precise/wordpress-0"),
+			URL:    srv.URL,
+			Secret: "s3cret",
+			Events: []string{"perm"},
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &wh)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(wh.CreateTime.IsZero(), gc.Equals, false)
+	expect := v5.Webhook{
+		WebhookId:  wh.WebhookId,
+		Entity:     charm.MustParseURL("cs:~bob/wordpress"),
+		URL:        srv.URL,
+		Events:     []string{"perm"},
+		Creator:    "bob",
+		CreateTime: wh.CreateTime.Truncate(time.Millisecond),
+	}
+	// The secret is only returned when the webhook is created.
+	c.Assert(wh.Secret, gc.Equals, "s3cret")
+
+	s.idmServer.SetDefaultUser("bob")
+	s.assertGet(c, "webhook/"+wh.WebhookId, expect)
+	s.assertGet(c, "webhook?entity=~bob/wordpress", []v5.Webhook{expect})
+	s.assertGet(c, "webhook?user=bob", []v5.Webhook{})
+
+	// Changing permissions notifies the webhook.
+	s.assertPut(c, "~bob/precise/wordpress-0/meta/perm/read", []string{"bob", "alice"})
+	n, err := s.store.RunWebhookDeliveries(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+
+	// A ping is delivered immediately.
+	var ping v5.WebhookDelivery
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("webhook/" + wh.WebhookId + "/ping"),
+		Do:      bakeryDo(nil),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &ping)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(ping.Event, gc.Equals, "ping")
+	c.Assert(ping.Status, gc.Equals, "delivered")
+	c.Assert(ping.Attempts, gc.HasLen, 1)
+	c.Assert(ping.Attempts[0].StatusCode, gc.Equals, http.StatusOK)
+
+	mu.Lock()
+	c.Assert(received, gc.HasLen, 2)
+	c.Assert(received[0].Get(charmstore.WebhookEventHeader), gc.Equals, "perm")
+	c.Assert(received[1].Get(charmstore.WebhookEventHeader), gc.Equals, "ping")
+	c.Assert(received[1].Get(charmstore.WebhookDeliveryHeader), gc.Equals, ping.DeliveryId)
+	mu.Unlock()
+
+	// The delivery log holds both deliveries, newest first.
+	var deliveries []v5.WebhookDelivery
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("webhook/" + wh.WebhookId + "/deliveries"),
+		Do:      bakeryDo(nil),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &deliveries)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(deliveries, gc.HasLen, 2)
+	c.Assert(deliveries[0].DeliveryId, gc.Equals, ping.DeliveryId)
+	c.Assert(deliveries[1].Event, gc.Equals, "perm")
+	c.Assert(deliveries[1].Status, gc.Equals, "delivered")
+	var payload charmstore.WebhookPayload
+	err = json.Unmarshal(deliveries[1].Payload, &payload)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(payload.Id, jc.DeepEquals, charm.MustParseURL("cs:~bob/precise/wordpress-0"))
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("webhook/" + wh.WebhookId + "/deliveries?limit=1"),
+		Do:      bakeryDo(nil),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			var ds []v5.WebhookDelivery
+			err := json.Unmarshal(m, &ds)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(ds, gc.HasLen, 1)
+		}),
+	})
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "DELETE",
+		URL:     storeURL("webhook/" + wh.WebhookId),
+		Do:      bakeryDo(nil),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("webhook/" + wh.WebhookId),
+		Do:           bakeryDo(nil),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `webhook "` + wh.WebhookId + `" not found`,
+		},
+	})
+}
+
+func (s *APISuite) TestNamespaceWebhook(c *gc.C) {
+	var wh v5.Webhook
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("webhook"),
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		JSONBody: v5.WebhookRequest{
+			User: "bob",
+			URL:  "http://0.1.2.3/hook",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &wh)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	// A secret is generated when none is given.
+	c.Assert(wh.Secret, gc.Not(gc.Equals), "")
+	c.Assert(wh.User, gc.Equals, "bob")
+
+	// Alice cannot see or manage bob's webhooks.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("webhook?user=bob"),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("webhook/" + wh.WebhookId),
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("webhook"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.WebhookRequest{
+			User: "bob",
+			URL:  "http://0.1.2.3/hook",
+		},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+
+	// Members of a group may manage its webhooks.
+	s.idmServer.AddUser("alice", "charmers")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("webhook"),
+		Do:      bakeryDo(s.idmServer.Client("alice")),
+		JSONBody: v5.WebhookRequest{
+			User: "charmers",
+			URL:  "https://0.1.2.3/hook",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {}),
+	})
+}
+
+var webhookErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no subject",
+	method:       "POST",
+	url:          "webhook",
+	body:         v5.WebhookRequest{URL: "http://0.1.2.3/hook"},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `exactly one of user and entity must be specified`,
+	},
+}, {
+	about:        "entity without user",
+	method:       "POST",
+	url:          "webhook",
+	body:         v5.WebhookRequest{Entity: charm.MustParseURL("wordpress"), URL: "http://0.1.2.3/hook"},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `user not specified in entity "cs:wordpress"`,
+	},
+}, {
+	about:        "entity not found",
+	method:       "POST",
+	url:          "webhook",
+	body:         v5.WebhookRequest{Entity: charm.MustParseURL("~bob/mysql"), URL: "http://0.1.2.3/hook"},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `base entity not found`,
+	},
+}, {
+	about:        "invalid URL",
+	method:       "POST",
+	url:          "webhook",
+	body:         v5.WebhookRequest{User: "bob", URL: "/hook"},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid webhook URL "/hook"`,
+	},
+}, {
+	about:        "invalid event",
+	method:       "POST",
+	url:          "webhook",
+	body:         v5.WebhookRequest{User: "bob", URL: "http://0.1.2.3/hook", Events: []string{"download"}},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid webhook event "download"`,
+	},
+}, {
+	about:        "list without subject",
+	method:       "GET",
+	url:          "webhook",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `exactly one of user and entity must be specified`,
+	},
+}, {
+	about:        "put not allowed",
+	method:       "PUT",
+	url:          "webhook",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `PUT not allowed`,
+	},
+}, {
+	about:        "unknown webhook",
+	method:       "GET",
+	url:          "webhook/bad-id",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `webhook "bad-id" not found`,
+	},
+}}
+
+func (s *APISuite) TestWebhookErrors(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	for i, test := range webhookErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(test.url),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) TestWebhookMethodErrors(c *gc.C) {
+	wh := s.addWebhook(c, "bob")
+	for _, path := range []string{"", "/ping", "/deliveries"} {
+		method := "PUT"
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       method,
+			URL:          storeURL("webhook/" + wh + path),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: http.StatusMethodNotAllowed,
+			ExpectBody: params.Error{
+				Code:    params.ErrMethodNotAllowed,
+				Message: method + ` not allowed`,
+			},
+		})
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("webhook/" + wh + "/other"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `not found`,
+		},
+	})
+}
+
+// addWebhook adds a webhook for the given namespace
+// and returns its id.
+func (s *APISuite) addWebhook(c *gc.C, user string) string {
+	var wh v5.Webhook
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("webhook"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.WebhookRequest{
+			User: user,
+			URL:  "http://0.1.2.3/hook",
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &wh)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	return wh.WebhookId
+}
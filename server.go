@@ -121,6 +121,56 @@ type ServerParams struct {
 	// the blobstore garbage collector worker.
 	RunBlobStoreGC bool
 
+	// BlobScrubInterval holds the interval at which the server
+	// will verify the integrity of every stored blob. If it
+	// is zero, the blob scrubber worker will not be run.
+	BlobScrubInterval time.Duration
+
+	// DeletedEntityRetention holds how long a deleted entity
+	// is kept, so that it can be restored, before it is removed
+	// permanently by the blobstore garbage collector worker.
+	// If it's zero, a default value will be used.
+	DeletedEntityRetention time.Duration
+
+	// RevisionPruneInterval holds the interval at which the server
+	// will prune old revisions according to their retention policies.
+	// If it is zero, the revision pruner worker will not be run.
+	RevisionPruneInterval time.Duration
+
+	// RetentionKeepUnpublished, RetentionKeepPublished and
+	// RetentionKeepYoungerThan hold the global revision retention
+	// policy, which applies to base entities without a policy of
+	// their own. See mongodoc.RetentionPolicy for details.
+	RetentionKeepUnpublished int
+	RetentionKeepPublished   bool
+	RetentionKeepYoungerThan time.Duration
+
+	// ScheduledPublishInterval holds the interval at which the
+	// server will make the scheduled publishes that are due.
+	// If it is zero, the scheduled publisher worker will not be run.
+	ScheduledPublishInterval time.Duration
+
+	// WebhookDeliveryInterval holds the interval at which the
+	// server will attempt the webhook deliveries that are due.
+	// If it is zero, the webhook deliverer worker will not be run.
+	WebhookDeliveryInterval time.Duration
+
+	// WebhookAllowPrivateAddresses holds whether webhook events
+	// may be delivered to loopback, link-local and private
+	// addresses. It should only be set when all the users that
+	// may add webhooks are trusted.
+	WebhookAllowPrivateAddresses bool
+
+	// PromulgatorsGroup holds the name of the group whose
+	// members may promulgate charms and bundles. If it's empty,
+	// "charmers" is used.
+	PromulgatorsGroup string
+
+	// Roles maps the names of roles to the users and groups
+	// that have them. The holder of the admin credentials
+	// has all roles.
+	Roles map[string][]string
+
 	// NewBlobBackend returns a new blobstore backend
 	// that may use the given MongoDB database.
 	// If this is nil, a MongoDB backend will be used.